@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// accepted is what the server knows of a connection it accepted.
+type accepted struct {
+	listener int
+	c        *incomingConn // nil while the Wrapper is at it
+	admitted bool          // its CONNECT was accepted
+}
+
+// acceptedConns are the connections of the server, from the accept on,
+// including the ones that have not sent CONNECT yet, which the registry
+// does not have.
+type acceptedConns struct {
+	mu      sync.Mutex // guards the fields below
+	idle    *sync.Cond // signalled when m gets empty
+	m       map[net.Conn]*accepted
+	closing bool         // set by Shutdown
+	removed map[int]bool // the listeners removed with RemoveListener
+}
+
+// track starts tracking conn, which came in on listener. It reports
+// false if the server or the listener is shutting down, in which case
+// the connection must be closed.
+func (a *acceptedConns) track(conn net.Conn, listener int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closing || a.removed[listener] {
+		return false
+	}
+	if a.m == nil {
+		a.m = make(map[net.Conn]*accepted)
+	}
+	a.m[conn] = &accepted{listener: listener}
+	return true
+}
+
+// attach records the incomingConn made for the accepted conn.
+func (a *acceptedConns) attach(conn net.Conn, c *incomingConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ac := a.m[conn]; ac != nil {
+		ac.c = c
+	}
+}
+
+// untrack stops tracking conn, once it is closed and done with.
+func (a *acceptedConns) untrack(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.m, conn)
+	if len(a.m) == 0 && a.idle != nil {
+		a.idle.Broadcast()
+	}
+}
+
+// admit is called when the CONNECT of c is accepted, just before c is
+// registered. It reports false if the server or the listener of c is
+// shutting down, in which case c must be refused. Otherwise it clears
+// the read deadline of the CONNECT, so that it cannot clear the one
+// that Shutdown sets afterwards.
+func (a *acceptedConns) admit(c *incomingConn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closing || a.removed[c.listener] {
+		return false
+	}
+	if ac := a.m[c.accepted]; ac != nil {
+		ac.admitted = true
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	return true
+}
+
+// shut stops the connections of listener, or of all of them if all is
+// set: the ones that are not admitted yet are closed, and the ones that
+// are are returned, for the caller to disconnect. None are admitted
+// afterwards.
+func (a *acceptedConns) shut(listener int, all bool) (admitted []*incomingConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if all {
+		a.closing = true
+	} else {
+		if a.removed == nil {
+			a.removed = make(map[int]bool)
+		}
+		a.removed[listener] = true
+	}
+	for conn, ac := range a.m {
+		if !all && ac.listener != listener {
+			continue
+		}
+		if ac.admitted {
+			admitted = append(admitted, ac.c)
+		} else {
+			conn.Close()
+		}
+	}
+	return admitted
+}
+
+// closeAll closes all the connections.
+func (a *acceptedConns) closeAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for conn := range a.m {
+		conn.Close()
+	}
+}
+
+// wait returns once all the connections are done with.
+func (a *acceptedConns) wait() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.idle == nil {
+		a.idle = sync.NewCond(&a.mu)
+	}
+	for len(a.m) > 0 {
+		a.idle.Wait()
+	}
+}
+
+// union returns the connections in cs, and the registered ones for
+// which keep returns true, once each.
+func (s *Server) union(cs []*incomingConn, keep func(*incomingConn) bool) []*incomingConn {
+	seen := make(map[*incomingConn]bool, len(cs))
+	for _, c := range cs {
+		seen[c] = true
+	}
+	for _, c := range s.conns() {
+		if !seen[c] && keep(c) {
+			seen[c] = true
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
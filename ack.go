@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An ackPayload is the payload of a QoS 1 or 2 PUBLISH received by a
+// ClientConn with ManualAck. It remembers what to acknowledge, and
+// wraps the payload that was read.
+type ackPayload struct {
+	proto.Payload
+	c    *ClientConn
+	id   uint16
+	qos  proto.QosLevel
+	once sync.Once
+}
+
+// ackLater arranges for m to be acknowledged by Ack, rather than now.
+func (c *ClientConn) ackLater(m *proto.Publish) {
+	m.Payload = &ackPayload{Payload: m.Payload, c: c, id: m.MessageId, qos: m.Header.QosLevel}
+}
+
+func (a *ackPayload) ack() {
+	a.once.Do(func() {
+		switch a.qos {
+		case proto.QosAtLeastOnce:
+			a.c.queue(job{m: &proto.PubAck{MessageId: a.id}})
+		case proto.QosExactlyOnce:
+			a.c.recvMu.Lock()
+			acked, ok := a.c.received[a.id]
+			if ok && !acked {
+				a.c.received[a.id] = true
+			}
+			a.c.recvMu.Unlock()
+			if ok && !acked {
+				a.c.queue(job{m: &proto.PubRec{MessageId: a.id}})
+			}
+		}
+	})
+}
+
+// Ack acknowledges m, a message from Incoming, when ManualAck is set.
+// Until then, the server keeps it in flight, and may send it again.
+// It does nothing for other messages, or when called again.
+func (c *ClientConn) Ack(m *proto.Publish) {
+	if a, ok := m.Payload.(*ackPayload); ok {
+		a.ack()
+	}
+}
+
+// Ack acknowledges the message, when it was received by a ClientConn
+// with ManualAck. See ClientConn.Ack.
+func (m *Message) Ack() {
+	if m.ack != nil {
+		m.ack.ack()
+	}
+}
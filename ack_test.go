@@ -0,0 +1,79 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestManualAck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(l)
+	svr.RetryInterval = 20 * time.Millisecond
+	svr.Start()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	sub, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ManualAck = true }, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect()
+	sub.Subscribe([]proto.TopicQos{
+		{Topic: "q1", Qos: proto.QosAtLeastOnce},
+		{Topic: "q2", Qos: proto.QosExactlyOnce},
+	})
+	pub, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+
+	inflight := func() (n int) {
+		svr.EachClient(func(ci ClientInfo) bool {
+			if ci.ClientId == sub.ClientId {
+				n = ci.Inflight
+			}
+			return true
+		})
+		return n
+	}
+
+	for _, x := range []struct {
+		topic string
+		qos   proto.QosLevel
+	}{{"q1", proto.QosAtLeastOnce}, {"q2", proto.QosExactlyOnce}} {
+		pub.Publish(&proto.Publish{
+			Header:    header(dupFalse, x.qos, retainFalse),
+			TopicName: x.topic,
+			Payload:   proto.BytesPayload("x"),
+		})
+		msg := NewMessage(<-sub.Incoming)
+		// Not acknowledged, so it stays in flight, and QoS 1 comes again.
+		time.Sleep(5 * svr.RetryInterval)
+		if n := inflight(); n != 1 {
+			t.Fatalf("%v: %v in flight before Ack", x.topic, n)
+		}
+		if x.qos == proto.QosAtLeastOnce {
+			if again := <-sub.Incoming; !again.Header.DupFlag {
+				t.Errorf("%v: sent again without the DUP flag", x.topic)
+			}
+		}
+		msg.Ack()
+		deadline := time.Now().Add(time.Second)
+		for inflight() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: still in flight after Ack", x.topic)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for len(sub.Incoming) > 0 {
+			(<-sub.Incoming).Payload.(*ackPayload).ack()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An Aggregate collects the messages published to topics matching
+// Filter during each Window, and publishes them all together as one
+// message on Topic. Backends that consume huge numbers of tiny
+// messages can subscribe to Topic instead, and save the overhead of
+// handling each one.
+type Aggregate struct {
+	Tenant string
+	Filter string
+	Topic  string
+	Window time.Duration
+	Format AggregateFormat
+}
+
+// An AggregateFormat says how the messages are combined into one.
+type AggregateFormat int
+
+const (
+	// AggregateJSON makes a JSON array of objects with "topic"
+	// and "payload" fields. The payload is base64 encoded.
+	AggregateJSON AggregateFormat = iota
+
+	// AggregateFrames puts the messages one after the other, each
+	// one as a 2 byte topic length, the topic, a 4 byte payload
+	// length, and the payload. The lengths are big endian.
+	AggregateFrames
+)
+
+type aggregated struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+type aggregator struct {
+	a Aggregate
+	w wild
+
+	mu    sync.Mutex // guards batch
+	batch []aggregated
+}
+
+// AddAggregate starts aggregating messages as described by a. It runs
+// until stop is called, or the server stops.
+func (s *Server) AddAggregate(a Aggregate) (stop func(), err error) {
+	ag := &aggregator{a: a, w: newWild(a.Filter, nil)}
+	if !ag.w.valid() || a.Window <= 0 || isWildcard(a.Topic) {
+		return nil, ErrBadFilter
+	}
+
+	s.subs.mu.Lock()
+	p := s.subs.part(a.Tenant)
+	p.aggregates = append(p.aggregates, ag)
+	s.subs.mu.Unlock()
+
+	quit := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(quit)
+			s.subs.mu.Lock()
+			p := s.subs.part(a.Tenant)
+			for i := range p.aggregates {
+				if p.aggregates[i] == ag {
+					p.aggregates = append(p.aggregates[:i], p.aggregates[i+1:]...)
+					break
+				}
+			}
+			s.subs.mu.Unlock()
+		})
+	}
+
+	go func() {
+		t := time.NewTicker(a.Window)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if m := ag.flush(); m != nil {
+					s.subs.submitFiltered(a.Tenant, m, nil)
+				}
+			case <-quit:
+				return
+			case <-s.Done:
+				return
+			}
+		}
+	}()
+	return stop, nil
+}
+
+// aggregate adds m to the aggregates in p that it matches.
+// s.mu must be held.
+func (p *partition) aggregate(parts []string, m *proto.Publish) {
+	for _, ag := range p.aggregates {
+		// Do not aggregate our own output.
+		if m.TopicName == ag.a.Topic || !ag.w.matches(parts) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := m.Payload.WritePayload(&buf); err != nil {
+			continue
+		}
+		ag.mu.Lock()
+		ag.batch = append(ag.batch, aggregated{m.TopicName, buf.Bytes()})
+		ag.mu.Unlock()
+	}
+}
+
+// flush returns the message for what was collected since the last
+// flush, or nil if nothing was.
+func (ag *aggregator) flush() *proto.Publish {
+	ag.mu.Lock()
+	batch := ag.batch
+	ag.batch = nil
+	ag.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var payload []byte
+	switch ag.a.Format {
+	case AggregateFrames:
+		var buf bytes.Buffer
+		for _, m := range batch {
+			binary.Write(&buf, binary.BigEndian, uint16(len(m.Topic)))
+			buf.WriteString(m.Topic)
+			binary.Write(&buf, binary.BigEndian, uint32(len(m.Payload)))
+			buf.Write(m.Payload)
+		}
+		payload = buf.Bytes()
+	default:
+		var err error
+		if payload, err = json.Marshal(batch); err != nil {
+			return nil
+		}
+	}
+	return &proto.Publish{
+		TopicName: ag.a.Topic,
+		Payload:   proto.BytesPayload(payload),
+	}
+}
@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestAggregate(t *testing.T) {
+	ag := &aggregator{a: Aggregate{Topic: "all", Format: AggregateFrames}, w: newWild("s/+", nil)}
+	p := &partition{aggregates: []*aggregator{ag}}
+	for _, topic := range []string{"s/1", "t/1", "all", "s/2"} {
+		p.aggregate(strings.Split(topic, "/"), &proto.Publish{
+			TopicName: topic,
+			Payload:   proto.BytesPayload("x"),
+		})
+	}
+
+	m := ag.flush()
+	if m == nil || m.TopicName != "all" {
+		t.Fatal("bad flush: ", m)
+	}
+	var buf bytes.Buffer
+	m.Payload.WritePayload(&buf)
+	want := "\x00\x03s/1\x00\x00\x00\x01x\x00\x03s/2\x00\x00\x00\x01x"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	if ag.flush() != nil {
+		t.Error("second flush should be empty")
+	}
+
+	ag.a.Format = AggregateJSON
+	p.aggregate([]string{"s", "1"}, &proto.Publish{TopicName: "s/1", Payload: proto.BytesPayload("x")})
+	buf.Reset()
+	ag.flush().Payload.WritePayload(&buf)
+	if want := `[{"topic":"s/1","payload":"eA=="}]`; buf.String() != want {
+		t.Errorf("got %v, want %v", buf.String(), want)
+	}
+}
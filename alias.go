@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	proto "github.com/huin/mqtt"
+)
+
+// resolveAlias deals with the topic alias of a PUBLISH from an MQTT 5
+// client. A PUBLISH with a topic and an alias sets the alias; one with
+// an alias and no topic is for the topic of the alias. It returns false
+// if the alias is not valid. Only the reader calls it.
+func (c *incomingConn) resolveAlias(m *proto.Publish, x *v5extra) bool {
+	n, ok := x.props.num(propTopicAlias)
+	if !ok {
+		return true
+	}
+	if n == 0 || n > uint32(c.svr.TopicAliasMaximum) {
+		return false
+	}
+	if m.TopicName == "" {
+		topic, ok := c.aliasesIn[uint16(n)]
+		m.TopicName = topic
+		return ok
+	}
+	if c.aliasesIn == nil {
+		c.aliasesIn = make(map[uint16]string)
+	}
+	c.aliasesIn[uint16(n)] = m.TopicName
+	return true
+}
+
+// alias returns the message and properties to send m to an MQTT 5
+// client with, using a topic alias if it accepts them. The first topics
+// sent get the aliases, up to the lower of the maximum of the client
+// and Server.TopicAliasMaximum; after that, topics go in full. Only the
+// writer calls it.
+func (c *incomingConn) alias(m *proto.Publish, x *v5extra) (*proto.Publish, *v5extra) {
+	max, _ := c.props.num(propTopicAliasMaximum)
+	if limit := uint32(c.svr.TopicAliasMaximum); limit < max {
+		max = limit
+	}
+	n, known := c.aliasesOut[m.TopicName]
+	if !known {
+		if uint32(len(c.aliasesOut)) >= max {
+			return m, x
+		}
+		if c.aliasesOut == nil {
+			c.aliasesOut = make(map[string]uint16)
+		}
+		n = uint16(len(c.aliasesOut) + 1)
+		c.aliasesOut[m.TopicName] = n
+	}
+
+	// Both m and x may be shared with other subscribers.
+	var ax v5extra
+	if x != nil {
+		ax = *x
+		ax.props = append(properties(nil), x.props...)
+	}
+	ax.props.setNum(propTopicAlias, uint32(n))
+	if known {
+		cp := *m
+		cp.TopicName = ""
+		m = &cp
+	}
+	return m, &ax
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An Envelope is what MQTT 3.1 and 3.1.1 subscribers receive in place
+// of the original payload when Server.Annotate is on. It is encoded as
+// JSON, with the original payload in base64.
+type Envelope struct {
+	Time    time.Time `json:"time"`    // when the broker received the message
+	From    string    `json:"from"`    // the client id of the publisher
+	Payload []byte    `json:"payload"` // the payload as published
+}
+
+// The names of the user properties that MQTT 5 subscribers receive
+// when Server.Annotate is on. They carry the same things as the fields
+// of an Envelope, with the time in RFC 3339 format.
+const (
+	AnnotateTime = "time"
+	AnnotateFrom = "from"
+)
+
+// annotateFor returns m and x as the subscriber c should receive
+// them when Server.Annotate is on. MQTT 5 has room for the annotation
+// beside the payload; the older versions get the payload wrapped.
+func annotateFor(c *incomingConn, m *proto.Publish, x *v5extra, from string, at time.Time) (*proto.Publish, *v5extra, error) {
+	if c.version == protocol5 {
+		return m, x.withAnnotation(from, at), nil
+	}
+	m, err := annotated(m, from, at)
+	return m, x, err
+}
+
+// annotated returns a copy of m with its payload wrapped in an
+// Envelope. m is shared with the other subscribers, so it is left
+// alone.
+func annotated(m *proto.Publish, from string, at time.Time) (*proto.Publish, error) {
+	var buf bytes.Buffer
+	if err := m.Payload.WritePayload(&buf); err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(&Envelope{
+		Time:    at,
+		From:    from,
+		Payload: buf.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	cp := *m
+	cp.Payload = proto.BytesPayload(js)
+	return &cp, nil
+}
+
+// withAnnotation returns x with the user properties that say when the
+// message arrived and who sent it. x may be shared, so it is copied.
+func (x *v5extra) withAnnotation(from string, at time.Time) *v5extra {
+	var cp v5extra
+	if x != nil {
+		cp = *x
+		cp.props = append(properties(nil), x.props...)
+	}
+	cp.props = append(cp.props,
+		property{id: propUserProperty, k: AnnotateTime, s: at.Format(time.RFC3339Nano)},
+		property{id: propUserProperty, k: AnnotateFrom, s: from})
+	return &cp
+}
@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestAnnotate(t *testing.T) {
+	subs := newSubscriptions(1)
+	subs.annotate = true
+	s := &Server{}
+	v3 := newTestConn(s, "v3")
+	v5 := newTestConn(s, "v5")
+	v5.version = protocol5
+	subs.add("a", v3, proto.QosAtMostOnce)
+	subs.add("a", v5, proto.QosAtMostOnce)
+
+	subs.submit(newTestConn(s, "pub"), &proto.Publish{
+		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+		TopicName: "a",
+		Payload:   proto.BytesPayload("hello"),
+	})
+
+	j := <-v3.jobs
+	var env Envelope
+	if err := json.Unmarshal(j.m.(*proto.Publish).Payload.(proto.BytesPayload), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.From != "pub" || string(env.Payload) != "hello" || env.Time.IsZero() {
+		t.Errorf("v3 got %+v", env)
+	}
+
+	j = <-v5.jobs
+	if got := string(j.m.(*proto.Publish).Payload.(proto.BytesPayload)); got != "hello" {
+		t.Errorf("v5 payload %q, want hello", got)
+	}
+	props := map[string]string{}
+	for _, p := range j.x.props {
+		if p.id == propUserProperty {
+			props[p.k] = p.s
+		}
+	}
+	if props[AnnotateFrom] != "pub" || props[AnnotateTime] == "" {
+		t.Errorf("v5 user properties %v", props)
+	}
+
+	// The retained copy is kept as it was published.
+	subs.flush()
+	if r := subs.retained(""); len(r) != 1 || string(r[0].Payload.(proto.BytesPayload)) != "hello" {
+		t.Errorf("retained %v", r)
+	}
+}
@@ -0,0 +1,133 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An authCache remembers successful authentications for a while, so
+// that a fleet of devices reconnecting over and over does not hit
+// an expensive authenticator each time. Failures are never cached.
+type authCache struct {
+	mu      sync.Mutex // guards access to entries
+	entries map[[sha256.Size]byte]authEntry
+}
+
+type authEntry struct {
+	user    string
+	expires time.Time
+}
+
+// The number of authentications cached before the expired ones are
+// swept out. If none are expired, the cache starts over, so that
+// clients making up credentials cannot make it grow without bound.
+const authCacheSize = 10000
+
+// authKey hashes the credentials that the authenticator could base
+// its decision on, so that the cache does not hold passwords. Each
+// field is prefixed with its length, so that one field cannot run
+// into the next: otherwise, a password ending with a certificate
+// would hash like the same password sent along with that certificate.
+func authKey(conn net.Conn, m *proto.Connect) [sha256.Size]byte {
+	h := sha256.New()
+	field := func(b []byte) {
+		binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	field([]byte(m.ClientId))
+	field([]byte(m.Username))
+	field([]byte(m.Password))
+	certs := peerCertificates(conn)
+	binary.Write(h, binary.BigEndian, uint32(len(certs)))
+	for _, cert := range certs {
+		field(cert.Raw)
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// lookup returns the user name that Authenticate left in the CONNECT
+// the last time, and whether it said yes.
+func (a *authCache) lookup(key [sha256.Size]byte) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.expires) {
+		delete(a.entries, key)
+		return "", false
+	}
+	return e.user, true
+}
+
+func (a *authCache) store(key [sha256.Size]byte, user string, ttl time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.entries) >= authCacheSize {
+		for k, e := range a.entries {
+			if now.After(e.expires) {
+				delete(a.entries, k)
+			}
+		}
+		if len(a.entries) >= authCacheSize {
+			a.entries = nil
+		}
+	}
+	if a.entries == nil {
+		a.entries = make(map[[sha256.Size]byte]authEntry)
+	}
+	a.entries[key] = authEntry{user: user, expires: now.Add(ttl)}
+}
+
+// invalidate forgets the cached authentications of user, or all of
+// them if user is "".
+func (a *authCache) invalidate(user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, e := range a.entries {
+		if user == "" || e.user == user {
+			delete(a.entries, k)
+		}
+	}
+}
+
+// authenticate asks Server.Authenticate about a CONNECT, unless it
+// already said yes less than AuthCacheTTL ago. Authenticate may change
+// the user name, as CertAuth does, so the cache remembers that too.
+func (s *Server) authenticate(conn net.Conn, m *proto.Connect) bool {
+	if s.Authenticate == nil {
+		return true
+	}
+	if s.AuthCacheTTL <= 0 {
+		return s.Authenticate(conn, m)
+	}
+
+	key := authKey(conn, m)
+	if user, ok := s.auth.lookup(key); ok {
+		m.Username = user
+		return true
+	}
+	if !s.Authenticate(conn, m) {
+		return false
+	}
+	s.auth.store(key, m.Username, s.AuthCacheTTL)
+	return true
+}
+
+// InvalidateAuth makes the server forget the cached authentications
+// of user, so that the next CONNECT using it is checked again. For
+// instance, call it when a password is changed or a device is revoked.
+// If user is "", the whole cache is emptied.
+func (s *Server) InvalidateAuth(user string) {
+	s.record(EventAdmin, nil, "InvalidateAuth "+user)
+	s.auth.invalidate(user)
+}
@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// certConn is a connection that presents certs, as a TLS one would.
+type certConn struct {
+	net.Conn
+	certs []*x509.Certificate
+}
+
+func (c certConn) ConnectionState() tls.ConnectionState {
+	return tls.ConnectionState{PeerCertificates: c.certs}
+}
+
+func TestAuthCache(t *testing.T) {
+	calls := 0
+	s := &Server{
+		Authenticate: func(conn net.Conn, m *proto.Connect) bool {
+			calls++
+			return m.Password == "right"
+		},
+		AuthCacheTTL: time.Minute,
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	connect := func(password string) bool {
+		return s.authenticate(conn, &proto.Connect{ClientId: "c", Username: "u", Password: password})
+	}
+
+	for i := 0; i < 3; i++ {
+		if !connect("right") {
+			t.Fatal("refused")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Authenticate called %v times", calls)
+	}
+	if connect("wrong") || connect("wrong") || calls != 3 {
+		t.Errorf("failure cached, or accepted: %v calls", calls)
+	}
+
+	s.InvalidateAuth("someone-else")
+	connect("right")
+	if calls != 3 {
+		t.Errorf("InvalidateAuth of another user emptied the cache")
+	}
+	s.InvalidateAuth("u")
+	connect("right")
+	if calls != 4 {
+		t.Errorf("InvalidateAuth did not empty the cache")
+	}
+
+	s.AuthCacheTTL = 10 * time.Millisecond
+	s.InvalidateAuth("")
+	connect("right")
+	time.Sleep(20 * time.Millisecond)
+	connect("right")
+	if calls != 6 {
+		t.Errorf("cache entry outlived AuthCacheTTL: %v calls", calls)
+	}
+}
+
+// A password ending with a certificate must not hash like the same
+// password sent along with that certificate.
+func TestAuthCacheForgedCert(t *testing.T) {
+	s := &Server{
+		Authenticate: func(conn net.Conn, m *proto.Connect) bool {
+			if len(peerCertificates(conn)) == 0 {
+				return false
+			}
+			m.Username = "device"
+			return true
+		},
+		AuthCacheTTL: time.Minute,
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+
+	m := &proto.Connect{ClientId: "c", Username: "u", Password: "p"}
+	if !s.authenticate(certConn{conn, []*x509.Certificate{cert}}, m) {
+		t.Fatal("refused the certificate")
+	}
+	forged := &proto.Connect{ClientId: "c", Username: "u", Password: "p\x00" + string(cert.Raw)}
+	if s.authenticate(conn, forged) {
+		t.Errorf("forged password accepted as %q", forged.Username)
+	}
+}
+
+// Clients making up credentials that Authenticate accepts cannot grow
+// the cache without bound.
+func TestAuthCacheBounded(t *testing.T) {
+	s := &Server{
+		Authenticate: func(conn net.Conn, m *proto.Connect) bool { return true },
+		AuthCacheTTL: time.Minute,
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	for i := 0; i < 2*authCacheSize+10; i++ {
+		s.authenticate(conn, &proto.Connect{ClientId: "c", Username: fmt.Sprint("u", i)})
+		if n := len(s.auth.entries); n > authCacheSize {
+			t.Fatalf("%v entries cached", n)
+		}
+	}
+	if _, ok := s.auth.lookup(authKey(conn, &proto.Connect{ClientId: "c", Username: fmt.Sprint("u", 2*authCacheSize+9)})); !ok {
+		t.Error("the last authentication was not cached")
+	}
+}
@@ -0,0 +1,135 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// An authzCache remembers the decisions of Server.Authorize for a
+// while, by client and topic, so that a chatty device does not hit an
+// expensive authorizer with each message. Unlike authCache, it
+// remembers refusals too: a device publishing where it may not would
+// otherwise be checked each time.
+type authzCache struct {
+	mu      sync.Mutex // guards access to entries
+	entries map[authzKey]authzEntry
+}
+
+// An authzKey has the tenant and user name of the client besides its
+// id, for a client id can be used by someone else later on, within
+// AuthorizeCacheTTL, and ACLFile decides by user name.
+type authzKey struct {
+	tenant    string
+	username  string
+	clientid  string
+	topic     string
+	subscribe bool
+}
+
+type authzEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+// The number of decisions cached before the expired ones are swept
+// out. If none are expired, the cache starts over.
+const authzCacheSize = 10000
+
+func (a *authzCache) lookup(k authzKey) (ok, found bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, found := a.entries[k]
+	if !found {
+		return false, false
+	}
+	if time.Now().After(e.expires) {
+		delete(a.entries, k)
+		return false, false
+	}
+	return e.ok, true
+}
+
+func (a *authzCache) store(k authzKey, ok bool, ttl time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.entries) >= authzCacheSize {
+		for k, e := range a.entries {
+			if now.After(e.expires) {
+				delete(a.entries, k)
+			}
+		}
+		if len(a.entries) >= authzCacheSize {
+			a.entries = nil
+		}
+	}
+	if a.entries == nil {
+		a.entries = make(map[authzKey]authzEntry)
+	}
+	a.entries[k] = authzEntry{ok: ok, expires: now.Add(ttl)}
+}
+
+// invalidate forgets the cached decisions about clientid, or all of
+// them if clientid is "".
+func (a *authzCache) invalidate(clientid string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k := range a.entries {
+		if clientid == "" || k.clientid == clientid {
+			delete(a.entries, k)
+		}
+	}
+}
+
+// authorize asks Server.Authorize whether c may publish to topic, or
+// subscribe to it, unless it already answered less than
+// AuthorizeCacheTTL ago.
+func (s *Server) authorize(c *incomingConn, topic string, subscribe bool) bool {
+	if s.Authorize == nil {
+		return true
+	}
+	if s.AuthorizeCacheTTL <= 0 {
+		return s.Authorize(c.tenant, c.username, c.clientid, topic, subscribe)
+	}
+
+	k := authzKey{c.tenant, c.username, c.clientid, topic, subscribe}
+	if ok, found := s.authz.lookup(k); found {
+		return ok
+	}
+	ok := s.Authorize(c.tenant, c.username, c.clientid, topic, subscribe)
+	s.authz.store(k, ok, s.AuthorizeCacheTTL)
+	return ok
+}
+
+// InvalidateAuthorization makes the server forget the cached
+// decisions of Authorize about clientid, or about everyone if clientid
+// is "". Call it when the access rules change. The subscriptions of
+// the clients concerned are checked again, and those that are not
+// allowed anymore are removed.
+func (s *Server) InvalidateAuthorization(clientid string) {
+	s.record(EventAdmin, nil, "InvalidateAuthorization "+clientid)
+	s.authz.invalidate(clientid)
+	if s.Authorize == nil {
+		return
+	}
+
+	for _, c := range s.conns() {
+		if clientid != "" && c.clientid != clientid {
+			continue
+		}
+		s.subs.mu.Lock()
+		filters := make([]string, 0, len(c.subStats))
+		for f := range c.subStats {
+			filters = append(filters, f)
+		}
+		s.subs.mu.Unlock()
+
+		for _, f := range filters {
+			if !s.authorize(c, f, true) && s.subs.unsub(f, c) {
+				log.Printf("%v may not subscribe to %v anymore, unsubscribed", c, f)
+				c.subscriptionChanged(false, f, 0)
+			}
+		}
+	}
+}
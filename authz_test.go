@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestAuthorizeCache(t *testing.T) {
+	calls := 0
+	allowed := true
+	s := &Server{
+		Authorize: func(tenant, username, clientid, topic string, subscribe bool) bool {
+			calls++
+			return allowed
+		},
+		AuthorizeCacheTTL: time.Minute,
+		subs:              newSubscriptions(1),
+	}
+	c := newTestConn(s, "authz-cache")
+	c.add()
+	defer c.del()
+
+	for i := 0; i < 3; i++ {
+		if !s.authorize(c, "a/b", false) {
+			t.Fatal("refused")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Authorize called %v times", calls)
+	}
+
+	s.subs.add("a/#", c, proto.QosAtMostOnce)
+	c.subStat("a/#")
+	allowed = false
+	s.InvalidateAuthorization("authz-cache")
+	if s.authorize(c, "a/b", false) {
+		t.Error("still allowed after InvalidateAuthorization")
+	}
+	if n := s.subs.count(c); n != 0 {
+		t.Errorf("%v subscriptions left", n)
+	}
+}
+
+func TestAuthorizeCacheUsers(t *testing.T) {
+	s := &Server{AuthorizeCacheTTL: time.Minute}
+	s.Authorize = func(tenant, username, clientid, topic string, subscribe bool) bool {
+		return username == "alice"
+	}
+	alice := newTestConn(s, "shared-id")
+	alice.username = "alice"
+	alice.add()
+	if !s.authorize(alice, "a", false) {
+		t.Fatal("alice refused")
+	}
+	alice.del()
+
+	mallory := newTestConn(s, "shared-id")
+	mallory.username = "mallory"
+	mallory.add()
+	defer mallory.del()
+	if s.authorize(mallory, "a", false) {
+		t.Error("mallory got the decision cached for alice")
+	}
+}
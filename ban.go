@@ -0,0 +1,154 @@
+package mqtt
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An address is forgotten once it has made no protocol error for
+// protoErrorWindow, unless it is banned.
+const protoErrorWindow = time.Hour
+
+// The most addresses protoErrors remembers. When it is full, the one
+// that made the oldest last error is forgotten to make room, so that
+// a scanner sending garbage from many addresses cannot fill memory.
+// Banned addresses are kept, so that such a flood cannot lift a ban;
+// when they are all banned, new addresses are not counted until a ban
+// ends.
+var maxProtoErrorAddrs = 10000
+
+// protoErrors counts the protocol errors made by each remote address,
+// and remembers which addresses are banned because of them.
+type protoErrors struct {
+	mu     sync.Mutex // guards access to fields below
+	counts map[string]*addrErrors
+	swept  time.Time // when expired addresses were last forgotten
+}
+
+type addrErrors struct {
+	n           int64
+	last        time.Time // of the last error
+	bannedUntil time.Time
+}
+
+// add counts an error from h, and returns its count, or nil if there
+// is no room for h. When threshold is not 0, and the count reaches a
+// multiple of it, h is banned for d.
+func (p *protoErrors) add(h string, now time.Time, threshold int, d time.Duration) *addrErrors {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counts == nil {
+		p.counts = make(map[string]*addrErrors)
+	}
+	ae, ok := p.counts[h]
+	if !ok {
+		if !p.prune(now) {
+			return nil
+		}
+		ae = &addrErrors{}
+		p.counts[h] = ae
+	}
+	ae.n++
+	ae.last = now
+	if threshold > 0 && ae.n%int64(threshold) == 0 {
+		ae.bannedUntil = now.Add(d)
+		log.Printf("banning %v for %v after %v protocol errors", h, d, ae.n)
+	}
+	return ae
+}
+
+// prune forgets the addresses that expired, once a minute, and makes
+// room for one more, if some address is not banned. It reports whether
+// there is room. p.mu must be held.
+func (p *protoErrors) prune(now time.Time) bool {
+	if now.Sub(p.swept) >= time.Minute {
+		for h, ae := range p.counts {
+			if now.Sub(ae.last) > protoErrorWindow && now.After(ae.bannedUntil) {
+				delete(p.counts, h)
+			}
+		}
+		p.swept = now
+	}
+	for len(p.counts) >= maxProtoErrorAddrs {
+		oldest := ""
+		var t time.Time
+		for h, ae := range p.counts {
+			if now.Before(ae.bannedUntil) {
+				continue
+			}
+			if oldest == "" || ae.last.Before(t) {
+				oldest, t = h, ae.last
+			}
+		}
+		if oldest == "" {
+			return false
+		}
+		delete(p.counts, oldest)
+	}
+	return true
+}
+
+// host returns the address without the port, since a client
+// reconnecting comes from a new port each time.
+func host(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
+
+// protocolError records a protocol error from a connection, and bans
+// its address when it reaches Server.BanThreshold.
+func (s *Server) protocolError(c *incomingConn) {
+	s.protocolErrorReason(c, reasonProtocolError)
+}
+
+// protocolErrorReason is like protocolError, with the reason code to
+// give MQTT 5 clients.
+func (s *Server) protocolErrorReason(c *incomingConn, reason byte) {
+	// MQTT 5 clients get told why, once they are connected.
+	if c.version == protocol5 && c.clientid != "" {
+		c.submitWith(&proto.Disconnect{}, &v5extra{reason: reason})
+	}
+
+	// The clients of a Unix domain socket all have the same address,
+	// so banning one would ban them all.
+	threshold := s.BanThreshold
+	if _, ok := c.conn.RemoteAddr().(*net.UnixAddr); ok {
+		threshold = 0
+	}
+	s.protoErrors.add(host(c.conn.RemoteAddr()), time.Now(), threshold, s.BanDuration)
+}
+
+// banned reports whether connections from addr should be refused.
+func (s *Server) banned(addr net.Addr) bool {
+	p := &s.protoErrors
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ae, ok := p.counts[host(addr)]
+	return ok && time.Now().Before(ae.bannedUntil)
+}
+
+// ProtocolErrors returns the number of protocol errors (undecodable
+// messages, messages out of order, invalid message ids and so on)
+// made by each remote address. An address is forgotten after an hour
+// without errors, unless it is banned, and at most 10000 addresses are
+// kept: the banned ones, and the most recent others.
+func (s *Server) ProtocolErrors() map[string]int64 {
+	p := &s.protoErrors
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]int64, len(p.counts))
+	for h, ae := range p.counts {
+		res[h] = ae.n
+	}
+	return res
+}
@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	proto "github.com/huin/mqtt"
+)
+
+// BatchTopic is where clients publish batches, when Server.Batches is
+// set. The payload of a batch is the messages one after the other,
+// each one as a flags byte (the QoS, plus 4 if it is retained), a 2
+// byte topic length, the topic, a 4 byte payload length, and the
+// payload. The lengths are big endian. ClientConn.PublishBatch makes
+// them.
+const BatchTopic = "$batch"
+
+// ErrBadBatch is returned when a batch is empty, has a message with an
+// invalid topic, or cannot be decoded.
+var ErrBadBatch = errors.New("invalid batch")
+
+// PublishBatch publishes msgs to the subscribers of tenant as one
+// unit. Each subscriber gets all of the messages it is subscribed to,
+// one after the other, without others in between, or none of them
+// when its queue has no room. The retained messages in the batch are
+// retained together too, before any other message is handled by the
+// same worker. See Server.DeliveryOrder: with DeliveryPerTopic, the
+// batch is in order with the other messages to the topic of its first
+// message.
+func (s *Server) PublishBatch(tenant string, msgs []*proto.Publish) error {
+	if err := checkBatch(msgs); err != nil {
+		return err
+	}
+	s.subs.queue(post{tenant: tenant, m: msgs[0], batch: msgs})
+	return nil
+}
+
+// submitBatch publishes the batch in the payload of m, from c.
+func (s *subscriptions) submitBatch(c *incomingConn, m *proto.Publish) error {
+	var buf bytes.Buffer
+	if err := m.Payload.WritePayload(&buf); err != nil {
+		return err
+	}
+	msgs, err := decodeBatch(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := checkBatch(msgs); err != nil {
+		return err
+	}
+	s.queue(post{c: c, tenant: c.tenant, m: msgs[0], batch: msgs})
+	return nil
+}
+
+func checkBatch(msgs []*proto.Publish) error {
+	if len(msgs) == 0 {
+		return ErrBadBatch
+	}
+	for _, m := range msgs {
+		if m.TopicName == "" || isWildcard(m.TopicName) {
+			return ErrBadBatch
+		}
+	}
+	return nil
+}
+
+// handleBatch is handle for a post with a batch. The messages for each
+// subscriber are collected, and queued for it as one.
+func (s *subscriptions) handleBatch(tag string, post post) {
+	jobs := make(map[*incomingConn][]job)
+	var conns []*incomingConn
+	collect := func(c *incomingConn, m proto.Message, x *v5extra) bool {
+		if _, ok := jobs[c]; !ok {
+			conns = append(conns, c)
+		}
+		jobs[c] = append(jobs[c], job{m: m, x: x})
+		return true
+	}
+	for _, m := range post.batch {
+		p := post
+		p.m, p.batch = m, nil
+		s.handle(tag, p, collect)
+	}
+	for _, c := range conns {
+		c.submitBatch(jobs[c])
+	}
+}
+
+// encodeBatch makes the payload of a batch; see BatchTopic.
+func encodeBatch(msgs []*proto.Publish) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		flags := byte(m.Header.QosLevel)
+		if m.Header.Retain {
+			flags |= 4
+		}
+		buf.WriteByte(flags)
+		binary.Write(&buf, binary.BigEndian, uint16(len(m.TopicName)))
+		buf.WriteString(m.TopicName)
+		binary.Write(&buf, binary.BigEndian, uint32(m.Payload.Size()))
+		if err := m.Payload.WritePayload(&buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBatch takes apart the payload of a batch.
+func decodeBatch(b []byte) ([]*proto.Publish, error) {
+	r := &v5reader{b: b}
+	var res []*proto.Publish
+	for len(r.b) != 0 && r.err == nil {
+		flags := r.byte()
+		topic := r.string()
+		payload := r.next(int(r.uint32()))
+		if flags&^7 != 0 || flags&3 > 2 {
+			return nil, ErrBadBatch
+		}
+		res = append(res, &proto.Publish{
+			Header:    header(dupFalse, proto.QosLevel(flags&3), retainFlag(flags&4 != 0)),
+			TopicName: topic,
+			Payload:   proto.BytesPayload(append([]byte(nil), payload...)),
+		})
+	}
+	if r.err != nil {
+		return nil, ErrBadBatch
+	}
+	return res, nil
+}
+
+// PublishBatch publishes msgs to a server with Server.Batches set, so
+// that the subscribers get all of them or none. The batch goes at QoS
+// 1, so PublishBatch returns once the server has it; the messages go
+// on to the subscribers at their own QoS.
+func (c *ClientConn) PublishBatch(msgs []*proto.Publish) error {
+	if err := checkBatch(msgs); err != nil {
+		return err
+	}
+	b, err := encodeBatch(msgs)
+	if err != nil {
+		return err
+	}
+	c.Publish(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: BatchTopic,
+		Payload:   proto.BytesPayload(b),
+	})
+	return nil
+}
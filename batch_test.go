@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestBatchEncoding(t *testing.T) {
+	msgs := []*proto.Publish{
+		{Header: header(dupFalse, proto.QosAtLeastOnce, retainTrue), TopicName: "dev/1/temp", Payload: proto.BytesPayload("21")},
+		{TopicName: "dev/1/humidity", Payload: proto.BytesPayload("")},
+	}
+	b, err := encodeBatch(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeBatch(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("got %v messages", len(got))
+	}
+	for i := range got {
+		if g, w := fmt.Sprintf("%+v", *got[i]), fmt.Sprintf("%+v", *msgs[i]); g != w {
+			t.Errorf("got %v, want %v", g, w)
+		}
+	}
+	if _, err := decodeBatch(b[:len(b)-3]); err != ErrBadBatch {
+		t.Errorf("truncated: got %v", err)
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	s := &Server{subs: newSubscriptions(1)}
+	sub, full := newTestConn(s, "sub"), newTestConn(s, "full")
+	full.jobs = make(chan job, 1)
+	full.jobs <- job{m: &proto.PingResp{}}
+	s.subs.add("dev/#", sub, proto.QosAtMostOnce)
+	s.subs.add("dev/1/+", full, proto.QosAtMostOnce)
+
+	err := s.PublishBatch("", []*proto.Publish{
+		{TopicName: "dev/1/temp", Payload: proto.BytesPayload("21")},
+		{TopicName: "dev/2/temp", Payload: proto.BytesPayload("19")},
+		{TopicName: "dev/1/humidity", Payload: proto.BytesPayload("40")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := <-sub.jobs
+	if len(j.batch) != 3 {
+		t.Fatalf("sub got %v messages as one", len(j.batch))
+	}
+	s.subs.flush()
+	if n := len(full.jobs); n != 1 {
+		t.Errorf("full got part of the batch: %v jobs", n)
+	}
+
+	if err := s.PublishBatch("", []*proto.Publish{{TopicName: "dev/+"}}); err != ErrBadBatch {
+		t.Errorf("wildcard: got %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A BridgeDirection says which way a BridgeRule forwards messages.
+type BridgeDirection int
+
+const (
+	BridgeOut  BridgeDirection = iota // from the local broker to the remote one
+	BridgeIn                          // from the remote broker to the local one
+	BridgeBoth                        // both ways
+)
+
+func (d BridgeDirection) String() string {
+	switch d {
+	case BridgeOut:
+		return "out"
+	case BridgeIn:
+		return "in"
+	case BridgeBoth:
+		return "both"
+	}
+	return fmt.Sprintf("BridgeDirection(%d)", int(d))
+}
+
+// A BridgeRule is what a topic line of a mosquitto bridge says:
+//
+//	topic pattern [[[out | in | both] qos] local-prefix remote-prefix]
+//
+// The bridge subscribes to LocalPrefix+Pattern on the local broker for
+// messages going out, and to RemotePrefix+Pattern on the remote one
+// for messages coming in. A message forwarded has its prefix replaced
+// by the one of the other side, so local/a with the prefixes "local/"
+// and "site1/" is published as site1/a. An empty Pattern stands for
+// the prefix itself, as one topic. Messages are forwarded at their own
+// QoS, up to Qos, and keep their retain flag. When several rules match
+// a message, the first one forwards it.
+type BridgeRule struct {
+	Pattern      string
+	Direction    BridgeDirection
+	Qos          proto.QosLevel
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// ErrBadBridgeRule is returned for a topic line that cannot be parsed.
+var ErrBadBridgeRule = errors.New("invalid bridge topic rule")
+
+// ParseBridgeRule parses a topic line of a mosquitto bridge, with or
+// without the "topic" keyword. As in mosquitto, "" stands for an empty
+// prefix, the direction defaults to out, and the QoS to 0.
+func ParseBridgeRule(line string) (BridgeRule, error) {
+	f := strings.Fields(line)
+	if len(f) > 0 && f[0] == "topic" {
+		f = f[1:]
+	}
+	for i := range f {
+		if f[i] == `""` {
+			f[i] = ""
+		}
+	}
+	var r BridgeRule
+	switch len(f) {
+	case 5:
+		r.LocalPrefix, r.RemotePrefix = f[3], f[4]
+		fallthrough
+	case 3:
+		q, err := strconv.Atoi(f[2])
+		if err != nil || q < 0 || q > 2 {
+			return r, ErrBadBridgeRule
+		}
+		r.Qos = proto.QosLevel(q)
+		fallthrough
+	case 2:
+		switch f[1] {
+		case "out":
+			r.Direction = BridgeOut
+		case "in":
+			r.Direction = BridgeIn
+		case "both":
+			r.Direction = BridgeBoth
+		default:
+			return r, ErrBadBridgeRule
+		}
+		fallthrough
+	case 1:
+		r.Pattern = f[0]
+	default:
+		return r, ErrBadBridgeRule
+	}
+	if r.Pattern == "" && r.LocalPrefix == "" && r.RemotePrefix == "" {
+		return r, ErrBadBridgeRule
+	}
+	return r, nil
+}
+
+// A bridgeRoute is a BridgeRule going one way.
+type bridgeRoute struct {
+	filter   wild
+	from, to string // the prefixes
+	qos      proto.QosLevel
+}
+
+// The default for Bridge.LoopWindow.
+const defaultLoopWindow = 10 * time.Second
+
+// A Bridge forwards messages between a local and a remote broker,
+// according to its Rules, as a mosquitto bridge does. Each broker is
+// reached through a SharedConn, so the connections can have other
+// users too.
+//
+// ClientConn sends no user properties, even over MQTT 5, so there is
+// no hop count. Instead, the bridge tags messages by remembering them:
+// it drops a message that comes back from the side it published it
+// to, within LoopWindow, such as the copy the remote broker sends back
+// for a rule that goes both ways. Loops through several bridges are not
+// seen; give the brokers on such a loop distinct prefixes.
+type Bridge struct {
+	Local, Remote *SharedConn
+	Rules         []BridgeRule
+
+	// LoopWindow is how long the bridge remembers the messages it
+	// published, to know them when they come back. Defaults to 10
+	// seconds.
+	LoopWindow time.Duration
+}
+
+// Run subscribes on both brokers and forwards messages until ctx is
+// done, when it returns ctx.Err(), or one of the connections closes,
+// when it returns its error. The subscriptions are dropped when it
+// returns, but the shared connections are left open.
+func (b *Bridge) Run(ctx context.Context) error {
+	var out, in []proto.TopicQos
+	var outRoutes, inRoutes []bridgeRoute
+	for _, r := range b.Rules {
+		lf, rf := r.LocalPrefix+r.Pattern, r.RemotePrefix+r.Pattern
+		lw, rw := newWild(lf, nil), newWild(rf, nil)
+		if !lw.valid() || !rw.valid() || r.Qos > proto.QosExactlyOnce {
+			return ErrBadBridgeRule
+		}
+		if r.Direction != BridgeIn {
+			out = append(out, proto.TopicQos{Topic: lf, Qos: r.Qos})
+			outRoutes = append(outRoutes, bridgeRoute{lw, r.LocalPrefix, r.RemotePrefix, r.Qos})
+		}
+		if r.Direction != BridgeOut {
+			in = append(in, proto.TopicQos{Topic: rf, Qos: r.Qos})
+			inRoutes = append(inRoutes, bridgeRoute{rw, r.RemotePrefix, r.LocalPrefix, r.Qos})
+		}
+	}
+	window := b.LoopWindow
+	if window <= 0 {
+		window = defaultLoopWindow
+	}
+
+	local := &bridgeSide{name: "local", v: b.Local.NewClient("bridge"), c: b.Local.c}
+	remote := &bridgeSide{name: "remote", v: b.Remote.NewClient("bridge"), c: b.Remote.c}
+	defer local.v.Close()
+	defer remote.v.Close()
+	if len(out) > 0 && local.v.Subscribe(out) == nil {
+		return local.err()
+	}
+	if len(in) > 0 && remote.v.Subscribe(in) == nil {
+		return remote.err()
+	}
+
+	done := make(chan *bridgeSide, 2)
+	go forward(local, remote, outRoutes, window, done)
+	go forward(remote, local, inRoutes, window, done)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s := <-done:
+		return s.err()
+	}
+}
+
+// forward publishes on to what comes from from, by the first of routes
+// that matches, until the Incoming channel of from closes.
+func forward(from, to *bridgeSide, routes []bridgeRoute, window time.Duration, done chan<- *bridgeSide) {
+	var levels [16]string
+	for m := range from.v.Incoming {
+		if from.echo(m, window) {
+			continue
+		}
+		parts := splitTopic(levels[:0], m.TopicName)
+		for _, r := range routes {
+			if !r.filter.matches(parts) {
+				continue
+			}
+			fwd := &proto.Publish{
+				Header:    proto.Header{QosLevel: atMostQos(m.Header.QosLevel, r.qos), Retain: m.Header.Retain},
+				TopicName: r.to + strings.TrimPrefix(m.TopicName, r.from),
+				Payload:   m.Payload,
+			}
+			to.sent(fwd, window)
+			if err := to.v.Publish(fwd); err != nil {
+				log.Printf("bridge: publishing %v on the %v broker: %v", fwd.TopicName, to.name, err)
+			}
+			break
+		}
+	}
+	done <- from
+}
+
+func atMostQos(q, max proto.QosLevel) proto.QosLevel {
+	if q > max {
+		return max
+	}
+	return q
+}
+
+// A bridgeSide is one of the brokers of a Bridge, with what the bridge
+// published to it lately.
+type bridgeSide struct {
+	name string
+	v    *VirtualClient
+	c    *ClientConn
+
+	mu     sync.Mutex // guards the fields below
+	recent map[uint64]*bridgeSent
+	swept  time.Time
+}
+
+// bridgeSent is how many copies of a message were published to a side,
+// and when the last one was.
+type bridgeSent struct {
+	n    int
+	last time.Time
+}
+
+func (s *bridgeSide) err() error {
+	if err := s.c.Err(); err != nil {
+		return err
+	}
+	return ErrConnectionClosed
+}
+
+// bridgeKey hashes the topic and payload of m.
+func bridgeKey(m *proto.Publish) (uint64, bool) {
+	h := fnv.New64a()
+	io.WriteString(h, m.TopicName)
+	h.Write([]byte{0})
+	if err := m.Payload.WritePayload(h); err != nil {
+		return 0, false
+	}
+	return h.Sum64(), true
+}
+
+// sent remembers that m is about to be published to s.
+func (s *bridgeSide) sent(m *proto.Publish, window time.Duration) {
+	key, ok := bridgeKey(m)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recent == nil {
+		s.recent = make(map[uint64]*bridgeSent)
+		s.swept = now
+	}
+	// Forget what is too old to matter, once per window.
+	if now.Sub(s.swept) > window {
+		for k, r := range s.recent {
+			if now.Sub(r.last) > window {
+				delete(s.recent, k)
+			}
+		}
+		s.swept = now
+	}
+	r := s.recent[key]
+	if r == nil || now.Sub(r.last) > window {
+		r = &bridgeSent{}
+		s.recent[key] = r
+	}
+	r.n++
+	r.last = now
+}
+
+// echo reports whether m, which came from s, is one of the messages
+// the bridge published to s less than window ago, and forgets one copy
+// of it if so.
+func (s *bridgeSide) echo(m *proto.Publish, window time.Duration) bool {
+	key, ok := bridgeKey(m)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.recent[key]
+	if r == nil || time.Since(r.last) > window {
+		return false
+	}
+	if r.n--; r.n == 0 {
+		delete(s.recent, key)
+	}
+	return true
+}
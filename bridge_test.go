@@ -0,0 +1,257 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestParseBridgeRule(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want BridgeRule
+		ok   bool
+	}{
+		{"topic sensors/#", BridgeRule{Pattern: "sensors/#"}, true},
+		{"sensors/# in", BridgeRule{Pattern: "sensors/#", Direction: BridgeIn}, true},
+		{"# both 1 local/ site1/", BridgeRule{Pattern: "#", Direction: BridgeBoth, Qos: 1, LocalPrefix: "local/", RemotePrefix: "site1/"}, true},
+		{`"" out 0 a/b c/d`, BridgeRule{LocalPrefix: "a/b", RemotePrefix: "c/d"}, true},
+		{"# sideways", BridgeRule{}, false},
+		{"# out 3", BridgeRule{}, false},
+		{"# out 1 only-local", BridgeRule{}, false},
+		{"", BridgeRule{}, false},
+	} {
+		got, err := ParseBridgeRule(tc.line)
+		if (err == nil) != tc.ok || tc.ok && got != tc.want {
+			t.Errorf("%q: got %+v, %v", tc.line, got, err)
+		}
+	}
+}
+
+// runBridge starts a local and a remote server, and a Bridge between
+// them with rules. It returns a client of each server, and stop, which
+// stops the bridge and returns what Run returned.
+func runBridge(t *testing.T, rules []BridgeRule) (lc, rc *ClientConn, local, remote *Server, stop func() error) {
+	start := func() (*Server, string) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		svr := NewServer(l)
+		svr.Start()
+		t.Cleanup(func() { svr.Stop(context.Background()) })
+		return svr, l.Addr().String()
+	}
+	connect := func(addr string) *ClientConn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := NewClientConn(conn)
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cc.Disconnect)
+		return cc
+	}
+	local, laddr := start()
+	remote, raddr := start()
+
+	b := &Bridge{
+		Local:  NewSharedConn(connect(laddr)),
+		Remote: NewSharedConn(connect(raddr)),
+		Rules:  rules,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- b.Run(ctx) }()
+	stop = func() error {
+		cancel()
+		return <-errs
+	}
+	return connect(laddr), connect(raddr), local, remote, stop
+}
+
+// waitSubscribed waits for someone to subscribe to topic on s.
+func waitSubscribed(t *testing.T, s *Server, topic string) {
+	t.Helper()
+	waitUntil(t, "a subscriber to "+topic, func() bool {
+		return len(s.subs.subscribers("", topic)) > 0
+	})
+}
+
+func TestBridge(t *testing.T) {
+	lc, rc, local, remote, stop := runBridge(t, []BridgeRule{
+		{Pattern: "up/#", Direction: BridgeOut, Qos: proto.QosAtLeastOnce, RemotePrefix: "site1/"},
+		{Pattern: "cmd", Direction: BridgeIn, LocalPrefix: "in/", RemotePrefix: "site1/"},
+	})
+	lc.Subscribe([]proto.TopicQos{{Topic: "in/#", Qos: proto.QosAtMostOnce}})
+	rc.Subscribe([]proto.TopicQos{{Topic: "site1/#", Qos: proto.QosAtMostOnce}})
+	waitSubscribed(t, local, "up/a")
+	waitSubscribed(t, remote, "site1/cmd")
+
+	expect := func(c *ClientConn, topic string) {
+		t.Helper()
+		if m := receive(c, 5*time.Second); m == nil {
+			t.Fatalf("nothing on %v", topic)
+		} else if m.TopicName != topic {
+			t.Errorf("got %v, want %v", m.TopicName, topic)
+		}
+	}
+	publish := func(c *ClientConn, topic string) {
+		c.Publish(&proto.Publish{TopicName: topic, Payload: proto.BytesPayload("x")})
+	}
+	publish(lc, "up/a")
+	expect(rc, "site1/up/a")
+	publish(rc, "site1/cmd")
+	expect(lc, "in/cmd")
+
+	if err := stop(); err != context.Canceled {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+// A rule going both ways delivers a message published on one side once
+// on the other, and does not bring it back to where it came from.
+func TestBridgeBoth(t *testing.T) {
+	lc, rc, local, remote, stop := runBridge(t, []BridgeRule{{Pattern: "chat/#", Direction: BridgeBoth}})
+	defer stop()
+	for _, c := range []*ClientConn{lc, rc} {
+		c.Subscribe([]proto.TopicQos{{Topic: "chat/#", Qos: proto.QosAtMostOnce}})
+	}
+	// Both the bridge and the client subscribe on each side.
+	for _, s := range []*Server{local, remote} {
+		waitUntil(t, "subscribers to chat/a", func() bool {
+			return len(s.subs.subscribers("", "chat/a")) == 2
+		})
+	}
+
+	lc.Publish(&proto.Publish{TopicName: "chat/a", Payload: proto.BytesPayload("from local")})
+	rc.Publish(&proto.Publish{TopicName: "chat/a", Payload: proto.BytesPayload("from remote")})
+	for _, side := range []struct {
+		name  string
+		c     *ClientConn
+		other string
+	}{{"local", lc, "from remote"}, {"remote", rc, "from local"}} {
+		got := make(map[string]int)
+		for m := receive(side.c, 5*time.Second); m != nil; m = receive(side.c, 200*time.Millisecond) {
+			got[string(m.Payload.(proto.BytesPayload))]++
+		}
+		if want := map[string]int{side.other: 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v side got %v, want %q once", side.name, got, side.other)
+		}
+	}
+}
+
+// echoBroker serves conn as a broker that sends every message it gets
+// back to the client, as mosquitto does for a client subscribed to the
+// topic, and sends what it got on got.
+func echoBroker(conn net.Conn, got chan<- *proto.Publish) {
+	defer conn.Close()
+	for {
+		m, err := proto.DecodeOneMessage(conn, nil)
+		if err != nil {
+			return
+		}
+		switch m := m.(type) {
+		case *proto.Connect:
+			(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted}).Encode(conn)
+		case *proto.Subscribe:
+			ack := &proto.SubAck{MessageId: m.MessageId}
+			for _, tq := range m.Topics {
+				ack.TopicsQos = append(ack.TopicsQos, tq.Qos)
+			}
+			ack.Encode(conn)
+		case *proto.Publish:
+			got <- m
+			m.Encode(conn)
+		case *proto.PingReq:
+			(&proto.PingResp{}).Encode(conn)
+		case *proto.Disconnect:
+			return
+		}
+	}
+}
+
+// The copy of a message that the remote broker sends back to the
+// bridge is not forwarded to the local one again.
+func TestBridgeLoop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := NewServer(l)
+	local.Start()
+	defer local.Stop(context.Background())
+	dial := func() *ClientConn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := NewClientConn(conn)
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	conn, peer := net.Pipe()
+	got := make(chan *proto.Publish, 10)
+	go echoBroker(peer, got)
+	rcc := NewClientConn(conn)
+	if err := rcc.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bridge{
+		Local:  NewSharedConn(dial()),
+		Remote: NewSharedConn(rcc),
+		Rules:  []BridgeRule{{Pattern: "chat/#", Direction: BridgeBoth}},
+	}
+	defer b.Local.Close()
+	defer b.Remote.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	lc := dial()
+	defer lc.Disconnect()
+	lc.Subscribe([]proto.TopicQos{{Topic: "chat/#", Qos: proto.QosAtMostOnce}})
+	waitUntil(t, "subscribers to chat/a", func() bool {
+		return len(local.subs.subscribers("", "chat/a")) == 2
+	})
+
+	lc.Publish(&proto.Publish{TopicName: "chat/a", Payload: proto.BytesPayload("x")})
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not forwarded to the remote broker")
+	}
+	if m := receive(lc, 200*time.Millisecond); m != nil {
+		t.Errorf("the echo of %v came back to the local broker", m.TopicName)
+	}
+	if len(got) != 0 {
+		t.Errorf("%v more copies sent to the remote broker", len(got))
+	}
+}
+
+func TestBridgeEcho(t *testing.T) {
+	var s bridgeSide
+	m := &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")}
+	s.sent(m, time.Minute)
+	s.sent(m, time.Minute)
+	if !s.echo(m, time.Minute) || !s.echo(m, time.Minute) {
+		t.Error("copies the bridge sent were not recognized")
+	}
+	if s.echo(m, time.Minute) {
+		t.Error("a third copy was taken for an echo")
+	}
+	other := &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("y")}
+	s.sent(m, time.Minute)
+	if s.echo(other, time.Minute) {
+		t.Error("another payload was taken for an echo")
+	}
+}
@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Capture records the raw bytes of MQTT frames, as they were read
+// from or written to the network, so that a session can be replayed
+// and debugged offline. Set Server.Capture to one in order to turn on
+// capturing; the mqttcap tool reads the resulting file.
+//
+// The file starts with the 8 byte magic "MQTTCAP1". It is followed
+// by any number of records, each made up of a fixed 21 byte header and
+// then the frame itself:
+//
+//	 0  int64   time the frame was seen, in nanoseconds since the Unix epoch
+//	 8  uint64  connection id, unique within one Server
+//	16  uint8   direction: 'i' for frames read, 'o' for frames written
+//	17  uint32  length of the frame in bytes
+//	21  []byte  the frame, starting with the fixed header
+//
+// All integers are big endian.
+type Capture struct {
+	mu  sync.Mutex // guards access to the fields below
+	w   *bufio.Writer
+	err error
+}
+
+// CaptureMagic is the header at the start of every capture file.
+const CaptureMagic = "MQTTCAP1"
+
+const captureHeaderLen = 21
+
+// The longest frame MQTT allows: the biggest remaining length, and a
+// fixed header of 1 byte plus 4 for the length.
+const maxFrameLen = 268435455 + 5
+
+// How often the server flushes its Capture, so that little is lost if
+// it crashes.
+const captureFlushInterval = time.Second
+
+// Directions of the frames in a capture file.
+const (
+	CaptureIn  = 'i'
+	CaptureOut = 'o'
+)
+
+// NewCapture creates a Capture writing to w. A Server flushes its
+// Capture every second, and when it shuts down. Otherwise, the caller
+// is responsible for calling Flush before closing w.
+func NewCapture(w io.Writer) *Capture {
+	c := &Capture{w: bufio.NewWriter(w)}
+	_, c.err = c.w.WriteString(CaptureMagic)
+	return c
+}
+
+// record appends one frame to the capture. Once a write fails,
+// the capture stops recording and Flush returns the error.
+func (c *Capture) record(id uint64, dir byte, frame []byte) {
+	var hdr [captureHeaderLen]byte
+	binary.BigEndian.PutUint64(hdr[0:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(hdr[8:], id)
+	hdr[16] = dir
+	binary.BigEndian.PutUint32(hdr[17:], uint32(len(frame)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if _, c.err = c.w.Write(hdr[:]); c.err != nil {
+		return
+	}
+	_, c.err = c.w.Write(frame)
+}
+
+// Flush writes any buffered records to the underlying writer.
+func (c *Capture) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.w.Flush()
+}
+
+// flushCapture flushes the Capture of the server every
+// captureFlushInterval, until the server stops.
+func (s *Server) flushCapture() {
+	t := time.NewTicker(captureFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Capture.Flush()
+		case <-s.Done:
+			s.Capture.Flush()
+			return
+		}
+	}
+}
+
+// ErrCaptureRecord is returned by CaptureReader.Next for a record whose
+// frame is longer than MQTT allows, which means the file is corrupt.
+var ErrCaptureRecord = errors.New("capture record longer than any MQTT frame")
+
+// A CaptureRecord is one frame read back from a capture file.
+type CaptureRecord struct {
+	Time  time.Time
+	Conn  uint64
+	Dir   byte
+	Frame []byte
+}
+
+// A CaptureReader reads the records from a capture file.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// ErrNotCapture is returned by NewCaptureReader when the input does
+// not start with CaptureMagic.
+var ErrNotCapture = errors.New("not an MQTT capture file")
+
+// NewCaptureReader checks the header of the capture file in r and
+// returns a CaptureReader ready to return its records.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+	var magic [len(CaptureMagic)]byte
+	if _, err := io.ReadFull(cr.r, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != CaptureMagic {
+		return nil, ErrNotCapture
+	}
+	return cr, nil
+}
+
+// Next returns the next record in the file. At the end of the file,
+// it returns io.EOF.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	var hdr [captureHeaderLen]byte
+	if _, err := io.ReadFull(cr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[17:])
+	if n > maxFrameLen {
+		return nil, ErrCaptureRecord
+	}
+	rec := &CaptureRecord{
+		Time:  time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:]))),
+		Conn:  binary.BigEndian.Uint64(hdr[8:]),
+		Dir:   hdr[16],
+		Frame: make([]byte, n),
+	}
+	if _, err := io.ReadFull(cr.r, rec.Frame); err != nil {
+		// A truncated frame at the end of the file is what you
+		// get from a broker that did not exit cleanly.
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return rec, nil
+}
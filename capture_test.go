@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCapture(&buf)
+	c.record(1, CaptureIn, []byte{0xc0, 0x00})
+	c.record(2, CaptureOut, []byte{0xd0, 0x00})
+	if err := c.Flush(); err != nil {
+		t.Fatal("flush: ", err)
+	}
+
+	// chop the last byte off to simulate a truncated file
+	cr, err := NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatal("reader: ", err)
+	}
+	rec, err := cr.Next()
+	if err != nil {
+		t.Fatal("next: ", err)
+	}
+	if rec.Conn != 1 || rec.Dir != CaptureIn || !bytes.Equal(rec.Frame, []byte{0xc0, 0x00}) {
+		t.Error("bad record: ", rec)
+	}
+	if _, err = cr.Next(); err != io.EOF {
+		t.Error("expected EOF, got ", err)
+	}
+
+	if _, err = NewCaptureReader(bytes.NewReader([]byte("not a capture"))); err != ErrNotCapture {
+		t.Error("expected ErrNotCapture, got ", err)
+	}
+
+	// A corrupt length is refused rather than allocated.
+	corrupt := append([]byte(CaptureMagic), make([]byte, captureHeaderLen)...)
+	copy(corrupt[len(CaptureMagic)+17:], []byte{0xff, 0xff, 0xff, 0xff})
+	cr, _ = NewCaptureReader(bytes.NewReader(corrupt))
+	if _, err = cr.Next(); err != ErrCaptureRecord {
+		t.Error("expected ErrCaptureRecord, got ", err)
+	}
+}
+
+func TestCaptureFlushedOnShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(l)
+	var buf bytes.Buffer
+	svr.Capture = NewCapture(&buf)
+	svr.Start()
+
+	cc, err := DialAndConnect(func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	svr.Shutdown()
+
+	cr, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := cr.Next(); err != nil || rec.Dir != CaptureIn {
+		t.Errorf("the CONNECT was not flushed: %v, %v", rec, err)
+	}
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A CertAuth authenticates clients by the X.509 certificate they
+// present over TLS, instead of a user name and password. Its
+// Authenticate method is made for Server.Authenticate. The identity
+// taken from the certificate replaces the user name of the client, so
+// that Server.Authorize, and ACLFile, go by it. Clients without a
+// valid certificate are refused.
+//
+// The certificate must be verified, either by the listener, with
+// tls.RequireAndVerifyClientCert, or by CertAuth itself, with Roots.
+type CertAuth struct {
+	// Roots, when non-nil, are the certificate authorities that client
+	// certificates are verified against. This is for listeners that
+	// only ask for certificates, so that clients without one can still
+	// be told why they are refused, in a CONNACK.
+	Roots *x509.CertPool
+
+	// Identity, when non-nil, makes up the user name from the
+	// certificate, for instance from the organizational unit, to map
+	// certificates to roles in the authorization rules. Returning ""
+	// refuses the client. By default, the user name is the common name
+	// of the certificate, or if it has none, its first DNS name or
+	// email address.
+	Identity func(cert *x509.Certificate) string
+}
+
+// Authenticate checks the certificate of conn, and sets the user name
+// of m to the identity it carries.
+func (a *CertAuth) Authenticate(conn net.Conn, m *proto.Connect) bool {
+	tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		log.Print("certauth: ", conn.RemoteAddr(), " did not connect over TLS")
+		return false
+	}
+	st := tc.ConnectionState()
+	if len(st.PeerCertificates) == 0 {
+		log.Print("certauth: no certificate from ", conn.RemoteAddr())
+		return false
+	}
+	leaf := st.PeerCertificates[0]
+	if a.Roots != nil {
+		inter := x509.NewCertPool()
+		for _, cert := range st.PeerCertificates[1:] {
+			inter.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         a.Roots,
+			Intermediates: inter,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			log.Print("certauth: ", conn.RemoteAddr(), ": ", err)
+			return false
+		}
+	} else if len(st.VerifiedChains) == 0 {
+		log.Print("certauth: the certificate from ", conn.RemoteAddr(), " was not verified")
+		return false
+	}
+
+	identity := certIdentity(leaf)
+	if a.Identity != nil {
+		identity = a.Identity(leaf)
+	}
+	if identity == "" {
+		log.Print("certauth: no identity in the certificate from ", conn.RemoteAddr())
+		return false
+	}
+	m.Username, m.UsernameFlag = identity, true
+	return true
+}
+
+// certIdentity returns the common name of cert, or its first DNS name
+// or email address.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Codec turns values into payloads and back, for one content type.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// The content type that a message without one is decoded as.
+const defaultContentType = "application/json"
+
+// RegisterCodec makes codec encode and decode the values of
+// contentType, such as "application/cbor", for PublishValue and
+// DecodeValue on this connection. A codec for "application/json" is
+// there to start with, and can be replaced.
+func (c *ClientConn) RegisterCodec(contentType string, codec Codec) {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	if c.codecs == nil {
+		c.codecs = make(map[string]Codec)
+	}
+	c.codecs[contentType] = codec
+}
+
+func (c *ClientConn) codecFor(contentType string) (Codec, error) {
+	c.codecMu.Lock()
+	defer c.codecMu.Unlock()
+	if codec, ok := c.codecs[contentType]; ok {
+		return codec, nil
+	}
+	if contentType == defaultContentType {
+		return jsonCodec{}, nil
+	}
+	return nil, fmt.Errorf("no codec registered for content type %q", contentType)
+}
+
+// PublishValue encodes v with the codec for contentType, and publishes
+// it to topic at qos, as Publish does. With MQTT5, the content type
+// goes along with the message, as its Content Type; MQTT 3.1 has no
+// room for it, so there the subscribers need to know what to expect
+// on the topic.
+func (c *ClientConn) PublishValue(topic, contentType string, qos proto.QosLevel, v interface{}) error {
+	codec, err := c.codecFor(contentType)
+	if err != nil {
+		return err
+	}
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	x := &v5extra{}
+	x.props.setStr(propContentType, contentType)
+	return c.publish(&proto.Publish{
+		Header:    proto.Header{QosLevel: qos},
+		TopicName: topic,
+		Payload:   proto.BytesPayload(payload),
+	}, x)
+}
+
+// DecodeValue decodes the payload of m, a message from Incoming, into
+// v with the codec for its Content Type. A message without one, as
+// they all are over MQTT 3.1, is decoded as JSON.
+func (c *ClientConn) DecodeValue(m *proto.Publish, v interface{}) error {
+	var buf bytes.Buffer
+	if err := m.Payload.WritePayload(&buf); err != nil {
+		return err
+	}
+	return c.decode(ContentType(m), buf.Bytes(), v)
+}
+
+// DecodeMessage is DecodeValue for a Message.
+func (c *ClientConn) DecodeMessage(msg *Message, v interface{}) error {
+	return c.decode(msg.ContentType, msg.Payload, v)
+}
+
+func (c *ClientConn) decode(contentType string, data []byte, v interface{}) error {
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	codec, err := c.codecFor(contentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// A typedPayload is the payload of a PUBLISH received by a ClientConn
+// from an MQTT 5 server, with the Content Type that came with it.
+type typedPayload struct {
+	proto.Payload
+	contentType string
+}
+
+// ContentType returns the MQTT 5 Content Type of m, a message from
+// Incoming, or "" if it came without one.
+func ContentType(m *proto.Publish) string {
+	p := m.Payload
+	if a, ok := p.(*ackPayload); ok {
+		p = a.Payload
+	}
+	if t, ok := p.(*typedPayload); ok {
+		return t.contentType
+	}
+	return ""
+}
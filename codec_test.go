@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A textCodec is a codec for strings only.
+type textCodec struct{}
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T as text", v)
+	}
+	return []byte(s), nil
+}
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	p, ok := v.(*string)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal text into %T", v)
+	}
+	*p = string(data)
+	return nil
+}
+
+func TestCodecs(t *testing.T) {
+	_, l, dial := testServer(t, nil)
+	defer l.Close()
+	v5 := func(cc *ClientConn) { cc.MQTT5 = true }
+	sub, err := DialAndConnect(dial, v5, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect()
+	sub.Subscribe([]proto.TopicQos{{Topic: "values/+", Qos: proto.QosAtLeastOnce}})
+	pub, err := DialAndConnect(dial, v5, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+
+	type reading struct {
+		Sensor string
+		Value  float64
+	}
+	if err := pub.PublishValue("values/json", "application/json", proto.QosAtLeastOnce, reading{"t1", 21.5}); err != nil {
+		t.Fatal(err)
+	}
+	var r reading
+	if m := receive(sub, time.Second); m == nil {
+		t.Fatal("no JSON message")
+	} else if ct := ContentType(m); ct != "application/json" || m.Header.QosLevel != proto.QosAtLeastOnce {
+		t.Errorf("got content type %q at QoS %v", ct, m.Header.QosLevel)
+	} else if err := sub.DecodeValue(m, &r); err != nil || r != (reading{"t1", 21.5}) {
+		t.Errorf("decoded %+v, %v", r, err)
+	}
+
+	// Codecs are registered on each connection.
+	if pub.PublishValue("values/text", "text/x-test", proto.QosAtMostOnce, "hello") == nil {
+		t.Error("published with a codec registered on no connection")
+	}
+	pub.RegisterCodec("text/x-test", textCodec{})
+	if err := pub.PublishValue("values/text", "text/x-test", proto.QosAtMostOnce, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	m := receive(sub, time.Second)
+	if m == nil {
+		t.Fatal("no text message")
+	}
+	var s string
+	if sub.DecodeValue(m, &s) == nil {
+		t.Error("decoded with a codec registered on another connection")
+	}
+	sub.RegisterCodec("text/x-test", textCodec{})
+	msg := NewMessage(m)
+	if err := sub.DecodeMessage(&msg, &s); err != nil || s != "hello" || msg.ContentType != "text/x-test" {
+		t.Errorf("decoded %q, %v, from content type %q", s, err, msg.ContentType)
+	}
+	if pub.PublishValue("values/text", "text/x-test", proto.QosAtMostOnce, 42) == nil {
+		t.Error("the codec error was not returned")
+	}
+}
+
+// Over MQTT 3.1, there is no content type, and values are taken for
+// JSON.
+func TestCodecsMQTT3(t *testing.T) {
+	_, l, dial := testServer(t, nil)
+	defer l.Close()
+	cc, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	cc.Subscribe([]proto.TopicQos{{Topic: "values/+", Qos: proto.QosAtMostOnce}})
+	other, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+
+	if err := other.PublishValue("values/n", "application/json", proto.QosAtMostOnce, 42); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if m := receive(cc, time.Second); m == nil {
+		t.Fatal("no message")
+	} else if ct := ContentType(m); ct != "" {
+		t.Errorf("content type %q over MQTT 3.1", ct)
+	} else if err := cc.DecodeValue(m, &n); err != nil || n != 42 {
+		t.Errorf("decoded %v, %v", n, err)
+	}
+}
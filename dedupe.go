@@ -0,0 +1,50 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"io"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A dedupe remembers the messages a connection published recently,
+// so that repeats can be dropped. It is only used by the reader, so
+// it needs no locking.
+type dedupe struct {
+	seen  map[uint64]time.Time
+	swept time.Time
+}
+
+// duplicate reports whether the same payload was published to the
+// same topic less than window ago, and remembers m if not.
+func (d *dedupe) duplicate(m *proto.Publish, window time.Duration) bool {
+	h := fnv.New64a()
+	io.WriteString(h, m.TopicName)
+	h.Write([]byte{0})
+	if err := m.Payload.WritePayload(h); err != nil {
+		return false
+	}
+	key := h.Sum64()
+
+	now := time.Now()
+	if d.seen == nil {
+		d.seen = make(map[uint64]time.Time)
+		d.swept = now
+	}
+	// Forget what is too old to matter, once per window.
+	if now.Sub(d.swept) > window {
+		for k, t := range d.seen {
+			if now.Sub(t) > window {
+				delete(d.seen, k)
+			}
+		}
+		d.swept = now
+	}
+
+	if t, ok := d.seen[key]; ok && now.Sub(t) <= window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	svr, l, dial := testServer(t, func(s *Server) { s.DedupeWindow = time.Minute })
+	defer l.Close()
+	sub, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect()
+	sub.Subscribe([]proto.TopicQos{{Topic: "a", Qos: proto.QosAtMostOnce}, {Topic: "b", Qos: proto.QosAtMostOnce}})
+	pub, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+
+	for _, x := range []struct{ topic, payload string }{{"a", "1"}, {"a", "1"}, {"b", "1"}, {"a", "2"}} {
+		pub.Publish(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			TopicName: x.topic,
+			Payload:   proto.BytesPayload(x.payload),
+		})
+	}
+	for i := 0; i < 3; i++ {
+		if receive(sub, time.Second) == nil {
+			t.Fatalf("got %v messages, want 3", i)
+		}
+	}
+	if m := receive(sub, 50*time.Millisecond); m != nil {
+		t.Errorf("got a duplicate on %v", m.TopicName)
+	}
+	if n := atomic.LoadInt64(&svr.stats.duplicates); n != 1 {
+		t.Errorf("%v duplicates counted", n)
+	}
+}
+
+func TestDedupeExpiry(t *testing.T) {
+	var d dedupe
+	m := &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")}
+	if d.duplicate(m, 10*time.Millisecond) || !d.duplicate(m, 10*time.Millisecond) {
+		t.Fatal("not caught within the window")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if d.duplicate(m, 10*time.Millisecond) {
+		t.Error("caught after the window")
+	}
+}
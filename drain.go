@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// drain is the state of a server that is being drained.
+type drain struct {
+	mu    sync.Mutex // guards access to fields below
+	on    bool
+	ref   string
+	empty chan struct{}
+}
+
+// How often Drain checks whether all the clients are gone.
+const drainPoll = 100 * time.Millisecond
+
+// Drain prepares the server for maintenance. From now on, it refuses
+// new connections with "server unavailable", or, for MQTT 5 clients
+// when ref is not empty, with "use another server" and ref as the
+// server reference. If Server.DrainNotice is set, ref is published
+// there. The clients already connected are left alone to finish what
+// they are doing, or, if Server.DrainRate is set, disconnected at that
+// rate; MQTT 5 ones are told to use ref, if any. Drain returns a
+// channel which is closed once the last of them is gone, and the
+// server can be stopped. Calling Drain again changes ref and returns
+// the same channel.
+func (s *Server) Drain(ref string) <-chan struct{} {
+	d := &s.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ref = ref
+	s.record(EventAdmin, nil, "Drain "+ref)
+	if s.DrainNotice != "" {
+		s.subs.submit(nil, &proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainTrue),
+			TopicName: s.DrainNotice,
+			Payload:   proto.BytesPayload(ref),
+		})
+	}
+	if d.on {
+		return d.empty
+	}
+	d.on = true
+	d.empty = make(chan struct{})
+	go func(empty chan struct{}) {
+		for atomic.LoadInt64(&s.stats.clients) > 0 {
+			time.Sleep(drainPoll)
+		}
+		close(empty)
+	}(d.empty)
+	if s.DrainRate > 0 {
+		go s.drainClients(time.Duration(float64(time.Second) / s.DrainRate))
+	}
+	return d.empty
+}
+
+// drainClients disconnects the clients one every interval. It does not
+// wait for a connection to be flushed before going to the next one.
+func (s *Server) drainClients(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for _, c := range s.conns() {
+		<-tick.C
+		_, ref := s.draining()
+		x := &v5extra{reason: reasonServerShuttingDown}
+		if ref != "" {
+			x.reason = reasonUseAnotherServer
+			x.props.setStr(propServerReference, ref)
+		}
+		log.Print(c, ": drained")
+		s.record(EventAdmin, c, "disconnected by Drain")
+		go c.disconnect(x)
+	}
+}
+
+// draining reports whether the server is being drained, and the
+// server reference to send to MQTT 5 clients.
+func (s *Server) draining() (bool, string) {
+	d := &s.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.on, d.ref
+}
@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A durable is a subscription set up on the server side for a client
+// id, whether or not that client is connected. While it is not
+// connected, the messages for it are queued.
+type durable struct {
+	clientid string
+	w        wild
+	qos      proto.QosLevel
+	c        *incomingConn // the client, when connected
+	queue    []*proto.Publish
+}
+
+// The number of messages queued for each durable subscription while
+// its client is away. After that, the oldest are dropped.
+const durableQueueLength = 1000
+
+// ErrBadFilter is returned when a topic filter is not valid.
+var ErrBadFilter = errors.New("invalid topic filter")
+
+// ErrBadQos is returned for a QoS level over 2.
+var ErrBadQos = errors.New("invalid QoS level")
+
+// AddDurable sets up a durable subscription to filter, at qos, for the
+// client clientid of tenant. Messages that match it are queued until
+// the client connects, even if it has never connected yet, so that
+// backend consumers can be provisioned ahead of time. When the client
+// connects, it gets the queued messages, and then the subscription
+// works like any other one until the client goes away again. Adding a
+// durable subscription that exists already changes its QoS.
+func (s *Server) AddDurable(tenant, clientid, filter string, qos proto.QosLevel) error {
+	w := newWild(filter, nil)
+	if !w.valid() {
+		return ErrBadFilter
+	}
+	if qos > proto.QosExactlyOnce {
+		return ErrBadQos
+	}
+	s.subs.mu.Lock()
+	defer s.subs.mu.Unlock()
+	p := s.subs.part(tenant)
+	for _, d := range p.durables {
+		if d.clientid == clientid && d.w.filter == filter {
+			d.qos = qos
+			return nil
+		}
+	}
+	p.durables = append(p.durables, &durable{clientid: clientid, w: w, qos: qos})
+	return nil
+}
+
+// RemoveDurable removes a durable subscription, and drops the messages
+// queued for it. If the client is connected, it stays subscribed until
+// it goes away.
+func (s *Server) RemoveDurable(tenant, clientid, filter string) {
+	s.subs.mu.Lock()
+	defer s.subs.mu.Unlock()
+	p := s.subs.part(tenant)
+	for i, d := range p.durables {
+		if d.clientid == clientid && d.w.filter == filter {
+			p.durables = append(p.durables[:i], p.durables[i+1:]...)
+			return
+		}
+	}
+}
+
+// queueDurable queues m for the durable subscriptions in p whose
+// client is away. It returns the clients that attached after the
+// subscribers of m, matches, were looked up, so did not get it, and
+// have to be sent it, at the QoS of their durable subscription. s.mu
+// must be held.
+func (p *partition) queueDurable(parts []string, m *proto.Publish, matches []match) []match {
+	var late []match
+	for _, d := range p.durables {
+		if !d.w.matches(parts) {
+			continue
+		}
+		if d.c != nil {
+			if !matched(matches, d.c) && !matched(late, d.c) {
+				late = append(late, match{c: d.c, filter: d.w.filter, qos: d.qos})
+			}
+			continue
+		}
+		if len(d.queue) >= durableQueueLength {
+			log.Printf("durable subscription %v for %v is full, dropping oldest message", d.w.filter, d.clientid)
+			d.queue = d.queue[1:]
+		}
+		d.queue = append(d.queue, m)
+	}
+	return late
+}
+
+func matched(matches []match, c *incomingConn) bool {
+	for _, mt := range matches {
+		if mt.c == c {
+			return true
+		}
+	}
+	return false
+}
+
+// attachDurables subscribes a newly connected client to its durable
+// subscriptions, and sends it what was queued for it. Subscribing and
+// taking the queue happen at once, so that each message published
+// meanwhile is either queued or delivered. The queued messages are
+// sent by flushDurables, on a goroutine of its own, so that the reader
+// of the client goes on meanwhile.
+func (s *subscriptions) attachDurables(c *incomingConn) {
+	s.mu.Lock()
+	var subscribed []*durable
+	var queued []job
+	p := s.part(c.tenant)
+	for _, d := range p.durables {
+		if d.clientid != c.clientid {
+			continue
+		}
+		if p.add(d.w.filter, c, d.qos) {
+			subscribed = append(subscribed, d)
+		}
+		d.c = c
+		for _, m := range d.queue {
+			queued = append(queued, job{m: deliverAt(m, d.qos, s.upgrade)})
+		}
+		d.queue = nil
+	}
+	s.mu.Unlock()
+
+	for _, d := range subscribed {
+		c.subscriptionChanged(true, d.w.filter, d.qos)
+	}
+	if len(queued) != 0 {
+		go c.flushDurables(queued)
+	}
+}
+
+// flushDurables sends c the messages queued for its durable
+// subscriptions. They wait for room in the send queue of the client,
+// rather than being dropped as a burst that does not fit; new messages
+// may come in between them.
+func (c *incomingConn) flushDurables(queued []job) {
+	for i, j := range queued {
+		j.since = time.Now()
+		if c.svr.SendQueueBytes > 0 {
+			// Counted against the budget, without being refused by it.
+			j.size = jobSize(j)
+			atomic.AddInt64(&c.queued, int64(j.size))
+		}
+		select {
+		case c.jobs <- j:
+		case <-c.Done:
+			atomic.AddInt64(&c.queued, -int64(j.size))
+			c.countDrop(int64(len(queued)-i), "went away before its durable subscriptions were flushed")
+			return
+		}
+	}
+}
+
+// detachDurables goes back to queueing for the durable subscriptions
+// of a client that went away.
+func (s *subscriptions) detachDurables(c *incomingConn) {
+	s.mu.Lock()
+	for _, d := range s.part(c.tenant).durables {
+		if d.c == c {
+			d.c = nil
+		}
+	}
+	s.mu.Unlock()
+}
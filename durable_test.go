@@ -0,0 +1,98 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestDurable(t *testing.T) {
+	// A send queue much shorter than the durable queue, which has to
+	// wait for room rather than be dropped.
+	svr, l, dial := testServer(t, func(s *Server) { s.sendQueue = 10 })
+	defer l.Close()
+	if err := svr.AddDurable("", "backend", "jobs/#", proto.QosAtLeastOnce); err != nil {
+		t.Fatal(err)
+	}
+	if svr.AddDurable("", "backend", "jobs/#/x", proto.QosAtMostOnce) != ErrBadFilter {
+		t.Error("invalid filter accepted")
+	}
+	if svr.AddDurable("", "backend", "jobs/#", 3) != ErrBadQos {
+		t.Error("invalid QoS accepted")
+	}
+
+	pub, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+	publish := func(i int) {
+		pub.Publish(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			TopicName: "jobs/a",
+			// Big enough for the backlog not to fit in the buffers of
+			// the connection.
+			Payload: proto.BytesPayload(fmt.Sprintf("%v%10000v", i, "")),
+		})
+	}
+
+	for i := 0; i < durableQueueLength; i++ {
+		publish(i)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		svr.subs.mu.Lock()
+		n := len(svr.subs.part("").durables[0].queue)
+		svr.subs.mu.Unlock()
+		if n == durableQueueLength {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v messages queued", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	watcher, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Disconnect()
+	watcher.Subscribe([]proto.TopicQos{{Topic: "ping", Qos: proto.QosAtMostOnce}})
+
+	sub, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = "backend" }, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect()
+
+	// The backlog does not hold up what the client sends, even while
+	// the client is not reading it.
+	sub.Publish(&proto.Publish{TopicName: "ping", Payload: proto.BytesPayload("x")})
+	if receive(watcher, 5*time.Second) == nil {
+		t.Error("the client was held up by its backlog")
+	}
+
+	got := make(map[string]bool)
+	for len(got) <= durableQueueLength {
+		if len(got) == durableQueueLength {
+			// With the backlog out of the way, there is room in the
+			// send queue for the next one.
+			publish(durableQueueLength)
+		}
+		select {
+		case m := <-sub.Incoming:
+			got[strings.TrimSpace(string(m.Payload.(proto.BytesPayload)))] = true
+			if m.Header.QosLevel != proto.QosAtLeastOnce {
+				t.Fatalf("got a message at QoS %v", m.Header.QosLevel)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v of %v messages", len(got), durableQueueLength+1)
+		}
+	}
+	if !got["0"] || !got[fmt.Sprint(durableQueueLength)] {
+		t.Error("missing the first queued message, or the one after connecting")
+	}
+}
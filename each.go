@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A ClientInfo describes a connected client, for EachClient.
+type ClientInfo struct {
+	ClientId   string
+	Tenant     string
+	RemoteAddr net.Addr
+	Queued     int   // messages waiting to be sent
+	Inflight   int   // QoS 1 and 2 messages waiting for acknowledgement
+	Dropped    int64 // messages dropped because the queue was full
+
+	// The certificates the client presented, leaf first, if it
+	// connected over TLS with a client certificate.
+	PeerCertificates []*x509.Certificate
+}
+
+// EachClient calls fn for each client connected to the server, until
+// fn returns false. Only the client ids are copied ahead of time, and
+// fn is called with nothing locked, so that a slow fn does not hold up
+// the clients connecting meanwhile. Those may or may not be seen. fn
+// must not call back into the Server: to disconnect some clients, for
+// instance, note them, and do it once EachClient has returned.
+func (s *Server) EachClient(fn func(ClientInfo) bool) {
+	s.clients.each(func(c *incomingConn) bool {
+		return fn(ClientInfo{
+			ClientId:   c.clientid,
+			Tenant:     c.tenant,
+			RemoteAddr: c.conn.RemoteAddr(),
+			Queued:     len(c.jobs),
+			Inflight:   c.inflight.len(),
+			Dropped:    atomic.LoadInt64(&c.dropped),
+
+			PeerCertificates: peerCertificates(c.conn),
+		})
+	})
+}
+
+// A SubscriptionInfo describes one subscription of a connected
+// client, for EachSubscription.
+type SubscriptionInfo struct {
+	ClientId string
+	Tenant   string
+	Filter   string
+	Qos      proto.QosLevel // the QoS granted
+
+	// What happened to the messages that matched Filter since the
+	// subscription was made. The ones neither delivered nor dropped
+	// were published by the client itself, or left out by
+	// Server.Transform or the like.
+	Matched   int64
+	Delivered int64 // queued to be sent to the client
+	Dropped   int64 // not sent because the queue of the client was full
+}
+
+// EachSubscription calls fn for each subscription of the clients
+// connected to the server, until fn returns false. The subscriptions
+// are copied with the subscriptions locked, and fn is called without
+// the lock, so that a slow fn does not hold up subscribing and
+// publishing. As with EachClient, fn must not call back into the
+// Server.
+func (s *Server) EachSubscription(fn func(SubscriptionInfo) bool) {
+	var infos []SubscriptionInfo
+	s.subs.mu.Lock()
+	for tenant, p := range s.subs.parts {
+		for filter, v := range p.subs {
+			for c, qos := range v {
+				infos = append(infos, subscriptionInfo(c, tenant, filter, qos))
+			}
+		}
+		for _, w := range p.wildcards {
+			infos = append(infos, subscriptionInfo(w.c, tenant, w.filter, w.qos))
+		}
+	}
+	s.subs.mu.Unlock()
+
+	for _, si := range infos {
+		if !fn(si) {
+			return
+		}
+	}
+}
+
+// subscriptionInfo describes the subscription of c to filter.
+// subscriptions.mu must be held.
+func subscriptionInfo(c *incomingConn, tenant, filter string, qos proto.QosLevel) SubscriptionInfo {
+	st := c.subStat(filter)
+	return SubscriptionInfo{
+		ClientId:  c.clientid,
+		Tenant:    tenant,
+		Filter:    filter,
+		Qos:       qos,
+		Matched:   atomic.LoadInt64(&st.matched),
+		Delivered: atomic.LoadInt64(&st.delivered),
+		Dropped:   atomic.LoadInt64(&st.dropped),
+	}
+}
+
+// subStats counts what happened to the messages that matched one
+// subscription. The counters are accessed with sync/atomic.
+type subStats struct {
+	matched, delivered, dropped int64
+}
+
+// subStat returns the counters of the subscription of c to filter,
+// creating them if needed. subscriptions.mu must be held.
+func (c *incomingConn) subStat(filter string) *subStats {
+	st, ok := c.subStats[filter]
+	if !ok {
+		if c.subStats == nil {
+			c.subStats = make(map[string]*subStats)
+		}
+		st = &subStats{}
+		c.subStats[filter] = st
+	}
+	return st
+}
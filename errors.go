@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A ConnectError is returned by ClientConn.Connect when the server
+// refuses the connection. Use errors.As to get at the return code,
+// or errors.Is to compare with ErrBadProtocolVersion and friends.
+type ConnectError struct {
+	Code proto.ReturnCode
+	msg  string
+}
+
+func (e *ConnectError) Error() string {
+	return e.msg
+}
+
+// The errors for each of the CONNACK return codes specified in the
+// specification.
+var (
+	ErrBadProtocolVersion    = &ConnectError{proto.RetCodeUnacceptableProtocolVersion, "Connection Refused: unacceptable protocol version"}
+	ErrIdentifierRejected    = &ConnectError{proto.RetCodeIdentifierRejected, "Connection Refused: identifier rejected"}
+	ErrServerUnavailable     = &ConnectError{proto.RetCodeServerUnavailable, "Connection Refused: server unavailable"}
+	ErrBadUsernameOrPassword = &ConnectError{proto.RetCodeBadUsernameOrPassword, "Connection Refused: bad user name or password"}
+	ErrNotAuthorized         = &ConnectError{proto.RetCodeNotAuthorized, "Connection Refused: not authorized"}
+)
+
+// connectError returns the error for a CONNACK return code, or nil
+// if the connection was accepted.
+func connectError(rc proto.ReturnCode) error {
+	if rc == proto.RetCodeAccepted {
+		return nil
+	}
+	if int(rc) < len(ConnectionErrors) {
+		return ConnectionErrors[rc]
+	}
+	return &ConnectError{rc, fmt.Sprintf("Connection Refused: unknown return code %v", rc)}
+}
+
+// A RedirectError is returned by ClientConn.Connect, or ClientConn.Err,
+// when an MQTT 5 server sends the client to another server, with a
+// Server Reference. Err is the error it would be without one:
+// ErrServerUnavailable for a refused CONNECT, and ErrServerDisconnect
+// for a DISCONNECT.
+type RedirectError struct {
+	Reference string // one or more servers, separated by spaces
+	Err       error
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("%v, use %v", e.Err, e.Reference)
+}
+
+func (e *RedirectError) Unwrap() error {
+	return e.Err
+}
+
+// Errors about the connection going away.
+var (
+	// ErrConnectionClosed is returned when the server closes the
+	// connection, for instance while the client is waiting for an answer.
+	ErrConnectionClosed = errors.New("connection closed")
+
+	// ErrServerDisconnect is returned by ClientConn.Err when the
+	// server sent DISCONNECT.
+	ErrServerDisconnect = errors.New("server sent DISCONNECT")
+
+	// ErrLocalClose is returned by ClientConn.Err after Disconnect.
+	ErrLocalClose = errors.New("connection closed by Disconnect")
+)
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestConnectError(t *testing.T) {
+	if connectError(proto.RetCodeAccepted) != nil {
+		t.Error("accepted should not be an error")
+	}
+	err := connectError(proto.RetCodeNotAuthorized)
+	if !errors.Is(err, ErrNotAuthorized) {
+		t.Error("expected ErrNotAuthorized, got ", err)
+	}
+
+	var ce *ConnectError
+	if !errors.As(connectError(42), &ce) || ce.Code != 42 {
+		t.Error("unknown code: got ", ce)
+	}
+}
+
+func TestProtoErrorsBounded(t *testing.T) {
+	defer func(n int) { maxProtoErrorAddrs = n }(maxProtoErrorAddrs)
+	maxProtoErrorAddrs = 3
+
+	var p protoErrors
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		p.add(fmt.Sprint("10.0.0.", i), now.Add(time.Duration(i)*time.Second), 0, 0)
+	}
+	if len(p.counts) != 3 || p.counts["10.0.0.9"] == nil || p.counts["10.0.0.7"] == nil {
+		t.Errorf("kept %v, want the 3 most recent", p.counts)
+	}
+
+	// Expired addresses are forgotten, unless banned.
+	p.counts["10.0.0.8"].bannedUntil = now.Add(2 * protoErrorWindow)
+	later := now.Add(protoErrorWindow + time.Minute)
+	p.add("10.0.0.100", later, 0, 0)
+	if len(p.counts) != 2 || p.counts["10.0.0.8"] == nil {
+		t.Errorf("kept %v, want the banned and the new address", p.counts)
+	}
+	if ae := p.add("10.0.0.100", later, 0, 0); ae.n != 2 {
+		t.Errorf("count %v, want 2", ae.n)
+	}
+}
+
+// A flood of new addresses does not push out a banned one.
+func TestProtoErrorsKeepBans(t *testing.T) {
+	defer func(n int) { maxProtoErrorAddrs = n }(maxProtoErrorAddrs)
+	maxProtoErrorAddrs = 3
+
+	var p protoErrors
+	now := time.Now()
+	p.add("10.0.0.1", now, 1, time.Hour)
+	for i := 2; i < 10; i++ {
+		p.add(fmt.Sprint("10.0.0.", i), now.Add(time.Duration(i)*time.Second), 0, 0)
+	}
+	if ae := p.counts["10.0.0.1"]; ae == nil || !now.Before(ae.bannedUntil) {
+		t.Errorf("the banned address was forgotten: %v", p.counts)
+	}
+
+	for i := 2; i < 5; i++ {
+		p.add(fmt.Sprint("10.0.0.", i), now, 1, time.Hour)
+	}
+	if ae := p.add("10.0.0.100", now, 1, time.Hour); ae != nil || len(p.counts) != 3 {
+		t.Errorf("made room among banned addresses: %v", p.counts)
+	}
+}
@@ -0,0 +1,101 @@
+// Command bridge is an example of a bridge between a local broker and
+// a broker in the cloud. The messages published locally to topics
+// matching -up are published in the cloud, under -prefix, and the ones
+// published in the cloud matching -down are published locally, with
+// the prefix taken off.
+//
+// For more than that, give -topic lines as in a mosquitto bridge
+// configuration, such as -topic "sensors/# both 1 local/ site1/".
+// They replace -up and -down.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+
+	proto "github.com/huin/mqtt"
+	"github.com/jeffallen/mqtt"
+)
+
+var local = flag.String("local", "localhost:1883", "address of the local broker")
+var cloud = flag.String("cloud", "", "address of the cloud broker, which speaks TLS")
+var user = flag.String("user", "", "username on the cloud broker")
+var pass = flag.String("pass", "", "password on the cloud broker")
+var prefix = flag.String("prefix", "site1/", "prefix of the topics in the cloud")
+var up = flag.String("up", "devices/#", "what to send to the cloud")
+var down = flag.String("down", "", "what to get from the cloud, under prefix; nothing when empty")
+
+// topics collects the -topic flags.
+type topics []mqtt.BridgeRule
+
+func (t *topics) String() string { return "" }
+
+func (t *topics) Set(line string) error {
+	r, err := mqtt.ParseBridgeRule(line)
+	if err != nil {
+		return err
+	}
+	*t = append(*t, r)
+	return nil
+}
+
+var rules topics
+
+func init() {
+	flag.Var(&rules, "topic", "a mosquitto bridge topic line; may be repeated")
+}
+
+func dialLocal() (*mqtt.ClientConn, error) {
+	return mqtt.DialAndConnect(func() (net.Conn, error) {
+		return net.Dial("tcp", *local)
+	}, nil, "", "")
+}
+
+func dialCloud() (*mqtt.ClientConn, error) {
+	return mqtt.DialAndConnect(func() (net.Conn, error) {
+		return mqtt.DialTLS(*cloud, &tls.Config{})
+	}, nil, *user, *pass)
+}
+
+func main() {
+	flag.Parse()
+	if *cloud == "" {
+		log.Fatal("-cloud is required")
+	}
+	if len(rules) == 0 {
+		rules = append(rules, mqtt.BridgeRule{
+			Pattern:      *up,
+			Direction:    mqtt.BridgeOut,
+			Qos:          proto.QosAtLeastOnce,
+			RemotePrefix: *prefix,
+		})
+		if *down != "" {
+			rules = append(rules, mqtt.BridgeRule{
+				Pattern:      *down,
+				Direction:    mqtt.BridgeIn,
+				Qos:          proto.QosAtLeastOnce,
+				RemotePrefix: *prefix,
+			})
+		}
+	}
+
+	lc, err := dialLocal()
+	if err != nil {
+		log.Fatal("bridge: ", err)
+	}
+	cc, err := dialCloud()
+	if err != nil {
+		log.Fatal("bridge: ", err)
+	}
+	b := &mqtt.Bridge{
+		Local:  mqtt.NewSharedConn(lc),
+		Remote: mqtt.NewSharedConn(cc),
+		Rules:  rules,
+	}
+	defer b.Local.Close()
+	defer b.Remote.Close()
+	log.Print("bridge: ", b.Run(context.Background()))
+}
@@ -0,0 +1,110 @@
+// Command broker is an example of an embedded MQTT broker, with users
+// and passwords from a file, TLS, and the retained messages readable
+// over HTTP. Stop it with ^C; it shuts down cleanly.
+//
+// The users file has one "user:password" per line. Lines starting
+// with # are comments.
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	proto "github.com/huin/mqtt"
+	"github.com/jeffallen/mqtt"
+)
+
+var addr = flag.String("addr", ":1883", "listen address")
+var cert = flag.String("cert", "", "TLS certificate file; TLS is off when empty")
+var key = flag.String("key", "", "TLS key file")
+var users = flag.String("users", "", "file of user:password lines; anyone may connect when empty")
+var web = flag.String("http", "", "address to serve /retained/ on; off when empty")
+
+// loadUsers reads the users and their passwords.
+func loadUsers(r io.Reader) (map[string]string, error) {
+	res := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		res[line[:i]] = line[i+1:]
+	}
+	return res, s.Err()
+}
+
+// authenticate returns an Authenticate function for the users.
+func authenticate(users map[string]string) func(net.Conn, *proto.Connect) bool {
+	return func(conn net.Conn, m *proto.Connect) bool {
+		pass, ok := users[m.Username]
+		return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(m.Password)) == 1
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	var l net.Listener
+	var err error
+	if *cert != "" {
+		var c tls.Certificate
+		c, err = tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			log.Fatal("certificate: ", err)
+		}
+		l, err = tls.Listen("tcp", *addr, &tls.Config{
+			Certificates: []tls.Certificate{c},
+			NextProtos:   []string{"mqtt"},
+		})
+	} else {
+		l, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		log.Fatal("listen: ", err)
+	}
+
+	svr := mqtt.NewServer(l)
+	if *users != "" {
+		f, err := os.Open(*users)
+		if err != nil {
+			log.Fatal("users: ", err)
+		}
+		u, err := loadUsers(f)
+		f.Close()
+		if err != nil {
+			log.Fatal("users: ", err)
+		}
+		svr.Authenticate = authenticate(u)
+	}
+	svr.Start()
+
+	if *web != "" {
+		http.Handle("/retained/", svr.RetainedHandler(""))
+		go func() {
+			log.Print("http: ", http.ListenAndServe(*web, nil))
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	select {
+	case <-sig:
+		r := svr.Shutdown()
+		log.Printf("shut down: %v clients, %v messages undelivered", r.Clients, r.Undelivered)
+	case <-svr.Done:
+	}
+}
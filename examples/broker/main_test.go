@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	u, err := loadUsers(strings.NewReader("# sensors\nsensor:s3cret\n\nadmin:a:b\nbroken\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authenticate(u)
+	for _, test := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"sensor", "s3cret", true},
+		{"sensor", "wrong", false},
+		{"admin", "a:b", true},
+		{"broken", "", false},
+		{"nobody", "", false},
+	} {
+		if got := auth(nil, &proto.Connect{Username: test.user, Password: test.pass}); got != test.want {
+			t.Errorf("%v/%v: got %v", test.user, test.pass, got)
+		}
+	}
+}
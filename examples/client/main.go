@@ -0,0 +1,113 @@
+// Command client is an example of a client that stays connected: when
+// the connection is lost, it connects again, with backoff, and
+// subscribes again. The messages it gets are sent to handlers by a
+// router, according to their topic.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	proto "github.com/huin/mqtt"
+	"github.com/jeffallen/mqtt"
+)
+
+var host = flag.String("host", "localhost:1883", "hostname of broker")
+var user = flag.String("user", "", "username")
+var pass = flag.String("pass", "", "password")
+
+// The longest to wait before connecting again.
+const maxBackoff = time.Minute
+
+// A router sends each message to the handler of the first route that
+// matches its topic.
+type router struct {
+	routes []route
+}
+
+type route struct {
+	filter string
+	fn     func(*mqtt.Message)
+}
+
+// handle adds a route for the messages matching filter.
+func (r *router) handle(filter string, fn func(*mqtt.Message)) {
+	r.routes = append(r.routes, route{filter, fn})
+}
+
+// subscriptions returns what to subscribe to for the routes.
+func (r *router) subscriptions() []proto.TopicQos {
+	res := make([]proto.TopicQos, len(r.routes))
+	for i, rt := range r.routes {
+		res[i] = proto.TopicQos{Topic: rt.filter, Qos: proto.QosAtLeastOnce}
+	}
+	return res
+}
+
+// dispatch sends m to its handler, and reports whether it found one.
+func (r *router) dispatch(m *mqtt.Message) bool {
+	for _, rt := range r.routes {
+		if match(rt.filter, m.Topic) {
+			rt.fn(m)
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether topic matches filter, which may have
+// wildcards.
+func match(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		switch {
+		case level == "#":
+			return true
+		case i >= len(t):
+			return false
+		case level != "+" && level != t[i]:
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func main() {
+	flag.Parse()
+
+	var r router
+	r.handle("devices/+/state", func(m *mqtt.Message) {
+		log.Printf("%v is %s", strings.Split(m.Topic, "/")[1], m.Payload)
+	})
+	r.handle("alerts/#", func(m *mqtt.Message) {
+		log.Printf("ALERT %v: %s", m.Topic, m.Payload)
+	})
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", *host) }
+	backoff := time.Second
+	for {
+		cc, err := mqtt.DialAndConnect(dial, nil, *user, *pass)
+		if err != nil {
+			log.Printf("connect: %v; trying again in %v", err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		log.Print("connected as ", cc.ClientId)
+
+		cc.Subscribe(r.subscriptions())
+		for in := range cc.Incoming {
+			m := mqtt.NewMessage(in)
+			if !r.dispatch(&m) {
+				log.Print("no route for ", m.Topic)
+			}
+		}
+		log.Print("connection lost: ", cc.Err())
+	}
+}
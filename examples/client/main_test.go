@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jeffallen/mqtt"
+)
+
+func TestRouter(t *testing.T) {
+	var r router
+	var got string
+	r.handle("devices/+/state", func(m *mqtt.Message) { got = "state" })
+	r.handle("devices/#", func(m *mqtt.Message) { got = "devices" })
+
+	for _, test := range []struct{ topic, want string }{
+		{"devices/1/state", "state"},
+		{"devices/1/state/extra", "devices"},
+		{"devices", "devices"},
+		{"other", ""},
+	} {
+		got = ""
+		r.dispatch(&mqtt.Message{Topic: test.topic})
+		if got != test.want {
+			t.Errorf("%v: got %q, want %q", test.topic, got, test.want)
+		}
+	}
+}
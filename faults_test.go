@@ -0,0 +1,242 @@
+package mqtt
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A faultConn is a net.Conn that loses some of the MQTT packets written
+// to it, sends others twice, and, if kill is non-zero, dies after
+// writing that many. It works on whole packets, so that what does get
+// through can still be read. Only the packets of the QoS exchanges are
+// tampered with, since the protocol recovers from losing those; losing
+// a CONNACK or a SUBACK just makes the test hang.
+type faultConn struct {
+	net.Conn
+	rand      *rand.Rand
+	drop, dup float64 // the chance that a packet is lost, or sent twice
+	kill      int
+	buf       []byte
+	n         int
+}
+
+func newFaultConn(c net.Conn, seed int64, drop, dup float64) *faultConn {
+	return &faultConn{Conn: c, rand: rand.New(rand.NewSource(seed)), drop: drop, dup: dup}
+}
+
+// Write is only called by one writer goroutine at a time, so it does
+// not need a lock.
+func (c *faultConn) Write(b []byte) (int, error) {
+	c.buf = append(c.buf, b...)
+	for {
+		n := packetLen(c.buf)
+		if n == 0 || n > len(c.buf) {
+			return len(b), nil
+		}
+		pkt := c.buf[:n]
+		times := 1
+		switch pkt[0] >> 4 {
+		case msgPublish, msgPubAck, msgPubRec, msgPubRel, msgPubComp:
+			if r := c.rand.Float64(); r < c.drop {
+				times = 0
+			} else if r < c.drop+c.dup {
+				times = 2
+			}
+		}
+		for i := 0; i < times; i++ {
+			if _, err := c.Conn.Write(pkt); err != nil {
+				return 0, err
+			}
+		}
+		c.buf = c.buf[n:]
+
+		c.n++
+		if c.kill > 0 && c.n >= c.kill {
+			c.Conn.Close()
+			return 0, ErrConnectionClosed
+		}
+	}
+}
+
+// The packet types the faults apply to.
+const (
+	msgPublish = 3
+	msgPubAck  = 4
+	msgPubRec  = 5
+	msgPubRel  = 6
+	msgPubComp = 7
+)
+
+// packetLen returns the length of the packet at the start of b, which
+// may be more than len(b), or 0 if b is too short to tell.
+func packetLen(b []byte) int {
+	n, mult := 0, 1
+	for i := 1; i < len(b) && i <= 4; i++ {
+		n += int(b[i]&0x7f) * mult
+		if b[i]&0x80 == 0 {
+			return 1 + i + n
+		}
+		mult *= 128
+	}
+	return 0
+}
+
+// A faultListener makes the connections it accepts into faultConns, to
+// tamper with what the server writes.
+type faultListener struct {
+	net.Listener
+	drop, dup float64
+	seed      int64
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.seed++
+	return newFaultConn(c, l.seed, l.drop, l.dup), nil
+}
+
+// pipeline runs a server and a subscriber, both losing and repeating
+// packets, and publishers that send msgs messages each at qos. When
+// kill is non-zero, the connections of the publishers die after that
+// many packets, and they connect again and publish what was not
+// acknowledged. It returns how many times each message arrived.
+func pipeline(t *testing.T, qos proto.QosLevel, publishers, msgs, kill int) map[string]int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(&faultListener{Listener: l, drop: 0.1, dup: 0.1})
+	svr.RetryInterval = 50 * time.Millisecond
+	svr.Start()
+
+	var seed int64
+	var seedMu sync.Mutex
+	dial := func(kill int) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			seedMu.Lock()
+			seed++
+			fc := newFaultConn(c, -seed, 0.1, 0.1)
+			seedMu.Unlock()
+			fc.kill = kill
+			return fc, nil
+		}
+	}
+	setup := func(cc *ClientConn) { cc.RetryInterval = 50 * time.Millisecond }
+
+	sub, err := DialAndConnect(dial(0), setup, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect()
+	sub.Subscribe([]proto.TopicQos{{Topic: "pipeline/#", Qos: qos}})
+
+	// Read as they come, so that the subscriber keeps acknowledging.
+	arrived := make(chan string, publishers*msgs*2)
+	go func() {
+		for m := range sub.Incoming {
+			arrived <- m.TopicName + "/" + string(m.Payload.(proto.BytesPayload))
+		}
+		close(arrived)
+	}()
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			left := make([]int, msgs)
+			for i := range left {
+				left[i] = i
+			}
+			for len(left) > 0 {
+				pub, err := DialAndConnect(dial(kill), setup, "", "")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var tokens []*PublishToken
+				for _, i := range left {
+					tokens = append(tokens, pub.PublishAsync(&proto.Publish{
+						Header:    header(dupFalse, qos, retainFalse),
+						TopicName: fmt.Sprint("pipeline/", p),
+						Payload:   proto.BytesPayload(strconv.Itoa(i)),
+					}))
+				}
+				var notAcked []int
+				for j, tok := range tokens {
+					if tok.Wait() != nil {
+						notAcked = append(notAcked, left[j])
+					}
+				}
+				pub.Disconnect()
+				left = notAcked
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	got := make(map[string]int)
+	timeout := time.After(10 * time.Second)
+	for len(got) < publishers*msgs {
+		select {
+		case k, ok := <-arrived:
+			if !ok {
+				t.Fatal("subscriber disconnected: ", sub.Err())
+			}
+			got[k]++
+		case <-timeout:
+			t.Fatalf("%v messages of %v arrived", len(got), publishers*msgs)
+		}
+	}
+	// Give the duplicates a chance to show up.
+	for {
+		select {
+		case k := <-arrived:
+			got[k]++
+		case <-time.After(4 * svr.RetryInterval):
+			return got
+		}
+	}
+}
+
+func TestPipelineAtLeastOnce(t *testing.T) {
+	const publishers, msgs = 4, 200
+	got := pipeline(t, proto.QosAtLeastOnce, publishers, msgs, 150)
+	for p := 0; p < publishers; p++ {
+		for i := 0; i < msgs; i++ {
+			if got[fmt.Sprintf("pipeline/%v/%v", p, i)] == 0 {
+				t.Errorf("message %v from %v was lost", i, p)
+			}
+		}
+	}
+}
+
+// Sessions are always clean, so a new connection cannot finish the QoS 2
+// exchanges of the one that died. Publishing again would rightly make
+// duplicates, so the connections are not killed here.
+func TestPipelineExactlyOnce(t *testing.T) {
+	const publishers, msgs = 4, 200
+	got := pipeline(t, proto.QosExactlyOnce, publishers, msgs, 0)
+	for p := 0; p < publishers; p++ {
+		for i := 0; i < msgs; i++ {
+			if n := got[fmt.Sprintf("pipeline/%v/%v", p, i)]; n != 1 {
+				t.Errorf("message %v from %v arrived %v times", i, p, n)
+			}
+		}
+	}
+}
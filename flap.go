@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// flaps remembers when each client id connected recently, to spot
+// clients that keep connecting and disconnecting.
+type flaps struct {
+	mu       sync.Mutex // guards access to fields below
+	connects map[string][]time.Time
+	records  int
+}
+
+// How often, in connections, flaps forgets the client ids that have
+// not connected within the window.
+const flapPruneEvery = 1000
+
+// flap records a connection of the client with key k, and returns how
+// long to delay its CONNACK. Once a client connects more than
+// Server.FlapThreshold times within Server.FlapWindow, it gets
+// Server.FlapPenalty, doubling with each further connection, but never
+// more than FlapWindow.
+func (s *Server) flap(k string) time.Duration {
+	if s.FlapWindow <= 0 {
+		return 0
+	}
+	now := time.Now()
+	f := &s.flaps
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connects == nil {
+		f.connects = make(map[string][]time.Time)
+	}
+
+	f.records++
+	if f.records%flapPruneEvery == 0 {
+		for k, times := range f.connects {
+			if now.Sub(times[len(times)-1]) > s.FlapWindow {
+				delete(f.connects, k)
+			}
+		}
+	}
+
+	times := append(recent(f.connects[k], now, s.FlapWindow), now)
+	f.connects[k] = times
+
+	over := len(times) - s.FlapThreshold
+	if s.FlapThreshold <= 0 || s.FlapPenalty <= 0 || over <= 0 {
+		return 0
+	}
+	d := s.FlapPenalty
+	for i := 1; i < over && d < s.FlapWindow; i++ {
+		d *= 2
+	}
+	if d > s.FlapWindow {
+		d = s.FlapWindow
+	}
+	log.Printf("client %q connected %v times in %v, delaying CONNACK by %v", k, len(times), s.FlapWindow, d)
+	return d
+}
+
+// recent returns the times that are within window of now.
+func recent(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > window {
+		i++
+	}
+	return times[i:]
+}
+
+// Flaps returns the number of times each client id connected within
+// the last FlapWindow, for the ones that connected more than once.
+// Client ids of tenants are prefixed by the tenant and a NUL byte.
+func (s *Server) Flaps() map[string]int {
+	now := time.Now()
+	f := &s.flaps
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := make(map[string]int)
+	for k, times := range f.connects {
+		if n := len(recent(times, now, s.FlapWindow)); n > 1 {
+			res[k] = n
+		}
+	}
+	return res
+}
+
+// flapping returns the number of clients over FlapThreshold.
+func (s *Server) flapping() int64 {
+	var n int64
+	for _, c := range s.Flaps() {
+		if s.FlapThreshold > 0 && c > s.FlapThreshold {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,28 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlapPenalty(t *testing.T) {
+	s := &Server{FlapWindow: time.Minute, FlapThreshold: 2, FlapPenalty: 10 * time.Second}
+	want := []time.Duration{0, 0, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, w := range want {
+		if got := s.flap("flappy"); got != w {
+			t.Errorf("connection %v: got delay %v, want %v", i+1, got, w)
+		}
+	}
+	if d := s.flap("calm"); d != 0 {
+		t.Errorf("another client got delay %v", d)
+	}
+	if n := s.Flaps()["flappy"]; n != len(want) {
+		t.Errorf("got %v connections, want %v", n, len(want))
+	}
+	if _, ok := s.Flaps()["calm"]; ok {
+		t.Error("a client that connected once is in Flaps")
+	}
+	if n := s.flapping(); n != 1 {
+		t.Errorf("got %v flapping clients, want 1", n)
+	}
+}
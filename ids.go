@@ -0,0 +1,14 @@
+package mqtt
+
+// An IdGenerator makes up ids, for instance to follow the conventions
+// of a tracing system (UUID v7, ULID, ...). The ids it returns should
+// be unique; the server tries again when one is in use.
+type IdGenerator interface {
+	NewId() string
+}
+
+// IdGeneratorFunc makes a function into an IdGenerator.
+type IdGeneratorFunc func() string
+
+// NewId calls f.
+func (f IdGeneratorFunc) NewId() string { return f() }
@@ -0,0 +1,216 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The default for Server.RetryInterval and ClientConn.RetryInterval.
+const defaultRetryInterval = 20 * time.Second
+
+// An inflight holds the QoS 1 and 2 PUBLISH messages sent on a
+// connection that the other side has not finished acknowledging,
+// by MessageId. It is shared by the goroutine sending the messages
+// and the one reading the acknowledgements.
+type inflight struct {
+	mu   sync.Mutex // guards access to fields below
+	last uint16     // the last MessageId given out
+	seq  uint64
+	msgs map[uint16]*outbound
+	less chan struct{} // closed, and replaced, when a message is removed
+}
+
+// An outbound is one message waiting for its acknowledgement.
+type outbound struct {
+	m     *proto.Publish
+	x     *v5extra      // for MQTT 5 clients, what m has no room for
+	seq   uint64        // the order messages were added in
+	rel   bool          // PUBREC arrived; now the PUBREL is waiting for PUBCOMP
+	sent  time.Time     // when the PUBLISH or PUBREL was last sent
+	sends int           // how many times it was sent again
+	done  chan struct{} // closed once the exchange is complete
+}
+
+// add gives m a MessageId that is not in use, and remembers it, with
+// x, until it is acknowledged. It returns nil when all of the ids are
+// in use.
+func (f *inflight) add(m *proto.Publish, x *v5extra, now time.Time) *outbound {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.msgs == nil {
+		f.msgs = make(map[uint16]*outbound)
+	}
+	if len(f.msgs) >= 0xffff {
+		return nil
+	}
+	for {
+		f.last++
+		// MessageId 0 is not allowed. See MQTT-2.3.1-1.
+		if _, used := f.msgs[f.last]; f.last != 0 && !used {
+			break
+		}
+	}
+	m.MessageId = f.last
+	f.seq++
+	o := &outbound{m: m, x: x, seq: f.seq, sent: now, done: make(chan struct{})}
+	f.msgs[m.MessageId] = o
+	return o
+}
+
+// remove forgets the message with this id, if it is at the stage given
+// by rel. It returns false if there was no such message.
+func (f *inflight) remove(id uint16, rel bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.msgs[id]
+	if !ok || o.rel != rel {
+		return false
+	}
+	delete(f.msgs, id)
+	close(o.done)
+	f.signal()
+	return true
+}
+
+// signal wakes up the goroutines in wait. f.mu must be held.
+func (f *inflight) signal() {
+	if f.less != nil {
+		close(f.less)
+		f.less = nil
+	}
+}
+
+// wait blocks until fewer than max messages are in flight. It returns
+// false if quit is closed first.
+func (f *inflight) wait(max int, quit <-chan struct{}) bool {
+	for {
+		f.mu.Lock()
+		if len(f.msgs) < max {
+			f.mu.Unlock()
+			return true
+		}
+		if f.less == nil {
+			f.less = make(chan struct{})
+		}
+		less := f.less
+		f.mu.Unlock()
+
+		select {
+		case <-less:
+		case <-quit:
+			return false
+		}
+	}
+}
+
+// ack handles a PUBACK, which completes a QoS 1 message.
+func (f *inflight) ack(id uint16) bool {
+	return f.remove(id, false)
+}
+
+// rec handles a PUBREC, the first acknowledgement of a QoS 2 message.
+// It returns the PUBREL to reply with. From here on, it is the PUBREL
+// that is sent again if no PUBCOMP arrives.
+func (f *inflight) rec(id uint16, now time.Time) *proto.PubRel {
+	f.mu.Lock()
+	if o, ok := f.msgs[id]; ok && o.m.Header.QosLevel == proto.QosExactlyOnce {
+		o.rel = true
+		o.sent = now
+	}
+	f.mu.Unlock()
+	return pubRel(id)
+}
+
+// comp handles a PUBCOMP, which completes a QoS 2 message.
+func (f *inflight) comp(id uint16) bool {
+	return f.remove(id, true)
+}
+
+func pubRel(id uint16) *proto.PubRel {
+	return &proto.PubRel{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: id,
+	}
+}
+
+// due returns what needs to be sent again because it was sent more
+// than d ago and is still not acknowledged: PUBLISH messages, with the
+// DUP flag set, and PUBREL messages.
+func (f *inflight) due(now time.Time, d time.Duration) []job {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var res []*outbound
+	for _, o := range f.msgs {
+		if now.Sub(o.sent) >= d {
+			res = append(res, o)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].seq < res[j].seq })
+
+	jobs := make([]job, len(res))
+	for i, o := range res {
+		o.sent = now
+		o.sends++
+		if o.rel {
+			jobs[i] = job{m: pubRel(o.m.MessageId)}
+			continue
+		}
+		// Send a copy, because whoever encodes it may not hold f.mu.
+		m := *o.m
+		m.Header.DupFlag = true
+		jobs[i] = job{m: &m, x: o.x}
+	}
+	return jobs
+}
+
+// giveUp forgets the messages that would be due, but were sent again
+// max times already, and returns how many there were.
+func (f *inflight) giveUp(now time.Time, d time.Duration, max int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for id, o := range f.msgs {
+		if now.Sub(o.sent) >= d && o.sends >= max {
+			delete(f.msgs, id)
+			close(o.done)
+			n++
+		}
+	}
+	if n > 0 {
+		f.signal()
+	}
+	return n
+}
+
+// drain forgets all the messages, and returns the ones that the
+// other side has not received for sure, in the order they were sent.
+func (f *inflight) drain() []job {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var res []*outbound
+	for _, o := range f.msgs {
+		if !o.rel {
+			res = append(res, o)
+		}
+		close(o.done)
+	}
+	f.msgs = nil
+	f.signal()
+	sort.Slice(res, func(i, j int) bool { return res[i].seq < res[j].seq })
+
+	jobs := make([]job, len(res))
+	for i, o := range res {
+		jobs[i] = job{m: o.m, x: o.x}
+	}
+	return jobs
+}
+
+// len returns the number of messages in flight.
+func (f *inflight) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.msgs)
+}
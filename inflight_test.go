@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestInflight(t *testing.T) {
+	var f inflight
+	now := time.Now()
+
+	// Ids wrap around, skipping 0 and the ones in use.
+	f.last = 0xfffe
+	m1 := &proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse)}
+	m2 := &proto.Publish{Header: header(dupFalse, proto.QosExactlyOnce, retainFalse)}
+	f.add(m1, nil, now)
+	f.add(m2, nil, now)
+	if m1.MessageId != 0xffff || m2.MessageId != 1 {
+		t.Fatalf("got ids %v and %v", m1.MessageId, m2.MessageId)
+	}
+
+	if msgs := f.due(now.Add(time.Second), time.Minute); len(msgs) != 0 {
+		t.Errorf("%v messages due too early", len(msgs))
+	}
+	msgs := f.due(now.Add(time.Minute), time.Minute)
+	if len(msgs) != 2 {
+		t.Fatalf("got %v messages due, want 2", len(msgs))
+	}
+	if p := msgs[0].m.(*proto.Publish); !p.Header.DupFlag || p.MessageId != m1.MessageId {
+		t.Errorf("first retransmit is %+v", p)
+	}
+	if m1.Header.DupFlag {
+		t.Error("retransmit changed the message in flight")
+	}
+
+	// A PUBCOMP does not complete a QoS 1 message, and a PUBACK does.
+	if f.comp(m1.MessageId) {
+		t.Error("PUBCOMP completed a QoS 1 message")
+	}
+	if !f.ack(m1.MessageId) || f.len() != 1 {
+		t.Error("PUBACK did not complete a QoS 1 message")
+	}
+
+	// After PUBREC, it is the PUBREL that goes out again.
+	if rel := f.rec(m2.MessageId, now); rel.MessageId != m2.MessageId {
+		t.Errorf("PUBREL for %v", rel.MessageId)
+	}
+	msgs = f.due(now.Add(time.Minute), time.Minute)
+	if len(msgs) != 1 {
+		t.Fatalf("got %v messages due, want 1", len(msgs))
+	}
+	if _, ok := msgs[0].m.(*proto.PubRel); !ok {
+		t.Errorf("retransmit is %T, want PUBREL", msgs[0].m)
+	}
+	if !f.comp(m2.MessageId) || f.len() != 0 {
+		t.Error("PUBCOMP did not complete a QoS 2 message")
+	}
+}
+
+func TestInflightGiveUp(t *testing.T) {
+	var f inflight
+	now := time.Now()
+	f.add(&proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse)}, nil, now)
+
+	for i := 1; i <= 2; i++ {
+		now = now.Add(time.Minute)
+		if n := f.giveUp(now, time.Minute, 2); n != 0 {
+			t.Fatalf("gave up after %v retries", i-1)
+		}
+		if msgs := f.due(now, time.Minute); len(msgs) != 1 {
+			t.Fatalf("retry %v: %v messages due", i, len(msgs))
+		}
+	}
+	if n := f.giveUp(now.Add(time.Second), time.Minute, 2); n != 0 {
+		t.Error("gave up before the message was due")
+	}
+	if n := f.giveUp(now.Add(time.Minute), time.Minute, 2); n != 1 || f.len() != 0 {
+		t.Errorf("gave up on %v, %v left", n, f.len())
+	}
+}
+
+func TestInflightDrain(t *testing.T) {
+	var f inflight
+	now := time.Now()
+	var ms []*proto.Publish
+	for i := 0; i < 5; i++ {
+		m := &proto.Publish{Header: header(dupFalse, proto.QosExactlyOnce, retainFalse)}
+		f.add(m, nil, now)
+		ms = append(ms, m)
+	}
+	// The client has the third one for sure.
+	f.rec(ms[2].MessageId, now)
+
+	got := f.drain()
+	want := []*proto.Publish{ms[0], ms[1], ms[3], ms[4]}
+	if len(got) != len(want) {
+		t.Fatalf("got %v messages, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].m != want[i] {
+			t.Errorf("message %v is %v, want id %v", i, got[i].m, want[i].MessageId)
+		}
+	}
+	if f.len() != 0 {
+		t.Error("drain left messages in flight")
+	}
+}
+
+func TestInflightWait(t *testing.T) {
+	var f inflight
+	m := &proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse)}
+	f.add(m, nil, time.Now())
+
+	quit := make(chan struct{})
+	close(quit)
+	if f.wait(1, quit) {
+		t.Error("wait did not notice quit")
+	}
+
+	done := make(chan bool)
+	go func() { done <- f.wait(1, nil) }()
+	f.ack(m.MessageId)
+	if !<-done {
+		t.Error("wait did not return true after ack")
+	}
+}
+
+func TestReceiveMaximum(t *testing.T) {
+	c := newTestConn(&Server{}, "c")
+	c.props = properties{{id: propReceiveMaximum, n: 1}}
+	c.inflight.add(&proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse)}, nil, time.Now())
+
+	w := &connWriter{bw: bufio.NewWriter(ioutil.Discard)}
+	for i := 0; i < 2; i++ {
+		m := &proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), TopicName: "a"}
+		if !c.send(job{m: m}, w) {
+			t.Fatal("send failed")
+		}
+	}
+	if len(c.held) != 2 || w.bw.Buffered() != 0 {
+		t.Errorf("%v held, %v bytes written", len(c.held), w.bw.Buffered())
+	}
+}
+
+func TestPauseDelivery(t *testing.T) {
+	s := &Server{stats: &stats{}}
+	c := newTestConn(s, "paused")
+	c.add()
+	defer c.del()
+	if s.PauseDelivery("", "nobody") != ErrNoClient {
+		t.Error("paused a client that is not connected")
+	}
+	other := newTestConn(s, "paused")
+	other.tenant = "other"
+	other.add()
+	defer other.del()
+	if err := s.PauseDelivery("other", "paused"); err != nil || !other.isPaused() || c.isPaused() {
+		t.Errorf("PauseDelivery of another tenant: %v", err)
+	}
+	if err := s.PauseDelivery("", "paused"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &connWriter{bw: bufio.NewWriter(ioutil.Discard)}
+	for _, qos := range []proto.QosLevel{proto.QosAtMostOnce, proto.QosAtLeastOnce} {
+		m := &proto.Publish{Header: header(dupFalse, qos, retainFalse), TopicName: "a", Payload: proto.BytesPayload("x")}
+		if !c.send(job{m: m}, w) {
+			t.Fatal("send failed")
+		}
+	}
+	if len(c.held) != 2 || w.bw.Buffered() != 0 {
+		t.Errorf("paused: %v held, %v bytes written", len(c.held), w.bw.Buffered())
+	}
+
+	if err := s.ResumeDelivery("", "paused"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.release(w) {
+		t.Fatal("release failed")
+	}
+	if len(c.held) != 0 || c.inflight.len() != 1 {
+		t.Errorf("resumed: %v held, %v in flight", len(c.held), c.inflight.len())
+	}
+}
@@ -0,0 +1,119 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An EventKind says what happened, in an Event.
+type EventKind string
+
+// The kinds of events in the journal.
+const (
+	EventConnect     EventKind = "connect"     // a client connected; Detail is its address
+	EventDisconnect  EventKind = "disconnect"  // a client went away
+	EventSubscribe   EventKind = "subscribe"   // Detail is the filter
+	EventUnsubscribe EventKind = "unsubscribe" // Detail is the filter
+	EventDrop        EventKind = "drop"        // messages for a client were dropped; Detail says why
+	EventAdmin       EventKind = "admin"       // a method like Drain or PauseDelivery was called; Detail says which
+)
+
+// An Event is something that happened in the broker, as kept by the
+// journal. See Server.JournalSize.
+type Event struct {
+	Seq      uint64 // counts the events, starting at 1
+	Time     time.Time
+	Kind     EventKind
+	ClientId string `json:",omitempty"`
+	Tenant   string `json:",omitempty"`
+	Detail   string `json:",omitempty"`
+}
+
+// journal keeps the latest events in a ring, and writes them all to
+// Server.Journal.
+type journal struct {
+	mu   sync.Mutex // guards access to fields below
+	ring []Event
+	seq  uint64
+	enc  *json.Encoder
+	w    io.Writer // what enc writes to
+}
+
+// record adds an event to the journal, if there is one. c may be nil,
+// for the events that are not about a client.
+func (s *Server) record(kind EventKind, c *incomingConn, detail string) {
+	if s.JournalSize <= 0 && s.Journal == nil {
+		return
+	}
+	e := Event{Time: time.Now(), Kind: kind, Detail: detail}
+	if c != nil {
+		e.ClientId, e.Tenant = c.clientid, c.tenant
+	}
+
+	j := &s.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	e.Seq = j.seq
+	if n := s.JournalSize; n > 0 {
+		if len(j.ring) != n {
+			j.resize(n)
+		}
+		j.ring[int((e.Seq-1)%uint64(n))] = e
+	}
+	if s.Journal != nil {
+		if j.w != s.Journal {
+			j.w, j.enc = s.Journal, json.NewEncoder(s.Journal)
+		}
+		if err := j.enc.Encode(e); err != nil {
+			log.Print("journal: ", err)
+		}
+	}
+}
+
+// resize makes the ring hold n events, keeping the latest ones.
+// j.mu must be held.
+func (j *journal) resize(n int) {
+	ring := make([]Event, n)
+	for _, e := range j.ring {
+		if e.Seq > 0 && e.Seq+uint64(n) > j.seq {
+			ring[int((e.Seq-1)%uint64(n))] = e
+		}
+	}
+	j.ring = ring
+}
+
+// Events returns the events kept in the journal that came after the
+// one numbered since, oldest first. Events(0) returns all of them, and
+// passing the Seq of the last event returned gets only the new ones,
+// to follow the journal. If some events were pushed out of the ring
+// before they could be returned, the first event has a Seq more than
+// since+1.
+func (s *Server) Events(since uint64) []Event {
+	j := &s.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n := uint64(len(j.ring))
+	if n == 0 || since >= j.seq {
+		return nil
+	}
+	first := since + 1
+	if j.seq-first >= n {
+		first = j.seq - n + 1
+	}
+	res := make([]Event, 0, j.seq-first+1)
+	for seq := first; seq <= j.seq; seq++ {
+		res = append(res, j.ring[(seq-1)%n])
+	}
+	return res
+}
+
+// countDrop counts n messages dropped for c, and records why.
+func (c *incomingConn) countDrop(n int64, why string) {
+	atomic.AddInt64(&c.dropped, n)
+	c.svr.record(EventDrop, c, why)
+}
@@ -0,0 +1,36 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Server{JournalSize: 3, Journal: &buf}
+	c := newTestConn(s, "c")
+	for _, f := range []string{"a", "b", "c", "d"} {
+		c.subscriptionChanged(true, f, 0)
+	}
+	c.countDrop(1, "test")
+
+	events := s.Events(0)
+	if len(events) != 3 || events[0].Seq != 3 || events[2].Kind != EventDrop || events[2].ClientId != "c" {
+		t.Errorf("got %+v", events)
+	}
+	if events := s.Events(4); len(events) != 1 || events[0].Seq != 5 {
+		t.Errorf("since 4: got %+v", events)
+	}
+	if events := s.Events(5); events != nil {
+		t.Errorf("since the last: got %+v", events)
+	}
+
+	dec := json.NewDecoder(&buf)
+	for seq := uint64(1); seq <= 5; seq++ {
+		var e Event
+		if err := dec.Decode(&e); err != nil || e.Seq != seq {
+			t.Fatalf("journal line %v: %+v, %v", seq, e, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds of the buckets of the latency histograms. The last
+// bucket, with no bound, counts the rest.
+var latencyBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// A histogram counts durations in the buckets of latencyBounds. The
+// zero value is ready to use, and it is safe for concurrent use.
+type histogram struct {
+	counts [len(latencyBounds) + 1]int64 // accessed with sync/atomic
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d >= latencyBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+}
+
+// A Histogram is a snapshot of how long things waited. Counts[i] is
+// the number that waited less than Bounds[i], and not less than the
+// bound before it. The last count, with no bound, is the rest.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+}
+
+func (h *histogram) snapshot() Histogram {
+	res := Histogram{
+		Bounds: latencyBounds[:],
+		Counts: make([]int64, len(h.counts)),
+	}
+	for i := range h.counts {
+		res.Counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return res
+}
+
+// Quantile returns the bound under which the fraction q of the counts
+// are, or -1 when they are over the last bound, or when there are no
+// counts.
+func (h Histogram) Quantile(q float64) time.Duration {
+	var total int64
+	for _, n := range h.Counts {
+		total += n
+	}
+	if total == 0 {
+		return -1
+	}
+	want := int64(q * float64(total))
+	var sum int64
+	for i, n := range h.Counts {
+		sum += n
+		if sum >= want && sum > 0 && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return -1
+}
+
+// A QueueLatency says how long messages waited in the queues of the
+// server since it started: Posts for a worker to fan them out to the
+// subscribers, and Jobs for the writer of a connection to send them.
+// When the waits grow, the server is near saturation, and about to
+// drop messages.
+type QueueLatency struct {
+	Posts Histogram
+	Jobs  Histogram
+}
+
+// QueueLatency returns the time messages spent waiting in the queues.
+func (s *Server) QueueLatency() QueueLatency {
+	return QueueLatency{
+		Posts: s.subs.postWait.snapshot(),
+		Jobs:  s.jobWait.snapshot(),
+	}
+}
+
+// publishLatency publishes the 50th and 99th percentiles of the queue
+// latency under $SYS/broker/latency/, in microseconds. Over the last
+// bucket, they are -1.
+func (s *Server) publishLatency() {
+	ql := s.QueueLatency()
+	for _, h := range []struct {
+		name string
+		h    Histogram
+	}{
+		{"posts", ql.Posts},
+		{"jobs", ql.Jobs},
+	} {
+		for _, q := range []struct {
+			name string
+			q    float64
+		}{
+			{"p50", 0.5},
+			{"p99", 0.99},
+		} {
+			d := h.h.Quantile(q.q)
+			if d > 0 {
+				d /= time.Microsecond
+			}
+			s.subs.submit(nil, statsMessage("$SYS/broker/latency/"+h.name+"/"+q.name, int64(d)))
+		}
+	}
+}
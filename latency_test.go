@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	if q := h.snapshot().Quantile(0.5); q != -1 {
+		t.Errorf("empty: got %v", q)
+	}
+	for i := 0; i < 98; i++ {
+		h.observe(50 * time.Microsecond)
+	}
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Minute)
+
+	snap := h.snapshot()
+	if q := snap.Quantile(0.5); q != 100*time.Microsecond {
+		t.Errorf("p50 is %v", q)
+	}
+	if q := snap.Quantile(0.99); q != 10*time.Millisecond {
+		t.Errorf("p99 is %v", q)
+	}
+	if q := snap.Quantile(1); q != -1 {
+		t.Errorf("p100 is %v, want over the last bound", q)
+	}
+}
@@ -0,0 +1,128 @@
+package mqtt
+
+import (
+	"bytes"
+	"log"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A PayloadLimit sets the largest payload, in bytes, that may be
+// published to topics matching Filter, and what to do with the
+// messages that are larger.
+type PayloadLimit struct {
+	Filter string
+	Max    int
+	Action PayloadAction
+
+	// RerouteTo is the topic that messages over the limit are
+	// published to instead, when Action is PayloadReroute.
+	RerouteTo string
+}
+
+// A PayloadAction says what happens to a message with a payload over
+// its PayloadLimit.
+type PayloadAction int
+
+const (
+	// PayloadDrop drops the message.
+	PayloadDrop PayloadAction = iota
+	// PayloadTruncate delivers the first Max bytes of the payload.
+	PayloadTruncate
+	// PayloadReroute publishes the message to RerouteTo, for instance
+	// for something else to store it, rather than to its topic.
+	PayloadReroute
+)
+
+func (a PayloadAction) String() string {
+	switch a {
+	case PayloadDrop:
+		return "drop"
+	case PayloadTruncate:
+		return "truncate"
+	case PayloadReroute:
+		return "reroute"
+	}
+	return "unknown"
+}
+
+type payloadLimit struct {
+	w wild
+	PayloadLimit
+}
+
+// compilePayloadLimits turns the filters of the limits into wilds
+// once, rather than for every message. Invalid filters are skipped.
+func compilePayloadLimits(limits []PayloadLimit) []payloadLimit {
+	var res []payloadLimit
+	for _, l := range limits {
+		w := newWild(l.Filter, nil)
+		if !w.valid() {
+			log.Print("ignoring payload limit with invalid filter ", l.Filter)
+			continue
+		}
+		if l.Action == PayloadReroute && (l.RerouteTo == "" || isWildcard(l.RerouteTo)) {
+			log.Print("ignoring payload limit with invalid reroute topic ", l.RerouteTo)
+			continue
+		}
+		res = append(res, payloadLimit{w: w, PayloadLimit: l})
+	}
+	return res
+}
+
+// oversize returns the first payload limit that the topic of m
+// matches, if m is over it.
+func (s *Server) oversize(m *proto.Publish) *PayloadLimit {
+	if len(s.payloadLimits) == 0 {
+		return nil
+	}
+	var levels [16]string
+	parts := splitTopic(levels[:0], m.TopicName)
+	for i := range s.payloadLimits {
+		l := &s.payloadLimits[i]
+		if l.w.matches(parts) {
+			if m.Payload.Size() > l.Max {
+				return &l.PayloadLimit
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// tooBig applies the payload limits to m, a message just read from c,
+// and reports whether it must be dropped. Truncating or rerouting
+// changes m in place, which is fine as it is not shared yet. The
+// reason is what to tell an MQTT 5 publisher: Quota Exceeded when
+// the message is dropped or truncated.
+func (s *Server) tooBig(c *incomingConn, m *proto.Publish) (drop bool, reason byte) {
+	l := s.oversize(m)
+	if l == nil {
+		return false, reasonSuccess
+	}
+	s.stats.messageTooBig()
+
+	action := l.Action
+	if s.OnOversize != nil {
+		action = s.OnOversize(c.clientid, m, *l)
+	}
+	switch action {
+	case PayloadTruncate:
+		var buf bytes.Buffer
+		if err := m.Payload.WritePayload(&buf); err != nil {
+			log.Print("truncate: ", err)
+			return true, reasonQuotaExceeded
+		}
+		m.Payload = proto.BytesPayload(buf.Bytes()[:l.Max])
+		return false, reasonQuotaExceeded
+	case PayloadReroute:
+		if l.RerouteTo == "" {
+			break
+		}
+		log.Printf("rerouting %v byte PUBLISH to %v from %v to %v", m.Payload.Size(), m.TopicName, c, l.RerouteTo)
+		m.TopicName = l.RerouteTo
+		return false, reasonSuccess
+	}
+	log.Printf("dropping %v byte PUBLISH to %v from %v", m.Payload.Size(), m.TopicName, c)
+	return true, reasonQuotaExceeded
+}
@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestPayloadLimits(t *testing.T) {
+	s := &Server{stats: &stats{}}
+	s.payloadLimits = compilePayloadLimits([]PayloadLimit{
+		{Filter: "firmware/#", Max: 8},
+		{Filter: "telemetry/+", Max: 4, Action: PayloadTruncate},
+		{Filter: "logs/#", Max: 4, Action: PayloadReroute, RerouteTo: "logs/oversize"},
+	})
+	c := newTestConn(s, "c")
+
+	pub := func(topic, payload string) *proto.Publish {
+		return &proto.Publish{TopicName: topic, Payload: proto.BytesPayload(payload)}
+	}
+	drop := func(m *proto.Publish) bool {
+		drop, _ := s.tooBig(c, m)
+		return drop
+	}
+	if m := pub("firmware/v2", "12345678"); drop(m) {
+		t.Error("dropped a payload at the limit")
+	}
+	if m := pub("firmware/v2", "123456789"); !drop(m) {
+		t.Error("did not drop a payload over the limit")
+	}
+	if m := pub("telemetry/t", "123456"); drop(m) || string(m.Payload.(proto.BytesPayload)) != "1234" {
+		t.Errorf("truncate: got %q", m.Payload)
+	}
+	if m := pub("logs/app", "123456"); drop(m) || m.TopicName != "logs/oversize" {
+		t.Errorf("reroute: got topic %v", m.TopicName)
+	}
+
+	s.OnOversize = func(clientid string, m *proto.Publish, l PayloadLimit) PayloadAction {
+		return PayloadDrop
+	}
+	if m := pub("logs/app", "123456"); !drop(m) {
+		t.Error("OnOversize was not obeyed")
+	}
+	if n := s.stats.tooBig; n != 4 {
+		t.Errorf("counted %v messages too big", n)
+	}
+}
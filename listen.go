@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"context"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// Listen subscribes to filter at qos, and calls fn with each message
+// that matches it, until ctx is done. Then it unsubscribes, and returns
+// ctx.Err(). If the connection closes first, it returns Err().
+//
+// Messages on Incoming that do not match filter, because of other
+// subscriptions, are dropped, so Listen is for a ClientConn that does
+// nothing else while it runs.
+func (c *ClientConn) Listen(ctx context.Context, filter string, qos proto.QosLevel, fn func(*Message)) error {
+	w := newWild(filter, nil)
+	if !w.valid() {
+		return ErrBadFilter
+	}
+	c.Subscribe([]proto.TopicQos{{Topic: filter, Qos: qos}})
+
+	var levels [16]string
+	for {
+		select {
+		case m, ok := <-c.Incoming:
+			if !ok {
+				return c.Err()
+			}
+			if w.matches(splitTopic(levels[:0], m.TopicName)) {
+				msg := NewMessage(m)
+				fn(&msg)
+			}
+		case <-ctx.Done():
+			c.stopListening(filter)
+			return ctx.Err()
+		}
+	}
+}
+
+// How long SyncRetained waits for another retained message before it
+// decides that it has them all.
+const syncQuiet = 200 * time.Millisecond
+
+// SyncRetained returns the retained messages on the topics matching
+// filter, by topic, to get the current state of things before
+// listening for changes. It subscribes, collects the retained messages
+// the server sends, and unsubscribes once none has come for a little
+// while. MQTT 3.1 has no way for the server to say it is done, so
+// that is the best it can do. As with Listen, the other messages on
+// Incoming are dropped while it runs.
+func (c *ClientConn) SyncRetained(ctx context.Context, filter string) (map[string][]byte, error) {
+	w := newWild(filter, nil)
+	if !w.valid() {
+		return nil, ErrBadFilter
+	}
+	c.Subscribe([]proto.TopicQos{{Topic: filter, Qos: proto.QosAtMostOnce}})
+
+	res := make(map[string][]byte)
+	quiet := time.NewTimer(syncQuiet)
+	defer quiet.Stop()
+	var levels [16]string
+	for {
+		select {
+		case m, ok := <-c.Incoming:
+			if !ok {
+				return nil, c.Err()
+			}
+			if !m.Header.Retain || !w.matches(splitTopic(levels[:0], m.TopicName)) {
+				continue
+			}
+			msg := NewMessage(m)
+			if len(msg.Payload) == 0 {
+				delete(res, msg.Topic)
+			} else {
+				res[msg.Topic] = append([]byte(nil), msg.Payload...)
+			}
+			msg.Release()
+
+			if !quiet.Stop() {
+				select {
+				case <-quiet.C:
+				default:
+				}
+			}
+			quiet.Reset(syncQuiet)
+		case <-quiet.C:
+			c.stopListening(filter)
+			return res, nil
+		case <-ctx.Done():
+			c.stopListening(filter)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// stopListening unsubscribes from filter. Until the server says it is
+// done, messages may still arrive, and they are dropped, so that the
+// reader is not stuck behind a full Incoming.
+func (c *ClientConn) stopListening(filter string) {
+	done := make(chan struct{})
+	go func() {
+		c.Unsubscribe([]string{filter})
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case _, ok := <-c.Incoming:
+			if !ok {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+// fakeServer answers the SUBSCRIBE and UNSUBSCRIBE of c, and sends msgs
+// after the SUBACK.
+func fakeServer(c *ClientConn, msgs ...*proto.Publish) {
+	for j := range c.out {
+		close(j.r)
+		switch m := j.m.(type) {
+		case *proto.Subscribe:
+			c.suback <- &proto.SubAck{MessageId: m.MessageId}
+			for _, p := range msgs {
+				c.Incoming <- p
+			}
+		case *proto.Unsubscribe:
+			c.unsuback <- &proto.UnsubAck{MessageId: m.MessageId}
+		}
+	}
+}
+
+func TestSyncRetained(t *testing.T) {
+	c := &ClientConn{
+		out:      make(chan job, 1),
+		Incoming: make(chan *proto.Publish),
+		done:     make(chan struct{}),
+		suback:   make(chan *proto.SubAck),
+		unsuback: make(chan *proto.UnsubAck),
+	}
+	defer close(c.out)
+	retained := func(topic, payload string) *proto.Publish {
+		return &proto.Publish{
+			Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+			TopicName: topic,
+			Payload:   proto.BytesPayload(payload),
+		}
+	}
+	go fakeServer(c,
+		retained("dev/1/state", "on"),
+		&proto.Publish{TopicName: "dev/2/state", Payload: proto.BytesPayload("live")},
+		retained("dev/2/state", "off"),
+		retained("dev/3/state", "gone"),
+		retained("dev/3/state", ""),
+	)
+
+	got, err := c.SyncRetained(context.Background(), "dev/+/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprintf("%s", got); s != "map[dev/1/state:on dev/2/state:off]" {
+		t.Errorf("got %v", s)
+	}
+	if len(c.subs) != 0 {
+		t.Errorf("still subscribed to %v", c.subs)
+	}
+}
@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrNoListener is returned by RemoveListener for an id it does not
+// know.
+var ErrNoListener = errors.New("no such listener")
+
+// listeners are the listeners added with AddListener.
+type listeners struct {
+	mu      sync.Mutex // guards access to fields below
+	m       map[int]net.Listener
+	last    int
+	started bool
+}
+
+// AddListener makes the server accept connections on l too, in
+// addition to the listener given to NewServer, which has id 0. It
+// returns the id of l, for RemoveListener. Listeners added before
+// Start begin accepting when it is called.
+func (s *Server) AddListener(l net.Listener) (id int) {
+	ls := &s.listeners
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.m == nil {
+		ls.m = make(map[int]net.Listener)
+	}
+	ls.last++
+	ls.m[ls.last] = l
+	if ls.started {
+		go s.accept(ls.last, l)
+	}
+	return ls.last
+}
+
+// RemoveListener closes the listener with the given id, closes the
+// connections on it that have not finished CONNECT, and disconnects
+// the clients that came in through it, letting them flush
+// their queues within DrainTimeout. The clients of the other listeners
+// are not affected. Removing listener 0, the one given to NewServer,
+// stops the server, and closes Done.
+func (s *Server) RemoveListener(id int) error {
+	var l net.Listener
+	if id == 0 {
+		l = s.l
+	} else {
+		ls := &s.listeners
+		ls.mu.Lock()
+		l = ls.m[id]
+		delete(ls.m, id)
+		ls.mu.Unlock()
+	}
+	if l == nil {
+		return ErrNoListener
+	}
+	s.record(EventAdmin, nil, fmt.Sprint("RemoveListener ", id))
+	l.Close()
+
+	// The connections that have not finished their CONNECT are closed,
+	// and the others are disconnected, even if not registered yet.
+	admitted := s.accepted.shut(id, false)
+	var wg sync.WaitGroup
+	for _, c := range s.union(admitted, func(c *incomingConn) bool { return c.listener == id }) {
+		wg.Add(1)
+		go func(c *incomingConn) {
+			defer wg.Done()
+			c.disconnect(nil)
+		}(c)
+	}
+	wg.Wait()
+	return nil
+}
+
+// closeListeners closes all the listeners added with AddListener.
+func (s *Server) closeListeners() {
+	ls := &s.listeners
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for id, l := range ls.m {
+		l.Close()
+		delete(ls.m, id)
+	}
+}
+
+// conns returns the connections of the server.
+func (s *Server) conns() []*incomingConn {
+	return s.clients.all()
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRemoveListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{l: l, Done: make(chan struct{}), stats: &stats{}, subs: newSubscriptions(0)}
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.AddListener(plain)
+	s.Start()
+	defer l.Close()
+
+	// A client of the listener that has not sent CONNECT yet.
+	early, err := net.Dial("tcp", plain.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer early.Close()
+	waitAccepted(t, s, 1)
+
+	stay, leave := newTestConn(s, "stay"), newTestConn(s, "leave")
+	leave.listener = id
+	stay.add()
+	leave.add()
+
+	if err := s.RemoveListener(id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-leave.Done:
+	case <-time.After(time.Second):
+		t.Fatal("client of the removed listener still connected")
+	}
+	select {
+	case <-stay.Done:
+		t.Fatal("client of the other listener disconnected")
+	default:
+	}
+	early.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := early.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("connection without CONNECT not closed: %v", err)
+	}
+	if c, err := net.Dial("tcp", plain.Addr().String()); err == nil {
+		c.Close()
+		t.Error("removed listener still accepting")
+	}
+	if c, err := net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Error("main listener: ", err)
+	} else {
+		c.Close()
+	}
+	if err := s.RemoveListener(id); err != ErrNoListener {
+		t.Errorf("removed twice: %v", err)
+	}
+}
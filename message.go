@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"bytes"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Message is a PUBLISH received on ClientConn.Incoming or from a
+// Server.Tap, with the parts of its header that applications care about
+// spelled out. The Payload of messages from a tap is shared with the
+// subscribers, so it must not be changed.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Qos     proto.QosLevel // the QoS it was delivered with, at most the one subscribed with
+
+	// Retained is true when the message is the retained state of
+	// Topic, sent because of a new subscription, rather than something
+	// that was just published.
+	Retained bool
+
+	// Duplicate is true when the server might have sent the message
+	// before, and not heard that it arrived. QoS 1 messages can arrive
+	// twice; ClientConn already drops the repeats of QoS 2 ones.
+	Duplicate bool
+
+	// ContentType is the MQTT 5 Content Type of the message, if the
+	// publisher gave one. See ClientConn.DecodeMessage.
+	ContentType string
+
+	buf *[]byte     // where Payload is, when it comes from the pool
+	ack *ackPayload // what Ack acknowledges, with ClientConn.ManualAck
+}
+
+// NewMessage returns the Message for a PUBLISH from Incoming.
+func NewMessage(m *proto.Publish) Message {
+	msg := Message{
+		Topic:     m.TopicName,
+		Qos:       m.Header.QosLevel,
+		Retained:  m.Header.Retain,
+		Duplicate: m.Header.DupFlag,
+	}
+	p := m.Payload
+	if a, ok := p.(*ackPayload); ok {
+		msg.ack, p = a, a.Payload
+	}
+	if t, ok := p.(*typedPayload); ok {
+		msg.ContentType, p = t.contentType, t.Payload
+	}
+	switch p := p.(type) {
+	case proto.BytesPayload:
+		msg.Payload = []byte(p)
+	case *pooledPayload:
+		msg.Payload, msg.buf = p.b, p.buf
+	case nil:
+	default:
+		var buf bytes.Buffer
+		p.WritePayload(&buf)
+		msg.Payload = buf.Bytes()
+	}
+	return msg
+}
+
+// Release gives the payload of a message received with
+// ClientConn.PooledPayloads back to the pool, to be used for another
+// message. After that, neither m.Payload nor the PUBLISH m was made
+// from may be used, and Release must not be called on a copy of m. For
+// other messages, it only sets m.Payload to nil.
+func (m *Message) Release() {
+	if m.buf != nil {
+		payloadPool.Put(m.buf)
+		m.buf = nil
+	}
+	m.Payload = nil
+}
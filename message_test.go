@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestNewMessage(t *testing.T) {
+	got := NewMessage(&proto.Publish{
+		Header:    header(dupTrue, proto.QosAtLeastOnce, retainTrue),
+		TopicName: "a/b",
+		MessageId: 3,
+		Payload:   proto.BytesPayload("on"),
+	})
+	want := Message{
+		Topic:     "a/b",
+		Payload:   []byte("on"),
+		Qos:       proto.QosAtLeastOnce,
+		Retained:  true,
+		Duplicate: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadPooled(t *testing.T) {
+	var b v5writer
+	b.string("a/b")
+	b.uint16(9)
+	b.WriteString("payload")
+	frame := frame5(0x3b, &b) // DUP, QoS 1, retain
+
+	m, err := readPooled(bufio.NewReader(bytes.NewReader(frame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := NewMessage(m.(*proto.Publish))
+	want := Message{
+		Topic:     "a/b",
+		Payload:   []byte("payload"),
+		Qos:       proto.QosAtLeastOnce,
+		Retained:  true,
+		Duplicate: true,
+	}
+	if msg.buf == nil || m.(*proto.Publish).MessageId != 9 {
+		t.Errorf("got %+v", m)
+	}
+	msg.buf, want.buf = nil, nil
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("got %+v, want %+v", msg, want)
+	}
+
+	if _, err := readPooled(bufio.NewReader(bytes.NewReader(frame[:len(frame)-1]))); err == nil {
+		t.Error("no error reading a short frame")
+	}
+}
+
+func TestServerPooledPayloads(t *testing.T) {
+	var b v5writer
+	b.string("a")
+	b.uint16(1)
+	b.WriteString("payload")
+	frame := frame5(0x33, &b) // QoS 1, retain
+	buf := getBuf(len(frame))
+	copy(*buf, frame)
+	m, err := pooledPublish(*buf, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := m.Payload.(*pooledPayload)
+
+	subs := newSubscriptions(1)
+	s := &Server{}
+	q0, q1 := newTestConn(s, "q0"), newTestConn(s, "q1")
+	subs.add("a", q0, proto.QosAtMostOnce)
+	subs.add("a", q1, proto.QosAtLeastOnce)
+	subs.submit(newTestConn(s, "pub"), m)
+	releasePayload(m) // as the reader does
+	subs.flush()
+
+	// Only the QoS 0 copy shares the buffer; the QoS 1 one and the
+	// retained one were copied.
+	j0, j1 := <-q0.jobs, <-q1.jobs
+	if j0.m.(*proto.Publish).Payload != p || j1.m.(*proto.Publish).Header.QosLevel != proto.QosAtLeastOnce {
+		t.Error("QoS 0 subscriber did not get the pooled payload")
+	}
+	if _, ok := j1.m.(*proto.Publish).Payload.(*pooledPayload); ok {
+		t.Error("QoS 1 subscriber got the pooled payload")
+	}
+	if r := subs.retained(""); len(r) != 1 || string(r[0].Payload.(proto.BytesPayload)) != "payload" {
+		t.Errorf("retained %v", r)
+	}
+	if n := atomic.LoadInt32(&p.refs); n != 1 {
+		t.Errorf("%v holders, want 1", n)
+	}
+	releasePayload(j0.m.(*proto.Publish)) // as the writer does
+	if n := atomic.LoadInt32(&p.refs); n != 0 {
+		t.Errorf("%v holders after the write, want 0", n)
+	}
+}
@@ -2,6 +2,8 @@
 package mqtt
 
 import (
+	"bufio"
+	"bytes"
 	crand "crypto/rand"
 	"errors"
 	"fmt"
@@ -9,7 +11,7 @@ import (
 	"log"
 	"math/rand"
 	"net"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,6 +23,7 @@ import (
 // A random number generator ready to make client-id's, if
 // they do not provide them to us.
 var cliRand *rand.Rand
+var cliRandMu sync.Mutex
 
 func init() {
 	var seed int64
@@ -38,10 +41,14 @@ type stats struct {
 	clients    int64
 	clientsMax int64
 	lastmsgs   int64
+	duplicates int64
+	tooBig     int64
 }
 
 func (s *stats) messageRecv()      { atomic.AddInt64(&s.recv, 1) }
 func (s *stats) messageSend()      { atomic.AddInt64(&s.sent, 1) }
+func (s *stats) messageDuplicate() { atomic.AddInt64(&s.duplicates, 1) }
+func (s *stats) messageTooBig()    { atomic.AddInt64(&s.tooBig, 1) }
 func (s *stats) clientConnect()    { atomic.AddInt64(&s.clients, 1) }
 func (s *stats) clientDisconnect() { atomic.AddInt64(&s.clients, -1) }
 
@@ -66,6 +73,10 @@ func (s *stats) publish(sub *subscriptions, interval time.Duration) {
 		atomic.LoadInt64(&s.recv)))
 	sub.submit(nil, statsMessage("$SYS/broker/messages/sent",
 		atomic.LoadInt64(&s.sent)))
+	sub.submit(nil, statsMessage("$SYS/broker/messages/duplicates",
+		atomic.LoadInt64(&s.duplicates)))
+	sub.submit(nil, statsMessage("$SYS/broker/messages/too-big",
+		atomic.LoadInt64(&s.tooBig)))
 
 	msgs := atomic.LoadInt64(&s.recv) + atomic.LoadInt64(&s.sent)
 	msgpersec := (msgs - s.lastmsgs) / int64(interval/time.Second)
@@ -75,6 +86,44 @@ func (s *stats) publish(sub *subscriptions, interval time.Duration) {
 	sub.submit(nil, statsMessage("$SYS/broker/messages/per-sec", msgpersec))
 }
 
+// publishClientStats sends the statistics for each connected client
+// under $SYS/broker/clients/<clientid>/, with the client id escaped by
+// escapeTopicLevel. They are only delivered to subscribers that
+// ClientStatsACL allows to see them, and they are not retained, so that
+// sendRetain cannot leak them.
+func (s *Server) publishClientStats() {
+	for _, c := range s.clients.all() {
+		id := c.clientid
+		allow := func(sub *incomingConn) bool {
+			return s.ClientStatsACL(sub.clientid, id)
+		}
+		prefix := "$SYS/broker/clients/" + escapeTopicLevel(id) + "/"
+		for _, st := range []struct {
+			name string
+			val  int64
+		}{
+			{"queue", int64(len(c.jobs))},
+			{"inflight", int64(c.inflight.len())},
+			{"dropped", atomic.LoadInt64(&c.dropped)},
+			{"subscriptions", int64(s.subs.count(c))},
+		} {
+			m := statsMessage(prefix+st.name, st.val)
+			m.Header.Retain = false
+			s.subs.submitFiltered(c.tenant, m, allow)
+		}
+	}
+}
+
+// topicLevelEscaper percent-encodes what cannot be in one level of a
+// topic name, and the % sign, so that the encoding can be undone.
+var topicLevelEscaper = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23", "\x00", "%00")
+
+// escapeTopicLevel makes s, a client id for instance, fit in one level
+// of a topic name: a/b+ becomes a%2Fb%2B.
+func escapeTopicLevel(s string) string {
+	return topicLevelEscaper.Replace(s)
+}
+
 // An intPayload implements proto.Payload, and is an int64 that
 // formats itself and then prints itself into the payload.
 type intPayload string
@@ -100,75 +149,195 @@ func (ip intPayload) Size() int {
 // This needs to hold copies of the proto.Publish, not pointers to
 // it, or else we can send out one with the wrong retain flag.
 type retain struct {
-	m    proto.Publish
-	wild wild
+	m       proto.Publish
+	x       *v5extra  // the MQTT 5 properties of m, if any
+	expires time.Time // when to forget m, if not zero
+	seq     uint64    // changes whenever m does; see partition.seq
+	from    string    // the client id of the publisher of m, if a client
+	at      time.Time // when m arrived, if from a client; see Server.Annotate
+	wild    wild
 }
 
 type subscriptions struct {
 	workers int
-	posts   chan post
+	posts   chan post   // taken by any worker
+	shards  []chan post // taken by one worker each, for DeliveryOrder
+	order   int32       // a DeliveryOrder; accessed with sync/atomic
+
+	stopping chan struct{}  // closed to make the workers exit
+	running  sync.WaitGroup // the workers that have not exited yet
+
+	mu          sync.Mutex // guards access to fields below
+	parts       map[string]*partition
+	maxRetained int
+	transform   func(clientid, filter string, m *proto.Publish) *proto.Publish
+	retentions  []retentionPolicy
+	upgrade     bool // see QosPolicy.Upgrade
+	overlaps    bool // see Server.OverlapCopies
+	annotate    bool // see Server.Annotate
+
+	postWait histogram // how long posts wait for a worker
+	stats    *stats
+}
 
-	mu        sync.Mutex // guards access to fields below
-	subs      map[string][]*incomingConn
-	wildcards []wild
-	retain    map[string]retain
-	stats     *stats
+// A partition holds the subscriptions and retained messages of one
+// tenant. Tenants cannot see each other's topics, and everything that
+// needs to be done to one tenant only has to look at its partition.
+// When multi-tenancy is not in use, everything is in the partition
+// for tenant "".
+type partition struct {
+	subs       map[string]map[*incomingConn]proto.QosLevel // the QoS granted to each subscriber
+	wildcards  []wild
+	wildCache  map[string][]wild // see matchingWilds
+	retain     map[string]retain
+	durables   []*durable
+	aggregates []*aggregator
+	sinks      []*sink
+	taps       []*tap
+	watchers   []chan RetainEvent
+	seq        uint64 // counts the retained messages set, to tell them apart
 }
 
-// The length of the queue that subscription processing
-// workers are taking from.
+// The default length of the queue that subscription processing
+// workers are taking from. See WithPostQueue.
 const postQueue = 100
 
 func newSubscriptions(workers int) *subscriptions {
+	return newSubscriptionsQueue(workers, postQueue)
+}
+
+func newSubscriptionsQueue(workers, queue int) *subscriptions {
 	s := &subscriptions{
-		subs:    make(map[string][]*incomingConn),
-		retain:  make(map[string]retain),
-		posts:   make(chan post, postQueue),
+		parts:   make(map[string]*partition),
+		posts:   make(chan post, queue),
+		shards:  make([]chan post, workers),
 		workers: workers,
 	}
+	for i := range s.shards {
+		s.shards[i] = make(chan post, queue)
+	}
+	s.stopping = make(chan struct{})
+	s.running.Add(s.workers)
 	for i := 0; i < s.workers; i++ {
 		go s.run(i)
 	}
 	return s
 }
 
-func (s *subscriptions) sendRetain(topic string, c *incomingConn) {
+// part returns the partition for a tenant, creating it if needed.
+// s.mu must be held.
+func (s *subscriptions) part(tenant string) *partition {
+	p, ok := s.parts[tenant]
+	if !ok {
+		p = &partition{
+			subs:   make(map[string]map[*incomingConn]proto.QosLevel),
+			retain: make(map[string]retain),
+		}
+		s.parts[tenant] = p
+	}
+	return p
+}
+
+// sendRetain sends the retained messages for a new subscription to
+// topic, at no more than the QoS granted for it.
+func (s *subscriptions) sendRetain(topic string, c *incomingConn, qos proto.QosLevel) {
 	s.mu.Lock()
+	p := s.part(c.tenant)
 	var tlist []string
 	if isWildcard(topic) {
-
-		// TODO: select matching topics from the retain map
+		w := newWild(topic, c)
+		var levels [16]string
+		for t := range p.retain {
+			if w.matches(splitTopic(levels[:0], t)) {
+				tlist = append(tlist, t)
+			}
+		}
+		sort.Strings(tlist)
 	} else {
 		tlist = []string{topic}
 	}
+	now := time.Now()
 	for _, t := range tlist {
-		if r, ok := s.retain[t]; ok {
-			c.submit(&r.m)
+		r, ok := p.retain[t]
+		if !ok {
+			continue
+		}
+		if r.expired(now) {
+			p.deleteRetain(t)
+			continue
+		}
+		m, x := &r.m, r.x.withSubId(c.subIds[topic])
+		if s.annotate && !r.at.IsZero() {
+			var err error
+			if m, x, err = annotateFor(c, m, x, r.from, r.at); err != nil {
+				log.Print("sendRetain: annotate: ", err)
+				continue
+			}
 		}
+		c.submitWith(deliverAt(m, qos, s.upgrade), x)
 	}
 	s.mu.Unlock()
 }
 
-func (s *subscriptions) add(topic string, c *incomingConn) {
+// setSubId sets the MQTT 5 subscription identifier of the subscription
+// of c to topic, or removes it if id is 0.
+func (s *subscriptions) setSubId(c *incomingConn, topic string, id uint32) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if id == 0 {
+		delete(c.subIds, topic)
+		return
+	}
+	if c.subIds == nil {
+		c.subIds = make(map[string]uint32)
+	}
+	c.subIds[topic] = id
+}
+
+// Subscribe a connection to topic, with the maximum QoS that
+// messages are sent to it at. Subscribing again to the same topic
+// replaces the QoS. It returns false if topic is not a valid filter.
+func (s *subscriptions) add(topic string, c *incomingConn, qos proto.QosLevel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.part(c.tenant).add(topic, c, qos)
+}
+
+// add is subscriptions.add within a partition. s.mu must be held.
+func (p *partition) add(topic string, c *incomingConn, qos proto.QosLevel) bool {
 	if isWildcard(topic) {
 		w := newWild(topic, c)
-		if w.valid() {
-			s.wildcards = append(s.wildcards, w)
+		if !w.valid() {
+			return false
 		}
+		w.qos = qos
+		p.forgetWilds()
+		for i := range p.wildcards {
+			if p.wildcards[i].c == c && p.wildcards[i].filter == topic {
+				p.wildcards[i].qos = qos
+				return true
+			}
+		}
+		p.wildcards = append(p.wildcards, w)
 	} else {
-		s.subs[topic] = append(s.subs[topic], c)
+		if p.subs[topic] == nil {
+			p.subs[topic] = make(map[*incomingConn]proto.QosLevel)
+		}
+		p.subs[topic][c] = qos
 	}
+	c.subStat(topic)
+	return true
 }
 
 type wild struct {
-	wild []string
-	c    *incomingConn
+	filter string
+	wild   []string
+	c      *incomingConn
+	qos    proto.QosLevel
 }
 
 func newWild(topic string, c *incomingConn) wild {
-	return wild{wild: strings.Split(topic, "/"), c: c}
+	return wild{filter: topic, wild: strings.Split(topic, "/"), c: c}
 }
 
 func (w wild) matches(parts []string) bool {
@@ -200,160 +369,714 @@ func (w wild) matches(parts []string) bool {
 	return false
 }
 
-// Find all connections that are subscribed to this topic.
-func (s *subscriptions) subscribers(topic string) []*incomingConn {
+// splitTopic appends the levels of topic to dst, like
+// strings.Split(topic, "/"). Called with a slice of an array on the
+// stack, it splits topics without allocating.
+func splitTopic(dst []string, topic string) []string {
+	for {
+		j := strings.IndexByte(topic, '/')
+		if j < 0 {
+			return append(dst, topic)
+		}
+		dst = append(dst, topic[:j])
+		topic = topic[j+1:]
+	}
+}
+
+// atMost returns m if its QoS is no more than qos, and otherwise a
+// copy of it with the QoS lowered to qos. Messages are sent at the QoS
+// they were published with, but no more than the subscriber asked for.
+func atMost(m *proto.Publish, qos proto.QosLevel) *proto.Publish {
+	if m.Header.QosLevel <= qos {
+		return m
+	}
+	cp := *m
+	cp.Header.QosLevel = qos
+	return &cp
+}
+
+// A match is a connection subscribed to a topic, and the filter
+// through which it is subscribed, and the QoS granted for it.
+type match struct {
+	c      *incomingConn
+	filter string
+	qos    proto.QosLevel
+	st     *subStats
+	id     uint32 // the MQTT 5 subscription identifier, if any
+}
+
+// Find all connections of a tenant that are subscribed to this topic.
+func (s *subscriptions) subscribers(tenant, topic string) []match {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	p := s.part(tenant)
 
 	// non-wildcard subscribers
-	res := s.subs[topic]
+	var res []match
+	for c, qos := range p.subs[topic] {
+		res = append(res, match{c, topic, qos, c.subStat(topic), c.subIds[topic]})
+	}
 
 	// process wildcards
-	parts := strings.Split(topic, "/")
-	for _, w := range s.wildcards {
-		if w.matches(parts) {
-			res = append(res, w.c)
-		}
+	for _, w := range p.matchingWilds(topic) {
+		res = append(res, match{w.c, w.filter, w.qos, w.c.subStat(w.filter), w.c.subIds[w.filter]})
 	}
 
 	return res
 }
 
-// Remove all subscriptions that refer to a connection.
-func (s *subscriptions) unsubAll(c *incomingConn) {
+// onePerClient removes the matches of clients that match more than once,
+// leaving the one with the highest QoS, so that each client gets one
+// copy of the message.
+func onePerClient(matches []match) []match {
+	if len(matches) < 2 {
+		return matches
+	}
+	best := make(map[*incomingConn]int, len(matches))
+	res := matches[:0:0]
+	for _, mt := range matches {
+		i, seen := best[mt.c]
+		if !seen {
+			best[mt.c] = len(res)
+			res = append(res, mt)
+		} else if mt.qos > res[i].qos {
+			res[i] = mt
+		}
+	}
+	return res
+}
+
+// Count the subscriptions that refer to a connection.
+func (s *subscriptions) count(c *incomingConn) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.part(c.tenant)
+
+	n := 0
+	for _, v := range p.subs {
+		if _, ok := v[c]; ok {
+			n++
+		}
+	}
+	for _, w := range p.wildcards {
+		if w.c == c {
+			n++
+		}
+	}
+	return n
+}
+
+// Remove all subscriptions that refer to a connection, and return
+// the filters they were for.
+func (s *subscriptions) unsubAll(c *incomingConn) []string {
+	var filters []string
 	s.mu.Lock()
-	for _, v := range s.subs {
-		for i := range v {
-			if v[i] == c {
-				v[i] = nil
+	p := s.part(c.tenant)
+	for topic, v := range p.subs {
+		if _, ok := v[c]; ok {
+			delete(v, c)
+			if len(v) == 0 {
+				delete(p.subs, topic)
 			}
+			filters = append(filters, topic)
 		}
 	}
 
 	// remove any associated entries in the wildcard list
 	var wildNew []wild
-	for i := 0; i < len(s.wildcards); i++ {
-		if s.wildcards[i].c != c {
-			wildNew = append(wildNew, s.wildcards[i])
+	for i := 0; i < len(p.wildcards); i++ {
+		if p.wildcards[i].c != c {
+			wildNew = append(wildNew, p.wildcards[i])
+		} else {
+			filters = append(filters, p.wildcards[i].filter)
 		}
 	}
-	s.wildcards = wildNew
+	if len(wildNew) != len(p.wildcards) {
+		p.forgetWilds()
+	}
+	p.wildcards = wildNew
+	c.subStats = nil
+	c.subIds = nil
 
 	s.mu.Unlock()
+	return filters
 }
 
-// Remove the subscription to topic for a given connection.
-func (s *subscriptions) unsub(topic string, c *incomingConn) {
+// Remove the subscription to topic for a given connection. It returns
+// true if there was one.
+func (s *subscriptions) unsub(topic string, c *incomingConn) bool {
+	found := false
 	s.mu.Lock()
-	if subs, ok := s.subs[topic]; ok {
-		nils := 0
-
-		// Search the list, removing references to our connection.
-		// At the same time, count the nils to see if this list is now empty.
-		for i := 0; i < len(subs); i++ {
-			if subs[i] == c {
-				subs[i] = nil
-			}
-			if subs[i] == nil {
-				nils++
+	p := s.part(c.tenant)
+	if isWildcard(topic) {
+		for i, w := range p.wildcards {
+			if w.c == c && w.filter == topic {
+				p.wildcards = append(p.wildcards[:i], p.wildcards[i+1:]...)
+				p.forgetWilds()
+				found = true
+				break
 			}
 		}
-
-		if nils == len(subs) {
-			delete(s.subs, topic)
+	} else if subs, ok := p.subs[topic]; ok {
+		_, found = subs[c]
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(p.subs, topic)
 		}
 	}
+	delete(c.subStats, topic)
+	delete(c.subIds, topic)
+	s.mu.Unlock()
+	return found
+}
+
+// wipe forgets all the retained messages of a tenant.
+func (s *subscriptions) wipe(tenant string) {
+	s.mu.Lock()
+	p := s.part(tenant)
+	for topic := range p.retain {
+		p.deleteRetain(topic)
+	}
 	s.mu.Unlock()
 }
 
+// retained returns copies of all the retained messages of a tenant.
+func (s *subscriptions) retained(tenant string) []proto.Publish {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.part(tenant)
+	res := make([]proto.Publish, 0, len(p.retain))
+	now := time.Now()
+	for _, r := range p.retain {
+		if r.expired(now) {
+			continue
+		}
+		res = append(res, r.m)
+	}
+	return res
+}
+
 // The subscription processing worker.
 func (s *subscriptions) run(id int) {
+	defer s.running.Done()
 	tag := fmt.Sprintf("worker %d ", id)
 	log.Print(tag, "started")
-	for post := range s.posts {
-		// Remember the original retain setting, but send out immediate
-		// copies without retain: "When a server sends a PUBLISH to a client
-		// as a result of a subscription that already existed when the
-		// original PUBLISH arrived, the Retain flag should not be set,
-		// regardless of the Retain flag of the original PUBLISH.
-		isRetain := post.m.Header.Retain
-		post.m.Header.Retain = false
-
-		// Handle "retain with payload size zero = delete retain".
-		// Once the delete is done, return instead of continuing.
-		if isRetain && post.m.Payload.Size() == 0 {
-			s.mu.Lock()
-			delete(s.retain, post.m.TopicName)
-			s.mu.Unlock()
+	for {
+		var post post
+		select {
+		case post = <-s.posts:
+		case post = <-s.shards[id]:
+		case <-s.stopping:
+			log.Print(tag, "stopped")
 			return
 		}
+		if post.barrier != nil {
+			post.barrier.reach()
+			continue
+		}
+		s.postWait.observe(time.Since(post.queued))
+		if post.batch != nil {
+			s.handleBatch(tag, post)
+			continue
+		}
+		s.handle(tag, post, (*incomingConn).submitWith)
+	}
+}
 
-		// Find all the connections that should be notified of this message.
-		conns := s.subscribers(post.m.TopicName)
+// handle does the work for one post: it hands the message to deliver
+// for each subscriber, and retains it if need be.
+func (s *subscriptions) handle(tag string, post post, deliver func(c *incomingConn, m proto.Message, x *v5extra) bool) {
+	// Remember the original retain setting, but send out immediate
+	// copies without retain: "When a server sends a PUBLISH to a client
+	// as a result of a subscription that already existed when the
+	// original PUBLISH arrived, the Retain flag should not be set,
+	// regardless of the Retain flag of the original PUBLISH.
+	isRetain := post.m.Header.Retain
+	post.m.Header.Retain = false
+	defer releasePayload(post.m)
+
+	// The retention policy of the topic has the last word.
+	s.mu.Lock()
+	policy := s.retention(post.m.TopicName)
+	s.mu.Unlock()
+	switch policy.retain {
+	case RetainNever:
+		isRetain = false
+	case RetainLast:
+		isRetain = isRetain || post.m.Payload.Size() != 0
+	}
+
+	// Handle "retain with payload size zero = delete retain".
+	// Once the delete is done, go on to the next post.
+	if isRetain && post.m.Payload.Size() == 0 {
+		s.mu.Lock()
+		s.part(post.tenant).deleteRetain(post.m.TopicName)
+		s.mu.Unlock()
+		return
+	}
 
-		// Queue the outgoing messages
-		for _, c := range conns {
-			// Do not echo messages back to where they came from.
-			if c == post.c {
+	// Find all the connections that should be notified of this message.
+	matches := s.subscribers(post.tenant, post.m.TopicName)
+	s.mu.Lock()
+	transform, upgrade, overlaps, annotate := s.transform, s.upgrade, s.overlaps, s.annotate
+	s.mu.Unlock()
+	annotate = annotate && post.c != nil && post.m.Payload.Size() != 0
+	if !overlaps {
+		matches = onePerClient(matches)
+	}
+
+	// Queue the outgoing messages
+	for _, mt := range matches {
+		c := mt.c
+		atomic.AddInt64(&mt.st.matched, 1)
+		// Do not echo messages back to where they came from.
+		if c == post.c {
+			continue
+		}
+		if post.allow != nil && !post.allow(c) {
+			continue
+		}
+
+		m := post.m
+		if transform != nil {
+			if m = transform(c.clientid, mt.filter, m); m == nil {
 				continue
 			}
-
-			if c != nil {
-				c.submit(post.m)
+		}
+		x := post.x.withSubId(mt.id)
+		if annotate {
+			var err error
+			if m, x, err = annotateFor(c, m, x, post.c.clientid, post.queued); err != nil {
+				log.Printf("%vannotate: %v", tag, err)
+				continue
 			}
 		}
+		m = deliverAt(m, mt.qos, upgrade)
+		if m.Header.QosLevel != proto.QosAtMostOnce {
+			// It stays in flight until it is acked, after the
+			// other subscribers are done with a pooled payload.
+			m = unpooled(m)
+		}
+		holdPayload(m)
+		if deliver(c, m, x) {
+			atomic.AddInt64(&mt.st.delivered, 1)
+		} else {
+			releasePayload(m)
+			atomic.AddInt64(&mt.st.dropped, 1)
+		}
+	}
 
-		if isRetain {
-			s.mu.Lock()
+	var late []match
+	var lateMsg *proto.Publish
+	s.mu.Lock()
+	if p := s.part(post.tenant); len(p.durables) != 0 || len(p.aggregates) != 0 || len(p.sinks) != 0 || len(p.taps) != 0 {
+		var levels [16]string
+		parts := splitTopic(levels[:0], post.m.TopicName)
+		m := unpooled(post.m)
+		late, lateMsg = p.queueDurable(parts, m, matches), m
+		p.aggregate(parts, m)
+		p.feedSinks(parts, m)
+		p.feedTaps(parts, m)
+	}
+	s.mu.Unlock()
+	for _, mt := range late {
+		if mt.c != post.c {
+			deliver(mt.c, deliverAt(lateMsg, mt.qos, upgrade), post.x)
+		}
+	}
+
+	if isRetain {
+		s.mu.Lock()
+		p := s.part(post.tenant)
+		_, exists := p.retain[post.m.TopicName]
+		if !exists && s.maxRetained > 0 && len(p.retain) >= s.maxRetained {
+			log.Printf("%vtenant %q is over its quota of %v retained messages, not retaining %v",
+				tag, post.tenant, s.maxRetained, post.m.TopicName)
+		} else {
 			// Save a copy of it, and set that copy's Retain to true, so that
 			// when we send it out later we notify new subscribers that this
 			// is an old message.
-			msg := *post.m
+			msg := *unpooled(post.m)
 			msg.Header.Retain = true
-			s.retain[post.m.TopicName] = retain{m: msg}
-			s.mu.Unlock()
+			p.setRetain(msg, post.x)
+			r := p.retain[msg.TopicName]
+			if post.c != nil {
+				r.from, r.at = post.c.clientid, post.queued
+			}
+			if policy.maxAge > 0 {
+				r.expires = time.Now().Add(policy.maxAge)
+			}
+			if x := post.x; x != nil && !x.expires.IsZero() && (r.expires.IsZero() || x.expires.Before(r.expires)) {
+				r.expires = x.expires
+			}
+			p.retain[msg.TopicName] = r
 		}
+		s.mu.Unlock()
 	}
 }
 
 func (s *subscriptions) submit(c *incomingConn, m *proto.Publish) {
-	s.posts <- post{c: c, m: m}
+	s.submitWith(c, m, nil)
+}
+
+// submitWith is like submit, with the MQTT 5 properties of m, which
+// are passed on to the subscribers that speak MQTT 5.
+func (s *subscriptions) submitWith(c *incomingConn, m *proto.Publish, x *v5extra) {
+	s.queue(post{c: c, tenant: tenantOf(c), m: m, x: x})
+}
+
+// submitFiltered is like submit, but only delivers the message to
+// subscribers for which allow returns true.
+func (s *subscriptions) submitFiltered(tenant string, m *proto.Publish, allow func(*incomingConn) bool) {
+	s.queue(post{tenant: tenant, m: m, allow: allow})
+}
+
+func tenantOf(c *incomingConn) string {
+	if c == nil {
+		return ""
+	}
+	return c.tenant
 }
 
 // A post is a unit of work for the subscription processing workers.
 type post struct {
-	c *incomingConn
-	m *proto.Publish
+	c      *incomingConn
+	tenant string
+	m      *proto.Publish
+	x      *v5extra                 // the MQTT 5 properties of m, if any
+	allow  func(*incomingConn) bool // if non-nil, which subscribers may see m
+
+	queued  time.Time        // when it was queued for the workers
+	barrier *barrier         // if non-nil, the post is only a barrier; see flush
+	batch   []*proto.Publish // if non-nil, m is batch[0], and they all go together; see PublishBatch
 }
 
 // A Server holds all the state associated with an MQTT server.
 type Server struct {
-	l             net.Listener
-	subs          *subscriptions
-	stats         *stats
-	Done          chan struct{}
-	StatsInterval time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
-	Dump          bool          // When true, dump the messages in and out.
+	l              net.Listener
+	subs           *subscriptions
+	stats          *stats
+	Done           chan struct{}
+	StatsInterval  time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
+	DrainTimeout   time.Duration // How long to try to flush a closing connection. Defaults to 1 second; 0 means do not flush.
+	ConnectTimeout time.Duration // How long a new connection has to send its CONNECT. Defaults to 5 seconds; 0 means forever.
+	FlushDelay     time.Duration // How long to wait for more messages to send in the same write. Defaults to 0.
+	Dump           bool          // When true, dump the messages in and out.
+	Capture        *Capture      // When non-nil, record the raw frames in and out.
+	Wrapper        ConnWrapper   // When non-nil, wraps each accepted connection.
+
+	// ClientStatsACL decides if the client subscriber may see the
+	// statistics of client id, published under $SYS/broker/clients/<id>/.
+	// In the topic, the characters of id that cannot be in a topic
+	// level, and %, are percent-encoded: a/b+ is under a%2Fb%2B/.
+	// When it is nil, per-client statistics are not published.
+	ClientStatsACL func(subscriber, id string) bool
+
+	// Tenant, when non-nil, turns on multi-tenancy. It is called with
+	// the CONNECT message of each client and returns the name of the
+	// tenant it belongs to. Clients only see the topics, subscriptions
+	// and retained messages of their own tenant. The broker-wide $SYS
+	// topics are published to tenant "", and the per-client ones to
+	// the tenant of the client.
+	Tenant func(connect *proto.Connect) string
+
+	// MaxRetained, if non-zero, is the number of retained messages
+	// each tenant may keep. Retained messages on new topics beyond that
+	// are delivered, but not retained.
+	MaxRetained int
+
+	// RejectEmptyClientId, when true, refuses clients that leave their
+	// client id empty, instead of making one up for them. By default,
+	// MQTT 3.1.1 clients with a clean session and MQTT 5 clients get a
+	// unique id starting with "auto-", and MQTT 5 clients are told what
+	// it is in the CONNACK.
+	RejectEmptyClientId bool
+
+	// ClientIds, when non-nil, makes the ids of the clients that leave
+	// theirs empty, instead of "auto-" ones. Ids longer than 23 bytes
+	// are only accepted by some clients.
+	ClientIds IdGenerator
+
+	// Will, when non-nil, decides on the will message of each client
+	// when it connects. It is given the CONNECT, and the will message
+	// the client asked for, or nil if none. It returns the will message
+	// to use instead, or nil for none. This can be used to enforce a
+	// standard presence message for a whole fleet, for instance.
+	Will func(connect *proto.Connect, will *proto.Publish) *proto.Publish
+
+	// Authenticate, when non-nil, is asked whether each client
+	// may connect. Clients it says no to are refused with "bad user
+	// name or password".
+	Authenticate func(conn net.Conn, connect *proto.Connect) bool
+
+	// AuthCacheTTL, when non-zero, is how long to remember that
+	// Authenticate said yes for a set of credentials. See InvalidateAuth.
+	AuthCacheTTL time.Duration
+
+	// Authorize, when non-nil, is asked whether the client may publish
+	// to topic, or, when subscribe is true, subscribe to the filter
+	// topic. It is given the tenant of the client, see Tenant, and the
+	// user name it connected with, as Authenticate left it. Messages
+	// it says no to are dropped, and subscriptions refused.
+	Authorize func(tenant, username, clientid, topic string, subscribe bool) bool
+
+	// AuthorizeCacheTTL, when non-zero, is how long to remember what
+	// Authorize said, by client and topic. See InvalidateAuthorization.
+	AuthorizeCacheTTL time.Duration
+
+	// SubscriptionChanged, when non-nil, is called each time a client
+	// subscribes or unsubscribes, including when its subscriptions are
+	// dropped because it went away. It is called from the goroutines
+	// handling the connection, so it should not block.
+	SubscriptionChanged func(SubscriptionEvent)
+
+	// ConnectLimits are the maximum lengths of the fields of a CONNECT.
+	// The default limits the client id to 23 bytes, as the spec says,
+	// and leaves the rest unlimited.
+	ConnectLimits ConnectLimits
+
+	// MaxPacketSize, if non-zero, is the largest packet a client may
+	// send, in bytes, fixed header included. Larger packets are
+	// refused before they are read, and the client is disconnected.
+	// MQTT 5 clients are told the limit in the CONNACK.
+	MaxPacketSize int
+
+	// QosPolicy caps the QoS levels that are granted and delivered.
+	QosPolicy QosPolicy
+
+	// NoRetain turns retained messages off: the retain flag of the
+	// messages and wills that clients publish is cleared. MQTT 5
+	// clients are told in the CONNACK, and those that set the flag
+	// anyway are disconnected.
+	NoRetain bool
+
+	// NoWildcards refuses the subscriptions to filters with wildcards.
+	// MQTT 5 clients are told in the CONNACK.
+	NoWildcards bool
+
+	// JournalSize, when non-zero, is how many of the latest events,
+	// like clients connecting and messages being dropped, are kept in
+	// memory, for Events. It helps to find out what happened during
+	// an incident.
+	JournalSize int
+
+	// Journal, when non-nil, gets every event as a line of JSON, to
+	// keep more history than JournalSize. Writes to it are not
+	// buffered, and made with the journal locked, so it should be
+	// quick, like a bufio.Writer flushed now and then.
+	Journal io.Writer
+
+	// OverlapCopies, when true, makes a client with several
+	// subscriptions matching a topic, like a/# and a/b, get a copy of
+	// each message for each of them. By default, it gets one copy, at
+	// the highest QoS granted, as MQTT 3.1.1 recommends.
+	OverlapCopies bool
+
+	// Batches, when true, makes messages that clients publish to
+	// BatchTopic be taken apart and published with PublishBatch.
+	Batches bool
+
+	// ClientIdValidator, when non-nil, is asked whether each client id
+	// that a client gives is acceptable, instead of checking its
+	// length against ConnectLimits.ClientId. It can allow ids longer
+	// than 23 bytes, restrict the characters or enforce a naming
+	// convention. Ids that the server makes up are not checked.
+	ClientIdValidator func(clientid string) bool
+
+	// Annotate, when true, makes the server record when each message
+	// from a client arrived and which client sent it, so that
+	// subscribers can measure latency and know where messages come
+	// from. MQTT 5 subscribers get this in the user properties named
+	// by AnnotateTime and AnnotateFrom. For MQTT 3.1 and 3.1.1
+	// subscribers, which have no properties, the payload is wrapped in
+	// an Envelope instead, so they must all expect this format. It is
+	// done as each copy is sent: retained messages, rules and sinks
+	// see the payload as it was published. Empty payloads, which
+	// delete retained messages, are left alone.
+	Annotate bool
+
+	// Transform, when non-nil, is called for each client that a
+	// message is about to be sent to, with the filter of the matching
+	// subscription. It returns the message to send instead, or nil to
+	// send nothing. It can be used to send smaller payloads to clients
+	// on slow links, for instance. It must not change m, which is shared
+	// by all the subscribers, but make a new message instead. With
+	// PooledPayloads, it must not keep m or its payload after it
+	// returns.
+	Transform func(clientid, filter string, m *proto.Publish) *proto.Publish
+
+	// PooledPayloads, when true, makes the server read the messages
+	// from clients into buffers from a pool, rather than allocating
+	// a payload for each one. The payload of a PUBLISH is shared by
+	// the subscribers it is sent to at QoS 0, and its buffer goes back
+	// to the pool once the last of them has written it. Whatever is
+	// kept for longer gets a copy: retained messages, messages sent at
+	// QoS 1 and 2, which stay in flight until they are acked, and those
+	// given to rules, sinks, taps and durable subscriptions.
+	PooledPayloads bool
+
+	// BanThreshold, if non-zero, is the number of protocol errors
+	// after which connections from the same address are refused for
+	// BanDuration. The errors are counted until the address has made
+	// none for an hour. See ProtocolErrors.
+	BanThreshold int
+	BanDuration  time.Duration
+
+	// PayloadLimits limits the size of the payloads that may be
+	// published to some topics. The first limit with a filter that
+	// matches the topic applies. Messages over the limit are counted in
+	// $SYS/broker/messages/too-big, and dropped, truncated or rerouted
+	// according to the Action of the limit. An MQTT 5 publisher is told
+	// Quota Exceeded in its PUBACK or PUBREC when its message is dropped
+	// or truncated.
+	PayloadLimits []PayloadLimit
+
+	// OnOversize, when non-nil, decides what to do with a message over
+	// its payload limit l, instead of l.Action. It must not change m.
+	OnOversize func(clientid string, m *proto.Publish, l PayloadLimit) PayloadAction
+
+	// Rules are applied, in order, to the messages published by the
+	// clients. See Rule.
+	Rules []Rule
+
+	// Retention decides what is retained on some topics, whatever the
+	// publishers ask for. The first policy with a filter that matches
+	// the topic applies; other topics are retained as published.
+	Retention []RetentionPolicy
+
+	// DedupeWindow, if non-zero, makes the server drop a message when
+	// the same client published the same payload to the same topic less
+	// than DedupeWindow before. The number dropped is published in
+	// $SYS/broker/messages/duplicates.
+	DedupeWindow time.Duration
+
+	// SendQueueBytes, if non-zero, limits the bytes of messages
+	// waiting to be sent to each client, in addition to the limit
+	// on their number. Messages over the limit are dropped. The
+	// messages held back while delivery is paused, or by the Receive
+	// Maximum of the client, count until they are sent.
+	SendQueueBytes int64
+
+	// SlowConsumer says what to do when the send queue of a client is
+	// full. By default, the message that does not fit is dropped.
+	SlowConsumer SlowConsumerPolicy
+
+	// RetryInterval is how long to wait for a client to acknowledge
+	// a QoS 1 or 2 message before sending it again. Defaults to 20
+	// seconds.
+	RetryInterval time.Duration
+
+	// MaxRetries, if non-zero, is how many times a QoS 1 or 2 message
+	// is sent again before giving up on it. Messages given up on are
+	// counted as dropped. By default, they are sent again until the
+	// client acknowledges them or goes away.
+	MaxRetries int
+
+	// SessionOwner, when non-nil, is asked at each accepted CONNECT
+	// whether the session of the client lives on another node. If so,
+	// it returns the server reference of that node, and the client is
+	// refused with "server unavailable", and told to use the other
+	// server if it speaks MQTT 5. It returns "" to keep the client.
+	SessionOwner func(connect *proto.Connect) (ref string)
+
+	// ReceiveMaximum, if non-zero, is the number of QoS 2 messages
+	// each MQTT 5 client may have in flight to the server at once. It is
+	// sent to the clients in the CONNACK. Whatever it is, the server
+	// sends each MQTT 5 client no more QoS 1 and 2 messages at once
+	// than the Receive Maximum of the client.
+	ReceiveMaximum uint16
+
+	// TopicAliasMaximum is the number of topic aliases MQTT 5 clients
+	// may use on each connection, and the most the server uses on its
+	// side, if the client accepts that many. Defaults to 0, for none.
+	TopicAliasMaximum uint16
+
+	// FlapWindow, if non-zero, makes the server count how many times
+	// each client id connects within that long, in order to spot clients
+	// that keep reconnecting. See Flaps. The number of clients over
+	// FlapThreshold is published in $SYS/broker/clients/flapping.
+	// When FlapPenalty is non-zero too, the CONNACK of such clients is
+	// delayed by FlapPenalty, doubling with each further connection, up
+	// to FlapWindow.
+	FlapWindow    time.Duration
+	FlapThreshold int
+	FlapPenalty   time.Duration
+
+	// DeliveryOrder says which messages must reach subscribers in the
+	// order they were published. The stricter orders leave some workers
+	// idle when the traffic is on few topics, or from few clients.
+	// Defaults to DeliveryPerTopic, which keeps the order the spec
+	// asks for, while the messages on different topics are still
+	// handled in parallel.
+	DeliveryOrder DeliveryOrder
+
+	// DrainRate is how many clients per second Drain disconnects, so
+	// that a load balancer can move them to other nodes a few at a
+	// time. 0 leaves them connected until they go by themselves.
+	DrainRate float64
+
+	// DrainNotice, if not empty, is the topic on which Drain publishes
+	// a retained message with the server reference, for instance
+	// "$SYS/broker/migration", for the clients that cannot be told in
+	// a CONNACK or DISCONNECT.
+	DrainNotice string
+
 	rand          *rand.Rand
+	lastConnId    uint64 // accessed with sync/atomic
+	auth          authCache
+	authz         authzCache
+	protoErrors   protoErrors
+	flaps         flaps
+	drain         drain
+	journal       journal
+	wills         delayedWills
+	shutdown      shutdown
+	jobWait       histogram // how long jobs wait for the writer
+	listeners     listeners
+	accepted      acceptedConns // all the connections, from the accept on
+	clients       registry      // the connections, by client id
+	payloadLimits []payloadLimit
+	rules         []rule
+	sendQueue     int // the length of the send queue of each client; see WithSendQueue
 }
 
 // NewServer creates a new MQTT server, which accepts connections from
 // the given listener. When the server is stopped (for instance by
 // another goroutine closing the net.Listener), channel Done will become
-// readable.
-func NewServer(l net.Listener) *Server {
+// readable. The options, if any, set the sizes of its queues and the
+// number of its workers.
+func NewServer(l net.Listener, opts ...ServerOption) *Server {
+	o := newServerOptions(opts)
 	svr := &Server{
-		l:             l,
-		stats:         &stats{},
-		Done:          make(chan struct{}),
-		StatsInterval: time.Second * 10,
-		subs:          newSubscriptions(runtime.GOMAXPROCS(0)),
+		l:              l,
+		stats:          &stats{},
+		Done:           make(chan struct{}),
+		StatsInterval:  time.Second * 10,
+		DrainTimeout:   time.Second,
+		ConnectTimeout: 5 * time.Second,
+		RetryInterval:  defaultRetryInterval,
+		ConnectLimits:  ConnectLimits{ClientId: 23},
+		DeliveryOrder:  DeliveryPerTopic,
+		sendQueue:      o.sendQueue,
+		subs:           newSubscriptionsQueue(o.workers, o.postQueue),
+	}
+
+	svr.subs.submit(nil, versionMessage())
+	if liteProfile {
+		return svr
 	}
 
 	// start the stats reporting goroutine
 	go func() {
 		for {
 			svr.stats.publish(svr.subs, svr.StatsInterval)
+			svr.publishLatency()
+			if svr.FlapWindow > 0 {
+				svr.subs.submit(nil, statsMessage("$SYS/broker/clients/flapping", svr.flapping()))
+			}
+			if svr.ClientStatsACL != nil {
+				svr.publishClientStats()
+			}
 			select {
 			case <-svr.Done:
 				return
@@ -369,34 +1092,305 @@ func NewServer(l net.Listener) *Server {
 
 // Start makes the Server start accepting and handling connections.
 func (s *Server) Start() {
+	s.subs.mu.Lock()
+	s.subs.maxRetained = s.MaxRetained
+	s.subs.transform = s.Transform
+	s.subs.retentions = compileRetention(s.Retention)
+	s.subs.upgrade = s.QosPolicy.Upgrade
+	s.subs.overlaps = s.OverlapCopies
+	s.subs.annotate = s.Annotate
+	s.subs.mu.Unlock()
+	s.subs.setOrder(s.DeliveryOrder)
+	s.payloadLimits = compilePayloadLimits(s.PayloadLimits)
+	s.rules = compileRules(s.Rules, s.Done)
+
+	if s.Capture != nil {
+		go s.flushCapture()
+	}
+
+	s.listeners.mu.Lock()
+	s.listeners.started = true
+	for id, l := range s.listeners.m {
+		go s.accept(id, l)
+	}
+	s.listeners.mu.Unlock()
+
 	go func() {
-		for {
-			conn, err := s.l.Accept()
-			if err != nil {
-				log.Print("Accept: ", err)
-				break
-			}
+		s.accept(0, s.l)
+		close(s.Done)
+	}()
+}
 
-			cli := s.newIncomingConn(conn)
-			s.stats.clientConnect()
-			cli.start()
+// accept accepts and handles the connections coming in on l, which
+// has the given id, until it fails.
+func (s *Server) accept(id int, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Print("Accept: ", err)
+			return
 		}
-		close(s.Done)
+
+		s.serve(id, conn)
+	}
+}
+
+// serve handles a new connection that came in on the listener with the
+// given id.
+func (s *Server) serve(id int, conn net.Conn) {
+	if s.banned(conn.RemoteAddr()) || !s.accepted.track(conn, id) {
+		conn.Close()
+		return
+	}
+
+	if s.Wrapper == nil {
+		cli := s.newIncomingConn(conn)
+		cli.listener = id
+		cli.accepted = conn
+		s.accepted.attach(conn, cli)
+		s.stats.clientConnect()
+		cli.start()
+		return
+	}
+
+	// The wrapper might do a handshake, so do not make the
+	// next client wait for it.
+	go func() {
+		wc, err := s.Wrapper.WrapConn(conn)
+		if err != nil {
+			log.Print("WrapConn: ", err)
+			conn.Close()
+			s.accepted.untrack(conn)
+			return
+		}
+		cli := s.newIncomingConn(wc)
+		cli.listener = id
+		cli.accepted = conn
+		s.accepted.attach(conn, cli)
+		s.stats.clientConnect()
+		cli.start()
 	}()
 }
 
+// A SubscriptionEvent describes a subscription being added or removed.
+type SubscriptionEvent struct {
+	Added    bool           // true for a new subscription, false for one removed
+	ClientId string         // the client the subscription belongs to
+	Tenant   string         // the tenant of the client
+	Filter   string         // the topic filter
+	Qos      proto.QosLevel // the QoS granted, when Added
+}
+
+func (c *incomingConn) subscriptionChanged(added bool, filter string, qos proto.QosLevel) {
+	if added {
+		c.svr.record(EventSubscribe, c, filter)
+	} else {
+		c.svr.record(EventUnsubscribe, c, filter)
+	}
+	if c.svr.SubscriptionChanged == nil {
+		return
+	}
+	c.svr.SubscriptionChanged(SubscriptionEvent{
+		Added:    added,
+		ClientId: c.clientid,
+		Tenant:   c.tenant,
+		Filter:   filter,
+		Qos:      qos,
+	})
+}
+
+// ConnectLimits holds the maximum length in bytes of each variable
+// length field of a CONNECT message. Zero means no limit.
+type ConnectLimits struct {
+	ClientId    int
+	Username    int
+	Password    int
+	WillTopic   int
+	WillMessage int
+}
+
+// connectLimits returns the ConnectLimits to check a CONNECT against.
+// The length of the client id is left to ClientIdValidator, if set.
+func (s *Server) connectLimits() ConnectLimits {
+	l := s.ConnectLimits
+	if s.ClientIdValidator != nil {
+		l.ClientId = 0
+	}
+	return l
+}
+
+// check returns the return code to refuse m with, if it breaks a limit.
+// There is no return code for an oversized will, so that is refused
+// as not authorized.
+func (l ConnectLimits) check(m *proto.Connect) proto.ReturnCode {
+	over := func(s string, max int) bool { return max > 0 && len(s) > max }
+	switch {
+	case over(m.ClientId, l.ClientId):
+		return proto.RetCodeIdentifierRejected
+	case over(m.Username, l.Username), over(m.Password, l.Password):
+		return proto.RetCodeBadUsernameOrPassword
+	case over(m.WillTopic, l.WillTopic), over(m.WillMessage, l.WillMessage):
+		return proto.RetCodeNotAuthorized
+	}
+	return proto.RetCodeAccepted
+}
+
+// size returns the largest remaining length of a CONNECT that fits in
+// the limits, or 0 if some field is unlimited.
+func (l ConnectLimits) size() int {
+	if l.ClientId == 0 || l.Username == 0 || l.Password == 0 ||
+		l.WillTopic == 0 || l.WillMessage == 0 {
+		return 0
+	}
+	// "MQIsdp", version, flags and keep alive, then each field
+	// with its two byte length.
+	return 8 + 1 + 1 + 2 +
+		2 + l.ClientId + 2 + l.Username + 2 + l.Password +
+		2 + l.WillTopic + 2 + l.WillMessage
+}
+
+// peekLength returns the remaining length from the fixed header of
+// the next message, without consuming it.
+func peekLength(br *bufio.Reader) (int, error) {
+	n, _, err := peekHeader(br)
+	return n, err
+}
+
+// peekHeader returns the remaining length and the length of the
+// fixed header of the next message, without consuming it.
+func peekHeader(br *bufio.Reader) (n, hlen int, err error) {
+	// One byte of message type and flags, then up to four bytes
+	// of length, 7 bits at a time.
+	mul := 1
+	for i := 1; i < 5; i++ {
+		b, err := br.Peek(i + 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		n += int(b[i]&0x7f) * mul
+		if b[i]&0x80 == 0 {
+			return n, i + 1, nil
+		}
+		mul *= 128
+	}
+	return 0, 0, errors.New("malformed remaining length")
+}
+
+// readFrame reads the next message, from the start of its fixed
+// header to the end, without decoding it.
+func readFrame(br *bufio.Reader) ([]byte, error) {
+	n, hlen, err := peekHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, hlen+n)
+	_, err = io.ReadFull(br, frame)
+	return frame, err
+}
+
+// WipeTenant forgets all the retained messages of a tenant. It only
+// touches the state of that tenant.
+func (s *Server) WipeTenant(tenant string) {
+	s.subs.wipe(tenant)
+}
+
+// SetRetained stores m as the retained message for its topic in a
+// tenant, as if a client had published it with the retain flag, but
+// without sending it to anyone. An empty payload removes the retained
+// message. It is meant for seeding a fresh server.
+func (s *Server) SetRetained(tenant string, m *proto.Publish) {
+	s.subs.mu.Lock()
+	defer s.subs.mu.Unlock()
+	p := s.subs.part(tenant)
+	if m.Payload.Size() == 0 {
+		p.deleteRetain(m.TopicName)
+		return
+	}
+	msg := *m
+	msg.Header.Retain = true
+	p.setRetain(msg, nil)
+}
+
+// RetainedMessages returns copies of the retained messages of a tenant,
+// for instance in order to export them.
+func (s *Server) RetainedMessages(tenant string) []proto.Publish {
+	return s.subs.retained(tenant)
+}
+
 // An IncomingConn represents a connection into a Server.
 type incomingConn struct {
-	svr      *Server
-	conn     net.Conn
-	jobs     chan job
-	clientid string
-	Done     chan struct{}
+	svr        *Server
+	id         uint64
+	conn       net.Conn
+	listener   int      // the id of the listener it came in on; see AddListener
+	accepted   net.Conn // the connection as accepted, before any Wrapper; the key in Server.accepted
+	jobs       chan job
+	clientid   string
+	username   string // from the CONNECT, for ACLFile
+	tenant     string
+	version    uint8                // the protocol level from the CONNECT
+	props      properties           // the properties of the CONNECT, from MQTT 5 clients
+	maxPacket  int                  // the Maximum Packet Size of an MQTT 5 client, or 0
+	will       *proto.Publish       // sent if the connection closes without a DISCONNECT
+	willX      *v5extra             // the MQTT 5 parts of will
+	willDelay  time.Duration        // how long to wait before sending will, from MQTT 5 clients
+	subStats   map[string]*subStats // by filter; guarded by subscriptions.mu
+	subIds     map[string]uint32    // MQTT 5 subscription identifiers by filter; guarded by subscriptions.mu
+	aliasesIn  map[uint16]string    // the topic aliases of the client; used by the reader
+	aliasesOut map[string]uint16    // our topic aliases for the client; used by the writer
+	held       []job                // QoS 1 and 2 messages over the Receive Maximum of the client; used by the writer, then takeover
+	acked      chan struct{}        // wakes the writer when messages in flight are acknowledged
+	dedupe     dedupe
+	inflight   inflight            // QoS 1 and 2 messages sent, waiting for acknowledgement
+	received   map[uint16]struct{} // QoS 2 messages received, waiting for PUBREL; used by the reader
+	dropped    int64               // messages that did not fit in jobs; accessed with sync/atomic
+	slow       int32               // set to 1 when disconnected by SlowConsumer; accessed with sync/atomic
+	paused     int32               // set to 1 by PauseDelivery; accessed with sync/atomic
+	queued     int64               // bytes of messages in jobs; accessed with sync/atomic
+	quit       chan struct{}       // closed by the reader when it exits
+	taken      chan struct{}       // closed by takeover, to make the writer send a DISCONNECT and exit
+	takenOver  int32               // set to 1 by the first takeover; accessed with sync/atomic
+	Done       chan struct{}       // closed by the writer when the connection is closed
 }
 
-var clients = make(map[string]*incomingConn)
-var clientsMu sync.Mutex
+// The protocol levels the server speaks.
+const (
+	protocol31  = 3 // MQTT 3.1, with protocol name "MQIsdp"
+	protocol311 = 4 // MQTT 3.1.1, with protocol name "MQTT"
+)
+
+// The SUBACK return code for a subscription that failed. It is only
+// sent to 3.1.1 clients; 3.1 has no way to say so.
+const subscribeFailure proto.QosLevel = 0x80
+
+// How many ids newClientId tries before giving up.
+const clientIdAttempts = 10
+
+// newClientId makes up a client id for a client of tenant that did not
+// give one, with ClientIds, or when it is nil, one that is short enough
+// to pass the 23 byte limit of the spec. It reports false if all the
+// ids it tried were in use.
+func (s *Server) newClientId(tenant string) (string, bool) {
+	for i := 0; i < clientIdAttempts; i++ {
+		var id string
+		if s.ClientIds != nil {
+			id = s.ClientIds.NewId()
+		} else {
+			cliRandMu.Lock()
+			id = fmt.Sprintf("auto-%016x", uint64(cliRand.Int63()))
+			cliRandMu.Unlock()
+		}
 
+		if s.clients.get(registryKey(tenant, id)) == nil {
+			return id, true
+		}
+	}
+	log.Printf("no unused client id after %v attempts", clientIdAttempts)
+	return "", false
+}
+
+// The default length of the send queue of each client. See
+// WithSendQueue.
 const sendingQueueLength = 10000
 
 // newIncomingConn creates a new incomingConn associated with this
@@ -405,10 +1399,14 @@ const sendingQueueLength = 10000
 // channel becomes readable.
 func (s *Server) newIncomingConn(conn net.Conn) *incomingConn {
 	return &incomingConn{
-		svr:  s,
-		conn: conn,
-		jobs: make(chan job, sendingQueueLength),
-		Done: make(chan struct{}),
+		svr:   s,
+		id:    atomic.AddUint64(&s.lastConnId, 1),
+		conn:  conn,
+		jobs:  make(chan job, s.sendQueueLength()),
+		acked: make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		taken: make(chan struct{}),
+		Done:  make(chan struct{}),
 	}
 }
 
@@ -421,75 +1419,299 @@ func (r receipt) wait() {
 }
 
 type job struct {
-	m proto.Message
-	r receipt
+	m     proto.Message
+	x     *v5extra // for MQTT 5 clients, what m has no room for; may be nil
+	r     receipt
+	size  int       // the bytes counted against the send queue budget
+	since time.Time // when it was queued for the writer
+	batch []job     // if non-nil, m is nil, and these are sent one after the other
 }
 
-// Start reading and writing on this connection.
+// Start reading and writing on this connection. The reader starts
+// the writer, once it has written the CONNACK.
 func (c *incomingConn) start() {
 	go c.reader()
-	go c.writer()
 }
 
-// Add this connection to the map, or find out that an existing connection
-// already exists for the same client-id.
-func (c *incomingConn) add() *incomingConn {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// The key of this connection in the registry of its server. Client ids only
+// need to be unique within a tenant.
+func (c *incomingConn) key() string {
+	return registryKey(c.tenant, c.clientid)
+}
 
-	existing, ok := clients[c.clientid]
-	if ok {
-		// this client id already exists, return it
-		return existing
+// registryKey is the key of clientid of tenant in the registry.
+func registryKey(tenant, clientid string) string {
+	if tenant == "" {
+		return clientid
 	}
+	return tenant + "\x00" + clientid
+}
 
-	clients[c.clientid] = c
-	return nil
+// Add this connection to the clients of its server, or find out that
+// an existing connection already exists for the same client-id.
+func (c *incomingConn) add() *incomingConn {
+	return c.svr.clients.add(c)
 }
 
 // Delete a connection; the connection must be closed by the caller first.
+// It is only removed if it is still us, and not the connection that
+// took over from us.
 func (c *incomingConn) del() {
-	clientsMu.Lock()
-	delete(clients, c.clientid)
-	clientsMu.Unlock()
-	return
+	c.svr.clients.del(c)
 }
 
-// Queue a message; no notification of sending is done.
+// Queue a message; no notification of sending is done. When the
+// messages in the queue add up to more than Server.SendQueueBytes, the
+// message is dropped. When the queue is full, Server.SlowConsumer
+// applies.
 func (c *incomingConn) submit(m proto.Message) {
-	j := job{m: m}
+	c.submitWith(m, nil)
+}
+
+// submitWith is like submit, with the MQTT 5 parts of the message,
+// which are only used if the client speaks MQTT 5. It reports whether
+// the message was queued.
+func (c *incomingConn) submitWith(m proto.Message, x *v5extra) bool {
+	return c.submitJob(job{m: m, x: x})
+}
+
+// submitBatch queues jobs as one, so that they are either all sent,
+// one after the other, or all dropped. It reports whether they were
+// queued.
+func (c *incomingConn) submitBatch(jobs []job) bool {
+	if len(jobs) == 1 {
+		return c.submitJob(jobs[0])
+	}
+	return c.submitJob(job{batch: jobs})
+}
+
+func (c *incomingConn) submitJob(j job) bool {
+	j.since = time.Now()
+	if max := c.svr.SendQueueBytes; max > 0 {
+		j.size = jobSize(j)
+		if atomic.AddInt64(&c.queued, int64(j.size)) > max && j.size > 0 {
+			atomic.AddInt64(&c.queued, -int64(j.size))
+			c.countDrop(1, "send queue over its byte budget")
+			log.Print(c, ": send queue over its byte budget, dropping message")
+			return false
+		}
+	}
 	select {
 	case c.jobs <- j:
+		return true
 	default:
-		log.Print(c, ": failed to submit message")
+		return c.full(j)
 	}
-	return
+}
+
+// jobSize is messageSize for a job, which may be a batch.
+func jobSize(j job) int {
+	if j.batch == nil {
+		return messageSize(j.m)
+	}
+	n := 0
+	for _, b := range j.batch {
+		n += messageSize(b.m)
+	}
+	return n
+}
+
+// messageSize estimates the memory held by a queued message. Only
+// PUBLISH messages can be big, so the others count as nothing.
+func messageSize(m proto.Message) int {
+	if p, ok := m.(*proto.Publish); ok {
+		return len(p.TopicName) + p.Payload.Size()
+	}
+	return 0
 }
 
 func (c *incomingConn) String() string {
 	return fmt.Sprintf("{IncomingConn: %v}", c.clientid)
 }
 
-// Queue a message, returns a channel that will be readable
-// when the message is sent.
-func (c *incomingConn) submitSync(m proto.Message) receipt {
-	j := job{m: m, r: make(receipt)}
-	c.jobs <- j
-	return j.r
+// takeover closes a connection because another one with the same
+// client id arrived. It returns the messages that were queued for the
+// client but not sent yet, so that the new connection can send them
+// instead. Nothing goes out on the old connection once takeover
+// starts, so nothing is sent twice. QoS 1 and 2 messages that were
+// sent but not acknowledged are handed over too, ahead of the others.
+//
+// When two new connections take over from the same one at once, only
+// one of them gets its messages; the other one gets nil, and finds the
+// winner in its place the next time it tries to add itself.
+func (c *incomingConn) takeover() []job {
+	if !atomic.CompareAndSwapInt32(&c.takenOver, 0, 1) {
+		<-c.Done
+		<-c.quit
+		return nil
+	}
+	// Stop the writer before closing the connection, so that it leaves
+	// what is queued to us rather than flushing it to a closed
+	// connection. It tells MQTT 5 clients why they are going away, as
+	// long as that does not take too long.
+	c.conn.SetWriteDeadline(time.Now().Add(takeoverTimeout))
+	close(c.taken)
+	t := time.NewTimer(takeoverTimeout)
+	select {
+	case <-c.Done:
+	case <-t.C:
+	}
+	t.Stop()
+	c.conn.Close()
+	<-c.Done
+	<-c.quit // the reader has dealt with the will
+
+	var res []job
+	res = append(res, c.inflight.drain()...)
+	res = append(res, c.held...)
+
+	// The writer is gone, so nobody else is reading jobs now.
+	for {
+		select {
+		case j := <-c.jobs:
+			atomic.AddInt64(&c.queued, -int64(j.size))
+			if _, ok := j.m.(*proto.Publish); ok {
+				res = append(res, j)
+			}
+			// Batches do not stay together across a takeover.
+			res = append(res, j.batch...)
+		default:
+			return res
+		}
+	}
+}
+
+// How long the writer of a connection that is being taken over has to
+// flush what it wrote, and the DISCONNECT of MQTT 5 clients.
+const takeoverTimeout = time.Second
+
+// leave is what the writer does when its connection is taken over. It
+// sends what was already written, and a DISCONNECT saying why to MQTT
+// 5 clients, and leaves the queued messages to the new connection.
+func (c *incomingConn) leave(w *connWriter) {
+	if !c.flush(w) || c.version != protocol5 {
+		return
+	}
+	if c.send(disconnectJob(reasonSessionTakenOver), w) {
+		c.flush(w)
+	}
+}
+
+// disconnectJob is a DISCONNECT with a reason, for MQTT 5 clients.
+func disconnectJob(reason byte) job {
+	return job{m: &proto.Disconnect{}, x: &v5extra{reason: reason}}
+}
+
+// disconnect queues a DISCONNECT, with x for MQTT 5 clients, behind
+// the messages already waiting for the client, and gives the writer up
+// to Server.DrainTimeout to flush them. After that, the connection is
+// closed regardless. It returns once the connection is closed.
+func (c *incomingConn) disconnect(x *v5extra) {
+	d := c.svr.DrainTimeout
+	if d <= 0 {
+		c.conn.Close()
+		<-c.Done
+		return
+	}
+
+	deadline := time.Now().Add(d)
+	c.conn.SetWriteDeadline(deadline)
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
+	select {
+	case c.jobs <- job{m: &proto.Disconnect{}, x: x}:
+	case <-c.Done:
+		return
+	case <-timeout.C:
+		c.conn.Close()
+		<-c.Done
+		return
+	}
+
+	select {
+	case <-c.Done:
+	case <-timeout.C:
+		c.conn.Close()
+		<-c.Done
+	}
 }
 
 func (c *incomingConn) reader() {
-	// On exit, close the connection and arrange for the writer to exit
-	// by closing the output channel.
+	// The writer is started once the CONNACK is written, or when the
+	// reader exits without one.
+	var w *connWriter
+	writing := false
+
+	// On exit, arrange for the writer to flush what is queued and then
+	// close the connection. When draining is turned off, close it now
+	// and let whatever is queued be dropped.
 	defer func() {
-		c.conn.Close()
+		if d := c.svr.DrainTimeout; d > 0 {
+			c.conn.SetWriteDeadline(time.Now().Add(d))
+		} else {
+			c.conn.Close()
+		}
 		c.svr.stats.clientDisconnect()
-		close(c.jobs)
+		c.publishWill()
+		if !writing {
+			if w == nil {
+				w = newConnWriter(c.conn)
+			}
+			go c.writer(w)
+		}
+		close(c.quit)
 	}()
 
+	br := bufio.NewReader(c.conn)
+
+	// connected is set once a CONNECT has been accepted and its CONNACK
+	// queued. Before that, the only thing a client may send is CONNECT,
+	// and after that it may not send another one. Either one is a
+	// protocol violation, and the spec says to close the connection.
+	connected := false
+	if d := c.svr.ConnectTimeout; d > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(d))
+	}
+
 	for {
-		// TODO: timeout (first message and/or keepalives)
-		m, err := proto.DecodeOneMessage(c.conn, nil)
+		// TODO: keepalive timeout
+		if !connected {
+			// Refuse to decode (and allocate memory for) a first
+			// message larger than the biggest CONNECT we would accept.
+			if max := c.svr.connectLimits().size(); max > 0 {
+				n, err := peekLength(br)
+				if err == nil && n > max {
+					log.Printf("reader: %v byte message before CONNECT from %v", n, c.conn.RemoteAddr())
+					c.svr.protocolError(c)
+					return
+				}
+			}
+		}
+		if max := c.svr.MaxPacketSize; max > 0 {
+			n, hlen, err := peekHeader(br)
+			if err == nil && hlen+n > max {
+				log.Printf("reader: %v byte message from %v is over MaxPacketSize", hlen+n, c.conn.RemoteAddr())
+				c.svr.protocolErrorReason(c, reasonPacketTooLarge)
+				return
+			}
+		}
+		var frame []byte
+		var buf *[]byte
+		var err error
+		if c.svr.PooledPayloads {
+			frame, buf, err = readPooledFrame(br)
+		} else {
+			frame, err = readFrame(br)
+		}
+		if c.svr.Capture != nil && len(frame) > 0 {
+			c.svr.Capture.record(c.id, CaptureIn, frame)
+		}
+		var m proto.Message
+		var x *v5extra
+		if err == nil {
+			m, x, err = c.decode(frame, buf)
+		}
 		if err != nil {
 			if err == io.EOF {
 				return
@@ -498,6 +1720,10 @@ func (c *incomingConn) reader() {
 				return
 			}
 			log.Print("reader: ", err)
+			// Network trouble is not the client's fault.
+			if _, isNet := err.(net.Error); !isNet && err != io.ErrUnexpectedEOF {
+				c.svr.protocolError(c)
+			}
 			return
 		}
 		c.svr.stats.messageRecv()
@@ -506,42 +1732,152 @@ func (c *incomingConn) reader() {
 			log.Printf("dump  in: %T", m)
 		}
 
+		if _, isConnect := m.(*proto.Connect); isConnect == connected {
+			if connected {
+				log.Print("reader: second CONNECT from ", c)
+			} else {
+				log.Printf("reader: %T before CONNECT from %v", m, c.conn.RemoteAddr())
+			}
+			c.svr.protocolError(c)
+			return
+		}
+
 		switch m := m.(type) {
 		case *proto.Connect:
 			rc := proto.RetCodeAccepted
 
-			if m.ProtocolName != "MQIsdp" ||
-				m.ProtocolVersion != 3 {
+			switch {
+			case m.ProtocolName == "MQIsdp" && m.ProtocolVersion == protocol31:
+			case m.ProtocolName == "MQTT" && m.ProtocolVersion == protocol311:
+			case m.ProtocolName == "MQTT" && m.ProtocolVersion == protocol5:
+			default:
 				log.Print("reader: reject connection from ", m.ProtocolName, " version ", m.ProtocolVersion)
 				rc = proto.RetCodeUnacceptableProtocolVersion
 			}
-
-			// Check client id.
-			if len(m.ClientId) < 1 || len(m.ClientId) > 23 {
+			c.version = m.ProtocolVersion
+
+			// Check client id. From 3.1.1 on, a client with a clean
+			// session may leave it to us to make one up, and from 5 on,
+			// any client may.
+			assigned := false
+			if len(m.ClientId) < 1 {
+				if !c.svr.RejectEmptyClientId && (c.version == protocol5 || c.version == protocol311 && m.CleanSession) {
+					// The id only has to be unique within the tenant,
+					// which is worked out before it is made up.
+					tenant := ""
+					if c.svr.Tenant != nil {
+						tenant = c.svr.Tenant(m)
+					}
+					var ok bool
+					if m.ClientId, ok = c.svr.newClientId(tenant); ok {
+						assigned = true
+					} else {
+						rc = proto.RetCodeIdentifierRejected
+					}
+				} else {
+					rc = proto.RetCodeIdentifierRejected
+				}
+			}
+			if rc == proto.RetCodeAccepted && !assigned && c.svr.ClientIdValidator != nil && !c.svr.ClientIdValidator(m.ClientId) {
+				log.Printf("reader: client id %q from %v is not valid", m.ClientId, c.conn.RemoteAddr())
 				rc = proto.RetCodeIdentifierRejected
 			}
-			c.clientid = m.ClientId
+			if rc == proto.RetCodeAccepted {
+				rc = c.svr.connectLimits().check(m)
+			}
+			draining, ref := c.svr.draining()
+			if rc == proto.RetCodeAccepted && draining {
+				rc = proto.RetCodeServerUnavailable
+			}
+			if rc == proto.RetCodeAccepted && !c.svr.authenticate(c.conn, m) {
+				rc = proto.RetCodeBadUsernameOrPassword
+			}
+			if rc == proto.RetCodeAccepted && c.svr.SessionOwner != nil {
+				if ref = c.svr.SessionOwner(m); ref != "" {
+					log.Printf("client %v belongs on %v", m.ClientId, ref)
+					rc = proto.RetCodeServerUnavailable
+				}
+			}
+			// Sessions are always clean, so the session present flag
+			// of 3.1.1 is always 0, which is what the zero value says.
+			connack := &proto.ConnAck{
+				ReturnCode: rc,
+			}
+			var ackx *v5extra
+			if c.version == protocol5 {
+				c.props = x.props
+				if n, ok := c.props.num(propMaximumPacketSize); ok {
+					c.maxPacket = int(n)
+				}
+				ackx = c.connackExtra(m.ClientId, assigned)
+				if ref != "" {
+					ackx.reason = reasonUseAnotherServer
+					ackx.props.setStr(propServerReference, ref)
+				}
+			}
 
-			// Disconnect existing connections.
-			if existing := c.add(); existing != nil {
-				disconnect := &proto.Disconnect{}
-				r := existing.submitSync(disconnect)
-				r.wait()
-				c.add()
+			// close connection if it was a bad connect, without
+			// disturbing a client that might already have this id
+			if rc != proto.RetCodeAccepted {
+				w = c.writeConnAck(connack, ackx)
+				log.Printf("Connection refused for %v: %v", c.conn.RemoteAddr(), connectError(rc))
+				return
 			}
 
-			// TODO: Last will
+			c.clientid = m.ClientId
+			c.username = m.Username
+			if c.svr.Tenant != nil {
+				c.tenant = c.svr.Tenant(m)
+			}
+			if d := c.svr.flap(c.key()); d > 0 {
+				time.Sleep(d)
+			}
+			if !c.svr.accepted.admit(c) {
+				connack.ReturnCode = proto.RetCodeServerUnavailable
+				w = c.writeConnAck(connack, ackx)
+				log.Printf("Connection refused for %v: the server is shutting down", c.conn.RemoteAddr())
+				return
+			}
+			if !c.setWill(m) {
+				connack.ReturnCode = proto.RetCodeNotAuthorized
+				w = c.writeConnAck(connack, ackx)
+				log.Printf("Connection refused for %v: %v", c.conn.RemoteAddr(), connectError(connack.ReturnCode))
+				return
+			}
+			if c.will != nil && x != nil {
+				if props := x.will.forwarded(); len(props) != 0 {
+					c.willX = &v5extra{props: props}
+				}
+				if n, ok := x.will.num(propWillDelay); ok {
+					c.willDelay = time.Duration(n) * time.Second
+				}
+			}
 
-			connack := &proto.ConnAck{
-				ReturnCode: rc,
+			// Take over from existing connections. Keep trying, in
+			// case another one with the same id comes and goes while
+			// we are at it.
+			var handoff []job
+			for {
+				existing := c.add()
+				if existing == nil {
+					break
+				}
+				handoff = append(handoff, existing.takeover()...)
+			}
+			if c.svr.wills.cancel(c.key()) {
+				log.Printf("client %v is back in time, its will is cancelled", c.clientid)
 			}
-			c.submit(connack)
 
-			// close connection if it was a bad connect
-			if rc != proto.RetCodeAccepted {
-				log.Printf("Connection refused for %v: %v", c.conn.RemoteAddr(), ConnectionErrors[rc])
+			if w = c.writeConnAck(connack, ackx); w == nil {
 				return
 			}
+			for _, j := range handoff {
+				c.submitWith(j.m, j.x)
+			}
+			go c.writer(w)
+			writing = true
+			connected = true
+			c.svr.subs.attachDurables(c)
 
 			// Log in mosquitto format.
 			clean := 0
@@ -549,24 +1885,134 @@ func (c *incomingConn) reader() {
 				clean = 1
 			}
 			log.Printf("New client connected from %v as %v (c%v, k%v).", c.conn.RemoteAddr(), c.clientid, clean, m.KeepAliveTimer)
+			c.svr.record(EventConnect, c, c.conn.RemoteAddr().String())
 
 		case *proto.Publish:
-			// TODO: Proper QoS support
-			if m.Header.QosLevel != proto.QosAtMostOnce {
-				log.Printf("reader: no support for QoS %v yet", m.Header.QosLevel)
-				return
-			}
 			if m.Header.QosLevel != proto.QosAtMostOnce && m.MessageId == 0 {
 				// Invalid message ID. See MQTT-2.3.1-1.
 				log.Printf("reader: invalid MessageId in PUBLISH.")
+				c.svr.protocolError(c)
+				return
+			}
+			if c.version == protocol5 && m.Header.QosLevel > c.svr.QosPolicy.maxQos() {
+				log.Print("reader: QoS 2 PUBLISH from ", c, ", which was told it is not supported")
+				c.svr.protocolErrorReason(c, reasonQosNotSupported)
+				return
+			}
+			if c.svr.NoRetain && m.Header.Retain {
+				if c.version == protocol5 {
+					log.Print("reader: retained PUBLISH from ", c, ", which was told it is not supported")
+					c.svr.protocolErrorReason(c, reasonRetainNotSupported)
+					return
+				}
+				m.Header.Retain = false
+			}
+
+			// A QoS 2 message that we have but is not released yet is
+			// the client sending it again because our PUBREC got lost.
+			// It was already sent on, so this time it is only acked.
+			_, seen := c.received[m.MessageId]
+			seen = seen && m.Header.QosLevel == proto.QosExactlyOnce
+			if max := int(c.svr.ReceiveMaximum); !seen && max > 0 && m.Header.QosLevel == proto.QosExactlyOnce && len(c.received) >= max {
+				log.Printf("reader: %v has more than %v QoS 2 messages in flight", c, max)
+				c.svr.protocolErrorReason(c, reasonReceiveMaxExceeded)
 				return
 			}
-			if isWildcard(m.TopicName) {
+
+			// The DUP flag is about this hop only, and it is not
+			// passed on to subscribers.
+			m.Header.DupFlag = false
+
+			// Of the MQTT 5 properties, only the ones about the message
+			// itself go on to subscribers. Topic aliases are resolved
+			// here, and only servers set subscription identifiers.
+			var fwd *v5extra
+			if x != nil {
+				if !c.resolveAlias(m, x) {
+					log.Print("reader: invalid topic alias from ", c)
+					c.svr.protocolErrorReason(c, reasonTopicAliasInvalid)
+					return
+				}
+				if _, ok := x.props.num(propSubscriptionId); ok {
+					log.Print("reader: subscription identifier in PUBLISH from ", c)
+					c.svr.protocolError(c)
+					return
+				}
+				if props := x.props.forwarded(); len(props) != 0 {
+					fwd = &v5extra{props: props}
+					if n, ok := props.num(propMessageExpiry); ok {
+						fwd.expires = time.Now().Add(time.Duration(n) * time.Second)
+					}
+				}
+			}
+
+			// What to tell an MQTT 5 publisher in the PUBACK or PUBREC.
+			reason := byte(reasonSuccess)
+			var drop bool
+			if seen {
+				// nothing to do
+			} else if isWildcard(m.TopicName) {
 				log.Print("reader: ignoring PUBLISH with wildcard topic ", m.TopicName)
+			} else if !c.svr.authorize(c, m.TopicName, false) {
+				log.Printf("reader: %v may not publish to %v, dropping message", c, m.TopicName)
+				reason = reasonNotAuthorized
+			} else if drop, reason = c.svr.tooBig(c, m); drop {
+				// dropped, and counted
+			} else if w := c.svr.DedupeWindow; w > 0 && c.dedupe.duplicate(m, w) {
+				c.svr.stats.messageDuplicate()
+			} else if c.svr.Batches && m.TopicName == BatchTopic {
+				if err := c.svr.subs.submitBatch(c, m); err != nil {
+					log.Printf("reader: dropping batch from %v: %v", c, err)
+				}
+			} else if c.svr.applyRules(c, m) {
+				// dropped by a rule
 			} else {
-				c.svr.subs.submit(c, m)
+				c.svr.subs.submitWith(c, m, fwd)
+			}
+			// If the payload is pooled, the reader is done with it;
+			// the workers and the writers hold it from here.
+			releasePayload(m)
+
+			var ackx *v5extra
+			if c.version == protocol5 && reason != reasonSuccess {
+				ackx = &v5extra{reason: reason}
 			}
-			c.submit(&proto.PubAck{MessageId: m.MessageId})
+			switch m.Header.QosLevel {
+			case proto.QosAtLeastOnce:
+				c.submitWith(&proto.PubAck{MessageId: m.MessageId}, ackx)
+			case proto.QosExactlyOnce:
+				// A PUBREC with an error ends the exchange: no PUBREL
+				// follows.
+				if ackx == nil {
+					if c.received == nil {
+						c.received = make(map[uint16]struct{})
+					}
+					c.received[m.MessageId] = struct{}{}
+				}
+				c.submitWith(&proto.PubRec{MessageId: m.MessageId}, ackx)
+			}
+
+		case *proto.PubAck:
+			c.inflight.ack(m.MessageId)
+			c.wakeWriter()
+
+		case *proto.PubRec:
+			// An MQTT 5 client can refuse the message, which ends the
+			// exchange right there.
+			if x != nil && x.reason >= reasonUnspecified {
+				c.inflight.ack(m.MessageId)
+				c.wakeWriter()
+				break
+			}
+			c.submit(c.inflight.rec(m.MessageId, time.Now()))
+
+		case *proto.PubRel:
+			delete(c.received, m.MessageId)
+			c.submit(&proto.PubComp{MessageId: m.MessageId})
+
+		case *proto.PubComp:
+			c.inflight.comp(m.MessageId)
+			c.wakeWriter()
 
 		case *proto.PingReq:
 			c.submit(&proto.PingResp{})
@@ -574,93 +2020,521 @@ func (c *incomingConn) reader() {
 		case *proto.Subscribe:
 			if m.Header.QosLevel != proto.QosAtLeastOnce {
 				// protocol error, disconnect
+				c.svr.protocolError(c)
 				return
 			}
 			if m.MessageId == 0 {
 				// Invalid message ID. See MQTT-2.3.1-1.
 				log.Printf("reader: invalid MessageId in SUBSCRIBE.")
+				c.svr.protocolError(c)
 				return
 			}
 			suback := &proto.SubAck{
 				MessageId: m.MessageId,
 				TopicsQos: make([]proto.QosLevel, len(m.Topics)),
 			}
+			var subId uint32
+			if x != nil {
+				if id, ok := x.props.num(propSubscriptionId); ok {
+					if id == 0 {
+						log.Print("reader: subscription identifier 0 from ", c)
+						c.svr.protocolError(c)
+						return
+					}
+					subId = id
+				}
+			}
+			// MQTT 3.1 has no return code for failure, so keep track
+			// of which ones succeeded here.
+			subscribed := make([]bool, len(m.Topics))
 			for i, tq := range m.Topics {
-				// TODO: Handle varying QoS correctly
-				c.svr.subs.add(tq.Topic, c)
-				suback.TopicsQos[i] = proto.QosAtMostOnce
+				suback.TopicsQos[i] = c.svr.QosPolicy.grant(c.clientid, tq.Topic, tq.Qos)
+				if c.svr.NoWildcards && isWildcard(tq.Topic) {
+					log.Printf("reader: %v may not subscribe to wildcard filter %v", c, tq.Topic)
+					switch {
+					case c.version == protocol5:
+						suback.TopicsQos[i] = proto.QosLevel(reasonWildcardsNotSupported)
+					case c.version >= protocol311:
+						suback.TopicsQos[i] = subscribeFailure
+					}
+					continue
+				}
+				if !c.svr.authorize(c, tq.Topic, true) {
+					log.Printf("reader: %v may not subscribe to %v", c, tq.Topic)
+					switch {
+					case c.version == protocol5:
+						suback.TopicsQos[i] = proto.QosLevel(reasonNotAuthorized)
+					case c.version >= protocol311:
+						suback.TopicsQos[i] = subscribeFailure
+					}
+					continue
+				}
+				c.svr.subs.setSubId(c, tq.Topic, subId)
+				if c.svr.subs.add(tq.Topic, c, suback.TopicsQos[i]) {
+					subscribed[i] = true
+					c.subscriptionChanged(true, tq.Topic, suback.TopicsQos[i])
+				} else {
+					c.svr.subs.setSubId(c, tq.Topic, 0)
+					if c.version >= protocol311 {
+						suback.TopicsQos[i] = subscribeFailure
+					}
+				}
 			}
 			c.submit(suback)
 
-			// Process retained messages.
-			for _, tq := range m.Topics {
-				c.svr.subs.sendRetain(tq.Topic, c)
+			// Process retained messages. MQTT 5 clients can ask not
+			// to get them, with the retain handling option.
+			for i, tq := range m.Topics {
+				if x != nil && x.options[i]>>4&0x03 == 2 {
+					continue
+				}
+				if subscribed[i] {
+					c.svr.subs.sendRetain(tq.Topic, c, suback.TopicsQos[i])
+				}
 			}
 
 		case *proto.Unsubscribe:
 			if m.Header.QosLevel != proto.QosAtMostOnce && m.MessageId == 0 {
 				// Invalid message ID. See MQTT-2.3.1-1.
 				log.Printf("reader: invalid MessageId in UNSUBSCRIBE.")
+				c.svr.protocolError(c)
 				return
 			}
-			for _, t := range m.Topics {
-				c.svr.subs.unsub(t, c)
+			codes := make([]byte, len(m.Topics))
+			for i, t := range m.Topics {
+				if c.svr.subs.unsub(t, c) {
+					c.subscriptionChanged(false, t, 0)
+				} else {
+					codes[i] = reasonNoSubscriptionExisted
+				}
 			}
 			ack := &proto.UnsubAck{MessageId: m.MessageId}
-			c.submit(ack)
+			c.submitWith(ack, &v5extra{codes: codes})
 
 		case *proto.Disconnect:
+			// A clean disconnect, so the will is not sent, unless an
+			// MQTT 5 client asks for it.
+			if x == nil || x.reason != reasonDisconnectWithWill {
+				c.will = nil
+			}
 			return
 
 		default:
 			log.Printf("reader: unknown msg type %T", m)
+			c.svr.protocolError(c)
 			return
 		}
 	}
 }
 
-func (c *incomingConn) writer() {
+// decode decodes a frame read by the reader, according to the
+// protocol level of the connection, or of the CONNECT in the frame.
+// x is only set for MQTT 5 connections. If buf is not nil, frame is in
+// it, and the payload of a PUBLISH is left there, held by the reader;
+// for the other messages, buf goes back to the pool.
+func (c *incomingConn) decode(frame []byte, buf *[]byte) (m proto.Message, x *v5extra, err error) {
+	v5 := c.version == protocol5 || (c.version == 0 && connectLevel(frame) == protocol5)
+	if buf != nil && frame[0]>>4 == 3 {
+		if v5 {
+			m, x, err = decodeV5Pooled(frame, buf)
+		} else {
+			m, err = pooledPublish(frame, buf)
+		}
+		if err != nil {
+			payloadPool.Put(buf)
+		}
+		return m, x, err
+	}
+	if buf != nil {
+		defer payloadPool.Put(buf)
+	}
+	if v5 {
+		return decodeV5(frame)
+	}
+	m, err = proto.DecodeOneMessage(bytes.NewReader(frame), nil)
+	return m, nil, err
+}
+
+func (c *incomingConn) writer(w *connWriter) {
 
 	// Close connection on exit in order to cause reader to exit.
 	defer func() {
 		c.conn.Close()
 		c.del()
-		c.svr.subs.unsubAll(c)
+		c.svr.accepted.untrack(c.accepted)
+		c.svr.subs.detachDurables(c)
+		for _, f := range c.svr.subs.unsubAll(c) {
+			c.subscriptionChanged(false, f, 0)
+		}
+		if c.clientid != "" {
+			c.svr.record(EventDisconnect, c, "")
+		}
+		close(c.Done)
 	}()
 
-	for job := range c.jobs {
-		if c.svr.Dump {
-			log.Printf("dump out: %T", job.m)
-		}
+	// Unacknowledged messages are checked on every tick, so they are
+	// sent again between one and two RetryIntervals after the last try.
+	retry := time.NewTicker(c.svr.retryInterval())
+	defer retry.Stop()
 
-		// TODO: write timeout
-		err := job.m.Encode(c.conn)
-		if job.r != nil {
-			// notifiy the sender that this message is sent
-			close(job.r)
-		}
-		if err != nil {
-			// This one is not interesting; it happens when clients
-			// disappear before we send their acks.
-			oe, isoe := err.(*net.OpError)
-			if isoe && oe.Err.Error() == "use of closed network connection" {
+	for {
+		var job job
+		select {
+		case job = <-c.jobs:
+		case <-retry.C:
+			if !c.retransmit(w) {
 				return
 			}
-			// In Go < 1.5, the error is not an OpError.
-			if err.Error() == "use of closed network connection" {
+			continue
+		case <-c.acked:
+			if !c.release(w) {
 				return
 			}
-
-			log.Print("writer: ", err)
+			continue
+		case <-c.taken:
+			c.leave(w)
 			return
+		default:
+			if !c.idle(w) {
+				return
+			}
+			select {
+			case job = <-c.jobs:
+			case <-retry.C:
+				if !c.retransmit(w) {
+					return
+				}
+				continue
+			case <-c.acked:
+				if !c.release(w) {
+					return
+				}
+				continue
+			case <-c.taken:
+				c.leave(w)
+				return
+			case <-c.quit:
+				// The reader is gone. Flush what is already queued, and
+				// count on the write deadline the reader set to keep
+				// us from hanging on a client that is not reading. When
+				// the server is shutting down, messages for us may still
+				// be with the workers; wait for them to be queued too,
+				// and then tell MQTT 5 clients why they are let go.
+				stopping := c.svr.awaitFlush()
+				for {
+					select {
+					case job := <-c.jobs:
+						if !c.send(job, w) {
+							return
+						}
+					default:
+						if stopping && c.version == protocol5 && c.clientid != "" {
+							c.send(disconnectJob(reasonServerShuttingDown), w)
+						}
+						c.flush(w)
+						return
+					}
+				}
+			}
+		}
+		if !c.send(job, w) {
+			return
+		}
+	}
+}
+
+// A connWriter holds the buffers the writer uses.
+// Messages are written into bw, and it is flushed when there are no
+// more waiting, so that a burst of messages goes out in as few writes
+// as possible.
+type connWriter struct {
+	bw    *bufio.Writer
+	frame bytes.Buffer // for capturing
+}
+
+func newConnWriter(conn net.Conn) *connWriter {
+	return &connWriter{bw: bufio.NewWriter(conn)}
+}
+
+// writeConnAck writes the CONNACK at once, from the reader, before
+// the writer is started. Going through the queue and the writer
+// would cost each client of a reconnect storm a goroutine switch or
+// two before it hears back. It returns the connWriter for the writer
+// to go on with, or nil if the client cannot be written to.
+func (c *incomingConn) writeConnAck(m *proto.ConnAck, x *v5extra) *connWriter {
+	w := newConnWriter(c.conn)
+	if d := c.svr.ConnectTimeout; d > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(d))
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	if !c.writeErr(c.write(m, x, w)) || !c.flush(w) {
+		return nil
+	}
+	return w
+}
+
+// idle is called when the job queue is empty. It flushes what was
+// written, after waiting up to Server.FlushDelay for more messages
+// to put in the same write. It returns false when the writer should
+// stop.
+func (c *incomingConn) idle(w *connWriter) bool {
+	if w.bw.Buffered() == 0 {
+		return true
+	}
+	if d := c.svr.FlushDelay; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		for w.bw.Buffered() != 0 {
+			select {
+			case job := <-c.jobs:
+				if !c.send(job, w) {
+					return false
+				}
+			case <-t.C:
+				return c.flush(w)
+			}
+		}
+		return true
+	}
+	return c.flush(w)
+}
+
+// flush writes out what is buffered. It returns false when the writer
+// should stop.
+func (c *incomingConn) flush(w *connWriter) bool {
+	return c.writeErr(w.bw.Flush())
+}
+
+// send writes one job to the connection. It returns false when the
+// writer should stop.
+func (c *incomingConn) send(job job, w *connWriter) bool {
+	if !job.since.IsZero() {
+		c.svr.jobWait.observe(time.Since(job.since))
+	}
+	if job.batch != nil {
+		// The bytes of the batch are let go of one message at a time.
+		for _, j := range job.batch {
+			if job.size > 0 {
+				j.size = messageSize(j.m)
+			}
+			if !c.send(j, w) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Hold back the QoS 1 and 2 messages over the Receive Maximum of
+	// the client, in order, until some of those in flight are acked,
+	// and all of them while delivery is paused.
+	if p, ok := job.m.(*proto.Publish); ok {
+		max := c.receiveMaximum()
+		if c.isPaused() || p.Header.QosLevel != proto.QosAtMostOnce && max > 0 && (len(c.held) > 0 || c.inflight.len() >= max) {
+			if len(c.held) >= c.svr.sendQueueLength() {
+				atomic.AddInt64(&c.queued, -int64(job.size))
+				c.countDrop(1, "too many messages held back")
+				log.Print(c, ": too many messages held back, dropping message")
+				releasePayload(p)
+				if job.r != nil {
+					close(job.r)
+				}
+				return true
+			}
+			c.held = append(c.held, job)
+			return true
+		}
+	}
+	return c.sendNow(job, w)
+}
+
+// sendNow is like send, without holding anything back.
+func (c *incomingConn) sendNow(job job, w *connWriter) bool {
+	atomic.AddInt64(&c.queued, -int64(job.size))
+	m := job.m
+	if p, ok := m.(*proto.Publish); ok {
+		// Once it is written, or not sent at all, the payload is
+		// not needed here any more.
+		defer releasePayload(p)
+		// Messages that expired while queued are not sent, and the
+		// others go with the expiry interval they have left.
+		x, fresh := job.x.fresh(time.Now())
+		if !fresh {
+			if job.r != nil {
+				close(job.r)
+			}
+			return true
 		}
+		job.x = x
+		// Nor are those the client said are too large for it.
+		if c.maxPacket > 0 && publishSize(p, x) > c.maxPacket {
+			c.countDrop(1, "over the Maximum Packet Size of the client")
+			log.Print(c, ": message over the Maximum Packet Size of the client, dropping it")
+			if job.r != nil {
+				close(job.r)
+			}
+			return true
+		}
+	}
+	if p, ok := m.(*proto.Publish); ok && p.Header.QosLevel != proto.QosAtMostOnce {
+		if p = c.track(p, job.x); p == nil {
+			if job.r != nil {
+				close(job.r)
+			}
+			return true
+		}
+		m = p
+	}
+
+	err := c.write(m, job.x, w)
+	if job.r != nil {
+		// notifiy the sender that this message is sent
+		close(job.r)
+	}
+	if !c.writeErr(err) {
+		return false
+	}
+
+	if _, ok := m.(*proto.Disconnect); ok {
+		c.flush(w)
+		log.Print("writer: sent disconnect message")
+		return false
+	}
+	return true
+}
+
+// write encodes a message into the write buffer, with the MQTT 5
+// parts in x if the client speaks MQTT 5.
+func (c *incomingConn) write(m proto.Message, x *v5extra, w *connWriter) error {
+	if c.svr.Dump {
+		log.Printf("dump out: %T", m)
+	}
+
+	encode := m.Encode
+	if c.version == protocol5 {
+		if p, ok := m.(*proto.Publish); ok {
+			m, x = c.alias(p, x)
+		}
+		encode = func(w io.Writer) error { return encodeV5(w, m, x) }
+	}
+
+	// TODO: write timeout
+	var err error
+	if c.svr.Capture != nil {
+		w.frame.Reset()
+		if err = encode(&w.frame); err == nil {
+			c.svr.Capture.record(c.id, CaptureOut, w.frame.Bytes())
+			_, err = w.bw.Write(w.frame.Bytes())
+		}
+	} else {
+		err = encode(w.bw)
+	}
+	if err == nil {
 		c.svr.stats.messageSend()
+	}
+	return err
+}
 
-		if _, ok := job.m.(*proto.Disconnect); ok {
-			log.Print("writer: sent disconnect message")
-			return
+// receiveMaximum returns how many QoS 1 and 2 messages the client
+// takes in flight at once, or 0 for no limit.
+func (c *incomingConn) receiveMaximum() int {
+	n, _ := c.props.num(propReceiveMaximum)
+	return int(n)
+}
+
+// release sends the messages that were held back, as far as the
+// Receive Maximum of the client allows now, unless delivery is paused.
+// It returns false when the writer should stop.
+func (c *incomingConn) release(w *connWriter) bool {
+	if c.isPaused() {
+		return true
+	}
+	max := c.receiveMaximum()
+	for len(c.held) > 0 {
+		j := c.held[0]
+		if p := j.m.(*proto.Publish); p.Header.QosLevel != proto.QosAtMostOnce && max > 0 && c.inflight.len() >= max {
+			break
+		}
+		c.held = c.held[1:]
+		if !c.sendNow(j, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// wakeWriter tells the writer that messages in flight were acked, or
+// that delivery was resumed, so it can send the ones held back.
+func (c *incomingConn) wakeWriter() {
+	select {
+	case c.acked <- struct{}{}:
+	default:
+	}
+}
+
+// track gives a QoS 1 or 2 message on its way to the client a
+// MessageId of its own, and keeps it in flight until the client
+// acknowledges it. Since the message may be shared with other
+// subscribers, it returns a copy to send. It returns nil if there
+// is no MessageId left, in which case the message is dropped.
+func (c *incomingConn) track(p *proto.Publish, x *v5extra) *proto.Publish {
+	cp := *p
+	cp.Header.DupFlag = false
+	if c.inflight.add(&cp, x, time.Now()) == nil {
+		c.countDrop(1, "too many messages in flight")
+		log.Print(c, ": too many messages in flight, dropping message")
+		return nil
+	}
+	return &cp
+}
+
+// retransmit sends again the messages that the client did not
+// acknowledge in time. It returns false when the writer should stop.
+func (c *incomingConn) retransmit(w *connWriter) bool {
+	now, d := time.Now(), c.svr.retryInterval()
+	if max := c.svr.MaxRetries; max > 0 {
+		if n := c.inflight.giveUp(now, d, max); n > 0 {
+			c.countDrop(int64(n), fmt.Sprintf("gave up on %v messages after %v retries", n, max))
+			log.Printf("%v: gave up on %v messages after %v retries", c, n, max)
+			if !c.release(w) {
+				return false
+			}
+		}
+	}
+	for _, j := range c.inflight.due(now, d) {
+		if !c.writeErr(c.write(j.m, j.x, w)) {
+			return false
 		}
 	}
+	return true
+}
+
+func (s *Server) retryInterval() time.Duration {
+	if s.RetryInterval <= 0 {
+		return defaultRetryInterval
+	}
+	return s.RetryInterval
+}
+
+// writeErr checks the result of a write. It returns false when the
+// writer should stop.
+func (c *incomingConn) writeErr(err error) bool {
+	if err == nil {
+		return true
+	}
+
+	// This one is not interesting; it happens when clients
+	// disappear before we send their acks.
+	oe, isoe := err.(*net.OpError)
+	if isoe && oe.Err.Error() == "use of closed network connection" {
+		return false
+	}
+	// In Go < 1.5, the error is not an OpError.
+	if err.Error() == "use of closed network connection" {
+		return false
+	}
+
+	log.Print("writer: ", err)
+	return false
 }
 
 // header is used to initialize a proto.Header when the zero value
@@ -710,27 +2584,54 @@ const clientQueueLength = 100
 // to an MQTT server. It should be allocated via NewClientConn.
 // Concurrent access to a ClientConn is NOT safe.
 type ClientConn struct {
-	ClientId string              // May be set before the call to Connect.
-	Dump     bool                // When true, dump the messages in and out.
-	Incoming chan *proto.Publish // Incoming messages arrive on this channel.
-	id       uint16              // next MessageId
-	out      chan job
-	conn     net.Conn
-	done     chan struct{} // This channel will be readable once a Disconnect has been successfully sent and the connection is closed.
-	connack  chan *proto.ConnAck
-	suback   chan *proto.SubAck
+	ClientId       string              // May be set before the call to Connect.
+	ClientIdPrefix string              // When ClientId is not set, the id made up by Connect starts with this.
+	Ids            IdGenerator         // When non-nil, Connect uses it to make up the ClientId, instead of ClientIdPrefix and a random number.
+	Dump           bool                // When true, dump the messages in and out.
+	Incoming       chan *proto.Publish // Incoming messages arrive on this channel. See NewMessage.
+	RetryInterval  time.Duration       // How long to wait for an acknowledgement before publishing again. Defaults to 20 seconds.
+	MaxInflight    int                 // How many QoS 1 and 2 messages may wait for acknowledgement at once. Defaults to 16.
+	PooledPayloads bool                // When true, payloads are read into pooled buffers. See Message.Release.
+	ManualAck      bool                // When true, QoS 1 and 2 messages are only acknowledged by Ack. See ClientConn.Ack.
+	MQTT5          bool                // When true, Connect speaks MQTT 5.0 instead of 3.1, so that the server can redirect the client. See RedirectError.
+	id             uint16              // next MessageId
+	v5             int32               // set by Connect when it speaks MQTT 5; used atomically
+	ref            string              // the server reference of the CONNACK, set by the reader before it is passed on
+	url            string              // the server URL, when made by DialURLAndConnect, for FollowRedirect
+	out            chan job
+	conn           net.Conn
+	quit           chan struct{} // closed by the reader when it exits, to make the writer exit
+	done           chan struct{} // This channel will be readable once a Disconnect has been successfully sent and the connection is closed.
+	retrying       sync.Once     // starts the retransmitting goroutine
+	connack        chan *proto.ConnAck
+	suback         chan *proto.SubAck
+	unsuback       chan *proto.UnsubAck
+	subs           []proto.TopicQos // what we are subscribed to
+	inflight       inflight
+	recvMu         sync.Mutex      // guards received
+	received       map[uint16]bool // QoS 2 messages received, waiting for PUBREL, and whether they were acknowledged
+	errMu          sync.Mutex      // guards err
+	err            error           // why the connection closed
+	codecMu        sync.Mutex      // guards codecs
+	codecs         map[string]Codec
 }
 
 // NewClientConn allocates a new ClientConn.
-func NewClientConn(c net.Conn) *ClientConn {
+func NewClientConn(c net.Conn, opts ...ClientOption) *ClientConn {
 	cc := &ClientConn{
 		conn:     c,
 		id:       1,
 		out:      make(chan job, clientQueueLength),
 		Incoming: make(chan *proto.Publish, clientQueueLength),
+		quit:     make(chan struct{}),
 		done:     make(chan struct{}),
 		connack:  make(chan *proto.ConnAck),
 		suback:   make(chan *proto.SubAck),
+		unsuback: make(chan *proto.UnsubAck),
+		received: make(map[uint16]bool),
+	}
+	for _, opt := range opts {
+		opt(cc)
 	}
 	go cc.reader()
 	go cc.writer()
@@ -738,22 +2639,41 @@ func NewClientConn(c net.Conn) *ClientConn {
 }
 
 func (c *ClientConn) reader() {
+	var why error
 	defer func() {
+		c.setErr(why)
 		// Cause the writer to exit.
-		close(c.out)
+		close(c.quit)
 		// Cause any goroutines waiting on messages to arrive to exit.
 		close(c.Incoming)
 		c.conn.Close()
 	}()
 
+	br := bufio.NewReader(c.conn)
 	for {
 		// TODO: timeout (first message and/or keepalives)
-		m, err := proto.DecodeOneMessage(c.conn, nil)
+		var m proto.Message
+		var x *v5extra
+		// Wait for the next message before looking at the protocol
+		// level, which Connect sets.
+		_, _, err := peekHeader(br)
+		switch {
+		case err != nil:
+		case atomic.LoadInt32(&c.v5) != 0:
+			m, x, err = c.readV5(br)
+		case c.PooledPayloads:
+			m, err = readPooled(br)
+		default:
+			m, err = proto.DecodeOneMessage(br, nil)
+		}
 		if err != nil {
+			why = err
 			if err == io.EOF {
+				why = ErrConnectionClosed
 				return
 			}
 			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				why = ErrConnectionClosed
 				return
 			}
 			log.Print("cli reader: ", err)
@@ -766,15 +2686,64 @@ func (c *ClientConn) reader() {
 
 		switch m := m.(type) {
 		case *proto.Publish:
-			c.Incoming <- m
+			if ct := x.contentType(); ct != "" {
+				m.Payload = &typedPayload{Payload: m.Payload, contentType: ct}
+			}
+			switch m.Header.QosLevel {
+			case proto.QosAtMostOnce:
+				c.Incoming <- m
+			case proto.QosAtLeastOnce:
+				if c.ManualAck {
+					c.ackLater(m)
+					c.Incoming <- m
+					break
+				}
+				c.Incoming <- m
+				c.queue(job{m: &proto.PubAck{MessageId: m.MessageId}})
+			case proto.QosExactlyOnce:
+				// Until the server releases it, the same MessageId
+				// is the same message, sent again. With ManualAck, it
+				// is only acknowledged again once Ack was called.
+				c.recvMu.Lock()
+				acked, seen := c.received[m.MessageId]
+				if !seen {
+					c.received[m.MessageId] = !c.ManualAck
+				}
+				c.recvMu.Unlock()
+				if !seen {
+					if c.ManualAck {
+						c.ackLater(m)
+					}
+					c.Incoming <- m
+				}
+				if !c.ManualAck || acked {
+					c.queue(job{m: &proto.PubRec{MessageId: m.MessageId}})
+				}
+			}
 		case *proto.PubAck:
-			// ignore these
-			continue
+			c.inflight.ack(m.MessageId)
+		case *proto.PubRec:
+			c.queue(job{m: c.inflight.rec(m.MessageId, time.Now())})
+		case *proto.PubRel:
+			c.recvMu.Lock()
+			delete(c.received, m.MessageId)
+			c.recvMu.Unlock()
+			c.queue(job{m: &proto.PubComp{MessageId: m.MessageId}})
+		case *proto.PubComp:
+			c.inflight.comp(m.MessageId)
 		case *proto.ConnAck:
+			c.ref = x.redirect()
 			c.connack <- m
 		case *proto.SubAck:
 			c.suback <- m
+		case *proto.UnsubAck:
+			c.unsuback <- m
+		case *proto.PingResp:
 		case *proto.Disconnect:
+			why = ErrServerDisconnect
+			if ref := x.redirect(); ref != "" {
+				why = &RedirectError{Reference: ref, Err: why}
+			}
 			return
 		default:
 			log.Printf("cli reader: got msg type %T", m)
@@ -782,6 +2751,22 @@ func (c *ClientConn) reader() {
 	}
 }
 
+// readV5 reads the next message from an MQTT 5 server.
+func (c *ClientConn) readV5(br *bufio.Reader) (proto.Message, *v5extra, error) {
+	var frame []byte
+	var buf *[]byte
+	var err error
+	if c.PooledPayloads {
+		frame, buf, err = readPooledFrame(br)
+	} else {
+		frame, err = readFrame(br)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeV5FromServer(frame, buf)
+}
+
 func (c *ClientConn) writer() {
 	// Close connection on exit in order to cause reader to exit.
 	defer func() {
@@ -790,13 +2775,24 @@ func (c *ClientConn) writer() {
 		close(c.done)
 	}()
 
-	for job := range c.out {
+	for {
+		var job job
+		select {
+		case job = <-c.out:
+		case <-c.quit:
+			return
+		}
 		if c.Dump {
 			log.Printf("dump out: %T", job.m)
 		}
 
 		// TODO: write timeout
-		err := job.m.Encode(c.conn)
+		var err error
+		if atomic.LoadInt32(&c.v5) != 0 {
+			err = encodeV5(c.conn, job.m, job.x)
+		} else {
+			err = job.m.Encode(c.conn)
+		}
 		if job.r != nil {
 			close(job.r)
 		}
@@ -813,12 +2809,18 @@ func (c *ClientConn) writer() {
 }
 
 // Connect sends the CONNECT message to the server. If the ClientId is not already
-// set, use a default (a 63-bit decimal random number). The "clean session"
-// bit is always set.
+// set, use Ids, or a default (ClientIdPrefix followed by a 63-bit decimal
+// random number). The "clean session" bit is always set. With MQTT5, a
+// server that sends the client elsewhere makes it return a *RedirectError.
 func (c *ClientConn) Connect(user, pass string) error {
 	// TODO: Keepalive timer
+	if c.ClientId == "" && c.Ids != nil {
+		c.ClientId = c.Ids.NewId()
+	}
 	if c.ClientId == "" {
-		c.ClientId = fmt.Sprint(cliRand.Int63())
+		cliRandMu.Lock()
+		c.ClientId = c.ClientIdPrefix + fmt.Sprint(cliRand.Int63())
+		cliRandMu.Unlock()
 	}
 	req := &proto.Connect{
 		ProtocolName:    "MQIsdp",
@@ -832,31 +2834,105 @@ func (c *ClientConn) Connect(user, pass string) error {
 		req.Username = user
 		req.Password = pass
 	}
+	if c.MQTT5 {
+		req.ProtocolName, req.ProtocolVersion = "MQTT", protocol5
+		atomic.StoreInt32(&c.v5, 1)
+	}
 
 	c.sync(req)
-	ack := <-c.connack
-	return ConnectionErrors[ack.ReturnCode]
+	select {
+	case ack := <-c.connack:
+		err := connectError(ack.ReturnCode)
+		if err != nil && c.ref != "" {
+			return &RedirectError{Reference: c.ref, Err: err}
+		}
+		return err
+	case <-c.done:
+		return ErrConnectionClosed
+	}
+}
+
+// IdRetries is the number of times DialAndConnect tries again when
+// the server rejects a client id that it made up.
+var IdRetries = 5
+
+// DialAndConnect calls dial to make a connection to the server, wraps it
+// in a ClientConn, lets setup (if not nil) set fields like Dump and
+// ClientIdPrefix, and then calls Connect. If the ClientId was left for
+// Connect to make up, and the server rejects it, perhaps because
+// another client already has it, DialAndConnect tries again on a new
+// connection with a new id, up to IdRetries times.
+//
+// DialAndConnect does not follow server redirects: with MQTT5 set by
+// setup, the error is a *RedirectError, and it is up to dial to pick
+// another server. DialURLAndConnect follows them.
+func DialAndConnect(dial func() (net.Conn, error), setup func(*ClientConn), user, pass string) (*ClientConn, error) {
+	for try := 0; ; try++ {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		cc := NewClientConn(conn)
+		if setup != nil {
+			setup(cc)
+		}
+		generated := cc.ClientId == ""
+
+		err = cc.Connect(user, pass)
+		if err == nil {
+			return cc, nil
+		}
+		conn.Close()
+		if !generated || !errors.Is(err, ErrIdentifierRejected) || try >= IdRetries {
+			return nil, err
+		}
+		log.Printf("client id %v rejected, trying again with a new one", cc.ClientId)
+	}
 }
 
 // ConnectionErrors is an array of errors corresponding to the
-// Connect return codes specified in the specification.
+// Connect return codes specified in the specification. It is kept
+// for compatibility; use errors.Is with ErrBadProtocolVersion and
+// friends instead.
 var ConnectionErrors = [6]error{
 	nil, // Connection Accepted (not an error)
-	errors.New("Connection Refused: unacceptable protocol version"),
-	errors.New("Connection Refused: identifier rejected"),
-	errors.New("Connection Refused: server unavailable"),
-	errors.New("Connection Refused: bad user name or password"),
-	errors.New("Connection Refused: not authorized"),
+	ErrBadProtocolVersion,
+	ErrIdentifierRejected,
+	ErrServerUnavailable,
+	ErrBadUsernameOrPassword,
+	ErrNotAuthorized,
 }
 
 // Disconnect sends a DISCONNECT message to the server. This function
 // blocks until the disconnect message is actually sent, and the connection
 // is closed.
 func (c *ClientConn) Disconnect() {
+	c.setErr(ErrLocalClose)
 	c.sync(&proto.Disconnect{})
 	<-c.done
 }
 
+// Err returns nil while the connection is open. Once it is closed
+// (for instance, when Incoming is closed), it returns why: ErrLocalClose
+// after a call to Disconnect, ErrServerDisconnect if the server asked
+// for it, ErrConnectionClosed if the server closed the connection,
+// or the error that reading from the connection failed with.
+func (c *ClientConn) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// setErr records why the connection closed, unless a reason was
+// already recorded.
+func (c *ClientConn) setErr(err error) {
+	c.errMu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.errMu.Unlock()
+}
+
 func (c *ClientConn) nextid() uint16 {
 	id := c.id
 	c.id++
@@ -872,23 +2948,186 @@ func (c *ClientConn) Subscribe(tqs []proto.TopicQos) *proto.SubAck {
 		Topics:    tqs,
 	})
 	ack := <-c.suback
+
+	// Remember them, replacing earlier subscriptions to the same filter.
+	for _, tq := range tqs {
+		c.forget(tq.Topic)
+		c.subs = append(c.subs, tq)
+	}
 	return ack
 }
 
-// Publish publishes the given message to the MQTT server.
-// The QosLevel of the message must be QosAtLeastOnce for now.
+// Unsubscribe unsubscribes this connection from a list of topics.
+func (c *ClientConn) Unsubscribe(topics []string) {
+	c.sync(&proto.Unsubscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: c.nextid(),
+		Topics:    topics,
+	})
+	<-c.unsuback
+
+	for _, t := range topics {
+		c.forget(t)
+	}
+}
+
+// forget removes a filter from the subscriptions of the connection.
+func (c *ClientConn) forget(filter string) {
+	for i := range c.subs {
+		if c.subs[i].Topic == filter {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Subscriptions returns the topic filters this connection is
+// subscribed to, and the QoS it asked for on each, so that an
+// application can save them and later use RestoreSubscriptions.
+func (c *ClientConn) Subscriptions() []proto.TopicQos {
+	return append([]proto.TopicQos(nil), c.subs...)
+}
+
+// RestoreSubscriptions subscribes again to a list of filters returned
+// by Subscriptions, for instance on a new connection after the old one
+// was lost, or after a restart. It returns nil if the list is empty.
+func (c *ClientConn) RestoreSubscriptions(tqs []proto.TopicQos) *proto.SubAck {
+	if len(tqs) == 0 {
+		return nil
+	}
+	return c.Subscribe(tqs)
+}
+
+// Publish publishes the given message to the MQTT server. At QoS
+// level 1 or 2, it blocks until the server has acknowledged the
+// message, or until the connection closes. Use PublishAsync to have
+// several messages in flight at once.
 func (c *ClientConn) Publish(m *proto.Publish) {
-	if m.QosLevel != proto.QosAtMostOnce {
-		panic("unsupported QoS level")
+	c.publish(m, nil)
+}
+
+// publish is Publish, with x for an MQTT 5 server. At QoS 1 and 2, it
+// returns what PublishToken.Wait does.
+func (c *ClientConn) publish(m *proto.Publish, x *v5extra) error {
+	if m.QosLevel == proto.QosAtMostOnce {
+		m.MessageId = c.nextid()
+		c.queue(job{m: m, x: x})
+		return nil
+	}
+	return c.publishAsync(m, x).Wait()
+}
+
+// The default for ClientConn.MaxInflight.
+const defaultMaxInflight = 16
+
+// PublishAsync publishes a QoS 1 or 2 message without waiting for
+// the server to acknowledge it. It only blocks while MaxInflight
+// messages are waiting for acknowledgement already. The messages are
+// sent in order, but the server may acknowledge them in any order.
+// Messages are sent again every RetryInterval until acknowledged.
+func (c *ClientConn) PublishAsync(m *proto.Publish) *PublishToken {
+	return c.publishAsync(m, nil)
+}
+
+func (c *ClientConn) publishAsync(m *proto.Publish, x *v5extra) *PublishToken {
+	max := c.MaxInflight
+	if max <= 0 {
+		max = defaultMaxInflight
+	}
+	t := &PublishToken{c: c}
+	if !c.inflight.wait(max, c.done) {
+		return t
+	}
+	c.retrying.Do(func() { go c.retransmit() })
+
+	o := c.inflight.add(m, x, time.Now())
+	if o == nil {
+		log.Print("cli: too many messages in flight, dropping message")
+		return t
+	}
+	t.o = o
+	c.queue(job{m: m, x: x})
+	return t
+}
+
+// A PublishToken is returned by PublishAsync, in order to find out
+// when the server has acknowledged the message.
+type PublishToken struct {
+	c *ClientConn
+	o *outbound // nil if the message was not sent
+}
+
+// Done returns a channel that is closed when the server has
+// acknowledged the message, or the connection closed before it did.
+func (t *PublishToken) Done() <-chan struct{} {
+	if t.o == nil {
+		return t.c.done
+	}
+	return t.o.done
+}
+
+// Wait blocks until the server has acknowledged the message, and
+// returns nil. If the connection closes first, it returns Err instead.
+func (t *PublishToken) Wait() error {
+	if t.o != nil {
+		select {
+		case <-t.o.done:
+			return nil
+		case <-t.c.done:
+			// It may have been acknowledged right before the end.
+			select {
+			case <-t.o.done:
+				return nil
+			default:
+			}
+		}
+	}
+	if err := t.c.Err(); err != nil {
+		return err
+	}
+	return ErrConnectionClosed
+}
+
+// retransmit sends again the messages that the server did not
+// acknowledge within RetryInterval, until the connection closes.
+func (c *ClientConn) retransmit() {
+	d := c.RetryInterval
+	if d <= 0 {
+		d = defaultRetryInterval
+	}
+	retry := time.NewTicker(d)
+	defer retry.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-retry.C:
+			for _, j := range c.inflight.due(time.Now(), d) {
+				c.queue(j)
+			}
+		}
+	}
+}
+
+// queue hands a job to the writer. It returns false if the writer
+// has exited, in which case the job will never be sent.
+func (c *ClientConn) queue(j job) bool {
+	select {
+	case c.out <- j:
+		return true
+	case <-c.done:
+		return false
 	}
-	m.MessageId = c.nextid()
-	c.out <- job{m: m}
 }
 
 // sync sends a message and blocks until it was actually sent.
 func (c *ClientConn) sync(m proto.Message) {
 	j := job{m: m, r: make(receipt)}
-	c.out <- j
-	<-j.r
+	if c.queue(j) {
+		select {
+		case <-j.r:
+		case <-c.done:
+		}
+	}
 	return
 }
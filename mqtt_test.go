@@ -0,0 +1,810 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// testServer starts a server on a local listener, after letting setup
+// (if not nil) configure it, and returns it with a function to dial
+// it. Stop it by closing l.
+func testServer(t *testing.T, setup func(*Server)) (svr *Server, l net.Listener, dial func() (net.Conn, error)) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr = NewServer(l)
+	if setup != nil {
+		setup(svr)
+	}
+	svr.Start()
+	dial = func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	return svr, l, dial
+}
+
+// receive returns the next message that cc gets, or nil if none comes
+// within d.
+func receive(cc *ClientConn, d time.Duration) *proto.Publish {
+	select {
+	case m := <-cc.Incoming:
+		return m
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// waitUntil waits for cond to be true, which the server makes it
+// asynchronously, and fails if it takes too long.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting until ", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPeekLength(t *testing.T) {
+	var tests = []struct {
+		in   []byte
+		want int
+		ok   bool
+	}{
+		{[]byte{0x10, 0x00}, 0, true},
+		{[]byte{0x10, 0x7f}, 127, true},
+		{[]byte{0x10, 0x80, 0x01}, 128, true},
+		{[]byte{0x10, 0xff, 0xff, 0xff, 0x7f}, 268435455, true},
+		{[]byte{0x10, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, false},
+		{[]byte{0x10, 0x80}, 0, false},
+	}
+
+	for _, x := range tests {
+		br := bufio.NewReader(bytes.NewReader(x.in))
+		got, err := peekLength(br)
+		if (err == nil) != x.ok || got != x.want {
+			t.Errorf("%x: got %v, %v", x.in, got, err)
+		}
+		// nothing should have been consumed
+		if br.Buffered() != len(x.in) {
+			t.Errorf("%x: consumed input", x.in)
+		}
+	}
+}
+
+func TestConnectLimits(t *testing.T) {
+	l := ConnectLimits{ClientId: 4, Username: 4, Password: 4}
+	var tests = []struct {
+		m    proto.Connect
+		want proto.ReturnCode
+	}{
+		{proto.Connect{ClientId: "abcd"}, proto.RetCodeAccepted},
+		{proto.Connect{ClientId: "abcde"}, proto.RetCodeIdentifierRejected},
+		{proto.Connect{ClientId: "a", Password: "secret"}, proto.RetCodeBadUsernameOrPassword},
+		{proto.Connect{ClientId: "a", WillMessage: "unlimited"}, proto.RetCodeAccepted},
+	}
+	for _, x := range tests {
+		if got := l.check(&x.m); got != x.want {
+			t.Errorf("%+v: got %v, want %v", x.m, got, x.want)
+		}
+	}
+	if l.size() != 0 {
+		t.Error("size should be unlimited")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := &Server{stats: &stats{}}
+	s.stats.clientConnect()
+	empty := s.Drain("other:1883")
+	if on, ref := s.draining(); !on || ref != "other:1883" {
+		t.Errorf("draining is %v, %q", on, ref)
+	}
+	if s.Drain("") != empty {
+		t.Error("second Drain returned another channel")
+	}
+
+	select {
+	case <-empty:
+		t.Fatal("empty with a client connected")
+	case <-time.After(2 * drainPoll):
+	}
+	s.stats.clientDisconnect()
+	select {
+	case <-empty:
+	case <-time.After(10 * drainPoll):
+		t.Fatal("not empty after the last client left")
+	}
+}
+
+func TestDrainRate(t *testing.T) {
+	s := &Server{stats: &stats{}, DrainRate: 50}
+	a, b := newTestConn(s, "drain-a"), newTestConn(s, "drain-b")
+	a.add()
+	b.add()
+	start := time.Now()
+	s.Drain("other:1883")
+	for _, c := range []*incomingConn{a, b} {
+		select {
+		case <-c.Done:
+		case <-time.After(time.Second):
+			t.Fatal(c, " not disconnected")
+		}
+	}
+	if d := time.Since(start); d < 2*time.Second/50 {
+		t.Errorf("two clients drained in %v", d)
+	}
+}
+
+// disconnect flushes the messages queued before the DISCONNECT, and
+// gives up on a client that does not read them within DrainTimeout.
+func TestDrainTimeout(t *testing.T) {
+	s := &Server{stats: &stats{}, subs: newSubscriptions(0), DrainTimeout: time.Second}
+	client, server := net.Pipe()
+	defer client.Close()
+	c := s.newIncomingConn(server)
+	c.version = protocol311
+	for i := 0; i < 3; i++ {
+		c.submit(&proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")})
+	}
+	go c.writer(newConnWriter(server))
+	go c.disconnect(nil)
+
+	for i := 0; i < 4; i++ {
+		m, err := proto.DecodeOneMessage(client, nil)
+		if err != nil {
+			t.Fatalf("message %v: %v", i, err)
+		}
+		if _, ok := m.(*proto.Publish); ok != (i < 3) {
+			t.Fatalf("message %v is a %T", i, m)
+		}
+		if _, ok := m.(*proto.Disconnect); ok != (i == 3) {
+			t.Fatalf("message %v is a %T", i, m)
+		}
+	}
+	select {
+	case <-c.Done:
+	case <-time.After(time.Second):
+		t.Fatal("not closed after the DISCONNECT")
+	}
+
+	// Nobody reads this time.
+	s.DrainTimeout = 50 * time.Millisecond
+	client, server = net.Pipe()
+	defer client.Close()
+	c = s.newIncomingConn(server)
+	c.submit(&proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")})
+	go c.writer(newConnWriter(server))
+	done := make(chan struct{})
+	go func() {
+		c.disconnect(nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still open long after DrainTimeout")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	s := &Server{stats: &stats{}, subs: newSubscriptions(0), ConnectTimeout: 10 * time.Millisecond}
+	client, server := net.Pipe()
+	defer client.Close()
+	c := s.newIncomingConn(server)
+	go c.reader()
+	select {
+	case <-c.quit:
+	case <-time.After(time.Second):
+		t.Fatal("no CONNECT, and the connection is still open")
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	s := &Server{stats: &stats{}, subs: newSubscriptions(0), MaxPacketSize: 1024}
+	client, server := net.Pipe()
+	defer client.Close()
+	c := s.newIncomingConn(server)
+	go c.reader()
+
+	// A CONNECT with a remaining length of 65535, and nothing more: it
+	// is refused before the server waits for the rest.
+	go client.Write([]byte{0x10, 0xff, 0xff, 0x03})
+	select {
+	case <-c.quit:
+	case <-time.After(time.Second):
+		t.Fatal("oversized packet, and the connection is still open")
+	}
+}
+
+func TestClientIds(t *testing.T) {
+	n := 0
+	gen := IdGeneratorFunc(func() string {
+		n++
+		return fmt.Sprint("gen-", n)
+	})
+	s := &Server{ClientIds: gen}
+	s.clients.add(&incomingConn{svr: s, clientid: "gen-1"})
+
+	if id, _ := s.newClientId(""); id != "gen-2" {
+		t.Errorf("got %v, want gen-2", id)
+	}
+
+	// Ids only need to be unique within a tenant.
+	s.clients.add(&incomingConn{svr: s, tenant: "a", clientid: "gen-3"})
+	if id, _ := s.newClientId("b"); id != "gen-3" {
+		t.Errorf("got %v in another tenant, want gen-3", id)
+	}
+	s.clients.add(&incomingConn{svr: s, tenant: "a", clientid: "gen-4"})
+	if id, _ := s.newClientId("a"); id != "gen-5" {
+		t.Errorf("got %v, want gen-5", id)
+	}
+
+	// A generator that only makes up ids in use is given up on.
+	s.ClientIds = IdGeneratorFunc(func() string { return "gen-1" })
+	if id, ok := s.newClientId(""); ok {
+		t.Errorf("got %v, which is in use", id)
+	}
+
+	s.ClientIds = nil
+	if id, _ := s.newClientId(""); !strings.HasPrefix(id, "auto-") {
+		t.Errorf("default id is %v", id)
+	}
+}
+
+func TestClientIdValidator(t *testing.T) {
+	_, l, dial := testServer(t, func(s *Server) {
+		s.ClientIdValidator = func(clientid string) bool { return strings.HasPrefix(clientid, "device-") }
+	})
+	defer l.Close()
+
+	long := "device-" + strings.Repeat("x", 33)
+	cc, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = long }, "", "")
+	if err != nil {
+		t.Fatalf("%v byte id refused: %v", len(long), err)
+	}
+	cc.Disconnect()
+
+	_, err = DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = "sensor-1" }, "", "")
+	if !errors.Is(err, ErrIdentifierRejected) {
+		t.Errorf("invalid id: got %v, want ErrIdentifierRejected", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	svr, l, dial := testServer(t, func(s *Server) {
+		s.Tenant = func(m *proto.Connect) string { return m.Username }
+		s.MaxRetained = 1
+	})
+	defer l.Close()
+	client := func(tenant, clientid string) *ClientConn {
+		cc, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = clientid }, tenant, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	retained := func(tenant string, n int) func() bool {
+		return func() bool { return len(svr.RetainedMessages(tenant)) == n }
+	}
+	pub := client("a", "pub")
+	defer pub.Disconnect()
+	// The same client id in another tenant is another client.
+	subA, subB := client("a", "sub"), client("b", "sub")
+	defer subA.Disconnect()
+	defer subB.Disconnect()
+	for _, cc := range []*ClientConn{subA, subB} {
+		cc.Subscribe([]proto.TopicQos{{Topic: "t", Qos: proto.QosAtMostOnce}, {Topic: "u", Qos: proto.QosAtMostOnce}})
+	}
+
+	for _, topic := range []string{"t", "u"} {
+		pub.Publish(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainTrue),
+			TopicName: topic,
+			Payload:   proto.BytesPayload("x"),
+		})
+		if m := receive(subA, time.Second); m == nil || m.TopicName != topic {
+			t.Fatalf("tenant a got %v, want %v", m, topic)
+		}
+		waitUntil(t, "one message is retained", retained("a", 1))
+	}
+	if m := receive(subB, 50*time.Millisecond); m != nil {
+		t.Errorf("tenant b got %v", m.TopicName)
+	}
+	// Over MaxRetained, u is delivered but not retained.
+	if r := svr.RetainedMessages("a"); r[0].TopicName != "t" {
+		t.Errorf("retained %v", r[0].TopicName)
+	}
+	if n := len(svr.RetainedMessages("b")); n != 0 {
+		t.Errorf("%v retained in tenant b", n)
+	}
+
+	svr.SetRetained("b", &proto.Publish{TopicName: "t", Payload: proto.BytesPayload("y")})
+	svr.WipeTenant("a")
+	if n := len(svr.RetainedMessages("a")); n != 0 {
+		t.Errorf("%v retained in tenant a after WipeTenant", n)
+	}
+	if n := len(svr.RetainedMessages("b")); n != 1 {
+		t.Errorf("WipeTenant of a left %v retained in tenant b", n)
+	}
+	late := client("a", "late")
+	defer late.Disconnect()
+	late.Subscribe([]proto.TopicQos{{Topic: "t", Qos: proto.QosAtMostOnce}})
+	if m := receive(late, 50*time.Millisecond); m != nil {
+		t.Error("got a retained message after WipeTenant")
+	}
+}
+
+func TestIdRetries(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	_, l, dial := testServer(t, func(s *Server) {
+		s.ClientIdValidator = func(clientid string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, clientid)
+			return len(seen) > 1
+		}
+	})
+	defer l.Close()
+
+	cc, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ClientIdPrefix = "dev-" }, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Disconnect()
+	mu.Lock()
+	if len(seen) != 2 || seen[0] == seen[1] || !strings.HasPrefix(seen[1], "dev-") {
+		t.Errorf("tried ids %v", seen)
+	}
+	seen = seen[:0]
+	mu.Unlock()
+
+	// An id given by the caller is not replaced.
+	_, err = DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = "fixed" }, "", "")
+	mu.Lock()
+	defer mu.Unlock()
+	if !errors.Is(err, ErrIdentifierRejected) || len(seen) != 1 {
+		t.Errorf("got %v after %v tries", err, len(seen))
+	}
+}
+
+func TestSendQueueBytes(t *testing.T) {
+	s := &Server{stats: &stats{}, SendQueueBytes: 10}
+	s.sendQueue = 3
+	c := newTestConn(s, "budget")
+	c.add()
+	defer c.del()
+	msg := func(payload string) *proto.Publish {
+		return &proto.Publish{TopicName: "a", Payload: proto.BytesPayload(payload)}
+	}
+	check := func(what string, queued, dropped int64) {
+		t.Helper()
+		if q, d := atomic.LoadInt64(&c.queued), atomic.LoadInt64(&c.dropped); q != queued || d != dropped {
+			t.Errorf("%v: %v bytes queued, %v dropped, want %v and %v", what, q, d, queued, dropped)
+		}
+	}
+
+	c.submit(msg("12345"))
+	c.submitBatch([]job{{m: msg("1")}, {m: msg("2")}})
+	check("up to the budget", 10, 0)
+	c.submit(msg("3"))
+	check("over the budget", 10, 1)
+
+	// Held back messages still count, until they are sent.
+	s.PauseDelivery("", "budget")
+	w := &connWriter{bw: bufio.NewWriter(ioutil.Discard)}
+	for len(c.jobs) > 0 {
+		c.send(<-c.jobs, w)
+	}
+	check("paused", 10, 1)
+	s.ResumeDelivery("", "budget")
+	c.release(w)
+	check("sent", 0, 1)
+
+	// A message that fits the budget, but not the queue, gives its
+	// bytes back.
+	for i := 0; i < 3; i++ {
+		c.submit(&proto.PingResp{})
+	}
+	c.submit(msg("4"))
+	check("queue full", 0, 2)
+}
+
+func TestSubscriptionChanged(t *testing.T) {
+	events := make(chan SubscriptionEvent, 10)
+	_, l, dial := testServer(t, func(s *Server) {
+		s.SubscriptionChanged = func(e SubscriptionEvent) { events <- e }
+	})
+	defer l.Close()
+	cc, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = "watched" }, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Subscribe([]proto.TopicQos{{Topic: "a/+", Qos: proto.QosAtLeastOnce}, {Topic: "b", Qos: proto.QosAtMostOnce}})
+	cc.Unsubscribe([]string{"a/+"})
+	cc.Disconnect()
+
+	want := []SubscriptionEvent{
+		{Added: true, ClientId: "watched", Filter: "a/+", Qos: proto.QosAtLeastOnce},
+		{Added: true, ClientId: "watched", Filter: "b", Qos: proto.QosAtMostOnce},
+		{Added: false, ClientId: "watched", Filter: "a/+"},
+		{Added: false, ClientId: "watched", Filter: "b"}, // went away
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Errorf("got %+v, want %+v", e, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %+v", w)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	_, l, dial := testServer(t, func(s *Server) {
+		s.Transform = func(clientid, filter string, m *proto.Publish) *proto.Publish {
+			switch clientid {
+			case "small":
+				short := *m
+				short.Payload = proto.BytesPayload(filter)
+				return &short
+			case "none":
+				return nil
+			}
+			return m
+		}
+	})
+	defer l.Close()
+	subs := make(map[string]*ClientConn)
+	for _, id := range []string{"small", "none", "full", "pub"} {
+		cc, err := DialAndConnect(dial, func(cc *ClientConn) { cc.ClientId = id }, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Disconnect()
+		cc.Subscribe([]proto.TopicQos{{Topic: "a/+", Qos: proto.QosAtMostOnce}})
+		subs[id] = cc
+	}
+	subs["pub"].Publish(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "a/b",
+		Payload:   proto.BytesPayload("the whole payload"),
+	})
+
+	for id, want := range map[string]string{"small": "a/+", "full": "the whole payload"} {
+		m := receive(subs[id], time.Second)
+		if m == nil || string(m.Payload.(proto.BytesPayload)) != want {
+			t.Errorf("%v got %v, want %q", id, m, want)
+		}
+	}
+	if m := receive(subs["none"], 50*time.Millisecond); m != nil {
+		t.Error("sent a message that Transform dropped")
+	}
+}
+
+func TestSetRetained(t *testing.T) {
+	svr, l, dial := testServer(t, func(s *Server) {
+		for _, topic := range []string{"seed/a", "seed/b"} {
+			s.SetRetained("", &proto.Publish{TopicName: topic, Payload: proto.BytesPayload(topic)})
+		}
+	})
+	defer l.Close()
+	svr.SetRetained("", &proto.Publish{TopicName: "seed/b", Payload: proto.BytesPayload{}})
+
+	cc, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	cc.Subscribe([]proto.TopicQos{{Topic: "seed/+", Qos: proto.QosAtMostOnce}})
+	m := receive(cc, time.Second)
+	if m == nil || m.TopicName != "seed/a" || !m.Header.Retain {
+		t.Errorf("got %v, want the seeded seed/a", m)
+	}
+	if m := receive(cc, 50*time.Millisecond); m != nil {
+		t.Errorf("got %v, which was removed", m.TopicName)
+	}
+}
+
+func TestRestoreSubscriptions(t *testing.T) {
+	_, l, dial := testServer(t, nil)
+	defer l.Close()
+	old, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Subscribe([]proto.TopicQos{{Topic: "a", Qos: proto.QosAtMostOnce}, {Topic: "b/#", Qos: proto.QosAtMostOnce}})
+	old.Subscribe([]proto.TopicQos{{Topic: "a", Qos: proto.QosAtLeastOnce}, {Topic: "c", Qos: proto.QosAtMostOnce}})
+	old.Unsubscribe([]string{"c"})
+	saved := old.Subscriptions()
+	old.Disconnect()
+	want := []proto.TopicQos{{Topic: "b/#", Qos: proto.QosAtMostOnce}, {Topic: "a", Qos: proto.QosAtLeastOnce}}
+	if !reflect.DeepEqual(saved, want) {
+		t.Fatalf("Subscriptions is %v, want %v", saved, want)
+	}
+
+	cc, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	if cc.RestoreSubscriptions(nil) != nil {
+		t.Error("subscribed to nothing")
+	}
+	if ack := cc.RestoreSubscriptions(saved); len(ack.TopicsQos) != 2 {
+		t.Fatalf("got %v", ack)
+	}
+	pub, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+	pub.Publish(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "b/c",
+		Payload:   proto.BytesPayload("x"),
+	})
+	if m := receive(cc, time.Second); m == nil || m.TopicName != "b/c" {
+		t.Errorf("got %v on the restored subscriptions", m)
+	}
+}
+
+// A writeCounter counts the writes made to it.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func TestFlushDelay(t *testing.T) {
+	s := &Server{stats: &stats{}, FlushDelay: 50 * time.Millisecond}
+	c := newTestConn(s, "c")
+	var out writeCounter
+	w := &connWriter{bw: bufio.NewWriter(&out)}
+	msg := &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")}
+
+	c.send(job{m: msg}, w)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.submit(msg)
+	}()
+	start := time.Now()
+	if !c.idle(w) {
+		t.Fatal("idle failed")
+	}
+	if d := time.Since(start); d < s.FlushDelay {
+		t.Errorf("flushed after %v", d)
+	}
+	var one bytes.Buffer
+	msg.Encode(&one)
+	if out.writes != 1 || out.Len() != 2*one.Len() {
+		t.Errorf("%v bytes in %v writes, want both messages in one", out.Len(), out.writes)
+	}
+
+	// Without FlushDelay, what is buffered goes at once.
+	s.FlushDelay = 0
+	c.send(job{m: msg}, w)
+	c.idle(w)
+	if out.writes != 2 {
+		t.Errorf("%v writes", out.writes)
+	}
+}
+
+func TestPacketOrder(t *testing.T) {
+	_, l, dial := testServer(t, nil)
+	defer l.Close()
+	connect := &proto.Connect{ProtocolName: "MQTT", ProtocolVersion: protocol311, ClientId: "order", KeepAliveTimer: 60}
+	publish := &proto.Publish{Header: header(dupFalse, proto.QosAtMostOnce, retainFalse), TopicName: "a", Payload: proto.BytesPayload("x")}
+	subscribe := &proto.Subscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 1,
+		Topics:    []proto.TopicQos{{Topic: "a", Qos: proto.QosAtMostOnce}},
+	}
+
+	for _, tc := range []struct {
+		name string
+		msgs []proto.Message
+	}{
+		{"PUBLISH before CONNECT", []proto.Message{publish}},
+		{"SUBSCRIBE before CONNECT", []proto.Message{subscribe}},
+		{"second CONNECT", []proto.Message{connect, connect}},
+	} {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range tc.msgs {
+			m.Encode(conn)
+		}
+		// Everything up to the violation is answered, then the
+		// connection is closed.
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var got []proto.Message
+		for {
+			m, err := proto.DecodeOneMessage(conn, nil)
+			if err != nil {
+				if isTimeout(err) {
+					t.Errorf("%v: connection still open", tc.name)
+				}
+				break
+			}
+			got = append(got, m)
+		}
+		conn.Close()
+		if want := len(tc.msgs) - 1; len(got) != want {
+			t.Errorf("%v: got %v replies, want %v", tc.name, len(got), want)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestEmptyClientId(t *testing.T) {
+	svr, l, dial := testServer(t, nil)
+	defer l.Close()
+	// connect sends m with an empty client id, and returns the return
+	// code, and for MQTT 5, the id the server assigned.
+	connect := func(m *proto.Connect) (proto.ReturnCode, string) {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		m.ProtocolName, m.KeepAliveTimer = "MQTT", 60
+		if m.ProtocolVersion != protocol5 {
+			m.Encode(conn)
+			ack, err := proto.DecodeOneMessage(conn, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ack.(*proto.ConnAck).ReturnCode, ""
+		}
+		encodeV5(conn, m, nil)
+		br := bufio.NewReader(conn)
+		n, hlen, err := peekHeader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, hlen+n)
+		io.ReadFull(br, frame)
+		ack, x, err := decodeV5FromServer(frame, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := x.props.str(propAssignedClientId)
+		return ack.(*proto.ConnAck).ReturnCode, id
+	}
+
+	if rc, _ := connect(&proto.Connect{ProtocolVersion: protocol311, CleanSession: true}); rc != proto.RetCodeAccepted {
+		t.Errorf("3.1.1 with a clean session: %v", rc)
+	}
+	if rc, _ := connect(&proto.Connect{ProtocolVersion: protocol311}); rc != proto.RetCodeIdentifierRejected {
+		t.Errorf("3.1.1 without a clean session: %v", rc)
+	}
+	_, id1 := connect(&proto.Connect{ProtocolVersion: protocol5})
+	_, id2 := connect(&proto.Connect{ProtocolVersion: protocol5})
+	if !strings.HasPrefix(id1, "auto-") || id1 == id2 {
+		t.Errorf("assigned ids %q and %q", id1, id2)
+	}
+
+	svr.RejectEmptyClientId = true
+	if rc, _ := connect(&proto.Connect{ProtocolVersion: protocol5}); rc != proto.RetCodeIdentifierRejected {
+		t.Errorf("RejectEmptyClientId: %v", rc)
+	}
+}
+
+func TestRegistryPerServer(t *testing.T) {
+	s1, s2 := &Server{}, &Server{}
+	c1, c2 := newTestConn(s1, "same"), newTestConn(s2, "same")
+	if c1.add() != nil || c2.add() != nil {
+		t.Fatal("the servers share their client ids")
+	}
+	if conns := s1.conns(); len(conns) != 1 || conns[0] != c1 {
+		t.Errorf("s1 has %v", conns)
+	}
+	c1.del()
+	if s2.clients.get("same") != c2 {
+		t.Error("deleting from s1 deleted from s2")
+	}
+	c2.del()
+}
+
+func TestSlowConsumer(t *testing.T) {
+	s := &Server{SlowConsumer: DropOldest}
+	c := newTestConn(s, "slow")
+	c.jobs = make(chan job, 1)
+	c.submit(&proto.Publish{TopicName: "old"})
+	if !c.submitWith(&proto.Publish{TopicName: "new"}, nil) {
+		t.Fatal("drop oldest did not queue the new message")
+	}
+	if m := (<-c.jobs).m.(*proto.Publish); m.TopicName != "new" || c.dropped != 1 {
+		t.Errorf("got %v, %v dropped", m.TopicName, c.dropped)
+	}
+
+	s.SlowConsumer = DisconnectSlow
+	c.submit(&proto.Publish{TopicName: "a"})
+	c.submit(&proto.Publish{TopicName: "b"})
+	select {
+	case <-c.Done:
+	case <-time.After(time.Second):
+		t.Error("slow client not disconnected")
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	o := newServerOptions([]ServerOption{WithWorkers(3), WithSendQueue(5), WithPostQueue(0)})
+	if o.workers != 3 || o.sendQueue != 5 || o.postQueue != postQueue {
+		t.Errorf("got %+v", o)
+	}
+	s := &Server{sendQueue: o.sendQueue}
+	if c := s.newIncomingConn(nil); cap(c.jobs) != 5 {
+		t.Errorf("send queue of %v", cap(c.jobs))
+	}
+}
+
+func TestEachClientUnlocked(t *testing.T) {
+	s := &Server{}
+	newTestConn(s, "a").add()
+	s.EachClient(func(ClientInfo) bool {
+		// A client connecting during the walk is not held up.
+		done := make(chan bool)
+		go func() { done <- newTestConn(s, "b").add() == nil }()
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Error("b not added")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("add blocked by EachClient")
+		}
+		return true
+	})
+	if n := len(s.conns()); n != 2 {
+		t.Errorf("%v clients, want 2", n)
+	}
+}
+
+func TestClientStatsTopics(t *testing.T) {
+	s := &Server{stats: &stats{}, subs: newSubscriptions(1)}
+	s.ClientStatsACL = func(subscriber, id string) bool { return true }
+	sub := newTestConn(s, "sub")
+	sub.add()
+	newTestConn(s, "a/b+#%").add()
+	s.subs.add("$SYS/broker/clients/+/queue", sub, proto.QosAtMostOnce)
+
+	s.publishClientStats()
+	s.subs.flush()
+	got := map[string]bool{}
+	for len(sub.jobs) > 0 {
+		j := <-sub.jobs
+		got[j.m.(*proto.Publish).TopicName] = true
+	}
+	for _, topic := range []string{"$SYS/broker/clients/sub/queue", "$SYS/broker/clients/a%2Fb%2B%23%25/queue"} {
+		if !got[topic] {
+			t.Errorf("no %v in %v", topic, got)
+		}
+	}
+}
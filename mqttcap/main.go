@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	proto "github.com/huin/mqtt"
+	"github.com/jeffallen/mqtt"
+)
+
+var conn = flag.Uint64("conn", 0, "only show frames for this connection id (0 means all)")
+var hex = flag.Bool("hex", false, "dump the raw bytes of each frame?")
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: mqttcap file")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	cr, err := mqtt.NewCaptureReader(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read:", err)
+		os.Exit(1)
+	}
+
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "read:", err)
+			os.Exit(1)
+		}
+		if *conn != 0 && rec.Conn != *conn {
+			continue
+		}
+
+		dir := " in"
+		if rec.Dir == mqtt.CaptureOut {
+			dir = "out"
+		}
+		m, err := proto.DecodeOneMessage(bytes.NewReader(rec.Frame), nil)
+		if err != nil {
+			fmt.Printf("%v conn %v %v: undecodable (%v)\n", rec.Time.Format(time.RFC3339Nano), rec.Conn, dir, err)
+		} else {
+			fmt.Printf("%v conn %v %v: %T %+v\n", rec.Time.Format(time.RFC3339Nano), rec.Conn, dir, m, m)
+		}
+		if *hex {
+			fmt.Printf("% x\n", rec.Frame)
+		}
+	}
+}
@@ -1,24 +1,257 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
+	proto "github.com/huin/mqtt"
 	"github.com/jeffallen/mqtt"
 )
 
-var addr = flag.String("addr", "localhost:1883", "listen address of broker")
+var addr = flag.String("addr", "localhost:1883", "listen address of broker, or a URL such as unix:///run/mqtt.sock")
+var network = flag.String("net", "tcp", "tcp4 or tcp6 to listen on IPv4 or IPv6 only, for -addr and -tlsaddr; tcp is both")
+var capture = flag.String("capture", "", "record the raw frames in and out to this file")
+var seed = flag.String("retain", "", "file of retained messages to start with")
+var showVersion = flag.Bool("version", false, "print the version and exit")
+var workers = flag.Int("workers", 0, "number of subscription workers (default GOMAXPROCS)")
+var sendQueue = flag.Int("sendq", 0, "number of messages that may wait for each client (default 10000)")
+var passwd = flag.String("passwd", "", "mosquitto password file; anyone may connect when empty")
+var aclFile = flag.String("acl", "", "mosquitto ACL file; anything is allowed when empty")
+var tlsAddr = flag.String("tlsaddr", "", "listen address for TLS; off when empty")
+var cert = flag.String("cert", "server.crt", "TLS certificate file, for -tlsaddr")
+var key = flag.String("key", "server.key", "TLS key file, for -tlsaddr")
+var wsAddr = flag.String("wsaddr", "", "listen address for MQTT over WebSocket, at /mqtt; off when empty")
+var caFile = flag.String("cafile", "", "CA certificates of the clients, for -tlsaddr; when set, TLS clients log in with their certificates")
 
 func main() {
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(mqtt.Version())
+		return
+	}
+	log.Print("mqttsrv ", mqtt.Version())
 
-	l, err := net.Listen("tcp", *addr)
+	l, err := listen(*addr)
 	if err != nil {
 		log.Print("listen: ", err)
 		return
 	}
-	svr := mqtt.NewServer(l)
+	svr := mqtt.NewServer(l, mqtt.WithWorkers(*workers), mqtt.WithSendQueue(*sendQueue))
+
+	if *seed != "" {
+		n, bad, err := seedRetained(svr, *seed)
+		if err != nil {
+			log.Print("retain: ", err)
+			return
+		}
+		log.Printf("retain: %v retained messages loaded, %v bad entries skipped", n, bad)
+	}
+
+	if err := loadAuth(svr); err != nil {
+		log.Print(err)
+		return
+	}
+
+	if *tlsAddr != "" {
+		if err := listenTLS(svr); err != nil {
+			log.Print("tls: ", err)
+			return
+		}
+	}
+
+	if *wsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/mqtt", svr.WebSocketHandler())
+		go func() {
+			log.Print("websocket: ", http.ListenAndServe(*wsAddr, mux))
+		}()
+	}
+
+	if *capture != "" {
+		f, err := os.Create(*capture)
+		if err != nil {
+			log.Print("capture: ", err)
+			return
+		}
+		defer f.Close()
+		svr.Capture = mqtt.NewCapture(f)
+		defer svr.Capture.Flush()
+
+		// Make sure the capture is flushed when we are interrupted.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			l.Close()
+		}()
+	}
+
 	svr.Start()
 	<-svr.Done
 }
+
+// listen listens on addr, which is a host and port, or a URL for
+// mqtt.ParseURL.
+func listen(addr string) (net.Listener, error) {
+	if !strings.Contains(addr, "://") {
+		return net.Listen(*network, addr)
+	}
+	t, a, err := mqtt.ParseURL(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(a)
+}
+
+// listenTLS adds the TLS listener. With -cafile, the clients on it
+// must present a certificate signed by one of those authorities, and
+// are authenticated by it; the clients of -addr are refused, unless
+// -passwd lets them in.
+func listenTLS(svr *mqtt.Server) error {
+	c, err := tls.LoadX509KeyPair(*cert, *key)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{c}}
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %v", *caFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+		certAuth := &mqtt.CertAuth{}
+		passwords := svr.Authenticate
+		svr.Authenticate = func(conn net.Conn, m *proto.Connect) bool {
+			if _, ok := conn.(*tls.Conn); ok {
+				return certAuth.Authenticate(conn, m)
+			}
+			return passwords != nil && passwords(conn, m)
+		}
+	}
+	_, err = svr.AddTransportListener(mqtt.TLSTransport{Network: *network, Config: cfg}, *tlsAddr)
+	return err
+}
+
+// loadAuth sets up the password and ACL files, if any, and reloads
+// them on SIGHUP.
+func loadAuth(svr *mqtt.Server) error {
+	var p *mqtt.PasswordFile
+	var a *mqtt.ACLFile
+	var err error
+	if *passwd != "" {
+		if p, err = mqtt.LoadPasswordFile(*passwd); err != nil {
+			return err
+		}
+		svr.Authenticate = p.Authenticate
+	}
+	if *aclFile != "" {
+		if a, err = mqtt.LoadACLFile(*aclFile); err != nil {
+			return err
+		}
+		svr.Authorize = a.Authorize
+	}
+	if p == nil && a == nil {
+		return nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if p != nil {
+				if err := p.Reload(); err != nil {
+					log.Print("reload: ", err)
+				}
+				svr.InvalidateAuth("")
+			}
+			if a != nil {
+				if err := a.Reload(); err != nil {
+					log.Print("reload: ", err)
+				}
+				svr.InvalidateAuthorization("")
+			}
+			log.Print("reloaded the password and ACL files")
+		}
+	}()
+	return nil
+}
+
+// seedRetained reads a file with one retained message per line, in
+// the form:
+//
+//	topic payload-file [qos]
+//
+// Blank lines and lines starting with # are ignored. A bad line, or
+// one whose payload file is missing (after a crash, for instance),
+// is logged and skipped, so that the broker still starts with the rest.
+// It returns the number of messages loaded and of lines skipped.
+func seedRetained(svr *mqtt.Server, file string) (loaded, skipped int, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m, err := seedLine(line)
+		if err != nil {
+			log.Printf("retain: %v:%v: %v, skipping", file, n, err)
+			skipped++
+			continue
+		}
+		svr.SetRetained("", m)
+		loaded++
+	}
+	return loaded, skipped, s.Err()
+}
+
+// seedLine parses one line of a seed file and reads its payload.
+func seedLine(line string) (*proto.Publish, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, errors.New("expected topic, payload file and optional qos")
+	}
+	if strings.ContainsAny(fields[0], "+#") {
+		return nil, fmt.Errorf("wildcard in topic %q", fields[0])
+	}
+	qos := 0
+	if len(fields) == 3 {
+		var err error
+		qos, err = strconv.Atoi(fields[2])
+		if err != nil || !proto.QosLevel(qos).IsValid() {
+			return nil, fmt.Errorf("bad qos %q", fields[2])
+		}
+	}
+	payload, err := ioutil.ReadFile(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	return &proto.Publish{
+		Header:    proto.Header{QosLevel: proto.QosLevel(qos), Retain: true},
+		TopicName: fields[0],
+		Payload:   proto.BytesPayload(payload),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package mqtt
+
+import (
+	"runtime"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A ServerOption tunes a Server made by NewServer, trading memory for
+// throughput.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	workers   int
+	postQueue int
+	sendQueue int
+}
+
+// WithWorkers sets the number of goroutines that match published
+// messages against the subscriptions. It defaults to GOMAXPROCS.
+// For all the options, zero means the default.
+func WithWorkers(n int) ServerOption {
+	return func(o *serverOptions) { o.workers = n }
+}
+
+// WithPostQueue sets how many published messages may wait for each
+// worker. It defaults to 100.
+func WithPostQueue(n int) ServerOption {
+	return func(o *serverOptions) { o.postQueue = n }
+}
+
+// WithSendQueue sets how many messages may wait to be sent to each
+// client before Server.SlowConsumer applies. It defaults to 10000.
+func WithSendQueue(n int) ServerOption {
+	return func(o *serverOptions) { o.sendQueue = n }
+}
+
+func newServerOptions(opts []ServerOption) serverOptions {
+	o := serverOptions{
+		workers:   runtime.GOMAXPROCS(0),
+		postQueue: postQueue,
+		sendQueue: sendingQueueLength,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.workers < 1 {
+		o.workers = runtime.GOMAXPROCS(0)
+	}
+	if o.postQueue < 1 {
+		o.postQueue = postQueue
+	}
+	if o.sendQueue < 1 {
+		o.sendQueue = sendingQueueLength
+	}
+	return o
+}
+
+// sendQueueLength is the length of the send queue of each client.
+func (s *Server) sendQueueLength() int {
+	if s.sendQueue > 0 {
+		return s.sendQueue
+	}
+	return sendingQueueLength
+}
+
+// A ClientOption tunes a ClientConn made by NewClientConn.
+type ClientOption func(*ClientConn)
+
+// WithClientQueue sets the length of the queue of messages to send,
+// and of Incoming. It defaults to 100.
+func WithClientQueue(n int) ClientOption {
+	return func(c *ClientConn) {
+		if n > 0 {
+			c.out = make(chan job, n)
+			c.Incoming = make(chan *proto.Publish, n)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// A DeliveryOrder says which messages are sure to reach each subscriber
+// in the order they were published.
+type DeliveryOrder int32
+
+const (
+	// DeliveryBestEffort hands each message to whichever worker is
+	// free, so messages may overtake each other. It makes the most of
+	// the workers.
+	DeliveryBestEffort DeliveryOrder = iota
+
+	// DeliveryPerPublisher keeps the messages of each client in the
+	// order it published them, whatever their topics.
+	DeliveryPerPublisher
+
+	// DeliveryPerTopic keeps the messages on each topic in the order
+	// they arrived, whoever published them. This is the default of
+	// NewServer.
+	DeliveryPerTopic
+)
+
+func (o DeliveryOrder) String() string {
+	switch o {
+	case DeliveryBestEffort:
+		return "best-effort"
+	case DeliveryPerPublisher:
+		return "per-publisher"
+	case DeliveryPerTopic:
+		return "per-topic"
+	}
+	return "invalid"
+}
+
+// setOrder changes how posts are spread over the workers.
+func (s *subscriptions) setOrder(o DeliveryOrder) {
+	atomic.StoreInt32(&s.order, int32(o))
+}
+
+// queue hands a post to the workers. The ordered modes always give
+// posts with the same key to the same worker, which handles them one
+// after the other.
+func (s *subscriptions) queue(p post) {
+	p.queued = time.Now()
+	holdPayload(p.m)
+	if len(s.shards) == 0 {
+		s.posts <- p
+		return
+	}
+	h := fnv.New32a()
+	switch DeliveryOrder(atomic.LoadInt32(&s.order)) {
+	case DeliveryPerPublisher:
+		if p.c != nil {
+			h.Write([]byte(p.c.tenant))
+			h.Write([]byte{0})
+			h.Write([]byte(p.c.clientid))
+		}
+	case DeliveryPerTopic:
+		h.Write([]byte(p.tenant))
+		h.Write([]byte{0})
+		h.Write([]byte(p.m.TopicName))
+	default:
+		s.posts <- p
+		return
+	}
+	s.shards[h.Sum32()%uint32(len(s.shards))] <- p
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"fmt"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+// deliver publishes n messages from each publisher on each topic, and
+// returns the payloads received by a subscriber to everything, which
+// are "publisher topic seq".
+func deliver(order DeliveryOrder, n int) []string {
+	s := &Server{}
+	subs := newSubscriptions(4)
+	subs.setOrder(order)
+	sub := newTestConn(s, "sub")
+	subs.add("#", sub, proto.QosAtMostOnce)
+
+	pubs := []*incomingConn{newTestConn(s, "p0"), newTestConn(s, "p1")}
+	topics := []string{"a", "b", "c"}
+	for i := 0; i < n; i++ {
+		for _, p := range pubs {
+			for _, topic := range topics {
+				subs.submit(p, &proto.Publish{
+					Header:    header(dupFalse, proto.QosAtMostOnce, retainFalse),
+					TopicName: topic,
+					Payload:   proto.BytesPayload(fmt.Sprintf("%v %v %v", p.clientid, topic, i)),
+				})
+			}
+		}
+	}
+
+	res := make([]string, 0, n*len(pubs)*len(topics))
+	for len(res) < cap(res) {
+		j := <-sub.jobs
+		res = append(res, string(j.m.(*proto.Publish).Payload.(proto.BytesPayload)))
+	}
+	return res
+}
+
+// inOrder checks that the messages with the same key arrived in the
+// order they were sent.
+func inOrder(t *testing.T, got []string, key func(pub, topic string) string) {
+	last := make(map[string]int)
+	for _, s := range got {
+		var pub, topic string
+		var i int
+		fmt.Sscan(s, &pub, &topic, &i)
+		k := key(pub, topic)
+		if l, ok := last[k]; ok && i < l {
+			t.Errorf("%q arrived after %v", s, l)
+		}
+		last[k] = i
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	const n = 200
+
+	got := deliver(DeliveryBestEffort, n)
+	if len(got) != n*6 {
+		t.Errorf("best-effort: got %v messages", len(got))
+	}
+
+	got = deliver(DeliveryPerPublisher, n)
+	inOrder(t, got, func(pub, topic string) string { return pub })
+
+	got = deliver(DeliveryPerTopic, n)
+	inOrder(t, got, func(pub, topic string) string { return topic })
+}
@@ -0,0 +1,352 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A PasswordFile checks the credentials of clients against a password
+// file in the format of mosquitto_passwd: one "user:hash" per line.
+// Lines starting with # are comments. The hashes it knows are the ones
+// mosquitto makes, "$6$" (salted SHA-512) and "$7$" (PBKDF2-SHA512);
+// others, like bcrypt, can be added with Hashes. Its Authenticate
+// method is made for Server.Authenticate.
+type PasswordFile struct {
+	// Hashes checks the passwords hashed with other schemes, by the
+	// prefix of the hash, for instance "$2y$" for bcrypt.
+	Hashes map[string]func(hash, password string) bool
+
+	path  string
+	mu    sync.RWMutex // guards users
+	users map[string]string
+}
+
+// LoadPasswordFile reads a password file. Call Reload on the result
+// to read it again when it changes.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	p := &PasswordFile{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the file again. If it cannot be read, the users are
+// left as they were. The server caches successful authentications for
+// AuthCacheTTL, so call Server.InvalidateAuth too.
+func (p *PasswordFile) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := readPasswords(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", p.path, err)
+	}
+	p.mu.Lock()
+	p.users = users
+	p.mu.Unlock()
+	return nil
+}
+
+func readPasswords(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("line %v: want user:hash", n)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, s.Err()
+}
+
+// Authenticate reports whether the user and password of m are in the
+// file.
+func (p *PasswordFile) Authenticate(conn net.Conn, m *proto.Connect) bool {
+	p.mu.RLock()
+	h, ok := p.users[m.Username]
+	p.mu.RUnlock()
+	if !ok || !m.UsernameFlag || !m.PasswordFlag {
+		return false
+	}
+	for prefix, check := range p.Hashes {
+		if strings.HasPrefix(h, prefix) {
+			return check(h, m.Password)
+		}
+	}
+	ok, err := checkMosquittoHash(h, m.Password)
+	if err != nil {
+		log.Printf("password file: user %v: %v", m.Username, err)
+	}
+	return ok
+}
+
+var errBadHash = errors.New("unknown password hash")
+
+// checkMosquittoHash checks password against a hash made by
+// mosquitto_passwd, which is "$6$salt$hash" for SHA-512 of the password
+// followed by the salt, or "$7$iterations$salt$hash" for PBKDF2 with
+// HMAC-SHA512. Salts and hashes are in base64.
+func checkMosquittoHash(h, password string) (bool, error) {
+	parts := strings.Split(h, "$")
+	var salt, want []byte
+	var err error
+	switch {
+	case len(parts) == 4 && parts[1] == "6":
+		if salt, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+			return false, errBadHash
+		}
+		if want, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+			return false, errBadHash
+		}
+		sum := sha512.Sum512(append([]byte(password), salt...))
+		return subtle.ConstantTimeCompare(sum[:], want) == 1, nil
+	case len(parts) == 5 && parts[1] == "7":
+		iter, err := strconv.Atoi(parts[2])
+		if err != nil || iter < 1 {
+			return false, errBadHash
+		}
+		if salt, err = base64.StdEncoding.DecodeString(parts[3]); err != nil {
+			return false, errBadHash
+		}
+		if want, err = base64.StdEncoding.DecodeString(parts[4]); err != nil {
+			return false, errBadHash
+		}
+		got := pbkdf2([]byte(password), salt, iter, len(want), sha512.New)
+		return subtle.ConstantTimeCompare(got, want) == 1, nil
+	}
+	return false, errBadHash
+}
+
+// pbkdf2 derives a key as in RFC 8018, section 5.2.
+func pbkdf2(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	n := prf.Size()
+	var key []byte
+	for block := 1; len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := 0; j < n; j++ {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// An ACLFile decides what clients may publish and subscribe to, from
+// a file in the format of the acl_file of mosquitto:
+//
+//	# comment
+//	topic read $SYS/#
+//	user alice
+//	topic readwrite sensors/#
+//	pattern write devices/%c/state
+//
+// "topic [read|write|readwrite|deny] filter" lines apply to the user
+// named by the "user" line above them, or, before any, to clients that
+// did not give a user name. "pattern" lines apply to everyone, with %u
+// replaced by the user name and %c by the client id. The access is
+// readwrite when left out. Reading is subscribing, and writing is
+// publishing; deny wins over the rest.
+type ACLFile struct {
+	path string
+	mu   sync.RWMutex // guards acl
+	acl  acl
+}
+
+type aclRule struct {
+	access string // read, write, readwrite or deny
+	filter string
+}
+
+type acl struct {
+	anon     []aclRule
+	users    map[string][]aclRule
+	patterns []aclRule
+}
+
+// LoadACLFile reads an ACL file. Call Reload on the result to read it
+// again when it changes.
+func LoadACLFile(path string) (*ACLFile, error) {
+	a := &ACLFile{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the file again. If it cannot be read, the rules are
+// left as they were. The server caches the decisions for
+// AuthorizeCacheTTL, and keeps the subscriptions made under the old
+// rules, so call Server.InvalidateAuthorization too.
+func (a *ACLFile) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	acl, err := readACL(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", a.path, err)
+	}
+	a.mu.Lock()
+	a.acl = acl
+	a.mu.Unlock()
+	return nil
+}
+
+func readACL(r io.Reader) (acl, error) {
+	res := acl{users: make(map[string][]aclRule)}
+	user, anon := "", true
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if f[0] == "user" {
+			if len(f) != 2 {
+				return acl{}, fmt.Errorf("line %v: want user name", n)
+			}
+			user, anon = f[1], false
+			continue
+		}
+		if f[0] != "topic" && f[0] != "pattern" {
+			return acl{}, fmt.Errorf("line %v: unknown keyword %v", n, f[0])
+		}
+		rule := aclRule{access: "readwrite"}
+		switch len(f) {
+		case 2:
+			rule.filter = f[1]
+		case 3:
+			rule.access, rule.filter = f[1], f[2]
+		default:
+			return acl{}, fmt.Errorf("line %v: want %v [access] filter", n, f[0])
+		}
+		switch rule.access {
+		case "read", "write", "readwrite", "deny":
+		default:
+			return acl{}, fmt.Errorf("line %v: unknown access %v", n, rule.access)
+		}
+		if !newWild(rule.filter, nil).valid() {
+			return acl{}, fmt.Errorf("line %v: invalid filter %v", n, rule.filter)
+		}
+		switch {
+		case f[0] == "pattern":
+			res.patterns = append(res.patterns, rule)
+		case anon:
+			res.anon = append(res.anon, rule)
+		default:
+			res.users[user] = append(res.users[user], rule)
+		}
+	}
+	return res, s.Err()
+}
+
+// Allowed reports whether a client connected as user may publish to
+// topic, when subscribe is false, or subscribe to the filter topic.
+func (a *ACLFile) Allowed(user, clientid, topic string, subscribe bool) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	rules := a.acl.anon
+	if user != "" {
+		rules = a.acl.users[user]
+	}
+	allowed := false
+	check := func(r aclRule, filter string) bool {
+		if !aclCovers(filter, topic, subscribe) {
+			return true
+		}
+		switch r.access {
+		case "deny":
+			return false
+		case "readwrite":
+			allowed = true
+		case "read":
+			allowed = allowed || subscribe
+		case "write":
+			allowed = allowed || !subscribe
+		}
+		return true
+	}
+	for _, r := range rules {
+		if !check(r, r.filter) {
+			return false
+		}
+	}
+	subst := strings.NewReplacer("%u", user, "%c", clientid)
+	for _, r := range a.acl.patterns {
+		if !check(r, subst.Replace(r.filter)) {
+			return false
+		}
+	}
+	return allowed
+}
+
+// aclCovers reports whether the filter of a rule covers topic, or,
+// for a subscription, every topic that the filter topic matches.
+func aclCovers(filter, topic string, subscribe bool) bool {
+	w := newWild(filter, nil)
+	if !w.valid() {
+		return false
+	}
+	if !subscribe {
+		return !isWildcard(topic) && w.matches(strings.Split(topic, "/"))
+	}
+	fl, tl := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		switch {
+		case tl[i] == "#":
+			return false
+		case f == "+":
+		case f != tl[i]:
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// Authorize can be used as Server.Authorize. It checks the rules for
+// the user name the client connected with; the file has no notion of
+// tenants.
+func (a *ACLFile) Authorize(tenant, username, clientid, topic string, subscribe bool) bool {
+	return a.Allowed(username, clientid, topic, subscribe)
+}
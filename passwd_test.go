@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestPasswordFile(t *testing.T) {
+	users, err := readPasswords(strings.NewReader(`# made by mosquitto_passwd
+sha:$6$MDEyMzQ1Njc4OWFiY2RlZg==$veVOCoSwGP72Xht1aILusDwsSUHyefI11yC6xJHBHZsnVJg6s2+oRchFr/YJLsRuAM0iTVMjwQpm2iqyxIn43A==
+pbkdf2:$7$101$MDEyMzQ1Njc4OWFiY2RlZg==$2T94EAX9Zumcm3NnUOBTGy/wopIXrvb9AsLmMjuW9Sj2vaWLgiwUGbm/EFczvljKs7jaQ/rKaQZTdYHuN2IdxQ==
+other:$x$secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PasswordFile{
+		users: users,
+		Hashes: map[string]func(hash, password string) bool{
+			"$x$": func(hash, password string) bool { return hash == "$x$"+password },
+		},
+	}
+	for _, x := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"sha", "secret", true},
+		{"sha", "wrong", false},
+		{"pbkdf2", "secret", true},
+		{"pbkdf2", "wrong", false},
+		{"other", "secret", true},
+		{"nobody", "secret", false},
+	} {
+		m := &proto.Connect{Username: x.user, Password: x.pass, UsernameFlag: true, PasswordFlag: true}
+		if got := p.Authenticate(nil, m); got != x.want {
+			t.Errorf("%v/%v: got %v", x.user, x.pass, got)
+		}
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	acl, err := readACL(strings.NewReader(`topic read public/#
+user alice
+topic readwrite sensors/#
+topic deny sensors/secret
+topic write cmd/+
+pattern read devices/%c/#
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &ACLFile{acl: acl}
+	for _, x := range []struct {
+		user, topic string
+		subscribe   bool
+		want        bool
+	}{
+		{"", "public/news", true, true},
+		{"", "public/news", false, false},
+		{"alice", "public/news", true, false},
+		{"alice", "sensors/1/temp", false, true},
+		{"alice", "sensors/+/temp", true, true},
+		{"alice", "sensors/secret", false, false},
+		{"alice", "cmd/reboot", false, true},
+		{"alice", "cmd/reboot", true, false},
+		{"alice", "cmd/#", true, false},
+		{"alice", "devices/c1/state", true, true},
+		{"alice", "devices/c2/state", true, false},
+		{"bob", "devices/c1/#", true, true},
+	} {
+		if got := a.Allowed(x.user, "c1", x.topic, x.subscribe); got != x.want {
+			t.Errorf("%v %v (subscribe %v): got %v", x.user, x.topic, x.subscribe, got)
+		}
+	}
+
+	if _, err := readACL(strings.NewReader("topic maybe a/b\n")); err == nil {
+		t.Error("unknown access accepted")
+	}
+}
+
+// Clients of different tenants can have the same id; each gets the
+// rights of its own user name.
+func TestACLFileTenants(t *testing.T) {
+	acl, err := readACL(strings.NewReader("user alice\ntopic readwrite admin/#\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Authorize: (&ACLFile{acl: acl}).Authorize}
+	connect := func(user string) *incomingConn {
+		c := newTestConn(s, "dev1")
+		c.username, c.tenant = user, user
+		c.add()
+		return c
+	}
+	alice := connect("alice")
+	defer alice.del()
+	mallory := connect("mallory")
+	defer mallory.del()
+
+	if !s.authorize(alice, "admin/x", false) {
+		t.Error("alice refused")
+	}
+	if s.authorize(mallory, "admin/x", false) {
+		t.Error("mallory got the rights of alice")
+	}
+}
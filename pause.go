@@ -0,0 +1,53 @@
+package mqtt
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// ErrNoClient is returned for a client id that is not connected.
+var ErrNoClient = errors.New("no such client")
+
+// PauseDelivery stops sending messages to a client, without
+// disconnecting it, for instance during a firmware update. The messages
+// are held for it, up to the length of its send queue, and the rest are
+// dropped. Acknowledgements and the like are still sent, so that the
+// client stays connected. tenant is the tenant of the client, see
+// Server.Tenant, or "" when there are none.
+func (s *Server) PauseDelivery(tenant, clientid string) error {
+	c := s.client(tenant, clientid)
+	if c == nil {
+		return ErrNoClient
+	}
+	if atomic.CompareAndSwapInt32(&c.paused, 0, 1) {
+		log.Print(c, ": delivery paused")
+		s.record(EventAdmin, c, "PauseDelivery")
+	}
+	return nil
+}
+
+// ResumeDelivery sends a client the messages held for it since
+// PauseDelivery, and those that come after.
+func (s *Server) ResumeDelivery(tenant, clientid string) error {
+	c := s.client(tenant, clientid)
+	if c == nil {
+		return ErrNoClient
+	}
+	if atomic.CompareAndSwapInt32(&c.paused, 1, 0) {
+		log.Print(c, ": delivery resumed")
+		s.record(EventAdmin, c, "ResumeDelivery")
+		c.wakeWriter()
+	}
+	return nil
+}
+
+func (c *incomingConn) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) != 0
+}
+
+// client returns the connection of the client of tenant with
+// clientid, or nil.
+func (s *Server) client(tenant, clientid string) *incomingConn {
+	return s.clients.get(registryKey(tenant, clientid))
+}
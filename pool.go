@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	proto "github.com/huin/mqtt"
+)
+
+// payloadPool holds the buffers that ClientConn and the server read
+// messages into when their PooledPayloads is set.
+var payloadPool sync.Pool
+
+// getBuf returns a buffer of n bytes from the pool.
+func getBuf(n int) *[]byte {
+	if p, ok := payloadPool.Get().(*[]byte); ok && cap(*p) >= n {
+		*p = (*p)[:n]
+		return p
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+// A pooledPayload is the payload of a PUBLISH read into a buffer from
+// payloadPool. On a ClientConn, the buffer goes back to the pool when
+// the Message made from it is released. On the server, the payload is
+// shared by the reader, the post for the workers, and each job queued
+// for a writer; refs counts them, and the last one to let go gives the
+// buffer back.
+type pooledPayload struct {
+	b    []byte
+	buf  *[]byte
+	refs int32
+}
+
+var errPooledPayload = errors.New("pooled payloads cannot be read into")
+
+func (p *pooledPayload) Size() int                      { return len(p.b) }
+func (p *pooledPayload) WritePayload(w io.Writer) error { _, err := w.Write(p.b); return err }
+func (p *pooledPayload) ReadPayload(r io.Reader) error  { return errPooledPayload }
+
+// holdPayload counts one more holder of the payload of m, if it is
+// pooled.
+func holdPayload(m *proto.Publish) {
+	if m == nil {
+		return
+	}
+	if p, ok := m.Payload.(*pooledPayload); ok {
+		atomic.AddInt32(&p.refs, 1)
+	}
+}
+
+// releasePayload is called by a holder of the payload of m that is done
+// with it. The last one gives the buffer back to the pool.
+func releasePayload(m *proto.Publish) {
+	if m == nil {
+		return
+	}
+	if p, ok := m.Payload.(*pooledPayload); ok && atomic.AddInt32(&p.refs, -1) == 0 {
+		payloadPool.Put(p.buf)
+	}
+}
+
+// unpooled returns m, or, if its payload is pooled, a copy of m with a
+// payload of its own, for keeping after the subscribers have written
+// it: retained, in flight, or queued for later.
+func unpooled(m *proto.Publish) *proto.Publish {
+	p, ok := m.Payload.(*pooledPayload)
+	if !ok {
+		return m
+	}
+	cp := *m
+	cp.Payload = proto.BytesPayload(append([]byte(nil), p.b...))
+	return &cp
+}
+
+// readPooledFrame is readFrame, into a buffer from the pool.
+func readPooledFrame(br *bufio.Reader) ([]byte, *[]byte, error) {
+	n, hlen, err := peekHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := getBuf(hlen + n)
+	if _, err := io.ReadFull(br, *buf); err != nil {
+		payloadPool.Put(buf)
+		return nil, nil, err
+	}
+	return *buf, buf, nil
+}
+
+// pooledPublish decodes the MQTT 3.1 PUBLISH in frame, leaving the
+// payload in buf, which frame is in. The caller holds the payload.
+func pooledPublish(frame []byte, buf *[]byte) (*proto.Publish, error) {
+	flags := frame[0] & 0x0f
+	m := &proto.Publish{Header: proto.Header{
+		DupFlag:  flags&0x08 != 0,
+		QosLevel: proto.QosLevel(flags >> 1 & 0x03),
+		Retain:   flags&0x01 != 0,
+	}}
+	r := &v5reader{b: frame[1:]}
+	r.varint() // the remaining length, which frame was read with
+	m.TopicName = r.string()
+	if m.Header.QosLevel.HasId() {
+		m.MessageId = r.uint16()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	m.Payload = &pooledPayload{b: r.b, buf: buf, refs: 1}
+	return m, nil
+}
+
+// readPooled reads the next message into a buffer from the pool. The
+// payload of a PUBLISH is left in the buffer, rather than copied; the
+// buffers of other messages go back to the pool at once.
+func readPooled(br *bufio.Reader) (proto.Message, error) {
+	frame, buf, err := readPooledFrame(br)
+	if err != nil {
+		return nil, err
+	}
+	if frame[0]>>4 != 3 {
+		m, err := proto.DecodeOneMessage(bytes.NewReader(frame), nil)
+		payloadPool.Put(buf)
+		return m, err
+	}
+	m, err := pooledPublish(frame, buf)
+	if err != nil {
+		payloadPool.Put(buf)
+		return nil, err
+	}
+	return m, nil
+}
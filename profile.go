@@ -0,0 +1,7 @@
+//go:build !mqttlite
+// +build !mqttlite
+
+package mqtt
+
+// liteProfile is true in the mqttlite build. See BuildProfile.
+const liteProfile = false
@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func benchPublish(b *testing.B, async bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	NewServer(l).Start()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	cc, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cc.Disconnect()
+
+	payload := proto.BytesPayload(make([]byte, 100))
+	tokens := make([]*PublishToken, 0, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := &proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			TopicName: "bench",
+			Payload:   payload,
+		}
+		if async {
+			tokens = append(tokens, cc.PublishAsync(m))
+		} else {
+			cc.Publish(m)
+		}
+	}
+	for _, t := range tokens {
+		if err := t.Wait(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishQos1(b *testing.B)      { benchPublish(b, false) }
+func BenchmarkPublishQos1Async(b *testing.B) { benchPublish(b, true) }
+
+// BenchmarkReconnect is a storm of clients connecting at once, each
+// op being one connection up to its CONNACK. Run it with
+// -benchtime 10000x for a 10k-reconnect storm.
+func BenchmarkReconnect(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	NewServer(l).Start()
+
+	var connect bytes.Buffer
+	m := &proto.Connect{ProtocolName: "MQTT", ProtocolVersion: 4, CleanSession: true, KeepAliveTimer: 60}
+	if err := m.Encode(&connect); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ack := make([]byte, 4)
+		for pb.Next() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			c.Write(connect.Bytes())
+			if _, err := io.ReadFull(c, ack); err != nil || ack[3] != 0 {
+				b.Error("no CONNACK: ", err)
+			}
+			c.Close()
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package mqtt
+
+import proto "github.com/huin/mqtt"
+
+// A QosPolicy says which QoS levels the server deals in, for
+// deployments that want to keep the protocol simple. The zero value is
+// what the spec says: all three levels are granted, and messages are
+// delivered at the QoS they were published with, or at the QoS granted
+// to the subscription if that is lower.
+type QosPolicy struct {
+	// NoQos2 turns QoS 2 off. Subscriptions asking for it are granted
+	// QoS 1, and MQTT 5 clients are told in the CONNACK that QoS 2 is
+	// not available; those that publish with it anyway are
+	// disconnected. MQTT 3 clients cannot be told, so their QoS 2
+	// messages are still accepted, and delivered at QoS 1 at most.
+	NoQos2 bool
+
+	// Upgrade makes messages go out at the QoS granted to the
+	// subscription, even when they were published at a lower one.
+	Upgrade bool
+
+	// Grant, when non-nil, decides the QoS granted to each
+	// subscription, given what the client asked for, after NoQos2. It
+	// can only lower it: a higher QoS than requested is ignored.
+	Grant func(clientid, filter string, requested proto.QosLevel) proto.QosLevel
+}
+
+// maxQos returns the highest QoS the server grants.
+func (p *QosPolicy) maxQos() proto.QosLevel {
+	if p.NoQos2 {
+		return proto.QosAtLeastOnce
+	}
+	return proto.QosExactlyOnce
+}
+
+// grant returns the QoS to grant to a subscription of the client to
+// filter, which asked for requested.
+func (p *QosPolicy) grant(clientid, filter string, requested proto.QosLevel) proto.QosLevel {
+	q := requested
+	if max := p.maxQos(); q > max {
+		q = max
+	}
+	if p.Grant != nil {
+		if g := p.Grant(clientid, filter, q); g < q {
+			q = g
+		}
+	}
+	return q
+}
+
+// deliverAt returns m as it goes out to a subscription granted qos: at
+// no more than qos, or, when upgrade is set, at qos exactly.
+func deliverAt(m *proto.Publish, qos proto.QosLevel, upgrade bool) *proto.Publish {
+	if !upgrade || m.Header.QosLevel >= qos {
+		return atMost(m, qos)
+	}
+	cp := *m
+	cp.Header.QosLevel = qos
+	return &cp
+}
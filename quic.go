@@ -0,0 +1,209 @@
+//go:build quic
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICTransport is MQTT over QUIC, which is experimental. Each client
+// is a QUIC connection, and MQTT goes over its first stream. The
+// connection keeps going when the address of the client changes, as
+// under a NAT, and QUIC does the flow control of the stream. The
+// standard library has no QUIC, so this uses github.com/quic-go/quic-go,
+// and it is only built with the quic build tag, to keep that dependency
+// optional.
+//
+// QUIC is always over TLS 1.3: to listen, TLS must hold the
+// certificates of the server, and to dial it is used as by DialTLS, and
+// may be nil. Its NextProtos default to "mqtt". Config may be nil for
+// the defaults of quic-go.
+//
+// Early turns on 0-RTT: a client resuming a session sends its CONNECT
+// along with the handshake, and the server takes it before the
+// handshake is done. 0-RTT data can be replayed by someone on the path,
+// so only turn it on where a replayed CONNECT, or the PUBLISH messages
+// right after it, do no harm.
+type QUICTransport struct {
+	TLS    *tls.Config
+	Config *quic.Config
+	Early  bool
+}
+
+// The ALPN protocol of MQTT over QUIC.
+const quicProto = "mqtt"
+
+// How long a client has to open its stream, and how long a closed
+// connection waits for the peer to read what was sent on it.
+const (
+	quicStreamTimeout = 10 * time.Second
+	quicLinger        = 5 * time.Second
+)
+
+// quicTransport returns the QUICTransport for ParseURL.
+func quicTransport(cfg *tls.Config) (Transport, error) {
+	return QUICTransport{TLS: cfg}, nil
+}
+
+func (t QUICTransport) tlsConfig(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{quicProto}
+	}
+	return cfg
+}
+
+// quicConfig returns Config, or a copy of it allowing 0-RTT if Early
+// is set.
+func (t QUICTransport) quicConfig() *quic.Config {
+	if !t.Early {
+		return t.Config
+	}
+	cfg := &quic.Config{}
+	if t.Config != nil {
+		cfg = t.Config.Clone()
+	}
+	cfg.Allow0RTT = true
+	return cfg
+}
+
+func (t QUICTransport) Listen(addr string) (net.Listener, error) {
+	var l quicAcceptor
+	var err error
+	if t.Early {
+		l, err = quic.ListenAddrEarly(addr, t.tlsConfig(t.TLS), t.quicConfig())
+	} else {
+		l, err = quic.ListenAddr(addr, t.tlsConfig(t.TLS), t.Config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ql := &quicListener{l: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	go ql.run()
+	return ql, nil
+}
+
+func (t QUICTransport) Dial(addr string) (net.Conn, error) {
+	cfg, err := clientTLSConfig(addr, t.TLS)
+	if err != nil {
+		return nil, err
+	}
+	dial := quic.DialAddr
+	if t.Early {
+		dial = quic.DialAddrEarly
+	}
+	qc, err := dial(context.Background(), addr, t.tlsConfig(cfg), t.quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	s, err := qc.OpenStreamSync(context.Background())
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: s, conn: qc}, nil
+}
+
+// A quicAcceptor is a *quic.Listener, or with 0-RTT, a
+// *quic.EarlyListener.
+type quicAcceptor interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// A quicListener accepts QUIC connections, and returns each as a
+// net.Conn once the client opened its stream, so that a slow client
+// does not hold up the others.
+type quicListener struct {
+	l     quicAcceptor
+	conns chan net.Conn
+	done  chan struct{} // closed when l is
+	err   error         // why, once done is closed
+	once  sync.Once
+}
+
+func (ql *quicListener) run() {
+	for {
+		qc, err := ql.l.Accept(context.Background())
+		if err != nil {
+			ql.close(err)
+			return
+		}
+		go ql.stream(qc)
+	}
+}
+
+// stream waits for the first stream of qc.
+func (ql *quicListener) stream(qc *quic.Conn) {
+	ctx, cancel := context.WithTimeout(qc.Context(), quicStreamTimeout)
+	s, err := qc.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		qc.CloseWithError(0, "no stream")
+		return
+	}
+	select {
+	case ql.conns <- &quicConn{Stream: s, conn: qc}:
+	case <-ql.done:
+		qc.CloseWithError(0, "")
+	}
+}
+
+func (ql *quicListener) close(err error) {
+	ql.once.Do(func() {
+		ql.err = err
+		close(ql.done)
+	})
+}
+
+func (ql *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ql.conns:
+		return c, nil
+	case <-ql.done:
+		return nil, ql.err
+	}
+}
+
+func (ql *quicListener) Close() error {
+	err := ql.l.Close()
+	ql.close(net.ErrClosed)
+	return err
+}
+
+func (ql *quicListener) Addr() net.Addr { return ql.l.Addr() }
+
+// A quicConn is the stream of a QUIC connection, as a net.Conn.
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close closes the stream. Closing the connection right away would
+// lose what is still on its way, such as a DISCONNECT, so that waits
+// for the peer to close it, for up to quicLinger.
+func (c *quicConn) Close() error {
+	err := c.Stream.Close()
+	c.Stream.CancelRead(0)
+	go func() {
+		select {
+		case <-c.conn.Context().Done():
+		case <-time.After(quicLinger):
+		}
+		c.conn.CloseWithError(0, "")
+	}()
+	return err
+}
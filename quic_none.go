@@ -0,0 +1,14 @@
+//go:build !quic
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// quicTransport fails, because QUICTransport is only built with the
+// quic build tag.
+func quicTransport(cfg *tls.Config) (Transport, error) {
+	return nil, errors.New("QUIC is only in builds with the quic tag")
+}
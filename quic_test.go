@@ -0,0 +1,88 @@
+//go:build quic
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestQUICTransport(t *testing.T) {
+	server := &tls.Config{Certificates: []tls.Certificate{testCert(t, "server")}}
+	l, err := QUICTransport{TLS: server}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(l)
+	svr.Start()
+	defer svr.Stop(context.Background())
+
+	tr, addr, err := ParseURL("quic://"+l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func() *ClientConn {
+		cc, err := DialTransport(tr, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	cc, pub := connect(), connect()
+	defer cc.Disconnect()
+	defer pub.Disconnect()
+	cc.Subscribe([]proto.TopicQos{{Topic: "quic", Qos: proto.QosAtLeastOnce}})
+	pub.Publish(&proto.Publish{
+		Header:    proto.Header{QosLevel: proto.QosAtLeastOnce},
+		TopicName: "quic",
+		Payload:   proto.BytesPayload("x"),
+	})
+	select {
+	case m := <-cc.Incoming:
+		if !bytes.Equal(m.Payload.(proto.BytesPayload), []byte("x")) {
+			t.Errorf("got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message over QUIC")
+	}
+}
+
+func TestQUICEarly(t *testing.T) {
+	server := &tls.Config{Certificates: []tls.Certificate{testCert(t, "server")}}
+	l, err := QUICTransport{TLS: server, Early: true}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(l)
+	svr.Start()
+	defer svr.Stop(context.Background())
+
+	client := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	tr := QUICTransport{TLS: client, Early: true}
+	early := func() bool {
+		conn, err := tr.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := NewClientConn(conn)
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		cc.Disconnect()
+		return conn.(*quicConn).conn.ConnectionState().Used0RTT
+	}
+	if early() {
+		t.Error("first connection used 0-RTT")
+	}
+	if !early() {
+		t.Error("resumed connection did not use 0-RTT")
+	}
+}
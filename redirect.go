@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// MaxRedirects is the number of server redirects DialURLAndConnect
+// follows before it gives up.
+var MaxRedirects = 5
+
+// ErrTooManyRedirects is returned by DialURLAndConnect when the servers
+// send it on more than MaxRedirects times, or back to one it tried.
+var ErrTooManyRedirects = errors.New("too many server redirects")
+
+// OnRedirect, if not nil, is called by DialURLAndConnect and
+// FollowRedirect with the URL of each server that sends the client on,
+// and the URL of the server it goes to next.
+var OnRedirect func(from, to string)
+
+// DialURLAndConnect is DialAndConnect for a server URL, as described by
+// ParseURL, speaking MQTT 5 so that it can follow server redirects. When
+// the server refuses the client with a Server Reference, as one that
+// is draining may do, it connects to the first of the servers there
+// that it did not try yet, up to MaxRedirects times. A reference that
+// is only a host, with or without a port, is reached the same way as
+// rawurl. cfg and setup are used for each server.
+//
+// ClientConn does not reconnect by itself, so when a server redirects
+// a client that is already connected, the connection just closes, and
+// ClientConn.Err returns a *RedirectError. FollowRedirect follows it.
+func DialURLAndConnect(rawurl string, cfg *tls.Config, setup func(*ClientConn), user, pass string) (*ClientConn, error) {
+	return connectURL(rawurl, nil, cfg, setup, user, pass)
+}
+
+// FollowRedirect connects to the server that cc, a connection made by
+// DialURLAndConnect or FollowRedirect, was sent to once connected,
+// as DialURLAndConnect does, and subscribes the new connection to the
+// filters cc was subscribed to. It does not go back to the server cc
+// was connected to. If cc did not close because of a redirect, its
+// Err is returned, or an error if it is still open.
+func FollowRedirect(cc *ClientConn, cfg *tls.Config, setup func(*ClientConn), user, pass string) (*ClientConn, error) {
+	var re *RedirectError
+	if err := cc.Err(); !errors.As(err, &re) {
+		if err == nil {
+			err = errors.New("connection was not redirected")
+		}
+		return nil, err
+	}
+	if cc.url == "" {
+		return nil, errors.New("connection was not made by DialURLAndConnect")
+	}
+	c, err := connectURL(cc.url, re, cfg, setup, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	c.RestoreSubscriptions(cc.Subscriptions())
+	return c, nil
+}
+
+// connectURL connects to rawurl, following redirects, or, if re is not
+// nil, to a server in re, where rawurl sent the client.
+func connectURL(rawurl string, re *RedirectError, cfg *tls.Config, setup func(*ClientConn), user, pass string) (*ClientConn, error) {
+	tried := map[string]bool{rawurl: true}
+	for redirects := 0; ; redirects++ {
+		if re != nil {
+			next := ""
+			for _, u := range References(rawurl, re.Reference) {
+				if !tried[u] {
+					next = u
+					break
+				}
+			}
+			if next == "" || redirects >= MaxRedirects {
+				return nil, fmt.Errorf("%w: %v sent us to %v", ErrTooManyRedirects, rawurl, re.Reference)
+			}
+			if OnRedirect != nil {
+				OnRedirect(rawurl, next)
+			}
+			rawurl = next
+			tried[rawurl] = true
+		}
+
+		t, addr, err := ParseURL(rawurl, cfg)
+		if err != nil {
+			return nil, err
+		}
+		dialed := rawurl
+		cc, err := DialAndConnect(func() (net.Conn, error) {
+			return t.Dial(addr)
+		}, func(cc *ClientConn) {
+			cc.MQTT5 = true
+			cc.url = dialed
+			if setup != nil {
+				setup(cc)
+			}
+		}, user, pass)
+		if !errors.As(err, &re) {
+			return cc, err
+		}
+	}
+}
+
+// References returns the URLs of the servers in ref, a Server Reference
+// received from the server at rawurl. The servers in ref are separated
+// by spaces, and each is a URL, or a host, with or without a port,
+// which is reached with the scheme and path of rawurl.
+func References(rawurl, ref string) []string {
+	from, err := url.Parse(rawurl)
+	var res []string
+	for _, r := range strings.Fields(ref) {
+		if err == nil && !strings.Contains(r, "://") {
+			r = (&url.URL{Scheme: from.Scheme, Host: r, Path: from.Path}).String()
+		}
+		res = append(res, r)
+	}
+	return res
+}
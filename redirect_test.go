@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestReferences(t *testing.T) {
+	got := References("wss://a.example.com/mqtt", "b.example.com:8443 tcp://c.example.com")
+	want := []string{"wss://b.example.com:8443/mqtt", "tcp://c.example.com"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	al, bl, cl := listen(), listen(), listen()
+	aaddr, baddr, caddr := al.Addr().String(), bl.Addr().String(), cl.Addr().String()
+	a, b, c := NewServer(al), NewServer(bl), NewServer(cl)
+	var ownerMu sync.Mutex
+	owner := baddr
+	a.SessionOwner = func(*proto.Connect) string {
+		ownerMu.Lock()
+		defer ownerMu.Unlock()
+		return owner
+	}
+	b.DrainRate = 1000
+	for _, s := range []*Server{a, b, c} {
+		s.Start()
+		defer s.Stop(context.Background())
+	}
+	var hops []string
+	OnRedirect = func(from, to string) { hops = append(hops, from+" "+to) }
+	defer func() { OnRedirect = nil }()
+
+	cc, err := DialURLAndConnect("tcp://"+aaddr, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(b.conns()); n != 1 {
+		t.Errorf("%v clients on the server redirected to, want 1", n)
+	}
+
+	// The rest of MQTT 5 works too.
+	if ack := cc.Subscribe([]proto.TopicQos{{Topic: "r", Qos: proto.QosAtLeastOnce}}); ack == nil || ack.TopicsQos[0] != proto.QosAtLeastOnce {
+		t.Errorf("SUBACK %v", ack)
+	}
+	cc.Publish(&proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), TopicName: "r", Payload: proto.BytesPayload("x")})
+	pub, err := DialURL("tcp://"+baddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+	pub.Publish(&proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), TopicName: "r", Payload: proto.BytesPayload("y")})
+	select {
+	case m := <-cc.Incoming:
+		if string(m.Payload.(proto.BytesPayload)) != "y" {
+			t.Errorf("got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message over MQTT 5")
+	}
+
+	// Once connected, a DISCONNECT with a reference is a RedirectError.
+	b.Drain(aaddr)
+	select {
+	case <-cc.Incoming:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not disconnected by Drain")
+	}
+	var re *RedirectError
+	if err := cc.Err(); !errors.As(err, &re) || re.Reference != aaddr || !errors.Is(err, ErrServerDisconnect) {
+		t.Errorf("Err() = %v", err)
+	}
+
+	// a sends clients to b, which is draining to a.
+	if _, err := DialURLAndConnect("tcp://"+aaddr, nil, nil, "", ""); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("going around in a loop: %v", err)
+	}
+	if _, err := FollowRedirect(cc, nil, nil, "", ""); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("going back to where the redirect came from: %v", err)
+	}
+
+	// Once a sends clients to c, the redirect leads there, and the
+	// subscriptions come along.
+	ownerMu.Lock()
+	owner = caddr
+	ownerMu.Unlock()
+	hops = nil
+	moved, err := FollowRedirect(cc, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moved.Disconnect()
+	if want := []string{"tcp://" + baddr + " tcp://" + aaddr, "tcp://" + aaddr + " tcp://" + caddr}; fmt.Sprint(hops) != fmt.Sprint(want) {
+		t.Errorf("redirected %q, want %q", hops, want)
+	}
+	pub, err = DialURL("tcp://"+caddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect()
+	pub.Publish(&proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), TopicName: "r", Payload: proto.BytesPayload("z")})
+	select {
+	case m := <-moved.Incoming:
+		if string(m.Payload.(proto.BytesPayload)) != "z" {
+			t.Errorf("got %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not restored after the redirect")
+	}
+}
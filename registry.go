@@ -0,0 +1,72 @@
+package mqtt
+
+import "sync"
+
+// A registry holds the connections of a Server, by the key of their
+// client id, so that two servers in one process have a client id
+// space each. The zero value is ready to use.
+type registry struct {
+	mu sync.Mutex // guards m
+	m  map[string]*incomingConn
+}
+
+// add puts c in the registry, unless another connection has the same
+// key, in which case that one is returned instead.
+func (r *registry) add(c *incomingConn) *incomingConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.m[c.key()]; ok {
+		return existing
+	}
+	if r.m == nil {
+		r.m = make(map[string]*incomingConn)
+	}
+	r.m[c.key()] = c
+	return nil
+}
+
+// del takes c out of the registry, if it is still there, and not the
+// connection that took over from it.
+func (r *registry) del(c *incomingConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[c.key()] == c {
+		delete(r.m, c.key())
+	}
+}
+
+// get returns the connection with key, or nil.
+func (r *registry) get(key string) *incomingConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.m[key]
+}
+
+// all returns the connections in the registry.
+func (r *registry) all() []*incomingConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]*incomingConn, 0, len(r.m))
+	for _, c := range r.m {
+		res = append(res, c)
+	}
+	return res
+}
+
+// each calls fn for each connection, until fn returns false. Only the
+// keys are copied with the registry locked; fn is called without the
+// lock, for the connections still there when their turn comes.
+func (r *registry) each(fn func(*incomingConn) bool) {
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.m))
+	for k := range r.m {
+		keys = append(keys, k)
+	}
+	r.mu.Unlock()
+
+	for _, k := range keys {
+		if c := r.get(k); c != nil && !fn(c) {
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build !mqttlite
+// +build !mqttlite
+
+package mqtt
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The longest a request to the RetainedHandler may wait for a change.
+const maxRetainedWait = 5 * time.Minute
+
+// RetainedHandler returns an HTTP handler that serves the retained
+// messages of tenant, for consumers that only speak HTTP. It is meant
+// to be mounted on "/retained/":
+//
+//	http.Handle("/retained/", s.RetainedHandler(""))
+//
+// GET /retained/{topic} returns the payload of the retained message of
+// topic, or 404 Not Found if there is none. The ETag of the response
+// changes whenever the retained message does. A request with a
+// matching If-None-Match gets 304 Not Modified, unless it also has a
+// wait parameter, like ?wait=30s. Then it is held until the retained
+// message changes, or until the wait is over, and gets 304 Not Modified
+// in that case.
+func (s *Server) RetainedHandler(tenant string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		i := strings.Index(r.URL.Path, "/retained/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		topic := r.URL.Path[i+len("/retained/"):]
+		if topic == "" || isWildcard(topic) {
+			http.Error(w, "bad topic", http.StatusBadRequest)
+			return
+		}
+
+		var wait time.Duration
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "bad wait", http.StatusBadRequest)
+				return
+			}
+			wait = d
+			if wait > maxRetainedWait {
+				wait = maxRetainedWait
+			}
+		}
+
+		tag := r.Header.Get("If-None-Match")
+		m, seq, ok := s.waitRetained(r, tenant, topic, tag, wait)
+		if tag == etag(seq) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag(seq))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := m.Payload.WritePayload(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	})
+}
+
+// etag returns the ETag of the retained message with sequence number
+// seq. Sequence number 0 stands for no retained message.
+func etag(seq uint64) string {
+	return `"` + strconv.FormatUint(seq, 10) + `"`
+}
+
+// waitRetained returns the retained message of topic, waiting up to
+// wait for it to have an ETag other than tag. It gives up early when
+// the request is canceled, or the server stops.
+func (s *Server) waitRetained(r *http.Request, tenant, topic, tag string, wait time.Duration) (m proto.Publish, seq uint64, ok bool) {
+	m, seq, ok = s.subs.retainedTopic(tenant, topic)
+	if wait == 0 || tag == "" || tag != etag(seq) {
+		return
+	}
+
+	events, stop := s.WatchRetained(tenant)
+	defer stop()
+	// It may have changed before we were watching.
+	if m, seq, ok = s.subs.retainedTopic(tenant, topic); tag != etag(seq) {
+		return
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	// Events are dropped if we fall behind, so check now and then
+	// even without one.
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Topic != topic {
+				continue
+			}
+		case <-poll.C:
+		case <-t.C:
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.Done:
+			return
+		}
+		if m, seq, ok = s.subs.retainedTopic(tenant, topic); tag != etag(seq) {
+			return
+		}
+	}
+}
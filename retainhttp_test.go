@@ -0,0 +1,72 @@
+//go:build !mqttlite
+// +build !mqttlite
+
+package mqtt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestRetainedHandler(t *testing.T) {
+	s := &Server{subs: newSubscriptions(0)}
+	set := func(payload string) {
+		s.subs.mu.Lock()
+		s.subs.part("").setRetain(proto.Publish{
+			Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+			TopicName: "dev/1/state",
+			Payload:   proto.BytesPayload(payload),
+		}, nil)
+		s.subs.mu.Unlock()
+	}
+	get := func(target, tag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		if tag != "" {
+			r.Header.Set("If-None-Match", tag)
+		}
+		s.RetainedHandler("").ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/retained/dev/1/state", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("missing: got %v", w.Code)
+	}
+	set("on")
+	w = get("/retained/dev/1/state", "")
+	if w.Code != http.StatusOK || w.Body.String() != "on" {
+		t.Fatalf("got %v %q", w.Code, w.Body.String())
+	}
+	tag := w.Header().Get("ETag")
+	if w = get("/retained/dev/1/state", tag); w.Code != http.StatusNotModified {
+		t.Errorf("same ETag: got %v", w.Code)
+	}
+	if w = get("/retained/dev/1/+", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("wildcard: got %v", w.Code)
+	}
+
+	// Long-poll: the request is held until the next change.
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get("/retained/dev/1/state?wait=10s", tag) }()
+	select {
+	case w = <-done:
+		t.Fatalf("returned before the change: %v", w.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+	set("off")
+	w = <-done
+	if w.Code != http.StatusOK || w.Body.String() != "off" || w.Header().Get("ETag") == tag {
+		t.Errorf("after change: got %v %q %v", w.Code, w.Body.String(), w.Header().Get("ETag"))
+	}
+
+	// And gives up with 304 when nothing changes.
+	tag = w.Header().Get("ETag")
+	if w = get("/retained/dev/1/state?wait=10ms", tag); w.Code != http.StatusNotModified {
+		t.Errorf("timeout: got %v", w.Code)
+	}
+}
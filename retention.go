@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"log"
+	"time"
+)
+
+// A Retention says what the server retains of the messages published
+// to a topic.
+type Retention int
+
+const (
+	// RetainAsPublished retains the messages that have the Retain
+	// flag set, as usual.
+	RetainAsPublished Retention = iota
+
+	// RetainNever retains nothing, whatever the Retain flag says, and
+	// leaves alone what is already retained.
+	RetainNever
+
+	// RetainLast retains the last message with a payload, even when the
+	// publisher did not set the Retain flag.
+	RetainLast
+)
+
+// A RetentionPolicy decides what is retained for the topics that match
+// Filter, so that misconfigured devices cannot pollute the retained
+// state. When MaxAge is non-zero, retained messages are forgotten once
+// they are that old.
+type RetentionPolicy struct {
+	Filter string
+	Retain Retention
+	MaxAge time.Duration
+}
+
+type retentionPolicy struct {
+	w      wild
+	retain Retention
+	maxAge time.Duration
+}
+
+// compileRetention turns the filters of the policies into wilds.
+// Invalid filters are skipped.
+func compileRetention(policies []RetentionPolicy) []retentionPolicy {
+	var res []retentionPolicy
+	for _, p := range policies {
+		w := newWild(p.Filter, nil)
+		if !w.valid() {
+			log.Print("ignoring retention policy with invalid filter ", p.Filter)
+			continue
+		}
+		res = append(res, retentionPolicy{w: w, retain: p.Retain, maxAge: p.MaxAge})
+	}
+	return res
+}
+
+// retention returns the first policy that topic matches, or the zero
+// policy, which retains as published. s.mu must be held.
+func (s *subscriptions) retention(topic string) retentionPolicy {
+	if len(s.retentions) == 0 {
+		return retentionPolicy{}
+	}
+	var levels [16]string
+	parts := splitTopic(levels[:0], topic)
+	for _, p := range s.retentions {
+		if p.w.matches(parts) {
+			return p
+		}
+	}
+	return retentionPolicy{}
+}
+
+// expired reports whether a retained message is too old to be sent.
+func (r retain) expired(now time.Time) bool {
+	return !r.expires.IsZero() && now.After(r.expires)
+}
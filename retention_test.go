@@ -0,0 +1,52 @@
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestRetention(t *testing.T) {
+	s := newSubscriptions(1)
+	s.retentions = compileRetention([]RetentionPolicy{
+		{Filter: "logs/#", Retain: RetainNever},
+		{Filter: "status/#", Retain: RetainLast},
+		{Filter: "weather/#", Retain: RetainAsPublished, MaxAge: time.Millisecond},
+	})
+	sub := newTestConn(&Server{}, "sub")
+	s.add("done", sub, proto.QosAtMostOnce)
+
+	for _, m := range []struct {
+		topic  string
+		retain retainFlag
+	}{
+		{"logs/a", retainTrue},
+		{"status/a", retainFalse},
+		{"status/a", retainFalse},
+		{"other", retainTrue},
+		{"other2", retainFalse},
+		{"weather/today", retainTrue},
+	} {
+		s.submit(nil, &proto.Publish{
+			Header:    header(dupFalse, proto.QosAtMostOnce, m.retain),
+			TopicName: m.topic,
+			Payload:   proto.BytesPayload("x"),
+		})
+	}
+	// With one worker, once this arrives the others are done.
+	s.submit(nil, &proto.Publish{TopicName: "done", Payload: proto.BytesPayload("x")})
+	<-sub.jobs
+
+	time.Sleep(5 * time.Millisecond)
+	var got []string
+	for _, m := range s.retained("") {
+		got = append(got, m.TopicName)
+	}
+	sort.Strings(got)
+	if want := []string{"other", "status/a"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("retained %v, want %v", got, want)
+	}
+}
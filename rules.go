@@ -0,0 +1,146 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A RuleAction is what a Rule does with the messages it matches.
+type RuleAction int
+
+const (
+	// RuleDrop drops the message; nobody gets it, and the rules after
+	// this one are not looked at.
+	RuleDrop RuleAction = iota
+
+	// RuleRepublish publishes a copy of the message on Topic, in
+	// addition to the original. The copy does not go through the rules.
+	RuleRepublish
+
+	// RuleRetain stores the message as the retained message of its
+	// topic, or of Topic if it is set, as if it had the retain flag.
+	RuleRetain
+
+	// RuleWebhook POSTs the payload to URL, with the topic in the
+	// X-MQTT-Topic header. The messages wait for the webhook in a
+	// queue like the one of a Sink, and are dropped if it is full.
+	RuleWebhook
+)
+
+// A Rule says to do Action with the messages published to topics
+// matching Filter, whose payload matches the regular expression Match.
+// An empty Match matches any payload. Rules let common routing be set
+// up from configuration, without writing Go hooks.
+type Rule struct {
+	Filter string
+	Match  string
+	Action RuleAction
+	Topic  string // for RuleRepublish and RuleRetain
+	URL    string // for RuleWebhook
+}
+
+type rule struct {
+	Rule
+	w     wild
+	match *regexp.Regexp
+	hook  *sink
+}
+
+// compileRules checks the rules and gets them ready to run. Invalid
+// rules are skipped. The webhooks run until done is closed.
+func compileRules(rules []Rule, done chan struct{}) []rule {
+	var res []rule
+	for _, r := range rules {
+		cr := rule{Rule: r, w: newWild(r.Filter, nil)}
+		if err := cr.compile(done); err != nil {
+			log.Printf("ignoring rule for %v: %v", r.Filter, err)
+			continue
+		}
+		res = append(res, cr)
+	}
+	return res
+}
+
+func (r *rule) compile(done chan struct{}) error {
+	if !r.w.valid() {
+		return ErrBadFilter
+	}
+	if r.Match != "" {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return err
+		}
+		r.match = re
+	}
+	switch r.Action {
+	case RuleDrop:
+	case RuleRepublish, RuleRetain:
+		if isWildcard(r.Topic) || r.Action == RuleRepublish && r.Topic == "" {
+			return fmt.Errorf("bad topic %q", r.Topic)
+		}
+	case RuleWebhook:
+		wh, err := newWebhook(r.URL)
+		if err != nil {
+			return err
+		}
+		hook, err := newSink(SinkConfig{Filter: r.Filter, Sink: wh})
+		if err != nil {
+			return err
+		}
+		r.hook = hook
+		go hook.run(nil, done)
+	default:
+		return fmt.Errorf("unknown action %v", r.Action)
+	}
+	return nil
+}
+
+// applyRules runs the rules on a message from c. It returns true if
+// the message is to be dropped.
+func (s *Server) applyRules(c *incomingConn, m *proto.Publish) bool {
+	if len(s.rules) == 0 {
+		return false
+	}
+	var levels [16]string
+	parts := splitTopic(levels[:0], m.TopicName)
+	var payload []byte
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.w.matches(parts) {
+			continue
+		}
+		if r.match != nil {
+			if payload == nil {
+				var buf bytes.Buffer
+				m.Payload.WritePayload(&buf)
+				payload = buf.Bytes()
+			}
+			if !r.match.Match(payload) {
+				continue
+			}
+		}
+
+		switch r.Action {
+		case RuleDrop:
+			return true
+		case RuleRepublish:
+			cp := *m
+			cp.TopicName = r.Topic
+			s.subs.submitFiltered(c.tenant, &cp, nil)
+		case RuleRetain:
+			cp := *unpooled(m)
+			if r.Topic != "" {
+				cp.TopicName = r.Topic
+			}
+			s.SetRetained(c.tenant, &cp)
+		case RuleWebhook:
+			cp := *unpooled(m)
+			r.hook.offer(&cp)
+		}
+	}
+	return false
+}
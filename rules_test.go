@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestRules(t *testing.T) {
+	s := &Server{subs: newSubscriptions(1)}
+	s.rules = compileRules([]Rule{
+		{Filter: "bad/#", Action: RuleRepublish}, // no topic, skipped
+		{Filter: "sensors/+/temp", Match: `^-`, Action: RuleDrop},
+		{Filter: "sensors/+/temp", Action: RuleRetain, Topic: "sensors/last"},
+		{Filter: "sensors/#", Match: `alarm`, Action: RuleRepublish, Topic: "alarms"},
+	}, nil)
+	if len(s.rules) != 3 {
+		t.Fatalf("%v rules compiled", len(s.rules))
+	}
+	c, sub := newTestConn(s, "c"), newTestConn(s, "sub")
+	s.subs.add("alarms", sub, proto.QosAtMostOnce)
+
+	publish := func(topic, payload string) bool {
+		return s.applyRules(c, &proto.Publish{TopicName: topic, Payload: proto.BytesPayload(payload)})
+	}
+	if !publish("sensors/1/temp", "-300") {
+		t.Error("-300 was not dropped")
+	}
+	if publish("sensors/1/temp", "20") {
+		t.Error("20 was dropped")
+	}
+	if r := s.subs.retained(""); len(r) != 1 || r[0].TopicName != "sensors/last" {
+		t.Errorf("retained %v", r)
+	}
+	if publish("sensors/door", "alarm!") {
+		t.Error("alarm was dropped")
+	}
+	if m := (<-sub.jobs).m.(*proto.Publish); m.TopicName != "alarms" {
+		t.Errorf("republished to %v", m.TopicName)
+	}
+}
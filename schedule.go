@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A ScheduledPublish describes a message that the server publishes
+// by itself, over and over, for instance as a heartbeat or to tell
+// devices to refresh their configuration.
+type ScheduledPublish struct {
+	Tenant  string
+	Topic   string
+	Payload []byte
+	Retain  bool
+
+	// Every is the time between publishes. Like cron, the publishes
+	// happen at multiples of Every since the Unix epoch, so servers
+	// with the same schedule publish at the same moments.
+	Every time.Duration
+}
+
+// next returns the time of the next publish after now. It does not use
+// now.Truncate, which counts from the zero Time rather than the epoch.
+func (sp ScheduledPublish) next(now time.Time) time.Time {
+	n, every := now.UnixNano(), int64(sp.Every)
+	since := (n%every + every) % every // how long since the last multiple
+	return time.Unix(0, n-since+every)
+}
+
+// Schedule makes the server publish a message on a schedule, until
+// the returned function is called, or the server stops.
+func (s *Server) Schedule(sp ScheduledPublish) (stop func()) {
+	quit := make(chan struct{})
+	var once sync.Once
+	stop = func() { once.Do(func() { close(quit) }) }
+	if sp.Every <= 0 {
+		return stop
+	}
+
+	go func() {
+		for {
+			t := time.NewTimer(sp.next(time.Now()).Sub(time.Now()))
+			select {
+			case <-t.C:
+			case <-quit:
+				t.Stop()
+				return
+			case <-s.Done:
+				t.Stop()
+				return
+			}
+
+			s.subs.submitFiltered(sp.Tenant, &proto.Publish{
+				Header:    header(dupFalse, proto.QosAtMostOnce, retainFlag(sp.Retain)),
+				TopicName: sp.Topic,
+				Payload:   proto.BytesPayload(sp.Payload),
+			}, nil)
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,24 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// 7 minutes does not divide the time between the zero Time and the
+	// epoch, so counting from the former would be off.
+	sp := ScheduledPublish{Every: 7 * time.Minute}
+	epoch7 := func(n int64) time.Time { return time.Unix(n*7*60, 0) }
+	for _, tc := range []struct {
+		now, want time.Time
+	}{
+		{epoch7(1000).Add(time.Second), epoch7(1001)},
+		{epoch7(1000), epoch7(1001)},
+		{epoch7(1001).Add(-time.Nanosecond), epoch7(1001)},
+	} {
+		if got := sp.next(tc.now); !got.Equal(tc.want) {
+			t.Errorf("next(%v) = %v, want %v", tc.now.UTC(), got.UTC(), tc.want.UTC())
+		}
+	}
+}
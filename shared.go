@@ -0,0 +1,269 @@
+package mqtt
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The length of the Incoming channel of each VirtualClient.
+const virtualQueueLength = 100
+
+// A SharedConn lets the parts of an application share one ClientConn,
+// instead of each having its own connection to the same broker. Each
+// part gets a VirtualClient, with its own subscriptions and its own
+// Incoming channel, and can come and go without disturbing the others.
+// The SharedConn takes over the Incoming channel of the ClientConn,
+// so Listen and SyncRetained cannot be used on it anymore.
+type SharedConn struct {
+	c   *ClientConn
+	cmu sync.Mutex // guards the use of c; taken before mu
+
+	// The router does not take cmu, since a SUBACK can be stuck behind
+	// a message for it to route.
+	mu      sync.Mutex // guards the fields below, and those of the VirtualClients
+	subs    map[string]*sharedSub
+	clients map[*VirtualClient]bool
+}
+
+// sharedSub is a subscription of the ClientConn, and how many virtual
+// clients want it.
+type sharedSub struct {
+	refs    int
+	qos     proto.QosLevel // what was asked for
+	granted proto.QosLevel
+}
+
+// NewSharedConn shares c, which must be connected. The connection is
+// the SharedConn's from now on: use VirtualClients to subscribe and
+// publish, and Close to disconnect.
+func NewSharedConn(c *ClientConn) *SharedConn {
+	s := &SharedConn{
+		c:       c,
+		subs:    make(map[string]*sharedSub),
+		clients: make(map[*VirtualClient]bool),
+	}
+	go s.route()
+	return s
+}
+
+// route hands each incoming message to the virtual clients subscribed
+// to it. One that is not keeping up loses the messages that do not fit
+// in its Incoming channel, so that it does not hold up the others.
+// Once the connection is gone, the Incoming channels are closed.
+func (s *SharedConn) route() {
+	for m := range s.c.Incoming {
+		levels := strings.Split(m.TopicName, "/")
+		s.mu.Lock()
+		for v := range s.clients {
+			if !v.wants(levels) {
+				continue
+			}
+			select {
+			case v.Incoming <- m:
+			default:
+				log.Printf("shared conn: virtual client %v is full, dropping message", v.Name)
+			}
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	for v := range s.clients {
+		close(v.Incoming)
+		delete(s.clients, v)
+	}
+	s.mu.Unlock()
+}
+
+// NewClient returns a new virtual client of the connection. The name
+// is only used in log messages.
+func (s *SharedConn) NewClient(name string) *VirtualClient {
+	v := &VirtualClient{
+		Name:     name,
+		Incoming: make(chan *proto.Publish, virtualQueueLength),
+		s:        s,
+		filters:  make(map[string]wild),
+	}
+	s.mu.Lock()
+	if s.c.Err() != nil {
+		close(v.Incoming)
+	} else {
+		s.clients[v] = true
+	}
+	s.mu.Unlock()
+	return v
+}
+
+// Close disconnects the shared connection, which closes the Incoming
+// channels of all the virtual clients.
+func (s *SharedConn) Close() {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	s.c.Disconnect()
+}
+
+// A VirtualClient is one user of a SharedConn. Its Incoming channel
+// gets the messages that match its own subscriptions, whatever the
+// other virtual clients subscribed to. The messages are shared with
+// the other virtual clients that get them, so they must not be
+// changed.
+type VirtualClient struct {
+	Name     string
+	Incoming chan *proto.Publish
+
+	s       *SharedConn
+	filters map[string]wild
+	closed  bool
+}
+
+// wants reports whether a message on the topic with these levels
+// matches one of the subscriptions of v. s.mu must be held.
+func (v *VirtualClient) wants(levels []string) bool {
+	for _, w := range v.filters {
+		if w.matches(levels) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe subscribes the virtual client to a list of filters. Only
+// the filters that no other virtual client is subscribed to, at the
+// same QoS or higher, are sent to the server; the QoS granted for the
+// others is the one the server granted before. It returns the QoS
+// granted for each filter, or nil if the connection is closed.
+func (v *VirtualClient) Subscribe(tqs []proto.TopicQos) []proto.QosLevel {
+	s := v.s
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	s.mu.Lock()
+	if v.closed || s.c.Err() != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	var send []proto.TopicQos
+	for _, tq := range tqs {
+		if sub := s.subs[tq.Topic]; sub == nil || sub.qos < tq.Qos {
+			send = append(send, tq)
+		}
+	}
+	s.mu.Unlock()
+
+	var ack *proto.SubAck
+	if len(send) > 0 {
+		if ack = s.c.Subscribe(send); ack == nil || len(ack.TopicsQos) != len(send) {
+			return nil
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ack != nil {
+		for i, tq := range send {
+			sub := s.subs[tq.Topic]
+			if sub == nil {
+				sub = &sharedSub{}
+				s.subs[tq.Topic] = sub
+			}
+			sub.qos, sub.granted = tq.Qos, ack.TopicsQos[i]
+		}
+	}
+
+	granted := make([]proto.QosLevel, len(tqs))
+	for i, tq := range tqs {
+		sub := s.subs[tq.Topic]
+		granted[i] = sub.granted
+		if sub.granted == subscribeFailure {
+			continue
+		}
+		if _, ok := v.filters[tq.Topic]; !ok {
+			sub.refs++
+		}
+		v.filters[tq.Topic] = newWild(tq.Topic, nil)
+	}
+	return granted
+}
+
+// Unsubscribe unsubscribes the virtual client from a list of filters.
+// The server is only asked to unsubscribe from those that no other
+// virtual client is subscribed to.
+func (v *VirtualClient) Unsubscribe(filters []string) {
+	s := v.s
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	v.unsubscribe(filters)
+}
+
+// unsubscribe is Unsubscribe with s.cmu held.
+func (v *VirtualClient) unsubscribe(filters []string) {
+	s := v.s
+	s.mu.Lock()
+	var send []string
+	for _, f := range filters {
+		if _, ok := v.filters[f]; !ok {
+			continue
+		}
+		delete(v.filters, f)
+		sub := s.subs[f]
+		if sub.refs--; sub.refs == 0 {
+			delete(s.subs, f)
+			send = append(send, f)
+		}
+	}
+	s.mu.Unlock()
+	if len(send) > 0 && s.c.Err() == nil {
+		s.c.Unsubscribe(send)
+	}
+}
+
+// Publish publishes a message on the shared connection. At QoS 1 or
+// 2, it blocks until the server acknowledges it, without holding up
+// the other virtual clients.
+func (v *VirtualClient) Publish(m *proto.Publish) error {
+	s := v.s
+	s.cmu.Lock()
+	s.mu.Lock()
+	closed := v.closed
+	s.mu.Unlock()
+	if closed {
+		s.cmu.Unlock()
+		return ErrConnectionClosed
+	}
+	if m.QosLevel == proto.QosAtMostOnce {
+		s.c.Publish(m)
+		s.cmu.Unlock()
+		return nil
+	}
+	t := s.c.PublishAsync(m)
+	s.cmu.Unlock()
+	return t.Wait()
+}
+
+// Close ends the virtual client: its subscriptions are dropped, and
+// its Incoming channel is closed. The shared connection stays up for
+// the others.
+func (v *VirtualClient) Close() {
+	s := v.s
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	s.mu.Lock()
+	if v.closed {
+		s.mu.Unlock()
+		return
+	}
+	v.closed = true
+	filters := make([]string, 0, len(v.filters))
+	for f := range v.filters {
+		filters = append(filters, f)
+	}
+	if s.clients[v] {
+		delete(s.clients, v)
+		close(v.Incoming)
+	}
+	s.mu.Unlock()
+	v.unsubscribe(filters)
+}
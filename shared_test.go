@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestSharedConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(l)
+	svr.Start()
+
+	connect := func() *ClientConn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := NewClientConn(conn)
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	pub := connect()
+	defer pub.Disconnect()
+	sc := NewSharedConn(connect())
+	defer sc.Close()
+
+	a, b := sc.NewClient("a"), sc.NewClient("b")
+	a.Subscribe([]proto.TopicQos{{Topic: "shared/#", Qos: proto.QosAtLeastOnce}})
+	b.Subscribe([]proto.TopicQos{{Topic: "shared/#", Qos: proto.QosAtLeastOnce}, {Topic: "other", Qos: proto.QosAtMostOnce}})
+	if n := sc.subs["shared/#"].refs; n != 2 {
+		t.Errorf("shared/# has %v refs, expected 2", n)
+	}
+
+	publish := func(topic string) {
+		pub.Publish(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			TopicName: topic,
+			Payload:   proto.BytesPayload("x"),
+		})
+	}
+	expect := func(v *VirtualClient, topic string) {
+		t.Helper()
+		select {
+		case m := <-v.Incoming:
+			if m.TopicName != topic {
+				t.Errorf("%v: got %v, expected %v", v.Name, m.TopicName, topic)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: nothing on %v", v.Name, topic)
+		}
+	}
+
+	publish("other")
+	publish("shared/1")
+	expect(b, "other")
+	expect(a, "shared/1")
+	expect(b, "shared/1")
+
+	// The subscription stays for b once a is gone.
+	a.Close()
+	if _, ok := <-a.Incoming; ok {
+		t.Error("Incoming of a closed virtual client is still open")
+	}
+	publish("shared/2")
+	expect(b, "shared/2")
+
+	b.Unsubscribe([]string{"shared/#"})
+	if _, ok := sc.subs["shared/#"]; ok {
+		t.Error("shared/# is still subscribed to")
+	}
+
+	sc.Close()
+	select {
+	case _, ok := <-b.Incoming:
+		if ok {
+			t.Error("got a message after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Incoming of b not closed after Close")
+	}
+}
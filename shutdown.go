@@ -0,0 +1,166 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A barrier is a post that tells the workers to report that they are
+// done with the posts queued before it.
+type barrier struct {
+	wg   sync.WaitGroup
+	hold chan struct{} // if non-nil, the workers wait for it to be closed
+}
+
+// reach is called by a worker when it gets to the barrier.
+func (b *barrier) reach() {
+	b.wg.Done()
+	if b.hold != nil {
+		<-b.hold
+	}
+}
+
+// flush returns once the posts queued before it was called have been
+// handled by the workers: delivered to the queues of the subscribers,
+// retained, and so on.
+func (s *subscriptions) flush() {
+	n := s.workers
+	if n == 0 {
+		return
+	}
+
+	// Each worker has its own shard, so a barrier in each one is
+	// enough for them.
+	b := &barrier{}
+	b.wg.Add(n)
+	for _, ch := range s.shards {
+		ch <- post{barrier: b}
+	}
+	b.wg.Wait()
+
+	// Any worker can take from posts, so there, workers wait at the
+	// barrier until all of them are there. That way none of them can
+	// take two barriers and leave another one working behind them.
+	b = &barrier{hold: make(chan struct{})}
+	b.wg.Add(n)
+	for i := 0; i < n; i++ {
+		s.posts <- post{barrier: b}
+	}
+	b.wg.Wait()
+	close(b.hold)
+}
+
+// shutdown is the state of a server being shut down.
+type shutdown struct {
+	mu      sync.Mutex
+	flushed chan struct{} // closed once the workers are flushed
+}
+
+// awaitFlush waits, if the server is shutting down, for the messages
+// that are still going through the workers to be delivered, and
+// reports whether it is. Writers call it before sending what is left in
+// their queue.
+func (s *Server) awaitFlush() bool {
+	s.shutdown.mu.Lock()
+	ch := s.shutdown.flushed
+	s.shutdown.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+	return ch != nil
+}
+
+// stop makes the workers exit, and waits for them to. Nothing may be
+// posted after that.
+func (s *subscriptions) stop() {
+	close(s.stopping)
+	s.running.Wait()
+}
+
+// A ShutdownReport says what became of the messages in the server when
+// it shut down.
+type ShutdownReport struct {
+	Clients     int   // the clients that were connected
+	Undelivered int64 // messages for them that were not sent, or not acknowledged
+}
+
+// Shutdown stops the server. Messages are either delivered or counted
+// as undelivered in the report; none are lost silently. It goes in this
+// order:
+//
+//  1. The listeners are closed, so no new clients come in, and the
+//     connections that have not finished their CONNECT are closed.
+//  2. The connected clients are not read from anymore, so no new
+//     messages come in. Their wills are published, if need be.
+//  3. The workers finish with the messages queued for them, which puts
+//     them in the queues of the subscribers, and in the retained
+//     messages.
+//  4. Each connection sends what is left in its queue, within
+//     Server.DrainTimeout, and is closed. MQTT 5 clients get a
+//     DISCONNECT saying that the server is shutting down.
+//
+// Then Shutdown counts what was left unsent or unacknowledged, and
+// returns.
+func (s *Server) Shutdown() ShutdownReport {
+	s.record(EventAdmin, nil, "Shutdown")
+	s.l.Close()
+	s.closeListeners()
+	<-s.Done
+
+	s.shutdown.mu.Lock()
+	flushed := make(chan struct{})
+	s.shutdown.flushed = flushed
+	s.shutdown.mu.Unlock()
+
+	// The clients still at CONNECT are closed, and the ones past it
+	// are flushed like the others, even if not registered yet.
+	conns := s.union(s.accepted.shut(0, true), func(*incomingConn) bool { return true })
+
+	for _, c := range conns {
+		c.conn.SetReadDeadline(time.Now())
+	}
+	for _, c := range conns {
+		<-c.quit
+	}
+	s.subs.flush()
+	close(flushed)
+
+	r := ShutdownReport{Clients: len(conns)}
+	for _, c := range conns {
+		<-c.Done
+		r.Undelivered += int64(len(c.jobs) + len(c.held) + c.inflight.len())
+	}
+	if s.Capture != nil {
+		s.Capture.Flush()
+	}
+	return r
+}
+
+// Stop shuts the server down as Shutdown does, and then stops the
+// workers that deliver messages, so that none of the goroutines of the
+// server are left. If ctx is done before the connections are flushed,
+// they are closed at once, and Stop returns ctx.Err(). The server must
+// not be used after Stop.
+func (s *Server) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.accepted.closeAll()
+		for _, c := range s.conns() {
+			c.conn.Close()
+		}
+		<-done
+	}
+	s.accepted.wait()
+	s.subs.stop()
+	return err
+}
@@ -0,0 +1,135 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestFlush(t *testing.T) {
+	const n = 500
+
+	for _, order := range []DeliveryOrder{DeliveryBestEffort, DeliveryPerPublisher} {
+		s := &Server{}
+		subs := newSubscriptions(4)
+		subs.setOrder(order)
+		sub := newTestConn(s, "sub")
+		subs.add("#", sub, proto.QosAtMostOnce)
+		pub := newTestConn(s, "pub")
+
+		for i := 0; i < n; i++ {
+			subs.submit(pub, &proto.Publish{
+				Header:    header(dupFalse, proto.QosAtMostOnce, retainFalse),
+				TopicName: "a",
+				Payload:   proto.BytesPayload("x"),
+			})
+		}
+		subs.flush()
+		if got := len(sub.jobs); got != n {
+			t.Errorf("%v: %v messages queued after flush, want %v", order, got, n)
+		}
+	}
+
+	// Without workers, there is nothing to wait for.
+	newSubscriptions(0).flush()
+}
+
+func TestStop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(l)
+	svr.Start()
+	cc, err := DialAndConnect(func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svr.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-svr.Done:
+	default:
+		t.Error("Done is not closed")
+	}
+	if _, ok := <-cc.Incoming; ok {
+		t.Error("client still connected")
+	}
+}
+
+// waitAccepted waits until the server tracks n connections.
+func waitAccepted(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.accepted.mu.Lock()
+		got := len(s.accepted.m)
+		s.accepted.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the server never had %v connections", n)
+}
+
+func TestStopBeforeConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l)
+	s.Start()
+
+	// A client that has not sent CONNECT yet.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitAccepted(t, s, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Its connection is closed, and a CONNECT now is not answered.
+	(&proto.Connect{ProtocolName: "MQTT", ProtocolVersion: protocol311, ClientId: "late", CleanSession: true}).Encode(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Errorf("got %v bytes after Stop", n)
+	}
+	waitAccepted(t, s, 0)
+}
+
+func TestAdmitAfterShutdown(t *testing.T) {
+	s := &Server{}
+	c := newTestConn(s, "late")
+	if !s.accepted.admit(c) {
+		t.Fatal("refused before shutdown")
+	}
+	s.accepted.shut(0, true)
+	if s.accepted.admit(c) {
+		t.Error("admitted during shutdown")
+	}
+
+	s = &Server{}
+	c = newTestConn(s, "late")
+	c.listener = 2
+	s.accepted.shut(2, false)
+	if s.accepted.admit(c) {
+		t.Error("admitted on a removed listener")
+	}
+	c.listener = 1
+	if !s.accepted.admit(c) {
+		t.Error("refused on another listener")
+	}
+}
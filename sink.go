@@ -0,0 +1,193 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Sink takes the messages published to some topics out of the
+// broker: to a bridge to another broker, a webhook, a database, and so
+// on. See AddSink.
+type Sink interface {
+	// Deliver passes m on. It must not change m, which is shared with
+	// the subscribers. Returning nil acks the message; returning
+	// an error nacks it, and it is tried again as the RetryPolicy says.
+	// Deliver is never called again before it returns, so a slow
+	// external system slows down its sink, and its sink only.
+	Deliver(m *proto.Publish) error
+}
+
+// A RetryPolicy decides what to do with a message that a Sink failed
+// to deliver attempt times, the last time with err. It returns how
+// long to wait before trying again, or false to drop the message.
+type RetryPolicy func(m *proto.Publish, attempt int, err error) (wait time.Duration, retry bool)
+
+// DefaultRetry tries a message 5 times, waiting one second more
+// before each new try.
+func DefaultRetry(m *proto.Publish, attempt int, err error) (time.Duration, bool) {
+	return time.Duration(attempt) * time.Second, attempt < 5
+}
+
+// A SinkConfig says which messages to send to Sink. The messages wait
+// for the sink in a queue of at most QueueLength, 1000 by default.
+// When the sink cannot keep up and the queue is full, new messages are
+// dropped, rather than held on to without limit. Retry decides what to
+// do with the messages the sink fails to deliver; it defaults to
+// DefaultRetry.
+type SinkConfig struct {
+	Tenant      string
+	Filter      string
+	Sink        Sink
+	QueueLength int
+	Retry       RetryPolicy
+}
+
+// The default number of messages waiting for a sink.
+const sinkQueueLength = 1000
+
+// SinkStats counts what happened to the messages for a sink.
+type SinkStats struct {
+	Delivered int64 // acked by the sink
+	Failed    int64 // given up on after retries
+	Dropped   int64 // not queued because the queue was full
+	Queued    int   // waiting to be delivered
+}
+
+type sink struct {
+	cfg   SinkConfig
+	w     wild
+	queue chan *proto.Publish
+	stats SinkStats // the counters are accessed with sync/atomic
+}
+
+// AddSink starts sending the messages that match cfg.Filter to
+// cfg.Sink. It runs until stop is called, or the server stops. The
+// messages still queued then are dropped. stats can be called at any
+// time to see how the sink is doing.
+func (s *Server) AddSink(cfg SinkConfig) (stop func(), stats func() SinkStats, err error) {
+	sk, err := newSink(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.subs.mu.Lock()
+	p := s.subs.part(cfg.Tenant)
+	p.sinks = append(p.sinks, sk)
+	s.subs.mu.Unlock()
+
+	quit := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(quit)
+			s.subs.mu.Lock()
+			p := s.subs.part(cfg.Tenant)
+			for i := range p.sinks {
+				if p.sinks[i] == sk {
+					p.sinks = append(p.sinks[:i], p.sinks[i+1:]...)
+					break
+				}
+			}
+			s.subs.mu.Unlock()
+		})
+	}
+
+	go sk.run(quit, s.Done)
+	return stop, sk.snapshot, nil
+}
+
+// newSink makes a sink for cfg, with the defaults filled in.
+func newSink(cfg SinkConfig) (*sink, error) {
+	sk := &sink{cfg: cfg, w: newWild(cfg.Filter, nil)}
+	if !sk.w.valid() || cfg.Sink == nil {
+		return nil, ErrBadFilter
+	}
+	if sk.cfg.QueueLength <= 0 {
+		sk.cfg.QueueLength = sinkQueueLength
+	}
+	if sk.cfg.Retry == nil {
+		sk.cfg.Retry = DefaultRetry
+	}
+	sk.queue = make(chan *proto.Publish, sk.cfg.QueueLength)
+	return sk, nil
+}
+
+// run delivers the queued messages one at a time, until quit or done
+// is closed.
+func (sk *sink) run(quit, done chan struct{}) {
+	for {
+		select {
+		case m := <-sk.queue:
+			if !sk.deliver(m, quit, done) {
+				return
+			}
+		case <-quit:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// deliver tries to deliver m until the sink acks it or the retry
+// policy gives up. It returns false if it was interrupted by quit or
+// done.
+func (sk *sink) deliver(m *proto.Publish, quit, done chan struct{}) bool {
+	for attempt := 1; ; attempt++ {
+		err := sk.cfg.Sink.Deliver(m)
+		if err == nil {
+			atomic.AddInt64(&sk.stats.Delivered, 1)
+			return true
+		}
+		wait, retry := sk.cfg.Retry(m, attempt, err)
+		if !retry {
+			log.Printf("sink %v: giving up on message to %v after %v attempts: %v", sk.cfg.Filter, m.TopicName, attempt, err)
+			atomic.AddInt64(&sk.stats.Failed, 1)
+			return true
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-quit:
+			t.Stop()
+			return false
+		case <-done:
+			t.Stop()
+			return false
+		}
+	}
+}
+
+func (sk *sink) snapshot() SinkStats {
+	return SinkStats{
+		Delivered: atomic.LoadInt64(&sk.stats.Delivered),
+		Failed:    atomic.LoadInt64(&sk.stats.Failed),
+		Dropped:   atomic.LoadInt64(&sk.stats.Dropped),
+		Queued:    len(sk.queue),
+	}
+}
+
+// feedSinks queues m for the sinks in p that it matches, without ever
+// waiting for them. s.mu must be held.
+func (p *partition) feedSinks(parts []string, m *proto.Publish) {
+	for _, sk := range p.sinks {
+		if sk.w.matches(parts) {
+			sk.offer(m)
+		}
+	}
+}
+
+// offer queues m for the sink, or drops it if the queue is full.
+func (sk *sink) offer(m *proto.Publish) {
+	select {
+	case sk.queue <- m:
+	default:
+		if atomic.AddInt64(&sk.stats.Dropped, 1) == 1 {
+			log.Printf("sink %v is not keeping up, dropping messages", sk.cfg.Filter)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A flakySink sends the topic of each message it is given to calls,
+// and fails each message the first time.
+type flakySink struct {
+	failed map[string]bool
+	calls  chan string
+}
+
+func (f *flakySink) Deliver(m *proto.Publish) error {
+	f.calls <- m.TopicName
+	if !f.failed[m.TopicName] {
+		f.failed[m.TopicName] = true
+		return errors.New("try again")
+	}
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	s := &Server{subs: newSubscriptions(1), Done: make(chan struct{})}
+	f := &flakySink{failed: make(map[string]bool), calls: make(chan string)}
+	stop, stats, err := s.AddSink(SinkConfig{
+		Filter:      "a/#",
+		Sink:        f,
+		QueueLength: 1,
+		Retry: func(m *proto.Publish, attempt int, err error) (time.Duration, bool) {
+			return 0, attempt < 2
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	publish := func(topic string) {
+		s.subs.submit(nil, &proto.Publish{TopicName: topic, Payload: proto.BytesPayload("x")})
+	}
+	publish("a/1")
+	if got := <-f.calls; got != "a/1" {
+		t.Fatalf("got %v", got)
+	}
+
+	// The sink is stuck retrying a/1 until we read calls, so a/2 is
+	// queued and a/3 is dropped.
+	for _, topic := range []string{"b", "a/2", "a/3"} {
+		publish(topic)
+	}
+	for stats().Dropped == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, want := range []string{"a/1", "a/2", "a/2"} {
+		if got := <-f.calls; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	for stats().Delivered != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if st := stats(); st.Dropped != 1 || st.Failed != 0 || st.Queued != 0 {
+		t.Errorf("stats are %+v", st)
+	}
+}
+
+func TestTap(t *testing.T) {
+	s := &Server{subs: newSubscriptions(1)}
+	ch, stop, err := s.TapWith(TapConfig{Filter: "a/+", Buffer: 2, DropOldest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := newTestConn(s, "done")
+	s.subs.add("done", done, proto.QosAtMostOnce)
+	for _, topic := range []string{"a/1", "a/2", "b", "a/3", "done"} {
+		s.subs.submit(nil, &proto.Publish{TopicName: topic, Payload: proto.BytesPayload("x")})
+	}
+	<-done.jobs
+
+	stop()
+	var got []string
+	for m := range ch {
+		got = append(got, m.Topic)
+	}
+	if len(got) != 2 || got[0] != "a/2" || got[1] != "a/3" {
+		t.Errorf("got %v", got)
+	}
+}
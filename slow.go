@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"log"
+	"sync/atomic"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A SlowConsumerPolicy says what to do when a message is submitted to
+// a client whose send queue is full. Whatever the policy, the messages
+// dropped are counted in ClientInfo.Dropped and
+// $SYS/broker/clients/{id}/dropped.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest drops the message that does not fit.
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest drops the message that waited longest, to make room
+	// for the new one. It may be an acknowledgement, so clients that
+	// publish at QoS 1 or 2 may have to send again.
+	DropOldest
+	// DisconnectSlow drops the message and closes the connection, so
+	// that the client can connect again and start afresh.
+	DisconnectSlow
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop newest"
+	case DropOldest:
+		return "drop oldest"
+	case DisconnectSlow:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// full is called by submitJob when j does not fit in the queue of c.
+// It applies Server.SlowConsumer, and reports whether j was queued
+// after all.
+func (c *incomingConn) full(j job) bool {
+	switch c.svr.SlowConsumer {
+	case DropOldest:
+		select {
+		case old := <-c.jobs:
+			c.drop(old)
+		default:
+		}
+		select {
+		case c.jobs <- j:
+			return true
+		default:
+		}
+	case DisconnectSlow:
+		if atomic.CompareAndSwapInt32(&c.slow, 0, 1) {
+			log.Print(c, ": send queue full, disconnecting")
+			c.conn.Close()
+		}
+	}
+	atomic.AddInt64(&c.queued, -int64(j.size))
+	c.countDrop(1, "send queue full")
+	log.Print(c, ": failed to submit message")
+	return false
+}
+
+// drop forgets a job taken off the queue of c, and counts it.
+func (c *incomingConn) drop(j job) {
+	atomic.AddInt64(&c.queued, -int64(j.size))
+	c.countDrop(1, "send queue full, dropped the oldest")
+	if p, ok := j.m.(*proto.Publish); ok {
+		releasePayload(p)
+	}
+	if j.r != nil {
+		close(j.r)
+	}
+	for _, b := range j.batch {
+		if b.r != nil {
+			close(b.r)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"crypto/tls"
+	"flag"
 	"github.com/jeffallen/mqtt"
 	"log"
 )
 
+var ticketKeys = flag.String("ticketkeys", "", "file of 32 byte TLS session ticket keys, shared by all brokers")
+
 // See http://mosquitto.org/man/mosquitto-tls-7.html for how to make the
 // server.{crt,key} files. Then use mosquitto like this to talk to it:
 //
@@ -13,6 +16,15 @@ import (
 //
 // tls-version is required, because Go's TLS is limited to TLS 1.0, but
 // OpenSSL will try to ask for TLS 1.2 by default.
+//
+// To let clients resume their TLS sessions across a restart of the
+// broker, or when they land on another broker behind the same load
+// balancer, make a key file with:
+//
+//   head -c 32 /dev/urandom > ticket.keys
+//
+// and give it to every broker with -ticketkeys. To rotate keys, put a
+// new key at the front of the file, and drop the old one a while later.
 
 func readCert() []tls.Certificate {
 	c, err := tls.LoadX509KeyPair("server.crt", "server.key")
@@ -23,10 +35,20 @@ func readCert() []tls.Certificate {
 }
 
 func main() {
+	flag.Parse()
+
 	cfg := &tls.Config{
 		Certificates: readCert(),
 		NextProtos:   []string{"mqtt"},
 	}
+	if *ticketKeys != "" {
+		keys, err := mqtt.LoadSessionTicketKeys(*ticketKeys)
+		if err != nil {
+			log.Print("ticket keys: ", err)
+			return
+		}
+		cfg.SetSessionTicketKeys(keys)
+	}
 	l, err := tls.Listen("tcp", ":8883", cfg)
 	if err != nil {
 		log.Print("listen: ", err)
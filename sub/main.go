@@ -46,9 +46,8 @@ func main() {
 	fmt.Println("Connected with client id", cc.ClientId)
 	cc.Subscribe(tq)
 
-	for m := range cc.Incoming {
-		fmt.Print(m.TopicName, "\t")
-		m.Payload.WritePayload(os.Stdout)
-		fmt.Println("\tr: ", m.Header.Retain)
+	for in := range cc.Incoming {
+		m := mqtt.NewMessage(in)
+		fmt.Printf("%v\t%s\tr: %v\n", m.Topic, m.Payload, m.Retained)
 	}
 }
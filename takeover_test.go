@@ -0,0 +1,208 @@
+package mqtt
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A closeConn is a net.Conn that only knows how to be closed.
+type closeConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *closeConn) RemoteAddr() net.Addr { return nil }
+
+func (c *closeConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *closeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// newTestConn makes an incomingConn with a fake writer, which does
+// what the real one does when its connection is closed.
+func newTestConn(s *Server, id string) *incomingConn {
+	cc := &closeConn{closed: make(chan struct{})}
+	c := s.newIncomingConn(cc)
+	c.clientid = id
+	go func() {
+		select {
+		case <-cc.closed:
+		case <-c.taken:
+		}
+		close(c.Done)
+	}()
+	go func() {
+		<-cc.closed
+		c.del()
+		close(c.quit)
+	}()
+	return c
+}
+
+func TestTakeoverHandoff(t *testing.T) {
+	s := &Server{}
+	old := newTestConn(s, "takeover-handoff")
+	if old.add() != nil {
+		t.Fatal("add failed")
+	}
+	old.submit(&proto.Publish{TopicName: "a"})
+	old.submit(&proto.PingResp{})
+	old.submit(&proto.Publish{TopicName: "b"})
+
+	c := newTestConn(s, "takeover-handoff")
+	existing := c.add()
+	if existing != old {
+		t.Fatal("expected to find the old connection")
+	}
+	jobs := existing.takeover()
+	if len(jobs) != 2 ||
+		jobs[0].m.(*proto.Publish).TopicName != "a" ||
+		jobs[1].m.(*proto.Publish).TopicName != "b" {
+		t.Errorf("bad handoff: %v", jobs)
+	}
+	if c.add() != nil {
+		t.Error("old connection still registered")
+	}
+	c.conn.Close()
+	<-c.Done
+}
+
+func TestTakeoverOnce(t *testing.T) {
+	s := &Server{}
+	old := newTestConn(s, "takeover-once")
+	old.submit(&proto.Publish{TopicName: "a"})
+
+	// Two new connections find the old one at the same time; the
+	// message goes to one of them, once.
+	res := make(chan []job)
+	for i := 0; i < 2; i++ {
+		go func() { res <- old.takeover() }()
+	}
+	n := len(<-res) + len(<-res)
+	if n != 1 {
+		t.Errorf("handed over %v messages, want 1", n)
+	}
+}
+
+func TestTakeoverFlap(t *testing.T) {
+	s := &Server{}
+	const n = 50
+	conns := make([]*incomingConn, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		conns[i] = newTestConn(s, "takeover-flap")
+		wg.Add(1)
+		go func(c *incomingConn) {
+			defer wg.Done()
+			for {
+				existing := c.add()
+				if existing == nil {
+					break
+				}
+				existing.takeover()
+			}
+		}(conns[i])
+	}
+	wg.Wait()
+
+	// Exactly one of them must have survived, and be registered.
+	winner := s.clients.get("takeover-flap")
+	alive := 0
+	for _, c := range conns {
+		select {
+		case <-c.Done:
+		default:
+			alive++
+			if c != winner {
+				t.Error("a connection is alive but not registered")
+			}
+		}
+	}
+	if alive != 1 {
+		t.Errorf("%v connections alive, want 1", alive)
+	}
+	winner.conn.Close()
+	<-winner.Done
+}
+
+func TestDelayedWill(t *testing.T) {
+	var w delayedWills
+	published := make(chan string, 2)
+	w.delay("a", time.Millisecond, func() { published <- "a" })
+	w.delay("b", 50*time.Millisecond, func() { published <- "b" })
+	if !w.cancel("b") {
+		t.Error("no will to cancel for b")
+	}
+	if w.cancel("c") {
+		t.Error("cancelled a will for c")
+	}
+
+	if got := <-published; got != "a" {
+		t.Errorf("published the will of %v", got)
+	}
+	select {
+	case got := <-published:
+		t.Errorf("published the will of %v too", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// A hookConn is a net.Conn that calls onClose when it is being closed.
+type hookConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+	closed  chan struct{}
+}
+
+func (c *hookConn) Close() error {
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+		c.Conn.Close()
+		close(c.closed)
+	})
+	return nil
+}
+
+// The messages queued while an MQTT 3 client is taken over go to the
+// new connection, not to the closed one, with the real writer.
+func TestTakeoverWriter(t *testing.T) {
+	s := &Server{stats: &stats{}, subs: newSubscriptions(1)}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+	hc := &hookConn{Conn: conn, closed: make(chan struct{})}
+	c := s.newIncomingConn(hc)
+	c.clientid, c.version = "takeover-writer", protocol311
+	c.add()
+	go func() {
+		<-hc.closed
+		c.del()
+		close(c.quit)
+	}()
+	go c.writer(newConnWriter(hc))
+
+	// The workers may still be queueing messages for the old
+	// connection as it closes.
+	hc.onClose = func() {
+		for i := 0; i < 3; i++ {
+			c.submit(&proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")})
+		}
+	}
+	if handoff := c.takeover(); len(handoff) != 3 {
+		t.Errorf("%v messages handed over, want 3", len(handoff))
+	}
+}
@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A TapConfig describes a tap: a read-only copy of the messages
+// published to topics matching Filter, for analytics or sampling. Up
+// to Buffer messages (100 by default) wait for the reader of the tap.
+// When it falls behind and the buffer is full, new messages are
+// dropped, or the oldest ones when DropOldest is set. Either way, the
+// publishers and the subscribers never wait for a tap.
+type TapConfig struct {
+	Tenant     string
+	Filter     string
+	Buffer     int
+	DropOldest bool
+}
+
+// The default number of messages buffered for a tap.
+const tapBuffer = 100
+
+type tap struct {
+	cfg TapConfig
+	w   wild
+	ch  chan *Message
+}
+
+// Tap starts copying the messages published to topics matching filter
+// to the returned channel, with the defaults of TapConfig. Unlike a
+// subscription, a tap is not a client, and it does not show up as one.
+// It runs until stop is called, which closes the channel.
+func (s *Server) Tap(filter string) (<-chan *Message, func()) {
+	ch, stop, err := s.TapWith(TapConfig{Filter: filter})
+	if err != nil {
+		// Like a subscription to an invalid filter, get nothing.
+		c := make(chan *Message)
+		close(c)
+		return c, func() {}
+	}
+	return ch, stop
+}
+
+// TapWith is like Tap, with the configuration in cfg. It returns
+// ErrBadFilter if cfg.Filter is not valid.
+func (s *Server) TapWith(cfg TapConfig) (<-chan *Message, func(), error) {
+	t := &tap{cfg: cfg, w: newWild(cfg.Filter, nil)}
+	if !t.w.valid() {
+		return nil, nil, ErrBadFilter
+	}
+	if t.cfg.Buffer <= 0 {
+		t.cfg.Buffer = tapBuffer
+	}
+	t.ch = make(chan *Message, t.cfg.Buffer)
+
+	s.subs.mu.Lock()
+	p := s.subs.part(cfg.Tenant)
+	p.taps = append(p.taps, t)
+	s.subs.mu.Unlock()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			s.subs.mu.Lock()
+			defer s.subs.mu.Unlock()
+			p := s.subs.part(cfg.Tenant)
+			for i := range p.taps {
+				if p.taps[i] == t {
+					p.taps = append(p.taps[:i], p.taps[i+1:]...)
+					break
+				}
+			}
+			close(t.ch)
+		})
+	}
+	return t.ch, stop, nil
+}
+
+// feedTaps copies m to the taps in p that it matches. s.mu must be
+// held.
+func (p *partition) feedTaps(parts []string, m *proto.Publish) {
+	for _, t := range p.taps {
+		if !t.w.matches(parts) {
+			continue
+		}
+		msg := NewMessage(m)
+		select {
+		case t.ch <- &msg:
+			continue
+		default:
+		}
+		if !t.cfg.DropOldest {
+			continue
+		}
+		select {
+		case <-t.ch:
+		default:
+		}
+		select {
+		case t.ch <- &msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+// ClientSessionCache is used by DialTLS when the tls.Config it is given
+// does not have a ClientSessionCache of its own. Because it is shared,
+// a client that reconnects to the same server resumes its earlier TLS
+// session, saving a round trip and the public key operations.
+var ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+// DialTLS connects to the MQTT server at addr over TLS and returns the
+// connection, ready for NewClientConn. Session resumption is turned on
+// unless cfg.SessionTicketsDisabled is set.
+func DialTLS(addr string, cfg *tls.Config) (*tls.Conn, error) {
+	cfg, err := clientTLSConfig(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", addr, cfg)
+}
+
+// clientTLSConfig returns cfg, or a copy of it with the session cache
+// and server name filled in for addr.
+func clientTLSConfig(addr string, cfg *tls.Config) (*tls.Config, error) {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ClientSessionCache == nil && !cfg.SessionTicketsDisabled {
+		cfg = cfg.Clone()
+		cfg.ClientSessionCache = ClientSessionCache
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	return cfg, nil
+}
+
+// ErrTicketKeys is returned by LoadSessionTicketKeys when the file
+// does not hold a whole number of keys.
+var ErrTicketKeys = errors.New("session ticket key file must hold a multiple of 32 bytes")
+
+// LoadSessionTicketKeys reads session ticket keys from a file holding
+// one or more 32 byte keys, for use with tls.Config.SetSessionTicketKeys.
+// The first key is used to make new tickets, and all of them are
+// accepted. By default, each Server makes up its own keys, which means
+// that tickets do not survive a restart and are not accepted by other
+// servers behind the same load balancer. Sharing a key file fixes that.
+func LoadSessionTicketKeys(file string) ([][32]byte, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || len(buf)%32 != 0 {
+		return nil, ErrTicketKeys
+	}
+	keys := make([][32]byte, len(buf)/32)
+	for i := range keys {
+		copy(keys[i][:], buf[i*32:])
+	}
+	return keys, nil
+}
+
+// AddTLSListener listens on addr, and makes the server accept TLS
+// connections there, with its own cfg, as AddListener does. Each
+// listener can have its own certificates, client authentication and
+// so on. The handshake is done by the reader of each connection, so a
+// slow client does not hold up the others.
+func (s *Server) AddTLSListener(addr string, cfg *tls.Config) (id int, err error) {
+	return s.AddTransportListener(TLSTransport{Config: cfg}, addr)
+}
+
+// PeerCertificates returns the certificates that the client of tenant
+// with clientid presented, leaf first, for instance for a Server.Authorize
+// that goes by them. It returns nil if the client did not connect over
+// TLS, or did not present any. Server.Authenticate can get them from
+// the connection it is given, which has a ConnectionState method: it is
+// a *tls.Conn, or for MQTT over WebSocket, a wrapper of one.
+func (s *Server) PeerCertificates(tenant, clientid string) []*x509.Certificate {
+	if c := s.client(tenant, clientid); c != nil {
+		return peerCertificates(c.conn)
+	}
+	return nil
+}
+
+// peerCertificates returns the certificates the peer presented on
+// conn, if it is a TLS connection whose handshake is done.
+func peerCertificates(conn net.Conn) []*x509.Certificate {
+	tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	return tc.ConnectionState().PeerCertificates
+}
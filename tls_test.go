@@ -0,0 +1,179 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert makes a self-signed certificate for name.
+func testCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsServer starts a server with a TLS listener using cfg, and returns
+// it and the address of that listener. Stop it by closing l.
+func tlsServer(t *testing.T, cfg *tls.Config) (svr *Server, l net.Listener, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr = NewServer(l)
+	cfg.Certificates = []tls.Certificate{testCert(t, "server")}
+	id, err := svr.AddTLSListener("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	svr.listeners.mu.Lock()
+	addr = svr.listeners.m[id].Addr().String()
+	svr.listeners.mu.Unlock()
+	return svr, l, addr
+}
+
+// tlsClient connects to addr as clientid, with cert if it is not nil.
+func tlsClient(addr, clientid string, cert *tls.Certificate) (*ClientConn, error) {
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cc := NewClientConn(conn)
+	cc.ClientId = clientid
+	if err := cc.Connect("", ""); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+func TestTLSListener(t *testing.T) {
+	svr, l, addr := tlsServer(t, &tls.Config{ClientAuth: tls.RequireAnyClientCert})
+	defer l.Close()
+	cert := testCert(t, "device-1")
+	cc, err := tlsClient(addr, "device-1", &cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+
+	certs := svr.PeerCertificates("", "device-1")
+	if len(certs) != 1 || certs[0].Subject.CommonName != "device-1" {
+		t.Errorf("peer certificates %v", certs)
+	}
+	if svr.PeerCertificates("", "nobody") != nil {
+		t.Error("certificates for a client that is not connected")
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	cert := testCert(t, "device-1")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	svr, l, addr := tlsServer(t, &tls.Config{ClientAuth: tls.RequestClientCert})
+	defer l.Close()
+	svr.Authenticate = (&CertAuth{Roots: roots}).Authenticate
+
+	cc, err := tlsClient(addr, "c1", &cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	if u := svr.clients.get("c1").username; u != "device-1" {
+		t.Errorf("user name %q", u)
+	}
+
+	if _, err := tlsClient(addr, "c2", nil); err == nil {
+		t.Error("client without a certificate connected")
+	}
+	other := testCert(t, "intruder")
+	if _, err := tlsClient(addr, "c3", &other); err == nil {
+		t.Error("client with an unknown certificate connected")
+	}
+}
+
+// Servers sharing ticket keys from LoadSessionTicketKeys resume each
+// other's sessions, through the ClientSessionCache of DialTLS.
+func TestSessionResumption(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tickets")
+	if err := ioutil.WriteFile(file, bytes.Repeat([]byte{7}, 64), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadSessionTicketKeys(file)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("%v keys, %v", len(keys), err)
+	}
+	listen := func(shared bool) string {
+		cfg := &tls.Config{}
+		if shared {
+			cfg.SetSessionTicketKeys(keys)
+		}
+		_, l, addr := tlsServer(t, cfg)
+		t.Cleanup(func() { l.Close() })
+		return addr
+	}
+	resumed := func(addr string) bool {
+		conn, err := DialTLS(addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Tickets come after the handshake, so wait for the CONNACK.
+		cc := NewClientConn(conn)
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		cc.Disconnect()
+		return conn.ConnectionState().DidResume
+	}
+
+	if resumed(listen(true)) {
+		t.Error("first connection resumed")
+	}
+	if !resumed(listen(true)) {
+		t.Error("not resumed by a server with the same ticket keys")
+	}
+	if resumed(listen(false)) {
+		t.Error("resumed by a server with other ticket keys")
+	}
+}
+
+func TestLoadSessionTicketKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tickets")
+	ioutil.WriteFile(file, make([]byte, 33), 0600)
+	if _, err := LoadSessionTicketKeys(file); err != ErrTicketKeys {
+		t.Errorf("33 bytes: got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// A Transport is a way for MQTT to get between clients and the server:
+// TCPTransport, TLSTransport and WebSocketTransport come with this
+// package, and QUICTransport with the quic build tag. Others can be
+// plugged in from outside it, since all the server and ClientConn need
+// is a net.Conn for each client.
+type Transport interface {
+	// Listen returns a listener for the clients coming in on addr,
+	// for Server.AddListener.
+	Listen(addr string) (net.Listener, error)
+	// Dial connects to the server at addr, for NewClientConn.
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport is MQTT over plain TCP. Network is "tcp4" or "tcp6" to
+// stick to IPv4 or IPv6. The default, "tcp", is dual stack: listening
+// on ":1883" or "[::]:1883" takes clients of both, and dialing a host
+// name tries all of its addresses.
+type TCPTransport struct {
+	Network string
+}
+
+func (t TCPTransport) network() string {
+	if t.Network == "" {
+		return "tcp"
+	}
+	return t.Network
+}
+
+func (t TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(t.network(), addr)
+}
+
+func (t TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial(t.network(), addr)
+}
+
+// TLSTransport is MQTT over TLS, over the Network of TCPTransport. To
+// listen, Config must hold the certificates of the server. To dial, it
+// is used as by DialTLS, and may be nil.
+type TLSTransport struct {
+	Network string
+	Config  *tls.Config
+}
+
+func (t TLSTransport) Listen(addr string) (net.Listener, error) {
+	l, err := TCPTransport{Network: t.Network}.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, t.Config), nil
+}
+
+func (t TLSTransport) Dial(addr string) (net.Conn, error) {
+	if t.Network == "" {
+		return DialTLS(addr, t.Config)
+	}
+	cfg, err := clientTLSConfig(addr, t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial(t.Network, addr, cfg)
+}
+
+// UnixTransport is MQTT over a Unix domain socket, for clients on the
+// same machine, such as a sidecar bridge. The address is the path of
+// the socket file. Closing the listener removes the file, and Listen
+// removes one left behind by a server that did not get to, as long as
+// nothing answers on it anymore.
+type UnixTransport struct{}
+
+func (UnixTransport) Listen(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err == nil {
+		return l, nil
+	}
+	if fi, serr := os.Stat(path); serr != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil, err
+	}
+	if conn, derr := net.Dial("unix", path); derr == nil {
+		conn.Close()
+		return nil, err
+	}
+	if rerr := os.Remove(path); rerr != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+func (UnixTransport) Dial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
+
+// AddTransportListener listens on addr with t, and makes the server
+// accept clients there, as AddListener does.
+func (s *Server) AddTransportListener(t Transport, addr string) (id int, err error) {
+	l, err := t.Listen(addr)
+	if err != nil {
+		return 0, err
+	}
+	return s.AddListener(l), nil
+}
+
+// DialTransport connects to the server at addr with t, and returns a
+// ClientConn for it, ready for Connect.
+func DialTransport(t Transport, addr string, opts ...ClientOption) (*ClientConn, error) {
+	conn, err := t.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientConn(conn, opts...), nil
+}
+
+// ParseURL returns the transport and the address of a server URL, such
+// as tcp://[::1]:1883 or wss://broker.example.com/mqtt. The schemes are:
+//
+//	tcp, mqtt        plain TCP, on port 1883 unless the URL says otherwise
+//	tcp4, tcp6       the same, over IPv4 or IPv6 only
+//	tls, ssl, mqtts  TLS with cfg, on port 8883
+//	ws, wss          WebSocket at the path of the URL, on port 80 or 443,
+//	                 with cfg for wss
+//	unix             a Unix domain socket, as in unix:///run/mqtt.sock
+//	quic             QUIC with cfg, on port 14567, with the quic build tag
+//
+// As in any URL, an IPv6 address goes in brackets.
+func ParseURL(rawurl string, cfg *tls.Config) (t Transport, addr string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme == "unix" {
+		if u.Opaque != "" || u.Host+u.Path == "" {
+			return nil, "", fmt.Errorf("no socket path in %q", rawurl)
+		}
+		return UnixTransport{}, u.Host + u.Path, nil
+	}
+	if u.Host == "" || u.Opaque != "" {
+		return nil, "", fmt.Errorf("no host in %q", rawurl)
+	}
+	// Without the brackets, where the address stops and the port
+	// starts is a guess.
+	if strings.Count(u.Host, ":") > 1 && !strings.HasPrefix(u.Host, "[") {
+		return nil, "", fmt.Errorf("IPv6 address in %q must be in brackets", rawurl)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "tcp", "mqtt", "tcp4", "tcp6":
+		if port == "" {
+			port = "1883"
+		}
+		network := u.Scheme
+		if network == "mqtt" {
+			network = "tcp"
+		}
+		t = TCPTransport{Network: network}
+	case "tls", "ssl", "mqtts":
+		if port == "" {
+			port = "8883"
+		}
+		t = TLSTransport{Config: cfg}
+	case "ws", "wss":
+		if u.Scheme == "wss" {
+			if port == "" {
+				port = "443"
+			}
+			if cfg == nil {
+				cfg = &tls.Config{}
+			}
+		} else {
+			if port == "" {
+				port = "80"
+			}
+			cfg = nil
+		}
+		if t, err = webSocketTransport(u.Path, cfg); err != nil {
+			return nil, "", err
+		}
+	case "quic":
+		if port == "" {
+			port = "14567"
+		}
+		if t, err = quicTransport(cfg); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown URL scheme %q", u.Scheme)
+	}
+	return t, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// DialURL connects to the server at a URL, as described by ParseURL,
+// and returns a ClientConn for it, ready for Connect.
+func DialURL(rawurl string, cfg *tls.Config, opts ...ClientOption) (*ClientConn, error) {
+	t, addr, err := ParseURL(rawurl, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return DialTransport(t, addr, opts...)
+}
+
+// ListenURL makes the server accept clients at a URL, as described by
+// ParseURL, as AddListener does. For TLS, cfg must hold the
+// certificates of the server. An empty host, as in tcp6://:1883,
+// listens on all the addresses of the machine.
+func (s *Server) ListenURL(rawurl string, cfg *tls.Config) (id int, err error) {
+	t, addr, err := ParseURL(rawurl, cfg)
+	if err != nil {
+		return 0, err
+	}
+	return s.AddTransportListener(t, addr)
+}
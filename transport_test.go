@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, addr string
+		t         Transport
+	}{
+		{"tcp://[::1]:1884", "[::1]:1884", TCPTransport{Network: "tcp"}},
+		{"tcp://[::1]", "[::1]:1883", TCPTransport{Network: "tcp"}},
+		{"mqtt://[fe80::1%25eth0]:1883", "[fe80::1%eth0]:1883", TCPTransport{Network: "tcp"}},
+		{"tcp6://:1883", ":1883", TCPTransport{Network: "tcp6"}},
+		{"tcp4://127.0.0.1", "127.0.0.1:1883", TCPTransport{Network: "tcp4"}},
+		{"mqtts://[2001:db8::1]", "[2001:db8::1]:8883", TLSTransport{}},
+		{"tls://broker.example.com:1999", "broker.example.com:1999", TLSTransport{}},
+		{"unix:///run/mqtt.sock", "/run/mqtt.sock", UnixTransport{}},
+		{"unix://mqtt.sock", "mqtt.sock", UnixTransport{}},
+	} {
+		tr, addr, err := ParseURL(tc.url, nil)
+		if err != nil {
+			t.Errorf("%v: %v", tc.url, err)
+			continue
+		}
+		if addr != tc.addr || tr != tc.t {
+			t.Errorf("%v: got %#v at %v, expected %#v at %v", tc.url, tr, addr, tc.t, tc.addr)
+		}
+	}
+
+	for _, bad := range []string{"::1:1883", "tcp://::1:1883", "udp://localhost", "tcp:localhost", "localhost:1883", "unix://", "unix:mqtt.sock"} {
+		if _, _, err := ParseURL(bad, nil); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
+
+func TestIPv6Listener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(l)
+	svr.Start()
+
+	id, err := svr.ListenURL("tcp6://[::1]:0", nil)
+	if err != nil {
+		t.Skip("no IPv6: ", err)
+	}
+	svr.listeners.mu.Lock()
+	_, port, _ := net.SplitHostPort(svr.listeners.m[id].Addr().String())
+	svr.listeners.mu.Unlock()
+
+	cc, err := DialURL("tcp://[::1]:"+port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Connect("", ""); err != nil {
+		t.Error(err)
+	}
+	cc.Disconnect()
+
+	if _, err := DialURL("tcp4://[::1]:"+port, nil); err == nil {
+		t.Error("dialed an IPv6 address over tcp4")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt.sock")
+
+	// A socket left behind by a server that crashed.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skip("no Unix domain sockets: ", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(l)
+	svr.Start()
+	if _, err := svr.ListenURL("unix://"+path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// One that a server answers on is left alone.
+	if _, err := (UnixTransport{}).Listen(path); err == nil {
+		t.Error("listened on a socket in use")
+	}
+
+	cc, err := DialURL("unix://"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Connect("", ""); err != nil {
+		t.Error(err)
+	}
+	cc.Disconnect()
+
+	svr.Shutdown()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still there after Shutdown: %v", err)
+	}
+}
@@ -0,0 +1,814 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The huin/mqtt codec only knows MQTT 3.1 and 3.1.1, so the packets of
+// MQTT 5 connections are taken apart and put together here. They are
+// decoded into the same proto messages as the others, so that the rest
+// of the server does not need to care which protocol a client speaks,
+// and the parts of MQTT 5 that proto has no room for go in a v5extra
+// next to them.
+
+// The protocol level of MQTT 5.
+const protocol5 = 5
+
+// A v5extra holds the parts of an MQTT 5 packet that the proto message
+// it decodes to, or is encoded from, has no room for. It is shared by
+// all the subscribers a message goes to, so it must not be changed
+// once it is submitted.
+type v5extra struct {
+	reason  byte       // the reason code of acks, CONNACK and DISCONNECT
+	props   properties // the properties of the packet
+	will    properties // CONNECT: the properties of the will message
+	options []byte     // SUBSCRIBE: the subscription options of each filter
+	codes   []byte     // UNSUBACK: the reason code for each filter
+	expires time.Time  // PUBLISH: when the message expires, if it has an expiry interval
+}
+
+// Reason codes.
+const (
+	reasonSuccess               = 0x00
+	reasonDisconnectWithWill    = 0x04
+	reasonNoSubscriptionExisted = 0x11
+	reasonUnspecified           = 0x80
+	reasonMalformed             = 0x81
+	reasonProtocolError         = 0x82
+	reasonNotAuthorized         = 0x87
+	reasonServerShuttingDown    = 0x8b
+	reasonSessionTakenOver      = 0x8e
+	reasonTopicFilterInvalid    = 0x8f
+	reasonReceiveMaxExceeded    = 0x93
+	reasonTopicAliasInvalid     = 0x94
+	reasonPacketTooLarge        = 0x95
+	reasonQuotaExceeded         = 0x97
+	reasonRetainNotSupported    = 0x9a
+	reasonQosNotSupported       = 0x9b
+	reasonUseAnotherServer      = 0x9c
+	reasonServerMoved           = 0x9d
+	reasonWildcardsNotSupported = 0xa2
+)
+
+// connackReasons are the MQTT 5 reason codes for the MQTT 3 CONNACK
+// return codes.
+var connackReasons = [...]byte{
+	proto.RetCodeAccepted:                    reasonSuccess,
+	proto.RetCodeUnacceptableProtocolVersion: 0x84,
+	proto.RetCodeIdentifierRejected:          0x85,
+	proto.RetCodeServerUnavailable:           0x88,
+	proto.RetCodeBadUsernameOrPassword:       0x86,
+	proto.RetCodeNotAuthorized:               reasonNotAuthorized,
+}
+
+// Property identifiers.
+const (
+	propPayloadFormat       = 0x01
+	propMessageExpiry       = 0x02
+	propContentType         = 0x03
+	propResponseTopic       = 0x08
+	propCorrelationData     = 0x09
+	propSubscriptionId      = 0x0b
+	propSessionExpiry       = 0x11
+	propAssignedClientId    = 0x12
+	propServerKeepAlive     = 0x13
+	propAuthMethod          = 0x15
+	propAuthData            = 0x16
+	propRequestProblemInfo  = 0x17
+	propWillDelay           = 0x18
+	propRequestResponseInfo = 0x19
+	propResponseInfo        = 0x1a
+	propServerReference     = 0x1c
+	propReasonString        = 0x1f
+	propReceiveMaximum      = 0x21
+	propTopicAliasMaximum   = 0x22
+	propTopicAlias          = 0x23
+	propMaximumQos          = 0x24
+	propRetainAvailable     = 0x25
+	propUserProperty        = 0x26
+	propMaximumPacketSize   = 0x27
+	propWildcardAvailable   = 0x28
+	propSubIdAvailable      = 0x29
+	propSharedAvailable     = 0x2a
+)
+
+// How each property is encoded.
+const (
+	kindByte = iota + 1
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString
+	kindBinary
+	kindPair
+)
+
+var propKinds = map[byte]int{
+	propPayloadFormat:       kindByte,
+	propMessageExpiry:       kindUint32,
+	propContentType:         kindString,
+	propResponseTopic:       kindString,
+	propCorrelationData:     kindBinary,
+	propSubscriptionId:      kindVarint,
+	propSessionExpiry:       kindUint32,
+	propAssignedClientId:    kindString,
+	propServerKeepAlive:     kindUint16,
+	propAuthMethod:          kindString,
+	propAuthData:            kindBinary,
+	propRequestProblemInfo:  kindByte,
+	propWillDelay:           kindUint32,
+	propRequestResponseInfo: kindByte,
+	propResponseInfo:        kindString,
+	propServerReference:     kindString,
+	propReasonString:        kindString,
+	propReceiveMaximum:      kindUint16,
+	propTopicAliasMaximum:   kindUint16,
+	propTopicAlias:          kindUint16,
+	propMaximumQos:          kindByte,
+	propRetainAvailable:     kindByte,
+	propUserProperty:        kindPair,
+	propMaximumPacketSize:   kindUint32,
+	propWildcardAvailable:   kindByte,
+	propSubIdAvailable:      kindByte,
+	propSharedAvailable:     kindByte,
+}
+
+// A property is one MQTT 5 property. Integers are kept in n, strings
+// and binary data in s, and user properties have their name in k.
+type property struct {
+	id byte
+	n  uint32
+	k  string
+	s  string
+}
+
+// The properties of a packet, in the order they came in.
+type properties []property
+
+// num returns the value of an integer property.
+func (ps properties) num(id byte) (uint32, bool) {
+	for _, p := range ps {
+		if p.id == id {
+			return p.n, true
+		}
+	}
+	return 0, false
+}
+
+// str returns the value of a string or binary property.
+func (ps properties) str(id byte) (string, bool) {
+	for _, p := range ps {
+		if p.id == id {
+			return p.s, true
+		}
+	}
+	return "", false
+}
+
+// setNum sets an integer property, replacing the one already there.
+func (ps *properties) setNum(id byte, n uint32) {
+	for i := range *ps {
+		if (*ps)[i].id == id {
+			(*ps)[i].n = n
+			return
+		}
+	}
+	*ps = append(*ps, property{id: id, n: n})
+}
+
+// setStr sets a string or binary property, replacing the one already
+// there.
+func (ps *properties) setStr(id byte, s string) {
+	for i := range *ps {
+		if (*ps)[i].id == id {
+			(*ps)[i].s = s
+			return
+		}
+	}
+	*ps = append(*ps, property{id: id, s: s})
+}
+
+// fresh returns x with the message expiry interval lowered to the time
+// that is left at now, or false if the message expired.
+func (x *v5extra) fresh(now time.Time) (*v5extra, bool) {
+	if x == nil || x.expires.IsZero() {
+		return x, true
+	}
+	left := x.expires.Sub(now)
+	if left <= 0 {
+		return nil, false
+	}
+	cp := *x
+	cp.props = append(properties(nil), x.props...)
+	cp.props.setNum(propMessageExpiry, uint32((left+time.Second-1)/time.Second))
+	return &cp, true
+}
+
+// redirect returns the server reference of a CONNACK or DISCONNECT
+// that sends the client to another server, or "" if it does not.
+func (x *v5extra) redirect() string {
+	if x == nil || x.reason != reasonUseAnotherServer && x.reason != reasonServerMoved {
+		return ""
+	}
+	ref, _ := x.props.str(propServerReference)
+	return ref
+}
+
+// contentType returns the Content Type of a PUBLISH, or "" if it has
+// none.
+func (x *v5extra) contentType() string {
+	if x == nil {
+		return ""
+	}
+	ct, _ := x.props.str(propContentType)
+	return ct
+}
+
+// withSubId returns x with the subscription identifier id, for the
+// subscriber whose subscription has it. x may be shared, so it is
+// copied. An id of 0 means none.
+func (x *v5extra) withSubId(id uint32) *v5extra {
+	if id == 0 {
+		return x
+	}
+	var cp v5extra
+	if x != nil {
+		cp = *x
+		cp.props = append(properties(nil), x.props...)
+	}
+	cp.props = append(cp.props, property{id: propSubscriptionId, n: id})
+	return &cp
+}
+
+// The properties of a PUBLISH that go from the publisher to the
+// subscribers. The others, like the topic alias, are about one hop.
+var forwardedProps = map[byte]bool{
+	propPayloadFormat:   true,
+	propMessageExpiry:   true,
+	propContentType:     true,
+	propResponseTopic:   true,
+	propCorrelationData: true,
+	propUserProperty:    true,
+}
+
+// forwarded returns the properties that are passed on to subscribers.
+func (ps properties) forwarded() properties {
+	var res properties
+	for _, p := range ps {
+		if forwardedProps[p.id] {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// connackExtra returns the properties of the CONNACK for an MQTT 5
+// client: where the server does not do what the CONNECT asked for, and
+// the features it does not have.
+func (c *incomingConn) connackExtra(clientid string, assigned bool) *v5extra {
+	x := &v5extra{}
+	if assigned {
+		x.props.setStr(propAssignedClientId, clientid)
+	}
+	// Sessions are always clean, so they end with the connection.
+	if n, _ := c.props.num(propSessionExpiry); n != 0 {
+		x.props.setNum(propSessionExpiry, 0)
+	}
+	if n := c.svr.ReceiveMaximum; n > 0 {
+		x.props.setNum(propReceiveMaximum, uint32(n))
+	}
+	if n := c.svr.TopicAliasMaximum; n > 0 {
+		x.props.setNum(propTopicAliasMaximum, uint32(n))
+	}
+	if n := c.svr.MaxPacketSize; n > 0 {
+		x.props.setNum(propMaximumPacketSize, uint32(n))
+	}
+	if max := c.svr.QosPolicy.maxQos(); max < proto.QosExactlyOnce {
+		x.props.setNum(propMaximumQos, uint32(max))
+	}
+	if c.svr.NoRetain {
+		x.props.setNum(propRetainAvailable, 0)
+	}
+	if c.svr.NoWildcards {
+		x.props.setNum(propWildcardAvailable, 0)
+	}
+	x.props.setNum(propSharedAvailable, 0)
+	return x
+}
+
+// publishSize returns the size of p encoded for an MQTT 5 client with
+// x, before any topic alias makes it smaller.
+func publishSize(p *proto.Publish, x *v5extra) int {
+	var props, length v5writer
+	if x != nil {
+		props.props(x.props)
+	} else {
+		props.props(nil)
+	}
+	n := 2 + len(p.TopicName) + props.Len() + p.Payload.Size()
+	if p.Header.QosLevel.HasId() {
+		n += 2
+	}
+	length.varint(uint32(n))
+	return 1 + length.Len() + n
+}
+
+var errMalformed = errors.New("malformed MQTT 5 packet")
+
+// A v5reader takes apart the body of a packet. Once it runs out of
+// bytes, it returns zeroes and sets err.
+type v5reader struct {
+	b   []byte
+	err error
+}
+
+func (r *v5reader) next(n int) []byte {
+	if n > len(r.b) {
+		r.err = errMalformed
+		r.b = nil
+		return make([]byte, n)
+	}
+	res := r.b[:n]
+	r.b = r.b[n:]
+	return res
+}
+
+func (r *v5reader) byte() byte     { return r.next(1)[0] }
+func (r *v5reader) uint16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *v5reader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *v5reader) string() string { return string(r.next(int(r.uint16()))) }
+
+func (r *v5reader) varint() uint32 {
+	var n uint32
+	for i := uint(0); i < 4; i++ {
+		b := r.byte()
+		n |= uint32(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	r.err = errMalformed
+	return 0
+}
+
+func (r *v5reader) props() properties {
+	n := int(r.varint())
+	if n > len(r.b) {
+		r.err = errMalformed
+		return nil
+	}
+	pr := &v5reader{b: r.next(n)}
+	var ps properties
+	for len(pr.b) > 0 && pr.err == nil {
+		p := property{id: pr.byte()}
+		switch propKinds[p.id] {
+		case kindByte:
+			p.n = uint32(pr.byte())
+		case kindUint16:
+			p.n = uint32(pr.uint16())
+		case kindUint32:
+			p.n = pr.uint32()
+		case kindVarint:
+			p.n = pr.varint()
+		case kindString, kindBinary:
+			p.s = pr.string()
+		case kindPair:
+			p.k = pr.string()
+			p.s = pr.string()
+		default:
+			pr.err = fmt.Errorf("unknown MQTT 5 property 0x%02x", p.id)
+		}
+		ps = append(ps, p)
+	}
+	if pr.err != nil {
+		r.err = pr.err
+	}
+	return ps
+}
+
+// connectLevel returns the protocol level of frame if it is a CONNECT,
+// and 0 if it is not.
+func connectLevel(frame []byte) byte {
+	if len(frame) < 2 || frame[0]>>4 != 1 {
+		return 0
+	}
+	r := &v5reader{b: frame[1:]}
+	r.varint()
+	r.string()
+	level := r.byte()
+	if r.err != nil {
+		return 0
+	}
+	return level
+}
+
+// decodeV5 decodes one MQTT 5 packet sent by a client, from the fixed
+// header to the end.
+func decodeV5(frame []byte) (proto.Message, *v5extra, error) {
+	return decodeV5Pooled(frame, nil)
+}
+
+// decodeV5Pooled is decodeV5 for a frame in buf, a buffer from the
+// pool. The payload of a PUBLISH is left in it, held by the caller;
+// if buf is nil, it is copied.
+func decodeV5Pooled(frame []byte, buf *[]byte) (proto.Message, *v5extra, error) {
+	if len(frame) < 2 {
+		return nil, nil, errMalformed
+	}
+	typ, flags := frame[0]>>4, frame[0]&0x0f
+	r := &v5reader{b: frame[1:]}
+	if n := r.varint(); r.err != nil || int(n) != len(r.b) {
+		return nil, nil, errMalformed
+	}
+	hdr := proto.Header{
+		DupFlag:  flags&0x08 != 0,
+		QosLevel: proto.QosLevel(flags >> 1 & 0x03),
+		Retain:   flags&0x01 != 0,
+	}
+
+	var m proto.Message
+	x := &v5extra{}
+	switch typ {
+	case 1:
+		c := &proto.Connect{}
+		c.ProtocolName = r.string()
+		c.ProtocolVersion = r.byte()
+		cf := r.byte()
+		c.CleanSession = cf&0x02 != 0
+		c.WillFlag = cf&0x04 != 0
+		c.WillQos = proto.QosLevel(cf >> 3 & 0x03)
+		c.WillRetain = cf&0x20 != 0
+		c.PasswordFlag = cf&0x40 != 0
+		c.UsernameFlag = cf&0x80 != 0
+		c.KeepAliveTimer = r.uint16()
+		x.props = r.props()
+		c.ClientId = r.string()
+		if c.WillFlag {
+			x.will = r.props()
+			c.WillTopic = r.string()
+			c.WillMessage = r.string()
+		}
+		if c.UsernameFlag {
+			c.Username = r.string()
+		}
+		if c.PasswordFlag {
+			c.Password = r.string()
+		}
+		m = c
+	case 3:
+		p := &proto.Publish{Header: hdr}
+		p.TopicName = r.string()
+		if p.Header.QosLevel.HasId() {
+			p.MessageId = r.uint16()
+		}
+		x.props = r.props()
+		if buf != nil {
+			p.Payload = &pooledPayload{b: r.b, buf: buf, refs: 1}
+		} else {
+			p.Payload = proto.BytesPayload(append([]byte(nil), r.b...))
+		}
+		r.b = nil
+		m = p
+	case 4, 5, 6, 7:
+		id := r.uint16()
+		if len(r.b) > 0 {
+			x.reason = r.byte()
+		}
+		if len(r.b) > 0 {
+			x.props = r.props()
+		}
+		switch typ {
+		case 4:
+			m = &proto.PubAck{Header: hdr, MessageId: id}
+		case 5:
+			m = &proto.PubRec{Header: hdr, MessageId: id}
+		case 6:
+			m = &proto.PubRel{Header: hdr, MessageId: id}
+		case 7:
+			m = &proto.PubComp{Header: hdr, MessageId: id}
+		}
+	case 8:
+		s := &proto.Subscribe{Header: hdr}
+		s.MessageId = r.uint16()
+		x.props = r.props()
+		for len(r.b) > 0 && r.err == nil {
+			topic := r.string()
+			opts := r.byte()
+			s.Topics = append(s.Topics, proto.TopicQos{Topic: topic, Qos: proto.QosLevel(opts & 0x03)})
+			x.options = append(x.options, opts)
+		}
+		m = s
+	case 10:
+		u := &proto.Unsubscribe{Header: hdr}
+		u.MessageId = r.uint16()
+		x.props = r.props()
+		for len(r.b) > 0 && r.err == nil {
+			u.Topics = append(u.Topics, r.string())
+		}
+		m = u
+	case 12:
+		m = &proto.PingReq{Header: hdr}
+	case 14:
+		if len(r.b) > 0 {
+			x.reason = r.byte()
+		}
+		if len(r.b) > 0 {
+			x.props = r.props()
+		}
+		m = &proto.Disconnect{Header: hdr}
+	default:
+		return nil, nil, fmt.Errorf("unexpected MQTT 5 packet type %v", typ)
+	}
+	if r.err == nil && len(r.b) != 0 {
+		r.err = errMalformed
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return m, x, nil
+}
+
+// decodeV5FromServer decodes one MQTT 5 packet sent by a server, for a
+// ClientConn speaking MQTT 5. The packets that go both ways are decoded
+// as decodeV5Pooled does, with buf. For the others, buf, if not nil,
+// goes back to the pool.
+func decodeV5FromServer(frame []byte, buf *[]byte) (proto.Message, *v5extra, error) {
+	if len(frame) < 2 {
+		return nil, nil, errMalformed
+	}
+	typ := frame[0] >> 4
+	switch typ {
+	case 2, 9, 11, 13:
+	default:
+		m, x, err := decodeV5Pooled(frame, buf)
+		if buf != nil && (typ != 3 || err != nil) {
+			payloadPool.Put(buf)
+		}
+		return m, x, err
+	}
+	if buf != nil {
+		defer payloadPool.Put(buf)
+	}
+	r := &v5reader{b: frame[1:]}
+	if n := r.varint(); r.err != nil || int(n) != len(r.b) {
+		return nil, nil, errMalformed
+	}
+
+	var m proto.Message
+	x := &v5extra{}
+	switch typ {
+	case 2:
+		r.byte() // session present; sessions are always clean
+		x.reason = r.byte()
+		x.props = r.props()
+		m = &proto.ConnAck{ReturnCode: connackCode(x.reason)}
+	case 9:
+		s := &proto.SubAck{MessageId: r.uint16()}
+		x.props = r.props()
+		for len(r.b) > 0 && r.err == nil {
+			code := r.byte()
+			q := proto.QosLevel(code)
+			if code >= reasonUnspecified {
+				q = subscribeFailure
+			}
+			s.TopicsQos = append(s.TopicsQos, q)
+			x.codes = append(x.codes, code)
+		}
+		m = s
+	case 11:
+		u := &proto.UnsubAck{MessageId: r.uint16()}
+		x.props = r.props()
+		x.codes = append([]byte(nil), r.b...)
+		r.b = nil
+		m = u
+	case 13:
+		m = &proto.PingResp{}
+	}
+	if r.err == nil && len(r.b) != 0 {
+		r.err = errMalformed
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return m, x, nil
+}
+
+// connackCode returns the MQTT 3 CONNACK return code for an MQTT 5
+// reason code. The reasons MQTT 3 has no code for, such as "use another
+// server", become "server unavailable".
+func connackCode(reason byte) proto.ReturnCode {
+	for rc, r := range connackReasons {
+		if r == reason {
+			return proto.ReturnCode(rc)
+		}
+	}
+	return proto.RetCodeServerUnavailable
+}
+
+// A v5writer puts together the body of a packet.
+type v5writer struct {
+	bytes.Buffer
+}
+
+func (w *v5writer) uint16(n uint16) {
+	w.WriteByte(byte(n >> 8))
+	w.WriteByte(byte(n))
+}
+
+func (w *v5writer) uint32(n uint32) {
+	w.uint16(uint16(n >> 16))
+	w.uint16(uint16(n))
+}
+
+func (w *v5writer) varint(n uint32) {
+	for {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			w.WriteByte(b)
+			return
+		}
+		w.WriteByte(b | 0x80)
+	}
+}
+
+func (w *v5writer) string(s string) {
+	w.uint16(uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *v5writer) props(ps properties) {
+	var pw v5writer
+	for _, p := range ps {
+		pw.WriteByte(p.id)
+		switch propKinds[p.id] {
+		case kindByte:
+			pw.WriteByte(byte(p.n))
+		case kindUint16:
+			pw.uint16(uint16(p.n))
+		case kindUint32:
+			pw.uint32(p.n)
+		case kindVarint:
+			pw.varint(p.n)
+		case kindString, kindBinary:
+			pw.string(p.s)
+		case kindPair:
+			pw.string(p.k)
+			pw.string(p.s)
+		}
+	}
+	w.varint(uint32(pw.Len()))
+	w.Write(pw.Bytes())
+}
+
+// encodeV5 writes m as an MQTT 5 packet, with the parts in x, which
+// may be nil. The server sends most of them; a ClientConn speaking
+// MQTT 5 sends CONNECT, SUBSCRIBE, UNSUBSCRIBE and PINGREQ too.
+func encodeV5(w io.Writer, m proto.Message, x *v5extra) error {
+	if x == nil {
+		x = &v5extra{}
+	}
+	var typ, flags byte
+	var body v5writer
+
+	// The acks leave out the reason code and properties when there
+	// is nothing to say.
+	ack := func(t byte, id uint16) {
+		typ = t
+		body.uint16(id)
+		if x.reason != reasonSuccess || len(x.props) != 0 {
+			body.WriteByte(x.reason)
+			body.props(x.props)
+		}
+	}
+
+	switch m := m.(type) {
+	case *proto.Connect:
+		typ = 1
+		body.string(m.ProtocolName)
+		body.WriteByte(m.ProtocolVersion)
+		var cf byte
+		if m.CleanSession {
+			cf |= 0x02
+		}
+		if m.WillFlag {
+			cf |= 0x04 | byte(m.WillQos)<<3
+			if m.WillRetain {
+				cf |= 0x20
+			}
+		}
+		if m.PasswordFlag {
+			cf |= 0x40
+		}
+		if m.UsernameFlag {
+			cf |= 0x80
+		}
+		body.WriteByte(cf)
+		body.uint16(m.KeepAliveTimer)
+		body.props(x.props)
+		body.string(m.ClientId)
+		if m.WillFlag {
+			body.props(x.will)
+			body.string(m.WillTopic)
+			body.string(m.WillMessage)
+		}
+		if m.UsernameFlag {
+			body.string(m.Username)
+		}
+		if m.PasswordFlag {
+			body.string(m.Password)
+		}
+	case *proto.ConnAck:
+		typ = 2
+		reason := x.reason
+		if reason == reasonSuccess && int(m.ReturnCode) < len(connackReasons) {
+			reason = connackReasons[m.ReturnCode]
+		}
+		body.WriteByte(0) // sessions are always clean, so no session present
+		body.WriteByte(reason)
+		body.props(x.props)
+	case *proto.Publish:
+		typ = 3
+		if m.Header.DupFlag {
+			flags |= 0x08
+		}
+		flags |= byte(m.Header.QosLevel) << 1
+		if m.Header.Retain {
+			flags |= 0x01
+		}
+		body.string(m.TopicName)
+		if m.Header.QosLevel.HasId() {
+			body.uint16(m.MessageId)
+		}
+		body.props(x.props)
+		if err := m.Payload.WritePayload(&body); err != nil {
+			return err
+		}
+	case *proto.PubAck:
+		ack(4, m.MessageId)
+	case *proto.PubRec:
+		ack(5, m.MessageId)
+	case *proto.PubRel:
+		ack(6, m.MessageId)
+		flags = 0x02
+	case *proto.PubComp:
+		ack(7, m.MessageId)
+	case *proto.Subscribe:
+		typ, flags = 8, 0x02
+		body.uint16(m.MessageId)
+		body.props(x.props)
+		for i, tq := range m.Topics {
+			body.string(tq.Topic)
+			opts := byte(tq.Qos)
+			if i < len(x.options) {
+				opts = x.options[i]
+			}
+			body.WriteByte(opts)
+		}
+	case *proto.SubAck:
+		typ = 9
+		body.uint16(m.MessageId)
+		body.props(x.props)
+		for _, q := range m.TopicsQos {
+			body.WriteByte(byte(q))
+		}
+	case *proto.UnsubAck:
+		typ = 11
+		body.uint16(m.MessageId)
+		body.props(x.props)
+		body.Write(x.codes)
+	case *proto.Unsubscribe:
+		typ, flags = 10, 0x02
+		body.uint16(m.MessageId)
+		body.props(x.props)
+		for _, t := range m.Topics {
+			body.string(t)
+		}
+	case *proto.PingReq:
+		typ = 12
+	case *proto.PingResp:
+		typ = 13
+	case *proto.Disconnect:
+		typ = 14
+		body.WriteByte(x.reason)
+		body.props(x.props)
+	default:
+		return fmt.Errorf("cannot encode %T as MQTT 5", m)
+	}
+
+	var hdr v5writer
+	hdr.WriteByte(typ<<4 | flags)
+	hdr.varint(uint32(body.Len()))
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
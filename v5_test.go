@@ -0,0 +1,383 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// frame5 puts a fixed header on a packet body.
+func frame5(first byte, body *v5writer) []byte {
+	var w v5writer
+	w.WriteByte(first)
+	w.varint(uint32(body.Len()))
+	w.Write(body.Bytes())
+	return w.Bytes()
+}
+
+func TestDecodeConnect5(t *testing.T) {
+	var b v5writer
+	b.string("MQTT")
+	b.WriteByte(protocol5)
+	b.WriteByte(0x80 | 0x20 | 0x08 | 0x04 | 0x02) // user name, will retain, will QoS 1, will, clean start
+	b.uint16(30)
+	b.props(properties{{id: propSessionExpiry, n: 3600}, {id: propReceiveMaximum, n: 10}})
+	b.string("client")
+	b.props(properties{{id: propWillDelay, n: 5}, {id: propContentType, s: "text/plain"}})
+	b.string("will/topic")
+	b.string("gone")
+	b.string("user")
+	frame := frame5(0x10, &b)
+
+	if l := connectLevel(frame); l != protocol5 {
+		t.Fatalf("connectLevel is %v", l)
+	}
+	m, x, err := decodeV5(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &proto.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: protocol5,
+		CleanSession:    true,
+		WillFlag:        true,
+		WillQos:         proto.QosAtLeastOnce,
+		WillRetain:      true,
+		UsernameFlag:    true,
+		KeepAliveTimer:  30,
+		ClientId:        "client",
+		WillTopic:       "will/topic",
+		WillMessage:     "gone",
+		Username:        "user",
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+	if n, _ := x.props.num(propReceiveMaximum); n != 10 {
+		t.Errorf("receive maximum is %v", n)
+	}
+	if n, _ := x.will.num(propWillDelay); n != 5 {
+		t.Errorf("will delay is %v", n)
+	}
+	if fwd := x.will.forwarded(); len(fwd) != 1 || fwd[0].s != "text/plain" {
+		t.Errorf("forwarded will properties are %v", fwd)
+	}
+}
+
+func TestPublish5(t *testing.T) {
+	m := &proto.Publish{
+		Header:    header(dupTrue, proto.QosExactlyOnce, retainTrue),
+		TopicName: "a/b",
+		MessageId: 42,
+		Payload:   proto.BytesPayload("hello"),
+	}
+	x := &v5extra{props: properties{
+		{id: propMessageExpiry, n: 60},
+		{id: propUserProperty, k: "key", s: "value"},
+		{id: propCorrelationData, s: "\x00\x01"},
+	}}
+	var buf bytes.Buffer
+	if err := encodeV5(&buf, m, x); err != nil {
+		t.Fatal(err)
+	}
+	got, gotx, err := decodeV5(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+	if !reflect.DeepEqual(gotx.props, x.props) {
+		t.Errorf("got properties %+v, want %+v", gotx.props, x.props)
+	}
+}
+
+func TestEncode5(t *testing.T) {
+	for _, test := range []struct {
+		m    proto.Message
+		x    *v5extra
+		want []byte
+	}{
+		{&proto.ConnAck{ReturnCode: proto.RetCodeBadUsernameOrPassword}, nil,
+			[]byte{0x20, 3, 0, 0x86, 0}},
+		{&proto.ConnAck{}, &v5extra{props: properties{{id: propSharedAvailable}}},
+			[]byte{0x20, 5, 0, 0, 2, propSharedAvailable, 0}},
+		{&proto.PubAck{MessageId: 7}, nil,
+			[]byte{0x40, 2, 0, 7}},
+		{&proto.PubRec{MessageId: 7}, &v5extra{reason: reasonUnspecified},
+			[]byte{0x50, 4, 0, 7, 0x80, 0}},
+		{pubRel(7), nil,
+			[]byte{0x62, 2, 0, 7}},
+		{&proto.SubAck{MessageId: 1, TopicsQos: []proto.QosLevel{1, subscribeFailure}}, nil,
+			[]byte{0x90, 5, 0, 1, 0, 1, 0x80}},
+		{&proto.UnsubAck{MessageId: 1}, &v5extra{codes: []byte{0, reasonNoSubscriptionExisted}},
+			[]byte{0xb0, 5, 0, 1, 0, 0, 0x11}},
+		{&proto.Disconnect{}, &v5extra{reason: reasonProtocolError},
+			[]byte{0xe0, 2, 0x82, 0}},
+	} {
+		var buf bytes.Buffer
+		if err := encodeV5(&buf, test.m, test.x); err != nil {
+			t.Errorf("%T: %v", test.m, err)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), test.want) {
+			t.Errorf("%T: got % x, want % x", test.m, buf.Bytes(), test.want)
+		}
+	}
+}
+
+func TestDecodeMalformed5(t *testing.T) {
+	var sub v5writer
+	sub.uint16(1)
+	sub.props(nil)
+	sub.string("a/+")
+	sub.WriteByte(0x21) // QoS 1, retain handling 2
+	good := frame5(0x82, &sub)
+	m, x, err := decodeV5(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := m.(*proto.Subscribe); len(s.Topics) != 1 || s.Topics[0].Qos != proto.QosAtLeastOnce || x.options[0]>>4 != 2 {
+		t.Errorf("got %+v, options % x", s, x.options)
+	}
+
+	for _, frame := range [][]byte{
+		good[:len(good)-1],                    // remaining length too long
+		append(good[:len(good):len(good)], 0), // remaining length too short
+		{0x30, 4, 0, 9, 'a', 'b'},             // topic longer than the packet
+		{0xe0, 2, 0, 1},                       // properties longer than the packet
+		{0xe0, 3, 0, 1, 0x7f},                 // unknown property
+		{0xf0, 0},                             // AUTH
+	} {
+		if _, _, err := decodeV5(frame); err == nil {
+			t.Errorf("no error decoding % x", frame)
+		}
+	}
+}
+
+func TestFresh(t *testing.T) {
+	now := time.Now()
+	x := &v5extra{
+		props:   properties{{id: propMessageExpiry, n: 60}},
+		expires: now.Add(60 * time.Second),
+	}
+	got, ok := x.fresh(now.Add(20*time.Second + time.Millisecond))
+	if n, _ := got.props.num(propMessageExpiry); !ok || n != 40 {
+		t.Errorf("got %v, %v seconds left", ok, n)
+	}
+	if n, _ := x.props.num(propMessageExpiry); n != 60 {
+		t.Errorf("the original was changed to %v", n)
+	}
+	if _, ok := x.fresh(now.Add(61 * time.Second)); ok {
+		t.Error("fresh after expiry")
+	}
+	if got, ok := (*v5extra)(nil).fresh(now); got != nil || !ok {
+		t.Error("nil is not fresh")
+	}
+}
+
+func TestTopicAlias(t *testing.T) {
+	c := newTestConn(&Server{TopicAliasMaximum: 2}, "c")
+
+	in := func(topic string, alias uint32) (string, bool) {
+		m := &proto.Publish{TopicName: topic}
+		ok := c.resolveAlias(m, &v5extra{props: properties{{id: propTopicAlias, n: alias}}})
+		return m.TopicName, ok
+	}
+	if _, ok := in("a/b", 1); !ok {
+		t.Error("could not set alias 1")
+	}
+	if topic, ok := in("", 1); !ok || topic != "a/b" {
+		t.Errorf("alias 1 is %q, %v", topic, ok)
+	}
+	for _, alias := range []uint32{0, 2, 3} {
+		if _, ok := in("", alias); ok {
+			t.Errorf("alias %v resolved", alias)
+		}
+	}
+
+	// The client takes 1 alias, so only the first topic gets one.
+	c.props = properties{{id: propTopicAliasMaximum, n: 1}}
+	x := &v5extra{props: properties{{id: propContentType, s: "text/plain"}}}
+	for _, want := range []struct {
+		topic, sent string
+		alias       uint32
+	}{
+		{"a", "a", 1},
+		{"b", "b", 0},
+		{"a", "", 1},
+	} {
+		m, mx := c.alias(&proto.Publish{TopicName: want.topic}, x)
+		alias, _ := mx.props.num(propTopicAlias)
+		if m.TopicName != want.sent || alias != want.alias {
+			t.Errorf("%v went as %q with alias %v", want.topic, m.TopicName, alias)
+		}
+	}
+	if len(x.props) != 1 {
+		t.Errorf("shared properties changed to %v", x.props)
+	}
+}
+
+func TestSubscriptionId(t *testing.T) {
+	s := newSubscriptions(1)
+	s.overlaps = true // a copy for each subscription, with its identifier
+	c := newTestConn(&Server{}, "c")
+	s.setSubId(c, "a/+", 7)
+	s.add("a/+", c, proto.QosAtMostOnce)
+	s.add("a/b", c, proto.QosAtMostOnce)
+
+	x := &v5extra{props: properties{{id: propContentType, s: "text/plain"}}}
+	s.submitWith(nil, &proto.Publish{TopicName: "a/b", Payload: proto.BytesPayload("x")}, x)
+	ids := make(map[uint32]bool)
+	for i := 0; i < 2; i++ {
+		id, _ := (<-c.jobs).x.props.num(propSubscriptionId)
+		ids[id] = true
+	}
+	if !ids[0] || !ids[7] {
+		t.Errorf("sent with subscription identifiers %v", ids)
+	}
+	if len(x.props) != 1 {
+		t.Errorf("shared properties changed to %v", x.props)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	s := &Server{NoRetain: true, NoWildcards: true, QosPolicy: QosPolicy{NoQos2: true}}
+	c := newTestConn(s, "c")
+	x := c.connackExtra("c", false)
+	for id, want := range map[byte]uint32{propMaximumQos: 1, propRetainAvailable: 0, propWildcardAvailable: 0} {
+		if n, ok := x.props.num(id); !ok || n != want {
+			t.Errorf("property %#x is %v, %v", id, n, ok)
+		}
+	}
+
+	c.svr = &Server{}
+	x = c.connackExtra("c", false)
+	for _, id := range []byte{propMaximumQos, propRetainAvailable, propWildcardAvailable} {
+		if _, ok := x.props.num(id); ok {
+			t.Errorf("property %#x sent by default", id)
+		}
+	}
+}
+
+func TestMaximumPacketSize(t *testing.T) {
+	m := &proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), TopicName: "a/b", Payload: proto.BytesPayload("hello")}
+	x := &v5extra{props: properties{{id: propContentType, s: "text/plain"}}}
+	var buf bytes.Buffer
+	encodeV5(&buf, m, x)
+	if n := publishSize(m, x); n != buf.Len() {
+		t.Errorf("publishSize is %v, encoded %v bytes", n, buf.Len())
+	}
+
+	c := newTestConn(&Server{stats: &stats{}}, "c")
+	c.version = protocol5
+	c.maxPacket = 30
+	buf.Reset()
+	w := &connWriter{bw: bufio.NewWriter(&buf)}
+	small := &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")}
+	big := &proto.Publish{TopicName: "a", Payload: proto.BytesPayload(make([]byte, 100))}
+	for _, m := range []*proto.Publish{big, small} {
+		if !c.send(job{m: m}, w) {
+			t.Fatal("send failed")
+		}
+	}
+	w.bw.Flush()
+	if buf.Len() != publishSize(small, nil) || c.dropped != 1 {
+		t.Errorf("wrote %v bytes, dropped %v messages", buf.Len(), c.dropped)
+	}
+}
+
+// readV5 reads the next MQTT 5 packet from the server on br.
+func readV5(t *testing.T, br *bufio.Reader) (proto.Message, *v5extra) {
+	t.Helper()
+	n, hlen, err := peekHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, hlen+n)
+	io.ReadFull(br, frame)
+	m, x, err := decodeV5FromServer(frame, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, x
+}
+
+func TestSubAckNotAuthorized(t *testing.T) {
+	_, l, dial := testServer(t, func(s *Server) {
+		s.Authorize = func(tenant, username, clientid, topic string, subscribe bool) bool { return false }
+	})
+	defer l.Close()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	read := func() (proto.Message, *v5extra) { return readV5(t, br) }
+
+	encodeV5(conn, &proto.Connect{ProtocolName: "MQTT", ProtocolVersion: protocol5, CleanSession: true, ClientId: "c", KeepAliveTimer: 60}, nil)
+	read()
+	encodeV5(conn, &proto.Subscribe{MessageId: 1, Topics: []proto.TopicQos{{Topic: "a", Qos: proto.QosAtMostOnce}}}, nil)
+	if _, x := read(); len(x.codes) != 1 || x.codes[0] != reasonNotAuthorized {
+		t.Errorf("got % x, want %#x", x.codes, reasonNotAuthorized)
+	}
+}
+
+func TestPubAckReasons(t *testing.T) {
+	_, l, dial := testServer(t, func(s *Server) {
+		s.Authorize = func(tenant, username, clientid, topic string, subscribe bool) bool {
+			return !strings.HasPrefix(topic, "secret/")
+		}
+		s.PayloadLimits = []PayloadLimit{
+			{Filter: "firmware/#", Max: 4},
+			{Filter: "telemetry/#", Max: 4, Action: PayloadTruncate},
+		}
+	})
+	defer l.Close()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	encodeV5(conn, &proto.Connect{ProtocolName: "MQTT", ProtocolVersion: protocol5, CleanSession: true, ClientId: "c", KeepAliveTimer: 60}, nil)
+	readV5(t, br)
+
+	for i, tc := range []struct {
+		topic  string
+		qos    proto.QosLevel
+		reason byte
+	}{
+		{"a", proto.QosAtLeastOnce, reasonSuccess},
+		{"secret/x", proto.QosAtLeastOnce, reasonNotAuthorized},
+		{"firmware/v2", proto.QosAtLeastOnce, reasonQuotaExceeded},
+		{"telemetry/t", proto.QosAtLeastOnce, reasonQuotaExceeded},
+		{"secret/x", proto.QosExactlyOnce, reasonNotAuthorized},
+		{"firmware/v2", proto.QosExactlyOnce, reasonQuotaExceeded},
+	} {
+		encodeV5(conn, &proto.Publish{
+			Header:    header(dupFalse, tc.qos, retainFalse),
+			MessageId: uint16(i + 1),
+			TopicName: tc.topic,
+			Payload:   proto.BytesPayload("123456"),
+		}, nil)
+		m, x := readV5(t, br)
+		var id uint16
+		switch m := m.(type) {
+		case *proto.PubAck:
+			id = m.MessageId
+		case *proto.PubRec:
+			id = m.MessageId
+		}
+		if id != uint16(i+1) || x.reason != tc.reason {
+			t.Errorf("%v at QoS %v: got %T %v with reason %#x, want %#x", tc.topic, tc.qos, m, id, x.reason, tc.reason)
+		}
+	}
+}
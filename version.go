@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	proto "github.com/huin/mqtt"
+)
+
+// version is the version of the package. Release builds set it with
+//
+//	go build -ldflags "-X github.com/jeffallen/mqtt.version=v1.2.3"
+//
+// Otherwise, Version finds out what it can from the build info.
+var version string
+
+const modulePath = "github.com/jeffallen/mqtt"
+
+// Version returns the version of the package and the Go version it
+// was built with, like "v1.2.3 go1.21.0". The broker publishes it in
+// $SYS/broker/version, so that operators can tell which build a fleet
+// is talking to.
+func Version() string {
+	v := version
+	if v == "" {
+		v = buildVersion()
+	}
+	return v + " " + runtime.Version()
+}
+
+// buildVersion returns the module version recorded in the binary, or
+// the VCS revision for a build of the module itself.
+func buildVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if bi.Main.Path != modulePath {
+		for _, dep := range bi.Deps {
+			if dep.Path == modulePath {
+				return dep.Version
+			}
+		}
+		return "devel"
+	}
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			return "devel-" + s.Value
+		}
+	}
+	return "devel"
+}
+
+// BuildProfile returns "lite" when the package was built with the
+// mqttlite build tag, and "full" otherwise. The lite profile is for
+// embedding the broker in small gateway binaries: it leaves out the
+// $SYS statistics, which also saves their goroutine and timers, and
+// webhook rules and the WebSocket transport, which saves net/http.
+func BuildProfile() string {
+	if liteProfile {
+		return "lite"
+	}
+	return "full"
+}
+
+// versionMessage is the retained message for $SYS/broker/version.
+func versionMessage() *proto.Publish {
+	return &proto.Publish{
+		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+		TopicName: "$SYS/broker/version",
+		Payload:   proto.BytesPayload(Version()),
+	}
+}
@@ -0,0 +1,35 @@
+package mqtt
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestVersion(t *testing.T) {
+	if v := Version(); !strings.HasSuffix(v, " "+runtime.Version()) || strings.HasPrefix(v, " ") {
+		t.Errorf("version is %q", v)
+	}
+	defer func(v string) { version = v }(version)
+	version = "v1.2.3"
+	want := "v1.2.3 " + runtime.Version()
+	if v := Version(); v != want {
+		t.Errorf("version is %q, want %q", v, want)
+	}
+
+	_, l, dial := testServer(t, nil)
+	defer l.Close()
+	cc, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	cc.Subscribe([]proto.TopicQos{{Topic: "$SYS/broker/version", Qos: proto.QosAtMostOnce}})
+	m := receive(cc, time.Second)
+	if m == nil || !m.Header.Retain || string(m.Payload.(proto.BytesPayload)) != want {
+		t.Errorf("got %v, want %q retained", m, want)
+	}
+}
@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A RetainEvent tells a watcher that the retained message of a topic
+// was set or deleted.
+type RetainEvent struct {
+	Topic   string
+	Deleted bool
+	Size    int // the size of the new payload, when not Deleted
+}
+
+// The number of events buffered for each watcher.
+const watchQueueLength = 100
+
+// WatchRetained returns a channel on which the changes to the retained
+// messages of a tenant are reported, for instance to mirror them into
+// a cache. If the receiver falls more than a hundred events behind,
+// events are dropped, so it should start over with RetainedMessages
+// when it cannot keep up. Call stop when done; it closes the channel.
+func (s *Server) WatchRetained(tenant string) (events <-chan RetainEvent, stop func()) {
+	ch := make(chan RetainEvent, watchQueueLength)
+	s.subs.mu.Lock()
+	p := s.subs.part(tenant)
+	p.watchers = append(p.watchers, ch)
+	s.subs.mu.Unlock()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			s.subs.mu.Lock()
+			p := s.subs.part(tenant)
+			for i := range p.watchers {
+				if p.watchers[i] == ch {
+					p.watchers = append(p.watchers[:i], p.watchers[i+1:]...)
+					break
+				}
+			}
+			s.subs.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, stop
+}
+
+// setRetain stores m, and its MQTT 5 properties x, as the retained
+// message of its topic. s.mu must be held.
+func (p *partition) setRetain(m proto.Publish, x *v5extra) {
+	p.seq++
+	p.retain[m.TopicName] = retain{m: m, x: x, seq: p.seq}
+	p.notify(RetainEvent{Topic: m.TopicName, Size: m.Payload.Size()})
+}
+
+// deleteRetain removes the retained message of topic.
+// s.mu must be held.
+func (p *partition) deleteRetain(topic string) {
+	if _, ok := p.retain[topic]; !ok {
+		return
+	}
+	delete(p.retain, topic)
+	p.notify(RetainEvent{Topic: topic, Deleted: true})
+}
+
+func (p *partition) notify(ev RetainEvent) {
+	for _, ch := range p.watchers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// retainedTopic returns the retained message of topic, and its
+// sequence number, if there is one.
+func (s *subscriptions) retainedTopic(tenant, topic string) (m proto.Publish, seq uint64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.part(tenant).retain[topic]
+	if !ok || r.expired(time.Now()) {
+		return m, 0, false
+	}
+	return r.m, r.seq, true
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestWatchRetained(t *testing.T) {
+	svr, l, dial := testServer(t, nil)
+	defer l.Close()
+	events, stop := svr.WatchRetained("")
+	others, stopOthers := svr.WatchRetained("other")
+	defer stopOthers()
+
+	// next skips the events of the retained $SYS topics.
+	next := func() RetainEvent {
+		for {
+			select {
+			case ev := <-events:
+				if !strings.HasPrefix(ev.Topic, "$SYS/") {
+					return ev
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no event")
+			}
+		}
+	}
+
+	svr.SetRetained("", &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("12345")})
+	if ev := next(); ev != (RetainEvent{Topic: "a", Size: 5}) {
+		t.Errorf("got %+v", ev)
+	}
+
+	// Changes made by clients are reported too.
+	cc, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	cc.Publish(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainTrue),
+		TopicName: "a",
+		Payload:   proto.BytesPayload{},
+	})
+	if ev := next(); ev != (RetainEvent{Topic: "a", Deleted: true}) {
+		t.Errorf("got %+v", ev)
+	}
+
+	select {
+	case ev := <-others:
+		t.Errorf("another tenant got %+v", ev)
+	default:
+	}
+
+	stop()
+	stop()
+	svr.SetRetained("", &proto.Publish{TopicName: "b", Payload: proto.BytesPayload("x")})
+	for ev := range events {
+		if ev.Topic == "b" {
+			t.Error("event after stop")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !mqttlite
+// +build !mqttlite
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A webhook is a Sink that POSTs messages to a URL.
+type webhook string
+
+func newWebhook(url string) (Sink, error) {
+	return webhook(url), nil
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (url webhook) Deliver(m *proto.Publish) error {
+	var buf bytes.Buffer
+	if err := m.Payload.WritePayload(&buf); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", string(url), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-MQTT-Topic", m.TopicName)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %v: %v", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build mqttlite
+// +build mqttlite
+
+package mqtt
+
+import "errors"
+
+// newWebhook fails, because the mqttlite build leaves out net/http.
+func newWebhook(url string) (Sink, error) {
+	return nil, errors.New("webhooks are not in the mqttlite build")
+}
@@ -0,0 +1,496 @@
+//go:build !mqttlite
+// +build !mqttlite
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The listener id of the clients that come in through WebSocketHandler.
+// It is not the id of any listener, so RemoveListener leaves them be.
+const webSocketListener = -1
+
+// The subprotocols of MQTT over WebSocket. The first is the standard
+// one; some older clients ask for the second.
+var webSocketProtocols = []string{"mqtt", "mqttv3.1"}
+
+// webSocketGUID is the constant that the Sec-WebSocket-Accept header
+// is made with, from RFC 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC11B65"
+
+// ErrWebSocketHandshake is returned by DialWebSocket when the server
+// does not upgrade the connection to a WebSocket.
+var ErrWebSocketHandshake = errors.New("websocket handshake failed")
+
+// errWebSocketClosed is returned by the Accept of a closed listener of
+// WebSocketTransport.
+var errWebSocketClosed = errors.New("websocket listener closed")
+
+// WebSocketHandler returns a handler that accepts MQTT over WebSocket,
+// for browsers and clients behind firewalls that only let HTTP out.
+// Mount it on any path of an http.Server, which takes care of TLS if
+// need be. The clients it accepts are handled like the ones of the
+// listeners, except that RemoveListener does not see them. Once the
+// server has stopped, it answers "service unavailable".
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-s.Done:
+			http.Error(w, "server stopped", http.StatusServiceUnavailable)
+			return
+		default:
+		}
+		conn, err := acceptWebSocket(w, r)
+		if err != nil {
+			log.Print("websocket: ", r.RemoteAddr, ": ", err)
+			return
+		}
+		s.serve(webSocketListener, conn)
+	})
+}
+
+// WebSocketTransport is MQTT over WebSocket, at Path, or /mqtt if it is
+// empty. With TLS set, it is over wss: to listen, TLS must hold the
+// certificates of the server, and to dial it is used as by DialTLS.
+// Use WebSocketHandler instead to share an http.Server with other
+// handlers.
+type WebSocketTransport struct {
+	Path string
+	TLS  *tls.Config
+}
+
+// webSocketTransport returns the WebSocketTransport for ParseURL.
+func webSocketTransport(path string, cfg *tls.Config) (Transport, error) {
+	return WebSocketTransport{Path: path, TLS: cfg}, nil
+}
+
+func (t WebSocketTransport) path() string {
+	if t.Path == "" {
+		return "/mqtt"
+	}
+	return t.Path
+}
+
+func (t WebSocketTransport) Listen(addr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if t.TLS != nil {
+		l, err = TLSTransport{Config: t.TLS}.Listen(addr)
+	} else {
+		l, err = TCPTransport{}.Listen(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wl := &wsListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(t.path(), wl.handle)
+	wl.hs = &http.Server{Handler: mux}
+	go wl.hs.Serve(l)
+	return wl, nil
+}
+
+func (t WebSocketTransport) Dial(addr string) (net.Conn, error) {
+	scheme := "ws://"
+	if t.TLS != nil {
+		scheme = "wss://"
+	}
+	return DialWebSocket(scheme+addr+t.path(), t.TLS)
+}
+
+// A wsListener hands the connections that its http.Server upgrades to
+// Accept.
+type wsListener struct {
+	net.Listener
+	hs    *http.Server
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *wsListener) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := acceptWebSocket(w, r)
+	if err != nil {
+		log.Print("websocket: ", r.RemoteAddr, ": ", err)
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errWebSocketClosed
+	}
+}
+
+// Close stops the listener. The connections it accepted are not closed.
+func (l *wsListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.hs.Close()
+}
+
+// acceptWebSocket does the server side of the handshake, and returns
+// the connection to speak MQTT over. If the request is not a WebSocket
+// upgrade for MQTT, it answers with an error itself.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.Method != "GET" || !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "not a websocket upgrade", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrWebSocketHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "no Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+	protocol := ""
+	for _, p := range webSocketProtocols {
+		if headerHas(r.Header, "Sec-WebSocket-Protocol", p) {
+			protocol = p
+			break
+		}
+	}
+	if protocol == "" {
+		http.Error(w, "the websocket subprotocol must be mqtt", http.StatusBadRequest)
+		return nil, ErrWebSocketHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot take over the connection", http.StatusInternalServerError)
+		return nil, errors.New("http.ResponseWriter is not an http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWSConn(conn, brw.Reader, false), nil
+}
+
+// DialWebSocket connects to the MQTT server at a ws:// or wss:// URL,
+// and returns the connection, ready for NewClientConn. For wss, tlsCfg
+// is used as by DialTLS; it may be nil.
+func DialWebSocket(rawurl string, tlsCfg *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host += ":80"
+		}
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		if u.Port() == "" {
+			host += ":443"
+		}
+		conn, err = DialTLS(host, tlsCfg)
+	default:
+		return nil, errors.New("websocket URL must be ws:// or wss://")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {webSocketProtocols[0]},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, ErrWebSocketHandshake
+	}
+	return newWSConn(conn, br, true), nil
+}
+
+// NewClientConnWS connects to the MQTT server at a ws:// or wss:// URL,
+// and returns a ClientConn for it, ready for Connect.
+func NewClientConnWS(rawurl string, tlsCfg *tls.Config, opts ...ClientOption) (*ClientConn, error) {
+	conn, err := DialWebSocket(rawurl, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientConn(conn, opts...), nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept for a key.
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerHas reports whether one of the comma separated values of the
+// header called name is value, ignoring case.
+func headerHas(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// A wsConn speaks WebSocket over a connection whose handshake is done.
+// MQTT does not care where the frames begin and end, so each Write
+// goes out as a binary frame, and Read returns the payloads of the
+// data frames one after the other. Close closes the connection without
+// a close frame, which could hang behind a write that is stuck; the
+// other side sees it as an abnormal closure, as MQTT over TCP does.
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // clients mask what they send, servers do not
+
+	// Used by Read only.
+	left   int64   // bytes of the current frame not read yet
+	mask   [4]byte // the mask of the current frame, if masked
+	pos    int64   // how far into the current frame we are, for the mask
+	masked bool
+
+	wmu sync.Mutex // guards writes, which come from Read too, for pongs
+}
+
+// A wssConn is a wsConn over TLS. Its ConnectionState lets
+// PeerCertificates and CertAuth see the certificate of the client.
+type wssConn struct {
+	*wsConn
+	tc interface{ ConnectionState() tls.ConnectionState }
+}
+
+func (c wssConn) ConnectionState() tls.ConnectionState {
+	return c.tc.ConnectionState()
+}
+
+// newWSConn returns a wsConn over conn, or a wssConn if conn is a TLS
+// connection.
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) net.Conn {
+	c := &wsConn{Conn: conn, br: br, client: client}
+	if tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return wssConn{wsConn: c, tc: tc}
+	}
+	return c
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.left == 0 {
+		op, n, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsContinuation, wsBinary:
+			c.left = n
+		case wsText:
+			// MQTT only goes in binary frames, and the spec says to
+			// close the connection on a text frame.
+			return 0, errors.New("websocket: text frame")
+		case wsClose, wsPing, wsPong:
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return 0, err
+			}
+			c.unmask(payload)
+			switch op {
+			case wsClose:
+				c.writeFrame(wsClose, payload)
+				return 0, io.EOF
+			case wsPing:
+				if err := c.writeFrame(wsPong, payload); err != nil {
+					return 0, err
+				}
+			}
+		default:
+			return 0, errors.New("websocket: unknown opcode")
+		}
+	}
+	if int64(len(b)) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.left -= int64(n)
+	return n, err
+}
+
+// readHeader reads the header of the next frame, and returns its
+// opcode and payload length. It fails on the frames that break the
+// rules of RFC 6455, which call for closing the connection.
+func (c *wsConn) readHeader() (op byte, n int64, err error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return 0, 0, err
+	}
+	if h[0]&0x70 != 0 {
+		// No extension was negotiated, so RSV1-3 must be 0.
+		return 0, 0, errors.New("websocket: reserved bits set")
+	}
+	fin := h[0]&0x80 != 0
+	op = h[0] & 0x0f
+	c.masked = h[1]&0x80 != 0
+	if c.masked == c.client {
+		return 0, 0, errors.New("websocket: wrong masking")
+	}
+	n = int64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, 0, err
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+		if n < 0 {
+			return 0, 0, errors.New("websocket: frame too long")
+		}
+	}
+	if op >= wsClose && (!fin || n > 125) {
+		return 0, 0, errors.New("websocket: fragmented or too long control frame")
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return 0, 0, err
+		}
+	}
+	c.pos = 0
+	return op, n, nil
+}
+
+// unmask unmasks the next bytes of the current frame, if it is masked.
+func (c *wsConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.pos%4]
+		c.pos++
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame sends payload in one frame, masked if c is a client.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	hdr := make([]byte, 2, 14+len(payload))
+	hdr[0] = 0x80 | op // FIN
+	switch n := len(payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		hdr = append(hdr, ext[:]...)
+	}
+	var mask [4]byte
+	if c.client {
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+	}
+	// One write per frame, so that it goes out in one segment.
+	frame := append(hdr, payload...)
+	if c.client {
+		body := frame[len(hdr):]
+		for i := range body {
+			body[i] ^= mask[i%4]
+		}
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
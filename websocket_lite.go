@@ -0,0 +1,15 @@
+//go:build mqttlite
+// +build mqttlite
+
+package mqtt
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// webSocketTransport fails, because the mqttlite build leaves out
+// net/http.
+func webSocketTransport(path string, cfg *tls.Config) (Transport, error) {
+	return nil, errors.New("WebSocket is not in the mqttlite build")
+}
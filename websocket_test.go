@@ -0,0 +1,182 @@
+//go:build !mqttlite
+// +build !mqttlite
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestWebSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(l)
+	svr.Start()
+	hs := httptest.NewServer(svr.WebSocketHandler())
+	defer hs.Close()
+
+	connect := func() *ClientConn {
+		cc, err := NewClientConnWS(strings.Replace(hs.URL, "http:", "ws:", 1)+"/mqtt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	pub, sub := connect(), connect()
+	defer pub.Disconnect()
+	defer sub.Disconnect()
+	sub.Subscribe([]proto.TopicQos{{Topic: "ws/#", Qos: proto.QosAtLeastOnce}})
+
+	// The lengths that take each of the three frame headers.
+	for _, n := range []int{10, 1000, 100000} {
+		payload := bytes.Repeat([]byte{'x'}, n)
+		pub.Publish(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			TopicName: "ws/a",
+			Payload:   proto.BytesPayload(payload),
+		})
+		select {
+		case m := <-sub.Incoming:
+			if got := m.Payload.(proto.BytesPayload); !bytes.Equal(got, payload) {
+				t.Errorf("%v bytes: got %v bytes back", n, len(got))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v bytes: nothing came back", n)
+		}
+	}
+
+	if _, err := DialWebSocket(hs.URL, nil); err == nil {
+		t.Error("dialed an http:// URL")
+	}
+}
+
+func TestTransports(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(l)
+	svr.Start()
+
+	server := &tls.Config{Certificates: []tls.Certificate{testCert(t, "server")}}
+	client := &tls.Config{InsecureSkipVerify: true}
+	for _, tr := range []struct{ listen, dial Transport }{
+		{TCPTransport{}, TCPTransport{}},
+		{TLSTransport{Config: server}, TLSTransport{Config: client}},
+		{WebSocketTransport{}, WebSocketTransport{}},
+		{WebSocketTransport{Path: "/ws", TLS: server}, WebSocketTransport{Path: "/ws", TLS: client}},
+	} {
+		id, err := svr.AddTransportListener(tr.listen, "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%#v: %v", tr.listen, err)
+		}
+		svr.listeners.mu.Lock()
+		addr := svr.listeners.m[id].Addr().String()
+		svr.listeners.mu.Unlock()
+
+		cc, err := DialTransport(tr.dial, addr)
+		if err != nil {
+			t.Fatalf("%#v: %v", tr.dial, err)
+		}
+		if err := cc.Connect("", ""); err != nil {
+			t.Errorf("%#v: %v", tr.dial, err)
+		}
+		cc.Disconnect()
+		if err := svr.RemoveListener(id); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWebSocketBadFrames(t *testing.T) {
+	noMask := []byte{0, 0, 0, 0}
+	frame := func(b0, b1 byte, payload ...byte) []byte {
+		f := append([]byte{b0, 0x80 | b1}, noMask...)
+		return append(f, payload...)
+	}
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"text", frame(0x81, 1, 'x')},
+		{"reserved bits", frame(0xc2, 1, 'x')},
+		{"fragmented ping", frame(0x09, 0)},
+		{"long ping", append(append([]byte{0x89, 0x80 | 126, 0, 126}, noMask...), make([]byte, 126)...)},
+	} {
+		a, b := net.Pipe()
+		go func() {
+			b.Write(tc.frame)
+			b.Close()
+		}()
+		c := newWSConn(a, bufio.NewReader(a), false)
+		if n, err := c.Read(make([]byte, 10)); err == nil || err == io.EOF {
+			t.Errorf("%v: read %v bytes, err %v", tc.name, n, err)
+		}
+		a.Close()
+	}
+
+	// A binary frame is fine.
+	a, b := net.Pipe()
+	defer a.Close()
+	go b.Write(frame(0x82, 1, 'x'))
+	buf := make([]byte, 10)
+	if n, err := newWSConn(a, bufio.NewReader(a), false).Read(buf); err != nil || string(buf[:n]) != "x" {
+		t.Errorf("binary frame: %q, %v", buf[:n], err)
+	}
+}
+
+func TestWebSocketPeerCertificates(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	svr := NewServer(l)
+	svr.Start()
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, "server")},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	id, err := svr.AddTransportListener(WebSocketTransport{TLS: cfg}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.listeners.mu.Lock()
+	addr := svr.listeners.m[id].Addr().String()
+	svr.listeners.mu.Unlock()
+
+	cert := testCert(t, "device-1")
+	cc, err := DialTransport(WebSocketTransport{TLS: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+	}}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.ClientId = "device-1"
+	if err := cc.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Disconnect()
+	if certs := svr.PeerCertificates("", "device-1"); len(certs) == 0 || certs[0].Subject.CommonName != "device-1" {
+		t.Errorf("got %v certificates over wss", len(certs))
+	}
+}
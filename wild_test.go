@@ -1,8 +1,11 @@
 package mqtt
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+
+	proto "github.com/huin/mqtt"
 )
 
 func TestWild(t *testing.T) {
@@ -43,3 +46,253 @@ func TestWild(t *testing.T) {
 		}
 	}
 }
+
+func benchSubscriptions() *subscriptions {
+	s := newSubscriptions(0)
+	for i := 0; i < 100; i++ {
+		s.add(fmt.Sprintf("sensors/%v/+/temp", i), &incomingConn{}, proto.QosAtMostOnce)
+		s.add(fmt.Sprintf("sensors/%v/room/temp", i), &incomingConn{}, proto.QosAtMostOnce)
+	}
+	s.add("sensors/#", &incomingConn{}, proto.QosAtMostOnce)
+	return s
+}
+
+func BenchmarkSubscribers(b *testing.B) {
+	s := benchSubscriptions()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.subscribers("", "sensors/42/kitchen/temp")
+	}
+}
+
+// The same few topics over and over, which the cache of matchingWilds
+// is for.
+func BenchmarkSubscribersHotTopics(b *testing.B) {
+	s := benchSubscriptions()
+	var topics []string
+	for i := 0; i < 10; i++ {
+		topics = append(topics, fmt.Sprintf("sensors/%v/kitchen/temp", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.subscribers("", topics[i%len(topics)])
+	}
+}
+
+// A subscription every so often, so that the cache of matchingWilds
+// is mostly empty, for comparison.
+func BenchmarkSubscribersUncached(b *testing.B) {
+	s := benchSubscriptions()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.mu.Lock()
+		s.part("").forgetWilds()
+		s.mu.Unlock()
+		s.subscribers("", "sensors/42/kitchen/temp")
+	}
+}
+
+func TestWildCache(t *testing.T) {
+	s := newSubscriptions(0)
+	a, b := &incomingConn{}, &incomingConn{}
+	s.add("a/+", a, proto.QosAtMostOnce)
+	if n := len(s.subscribers("", "a/b")); n != 1 {
+		t.Fatalf("%v subscribers", n)
+	}
+	s.add("a/#", b, proto.QosAtLeastOnce)
+	if n := len(s.subscribers("", "a/b")); n != 2 {
+		t.Errorf("%v subscribers after subscribe", n)
+	}
+	s.add("a/#", b, proto.QosExactlyOnce)
+	for _, m := range s.subscribers("", "a/b") {
+		if m.c == b && m.qos != proto.QosExactlyOnce {
+			t.Errorf("QoS %v after subscribing again", m.qos)
+		}
+	}
+	s.unsub("a/+", a)
+	if n := len(s.subscribers("", "a/b")); n != 1 {
+		t.Errorf("%v subscribers after unsubscribe", n)
+	}
+	s.unsubAll(b)
+	if n := len(s.subscribers("", "a/b")); n != 0 {
+		t.Errorf("%v subscribers after unsubscribing all", n)
+	}
+}
+
+func TestSplitTopic(t *testing.T) {
+	var buf [2]string
+	for _, topic := range []string{"", "/", "a", "a/b", "a//b/", "a/b/c/d/e"} {
+		got := splitTopic(buf[:0], topic)
+		want := strings.Split(topic, "/")
+		if fmt.Sprint(got) != fmt.Sprint(want) || len(got) != len(want) {
+			t.Errorf("%q: got %q, want %q", topic, got, want)
+		}
+	}
+}
+
+func BenchmarkSplitTopic(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf [16]string
+		splitTopic(buf[:0], "sensors/42/kitchen/temp")
+	}
+}
+
+func BenchmarkSplit(b *testing.B) {
+	// The way subscribers used to split, for comparison.
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		strings.Split("sensors/42/kitchen/temp", "/")
+	}
+}
+
+func TestRetainWildcard(t *testing.T) {
+	s := newSubscriptions(0)
+	c := newTestConn(&Server{}, "sub")
+	p := s.part("")
+	for _, topic := range []string{"sensors/1/temp", "sensors/2/temp", "sensors/2/humidity", "other/temp"} {
+		p.setRetain(proto.Publish{
+			Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+			TopicName: topic,
+			Payload:   proto.BytesPayload("x"),
+		}, nil)
+	}
+
+	s.sendRetain("sensors/+/temp", c, proto.QosAtMostOnce)
+	var got []string
+	for len(c.jobs) > 0 {
+		got = append(got, (<-c.jobs).m.(*proto.Publish).TopicName)
+	}
+	if want := []string{"sensors/1/temp", "sensors/2/temp"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSubscriptionQos(t *testing.T) {
+	s := newSubscriptions(1)
+	svr := &Server{}
+	c0, c1 := newTestConn(svr, "c0"), newTestConn(svr, "c1")
+	s.add("a/b", c0, proto.QosExactlyOnce)
+	s.add("a/b", c0, proto.QosAtMostOnce) // resubscribing replaces the QoS
+	s.add("a/+", c1, proto.QosAtLeastOnce)
+
+	s.submit(nil, &proto.Publish{
+		Header:    header(dupFalse, proto.QosExactlyOnce, retainFalse),
+		TopicName: "a/b",
+		MessageId: 1,
+		Payload:   proto.BytesPayload("x"),
+	})
+	if q := (<-c0.jobs).m.(*proto.Publish).Header.QosLevel; q != proto.QosAtMostOnce {
+		t.Errorf("c0 got QoS %v", q)
+	}
+	if q := (<-c1.jobs).m.(*proto.Publish).Header.QosLevel; q != proto.QosAtLeastOnce {
+		t.Errorf("c1 got QoS %v", q)
+	}
+}
+
+func TestOverlappingSubscriptions(t *testing.T) {
+	s := newSubscriptions(1)
+	svr := &Server{}
+	c, other := newTestConn(svr, "c"), newTestConn(svr, "other")
+	s.add("a/#", c, proto.QosAtMostOnce)
+	s.add("a/b", c, proto.QosAtLeastOnce)
+	s.add("a/+", c, proto.QosAtMostOnce)
+	s.add("a/b", other, proto.QosAtMostOnce)
+
+	s.submit(nil, &proto.Publish{
+		Header:    header(dupFalse, proto.QosExactlyOnce, retainFalse),
+		TopicName: "a/b",
+		MessageId: 1,
+		Payload:   proto.BytesPayload("x"),
+	})
+	s.flush()
+	if n := len(c.jobs); n != 1 {
+		t.Fatalf("c got %v copies", n)
+	}
+	if q := (<-c.jobs).m.(*proto.Publish).Header.QosLevel; q != proto.QosAtLeastOnce {
+		t.Errorf("c got QoS %v, want the highest granted", q)
+	}
+	if n := len(other.jobs); n != 1 {
+		t.Errorf("other got %v copies", n)
+	}
+}
+
+func TestQosPolicy(t *testing.T) {
+	p := QosPolicy{NoQos2: true}
+	if q := p.grant("c", "a", proto.QosExactlyOnce); q != proto.QosAtLeastOnce {
+		t.Errorf("NoQos2 granted %v", q)
+	}
+	p.Grant = func(clientid, filter string, requested proto.QosLevel) proto.QosLevel {
+		if filter == "telemetry/#" {
+			return proto.QosAtMostOnce
+		}
+		return proto.QosExactlyOnce // more than asked for, so ignored
+	}
+	if q := p.grant("c", "telemetry/#", proto.QosAtLeastOnce); q != proto.QosAtMostOnce {
+		t.Errorf("Grant: got %v", q)
+	}
+	if q := p.grant("c", "cmd", proto.QosAtMostOnce); q != proto.QosAtMostOnce {
+		t.Errorf("Grant upgraded to %v", q)
+	}
+
+	m := &proto.Publish{Header: header(dupFalse, proto.QosAtMostOnce, retainFalse)}
+	if q := deliverAt(m, proto.QosAtLeastOnce, false).Header.QosLevel; q != proto.QosAtMostOnce {
+		t.Errorf("without Upgrade: got %v", q)
+	}
+	if q := deliverAt(m, proto.QosAtLeastOnce, true).Header.QosLevel; q != proto.QosAtLeastOnce {
+		t.Errorf("with Upgrade: got %v", q)
+	}
+	if m.Header.QosLevel != proto.QosAtMostOnce {
+		t.Error("Upgrade changed the original")
+	}
+}
+
+func TestUnsubWildcard(t *testing.T) {
+	s := newSubscriptions(0)
+	c, other := &incomingConn{}, &incomingConn{}
+	s.add("a/+/b", c, proto.QosAtMostOnce)
+	s.add("a/#", c, proto.QosAtMostOnce)
+	s.add("a/+/b", other, proto.QosAtMostOnce)
+
+	if !s.unsub("a/+/b", c) {
+		t.Error("a/+/b was not found")
+	}
+	if s.unsub("a/+/b", c) {
+		t.Error("a/+/b was found twice")
+	}
+	if n := s.count(c); n != 1 {
+		t.Errorf("c has %v subscriptions left", n)
+	}
+	if n := len(s.subscribers("", "a/x/b")); n != 2 {
+		t.Errorf("a/x/b has %v subscribers", n)
+	}
+}
+
+func TestSubscriptionStats(t *testing.T) {
+	s := newSubscriptions(1)
+	svr := &Server{subs: s}
+	c, done := newTestConn(svr, "c"), newTestConn(svr, "done")
+	c.jobs = make(chan job, 1)
+	s.add("a/+", c, proto.QosAtMostOnce)
+	s.add("done", done, proto.QosAtMostOnce)
+
+	for _, from := range []*incomingConn{c, nil, nil} {
+		s.submit(from, &proto.Publish{TopicName: "a/b", Payload: proto.BytesPayload("x")})
+	}
+	// With one worker, once this arrives the others are done.
+	s.submit(nil, &proto.Publish{TopicName: "done", Payload: proto.BytesPayload("x")})
+	<-done.jobs
+
+	var got SubscriptionInfo
+	svr.EachSubscription(func(si SubscriptionInfo) bool {
+		if si.ClientId == "c" {
+			got = si
+		}
+		return true
+	})
+	if got.Filter != "a/+" || got.Matched != 3 || got.Delivered != 1 || got.Dropped != 1 {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,34 @@
+package mqtt
+
+// wildCacheSize is how many topics a partition remembers the matching
+// wildcard subscriptions of. When there are more, it starts over.
+const wildCacheSize = 4096
+
+// matchingWilds returns the wildcard subscriptions of p that match
+// topic. Publishers tend to use the same few topics over and over, so
+// the result is kept until the wildcard subscriptions change, and the
+// next message to topic skips the matching. s.mu must be held.
+func (p *partition) matchingWilds(topic string) []wild {
+	if ws, ok := p.wildCache[topic]; ok {
+		return ws
+	}
+	var levels [16]string
+	parts := splitTopic(levels[:0], topic)
+	var ws []wild
+	for _, w := range p.wildcards {
+		if w.matches(parts) {
+			ws = append(ws, w)
+		}
+	}
+	if p.wildCache == nil || len(p.wildCache) >= wildCacheSize {
+		p.wildCache = make(map[string][]wild)
+	}
+	p.wildCache[topic] = ws
+	return ws
+}
+
+// forgetWilds empties the cache of matchingWilds, when a wildcard
+// subscription comes, goes, or changes its QoS. s.mu must be held.
+func (p *partition) forgetWilds() {
+	p.wildCache = nil
+}
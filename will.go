@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// willMessage returns the will message a client asked for in its
+// CONNECT, or nil if it did not ask for one.
+func willMessage(m *proto.Connect) *proto.Publish {
+	if !m.WillFlag {
+		return nil
+	}
+	return &proto.Publish{
+		Header:    header(dupFalse, m.WillQos, retainFlag(m.WillRetain)),
+		TopicName: m.WillTopic,
+		Payload:   proto.BytesPayload([]byte(m.WillMessage)),
+	}
+}
+
+// setWill decides on the will message of a connection, once its
+// CONNECT has been accepted. The will goes through Authorize and the
+// payload limits as a PUBLISH would, at once rather than when it is
+// sent. It returns false, and sets no will, if the client may not
+// publish to the will topic, and then the connection is refused.
+func (c *incomingConn) setWill(m *proto.Connect) bool {
+	will := willMessage(m)
+	if c.svr.Will != nil {
+		will = c.svr.Will(m, will)
+	}
+	if will != nil && isWildcard(will.TopicName) {
+		log.Print("reader: ignoring will with wildcard topic ", will.TopicName)
+		will = nil
+	}
+	if will != nil && !c.svr.authorize(c, will.TopicName, false) {
+		log.Printf("reader: %v may not publish its will to %v", c, will.TopicName)
+		return false
+	}
+	if will != nil {
+		if drop, _ := c.svr.tooBig(c, will); drop {
+			will = nil
+		}
+	}
+	if will != nil && will.Header.Retain && c.svr.NoRetain {
+		cp := *will
+		cp.Header.Retain = false
+		will = &cp
+	}
+	c.will = will
+	return true
+}
+
+// publishWill sends the will message, if there is one. It is called
+// when the connection closes without the client sending DISCONNECT.
+// When the client asked for a will delay, the will is only sent once
+// the delay is over, unless the client is back by then. The rules see
+// the will when it is sent, as they see any PUBLISH.
+func (c *incomingConn) publishWill() {
+	if c.will == nil {
+		return
+	}
+	will, x := c.will, c.willX
+	c.will = nil
+	publish := func() {
+		if !c.svr.applyRules(c, will) {
+			c.svr.subs.submitWith(c, will, x)
+		}
+	}
+	if c.willDelay <= 0 {
+		publish()
+		return
+	}
+	c.svr.wills.delay(c.key(), c.willDelay, publish)
+}
+
+// delayedWills holds the will messages waiting for their delay to be
+// over, by client key.
+type delayedWills struct {
+	mu     sync.Mutex // guards access to fields below
+	timers map[string]*time.Timer
+}
+
+// delay calls publish after d, unless cancel is called for k before.
+func (w *delayedWills) delay(k string, d time.Duration, publish func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timers == nil {
+		w.timers = make(map[string]*time.Timer)
+	}
+	if t, ok := w.timers[k]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		w.mu.Lock()
+		if w.timers[k] != t {
+			// cancelled, or replaced by a later will
+			w.mu.Unlock()
+			return
+		}
+		delete(w.timers, k)
+		w.mu.Unlock()
+		publish()
+	})
+	w.timers[k] = t
+}
+
+// cancel forgets the delayed will of the client with key k, if any,
+// because it reconnected in time. It reports whether there was one.
+func (w *delayedWills) cancel(k string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t, ok := w.timers[k]
+	if ok {
+		t.Stop()
+		delete(w.timers, k)
+	}
+	return ok
+}
@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// vanish connects with m, and goes away without a DISCONNECT. It
+// returns the return code of the CONNACK.
+func vanish(t *testing.T, dial func() (net.Conn, error), m *proto.Connect) proto.ReturnCode {
+	t.Helper()
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m.ProtocolName, m.ProtocolVersion, m.CleanSession, m.KeepAliveTimer = "MQTT", protocol311, true, 60
+	m.Encode(conn)
+	ack, err := proto.DecodeOneMessage(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ack.(*proto.ConnAck).ReturnCode
+}
+
+func TestWillHook(t *testing.T) {
+	_, l, dial := testServer(t, func(s *Server) {
+		s.Will = func(m *proto.Connect, will *proto.Publish) *proto.Publish {
+			if m.ClientId == "quiet" {
+				return nil
+			}
+			if will != nil {
+				return will
+			}
+			return &proto.Publish{TopicName: "presence/" + m.ClientId, Payload: proto.BytesPayload("offline")}
+		}
+	})
+	defer l.Close()
+	watcher, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Disconnect()
+	watcher.Subscribe([]proto.TopicQos{{Topic: "presence/+", Qos: proto.QosAtMostOnce}, {Topic: "wills/+", Qos: proto.QosAtMostOnce}})
+
+	vanish(t, dial, &proto.Connect{ClientId: "device"})
+	m := receive(watcher, time.Second)
+	if m == nil || m.TopicName != "presence/device" || string(m.Payload.(proto.BytesPayload)) != "offline" {
+		t.Errorf("got %v, want the will made up for device", m)
+	}
+
+	vanish(t, dial, &proto.Connect{ClientId: "kept", WillFlag: true, WillTopic: "wills/kept", WillMessage: "gone"})
+	if m := receive(watcher, time.Second); m == nil || m.TopicName != "wills/kept" {
+		t.Errorf("got %v, want the will of the client", m)
+	}
+
+	vanish(t, dial, &proto.Connect{ClientId: "quiet", WillFlag: true, WillTopic: "wills/quiet", WillMessage: "gone"})
+	if m := receive(watcher, 50*time.Millisecond); m != nil {
+		t.Errorf("got %v, from a will the hook removed", m.TopicName)
+	}
+}
+
+// A will is held to what the client may publish, and the rules see it
+// when it is sent.
+func TestWillChecks(t *testing.T) {
+	_, l, dial := testServer(t, func(s *Server) {
+		s.Authorize = func(tenant, username, clientid, topic string, subscribe bool) bool {
+			return subscribe || !strings.HasPrefix(topic, "secret/")
+		}
+		s.PayloadLimits = []PayloadLimit{{Filter: "wills/big", Max: 4}}
+		s.Rules = []Rule{{Filter: "wills/dropped", Action: RuleDrop}}
+	})
+	defer l.Close()
+	watcher, err := DialAndConnect(dial, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Disconnect()
+	watcher.Subscribe([]proto.TopicQos{{Topic: "secret/#", Qos: proto.QosAtMostOnce}, {Topic: "wills/+", Qos: proto.QosAtMostOnce}})
+
+	if rc := vanish(t, dial, &proto.Connect{ClientId: "mallory", WillFlag: true, WillTopic: "secret/x", WillMessage: "pwned"}); rc != proto.RetCodeNotAuthorized {
+		t.Errorf("will to a topic the client may not publish to: %v", connectError(rc))
+	}
+	if rc := vanish(t, dial, &proto.Connect{ClientId: "big", WillFlag: true, WillTopic: "wills/big", WillMessage: "too long"}); rc != proto.RetCodeAccepted {
+		t.Errorf("will over the payload limit: %v", connectError(rc))
+	}
+	vanish(t, dial, &proto.Connect{ClientId: "dropped", WillFlag: true, WillTopic: "wills/dropped", WillMessage: "gone"})
+	if m := receive(watcher, 100*time.Millisecond); m != nil {
+		t.Errorf("got %v, %q", m.TopicName, m.Payload)
+	}
+
+	vanish(t, dial, &proto.Connect{ClientId: "ok", WillFlag: true, WillTopic: "wills/ok", WillMessage: "gone"})
+	if m := receive(watcher, time.Second); m == nil || m.TopicName != "wills/ok" {
+		t.Errorf("got %v, want the will of ok", m)
+	}
+}
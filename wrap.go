@@ -0,0 +1,38 @@
+package mqtt
+
+import "net"
+
+// A ConnWrapper puts another transport underneath MQTT, for instance
+// compression, a tunnel, or a rate limiter. WrapConn is given a
+// newly accepted or dialed connection, and returns the connection
+// that MQTT should be spoken over. It may do a handshake first.
+// If it returns an error, the connection is closed.
+type ConnWrapper interface {
+	WrapConn(c net.Conn) (net.Conn, error)
+}
+
+// The ConnWrapperFunc type is an adapter to allow the use of
+// ordinary functions as ConnWrappers.
+type ConnWrapperFunc func(c net.Conn) (net.Conn, error)
+
+// WrapConn calls f(c).
+func (f ConnWrapperFunc) WrapConn(c net.Conn) (net.Conn, error) {
+	return f(c)
+}
+
+// WrapDial returns a dial function for DialAndConnect which wraps the
+// connections made by dial with w.
+func WrapDial(dial func() (net.Conn, error), w ConnWrapper) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		wc, err := w.WrapConn(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return wc, nil
+	}
+}